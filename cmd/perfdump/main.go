@@ -63,8 +63,12 @@ func main() {
 		{"core groups", f.Meta.CoreGroups},
 		{"thread groups", f.Meta.ThreadGroups},
 		{"NUMA nodes", f.Meta.NUMANodes},
+		{"memory block size", f.Meta.MemBlockSize},
+		{"memory nodes", f.Meta.MemNodes},
 		{"PMU mappings", f.Meta.PMUMappings},
 		{"groups", f.Meta.Groups},
+		{"compression", f.Meta.Compression},
+		{"compression level", f.Meta.CompressionLevel},
 	} {
 		if hdr.val == reflect.Zero(reflect.ValueOf(hdr.val).Type()) {
 			continue
@@ -0,0 +1,312 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// A BPFProg describes a BPF program that was loaded while recording
+// a profile.
+type BPFProg struct {
+	// ID is the kernel's ID for this program.
+	ID uint32
+
+	// Type is the BPF program type, such as 1 for
+	// BPF_PROG_TYPE_SOCKET_FILTER.
+	Type uint32
+
+	// Tag is the hash of the program's instructions.
+	Tag [8]byte
+
+	// Name is the name the program was loaded with, which may be
+	// truncated to 15 bytes.
+	Name string
+
+	// BTFID is the ID of the program's BTF type information in
+	// FileMeta.BPFBTF, or 0 if it has none.
+	BTFID uint32
+
+	// Funcs are the JITed functions of this program. The first
+	// function is the program's main function and the rest are
+	// its sub-programs.
+	Funcs []BPFFunc
+}
+
+// A BPFFunc is a single JITed function of a BPF program.
+type BPFFunc struct {
+	// Name is the symbol name perf uses for this function, such
+	// as "bpf_prog_6deef7357e7b4530_sys_enter".
+	Name string
+
+	// Addr and Len are the kernel address and length in bytes of
+	// the function's JITed code.
+	Addr, Len uint64
+}
+
+type bpfProg struct {
+	BPFProg
+
+	// funcTypes is the BTF type ID of each function in Funcs, or
+	// nil if the program has no BTF function information.
+	funcTypes []uint32
+
+	// funcTags is the tag of each function in Funcs, or nil if
+	// perf didn't record them. Each sub-program has its own tag.
+	funcTags [][8]byte
+}
+
+// BPFProgInfo returns the BPF programs loaded while recording f, or
+// nil if f does not record them. perf records these with
+// HEADER_BPF_PROG_INFO. Function names are resolved using the
+// program's BTF information if f records it.
+func (f *File) BPFProgInfo() ([]BPFProg, error) {
+	if f.Meta.bpfProgs == nil {
+		return nil, nil
+	}
+	btfNames := make(map[uint32][]string)
+	progs := make([]BPFProg, len(f.Meta.bpfProgs))
+	for i, p := range f.Meta.bpfProgs {
+		var names []string
+		if data, ok := f.Meta.BPFBTF[p.BTFID]; ok && p.funcTypes != nil {
+			if names, ok = btfNames[p.BTFID]; !ok {
+				var err error
+				names, err = parseBTFNames(data)
+				if err != nil {
+					return nil, fmt.Errorf("BTF %d: %v", p.BTFID, err)
+				}
+				btfNames[p.BTFID] = names
+			}
+		}
+
+		progs[i] = p.BPFProg
+		progs[i].Funcs = make([]BPFFunc, len(p.Funcs))
+		for j, fn := range p.Funcs {
+			// See synthesize_bpf_prog_name in
+			// tools/perf/util/bpf-event.c.
+			tag := p.Tag
+			if j < len(p.funcTags) {
+				tag = p.funcTags[j]
+			}
+			fn.Name = "bpf_prog_" + hex.EncodeToString(tag[:])
+			short := ""
+			if names != nil {
+				if id := p.funcTypes[j]; int(id) < len(names) {
+					short = names[id]
+				}
+			} else if len(p.Funcs) == 1 {
+				short = p.Name
+			} else {
+				short = "F"
+			}
+			if short != "" {
+				fn.Name += "_" + short
+			}
+			progs[i].Funcs[j] = fn
+		}
+	}
+	return progs, nil
+}
+
+// Offsets of fields in struct bpf_prog_info.
+const (
+	bpfInfoType           = 0
+	bpfInfoID             = 4
+	bpfInfoTag            = 8
+	bpfInfoName           = 64
+	bpfInfoNrJitedKsyms   = 104
+	bpfInfoNrJitedFuncLen = 108
+	bpfInfoJitedKsyms     = 112
+	bpfInfoJitedFuncLens  = 120
+	bpfInfoBTFID          = 128
+	bpfInfoFuncInfoRecLen = 132
+	bpfInfoFuncInfo       = 136
+	bpfInfoNrFuncInfo     = 144
+	bpfInfoNrProgTags     = 180
+	bpfInfoProgTags       = 184
+	bpfInfoSize           = 192
+)
+
+// Bits in the arrays mask of struct perf_bpil.
+const (
+	bpilJitedKsyms    = 3
+	bpilJitedFuncLens = 4
+	bpilFuncInfo      = 5
+	bpilProgTags      = 8
+)
+
+func (m *FileMeta) parseBPFProgInfo(bd bufDecoder) error {
+	// See write_bpf_prog_info in tools/perf/util/header.c. Each
+	// program is a struct perf_bpil, whose array pointers have
+	// been converted to offsets into its data.
+	count := bd.u32()
+	progs := []bpfProg{}
+	for i := uint32(0); i < count && !bd.overflow; i++ {
+		infoLen, dataLen := int(bd.u32()), int(bd.u32())
+		arrays := bd.u64()
+		if !bd.need(infoLen) {
+			break
+		}
+		// Older kernels have a shorter bpf_prog_info. Treat
+		// missing fields as zero.
+		info := make([]byte, bpfInfoSize)
+		copy(info, bd.buf[:infoLen])
+		bd.skip(infoLen)
+		if !bd.need(dataLen) {
+			break
+		}
+		data := bd.buf[:dataLen]
+		bd.skip(dataLen)
+
+		o := bd.order
+		array := func(bit uint, ptr, n, size int) []byte {
+			off, l := o.Uint64(info[ptr:]), uint64(size)*uint64(o.Uint32(info[n:]))
+			if arrays&(1<<bit) == 0 || off > uint64(len(data)) || l > uint64(len(data))-off {
+				return nil
+			}
+			return data[off : off+l]
+		}
+
+		var p bpfProg
+		p.Type, p.ID = o.Uint32(info[bpfInfoType:]), o.Uint32(info[bpfInfoID:])
+		copy(p.Tag[:], info[bpfInfoTag:])
+		p.Name = (&bufDecoder{buf: info[bpfInfoName : bpfInfoName+16]}).cstring()
+		p.BTFID = o.Uint32(info[bpfInfoBTFID:])
+
+		ksyms := array(bpilJitedKsyms, bpfInfoJitedKsyms, bpfInfoNrJitedKsyms, 8)
+		lens := array(bpilJitedFuncLens, bpfInfoJitedFuncLens, bpfInfoNrJitedFuncLen, 4)
+		p.Funcs = make([]BPFFunc, len(ksyms)/8)
+		for j := range p.Funcs {
+			p.Funcs[j].Addr = o.Uint64(ksyms[j*8:])
+			if j*4 < len(lens) {
+				p.Funcs[j].Len = uint64(o.Uint32(lens[j*4:]))
+			}
+		}
+
+		// Each func_info record starts with the function's
+		// instruction offset and BTF type ID.
+		recLen := int(o.Uint32(info[bpfInfoFuncInfoRecLen:]))
+		if recLen >= 8 && p.BTFID != 0 {
+			finfo := array(bpilFuncInfo, bpfInfoFuncInfo, bpfInfoNrFuncInfo, recLen)
+			if len(finfo) >= len(p.Funcs)*recLen {
+				p.funcTypes = make([]uint32, len(p.Funcs))
+				for j := range p.funcTypes {
+					p.funcTypes[j] = o.Uint32(finfo[j*recLen+4:])
+				}
+			}
+		}
+
+		// Each sub-program has its own tag.
+		tags := array(bpilProgTags, bpfInfoProgTags, bpfInfoNrProgTags, 8)
+		if len(tags) >= len(p.Funcs)*8 && len(p.Funcs) > 0 {
+			p.funcTags = make([][8]byte, len(p.Funcs))
+			for j := range p.funcTags {
+				copy(p.funcTags[j][:], tags[j*8:])
+			}
+		}
+		progs = append(progs, p)
+	}
+	if bd.overflow {
+		return fmt.Errorf("BPF program info is truncated")
+	}
+	m.bpfProgs = progs
+	return nil
+}
+
+func (m *FileMeta) parseBPFBTF(bd bufDecoder) error {
+	// See write_bpf_btf in tools/perf/util/header.c.
+	count := bd.u32()
+	btf := make(map[uint32][]byte)
+	for i := uint32(0); i < count && !bd.overflow; i++ {
+		id, size := bd.u32(), int(bd.u32())
+		if !bd.need(size) {
+			break
+		}
+		data := make([]byte, size)
+		bd.bytes(data)
+		btf[id] = data
+	}
+	if bd.overflow {
+		return fmt.Errorf("BPF BTF data is truncated")
+	}
+	m.BPFBTF = btf
+	return nil
+}
+
+// BTF type kinds. See include/uapi/linux/btf.h.
+const (
+	btfKindInt       = 1
+	btfKindArray     = 3
+	btfKindStruct    = 4
+	btfKindUnion     = 5
+	btfKindEnum      = 6
+	btfKindFuncProto = 13
+	btfKindVar       = 14
+	btfKindDatasec   = 15
+	btfKindDeclTag   = 17
+	btfKindEnum64    = 19
+)
+
+// parseBTFNames parses raw BTF type information and returns the name
+// of each type, indexed by type ID. Type 0 is void and has no name.
+func parseBTFNames(data []byte) ([]string, error) {
+	bd := bufDecoder{buf: data, order: binary.LittleEndian}
+	switch bd.u16() {
+	case 0xeb9f:
+	case 0x9feb:
+		bd.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad BTF magic")
+	}
+	bd.u8() // Version
+	bd.u8() // Flags
+	hdrLen := bd.u32()
+	typeOff, typeLen := bd.u32(), bd.u32()
+	strOff, strLen := bd.u32(), bd.u32()
+	if bd.overflow {
+		return nil, fmt.Errorf("BTF header is truncated")
+	}
+
+	section := func(off, l uint32) []byte {
+		start := uint64(hdrLen) + uint64(off)
+		if start > uint64(len(data)) || uint64(l) > uint64(len(data))-start {
+			return nil
+		}
+		return data[start : start+uint64(l)]
+	}
+	types, strs := section(typeOff, typeLen), section(strOff, strLen)
+	if types == nil || strs == nil {
+		return nil, fmt.Errorf("BTF sections are out of bounds")
+	}
+
+	names := []string{""}
+	td := bufDecoder{buf: types, order: bd.order}
+	for len(td.buf) > 0 && !td.overflow {
+		nameOff, info := td.u32(), td.u32()
+		td.u32() // Size or type
+		vlen := int(info & 0xffff)
+		switch (info >> 24) & 0x1f {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			td.skip(4)
+		case btfKindArray:
+			td.skip(12)
+		case btfKindStruct, btfKindUnion, btfKindDatasec, btfKindEnum64:
+			td.skip(12 * vlen)
+		case btfKindEnum, btfKindFuncProto:
+			td.skip(8 * vlen)
+		}
+		name := ""
+		if nameOff < uint32(len(strs)) {
+			name = (&bufDecoder{buf: strs[nameOff:]}).cstring()
+		}
+		names = append(names, name)
+	}
+	if td.overflow {
+		return nil, fmt.Errorf("BTF types are truncated")
+	}
+	return names, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// bpfProgInfoData returns one struct perf_bpil entry of a
+// HEADER_BPF_PROG_INFO section.
+func bpfProgInfoData(id, btfID uint32, tag string, name string, addrs []uint64, lens []uint32, funcTypes []uint32, funcTags []string) []byte {
+	o := binary.LittleEndian
+	info := make([]byte, bpfInfoSize)
+	o.PutUint32(info[bpfInfoType:], 2)
+	o.PutUint32(info[bpfInfoID:], id)
+	copy(info[bpfInfoTag:], tag)
+	copy(info[bpfInfoName:], name)
+	o.PutUint32(info[bpfInfoBTFID:], btfID)
+
+	var data bytes.Buffer
+	var arrays uint64
+	addArray := func(bit uint, ptr, n int, count int, x interface{}) {
+		arrays |= 1 << bit
+		o.PutUint64(info[ptr:], uint64(data.Len()))
+		o.PutUint32(info[n:], uint32(count))
+		binary.Write(&data, o, x)
+	}
+	addArray(bpilJitedKsyms, bpfInfoJitedKsyms, bpfInfoNrJitedKsyms, len(addrs), addrs)
+	addArray(bpilJitedFuncLens, bpfInfoJitedFuncLens, bpfInfoNrJitedFuncLen, len(lens), lens)
+	if funcTypes != nil {
+		o.PutUint32(info[bpfInfoFuncInfoRecLen:], 8)
+		var finfo []uint32
+		for i, typ := range funcTypes {
+			finfo = append(finfo, uint32(i*10), typ)
+		}
+		addArray(bpilFuncInfo, bpfInfoFuncInfo, bpfInfoNrFuncInfo, len(funcTypes), finfo)
+	}
+	if funcTags != nil {
+		var tags []byte
+		for _, tag := range funcTags {
+			tags = append(tags, tag...)
+		}
+		addArray(bpilProgTags, bpfInfoProgTags, bpfInfoNrProgTags, len(funcTags), tags)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, o, []uint32{uint32(len(info)), uint32(data.Len())})
+	binary.Write(&buf, o, arrays)
+	buf.Write(info)
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// btfData returns raw BTF containing a FUNC_PROTO type followed by a
+// FUNC type for each name.
+func btfData(funcs ...string) []byte {
+	o := binary.LittleEndian
+	var types, strs bytes.Buffer
+	strs.WriteByte(0)
+	// A FUNC_PROTO with one parameter.
+	binary.Write(&types, o, []uint32{0, btfKindFuncProto<<24 | 1, 0, 0, 0})
+	for _, name := range funcs {
+		binary.Write(&types, o, []uint32{uint32(strs.Len()), 12 << 24, 1})
+		strs.WriteString(name)
+		strs.WriteByte(0)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, o, uint16(0xeb9f))
+	buf.Write([]byte{1, 0})
+	binary.Write(&buf, o, []uint32{24, 0, uint32(types.Len()), uint32(types.Len()), uint32(strs.Len())})
+	buf.Write(types.Bytes())
+	buf.Write(strs.Bytes())
+	return buf.Bytes()
+}
+
+func TestBPFProgInfo(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	var progs bytes.Buffer
+	binary.Write(&progs, binary.LittleEndian, uint32(3))
+	progs.Write(bpfProgInfoData(10, 5, "\x01\x02\x03\x04\x05\x06\x07\x08", "main", []uint64{0x1000, 0x2000}, []uint32{0x100, 0x80}, []uint32{2, 3},
+		[]string{"\x01\x02\x03\x04\x05\x06\x07\x08", "\x11\x12\x13\x14\x15\x16\x17\x18"}))
+	progs.Write(bpfProgInfoData(11, 0, "\xaa\xbb\xcc\xdd\xee\xff\x00\x11", "single", []uint64{0x3000}, []uint32{0x40}, nil, nil))
+	progs.Write(bpfProgInfoData(12, 0, "\x00\x00\x00\x00\x00\x00\x00\x01", "multi", []uint64{0x4000, 0x5000}, []uint32{0x10, 0x20}, nil,
+		[]string{"\x00\x00\x00\x00\x00\x00\x00\x01", "\x00\x00\x00\x00\x00\x00\x00\x02"}))
+	tf.addFeature(FeatureBPFProgInfo, progs.Bytes())
+	var btf bytes.Buffer
+	blob := btfData("sys_enter", "helper")
+	binary.Write(&btf, binary.LittleEndian, []uint32{1, 5, uint32(len(blob))})
+	btf.Write(blob)
+	tf.addFeature(FeatureBPFBTF, btf.Bytes())
+	tf.record(RecordTypeSample, 0, uint64(0x1000))
+	f := tf.open(t)
+
+	if !bytes.Equal(f.Meta.BPFBTF[5], blob) {
+		t.Errorf("got BTF %x, want %x", f.Meta.BPFBTF[5], blob)
+	}
+	got, err := f.BPFProgInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BPFProg{
+		{ID: 10, Type: 2, Tag: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Name: "main", BTFID: 5, Funcs: []BPFFunc{
+			{"bpf_prog_0102030405060708_sys_enter", 0x1000, 0x100},
+			{"bpf_prog_1112131415161718_helper", 0x2000, 0x80},
+		}},
+		{ID: 11, Type: 2, Tag: [8]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11}, Name: "single", Funcs: []BPFFunc{
+			{"bpf_prog_aabbccddeeff0011_single", 0x3000, 0x40},
+		}},
+		{ID: 12, Type: 2, Tag: [8]byte{7: 1}, Name: "multi", Funcs: []BPFFunc{
+			{"bpf_prog_0000000000000001_F", 0x4000, 0x10},
+			{"bpf_prog_0000000000000002_F", 0x5000, 0x20},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBPFProgInfoMissing(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeSample, 0, uint64(0x1000))
+	got, err := tf.open(t).BPFProgInfo()
+	if got != nil || err != nil {
+		t.Errorf("got %v, %v; want nil, nil", got, err)
+	}
+}
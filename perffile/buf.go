@@ -15,18 +15,30 @@ import (
 // This is based on bufio.Reader. This could apply to an arbitrary
 // io.Reader, but it's specialized for our one current use so the
 // linker can statically resolve the method calls.
+//
+// Unlike bufio.Reader, seeks to any position that is still in the
+// buffer, including positions before the current read position, are
+// satisfied from the buffer. This makes reading records in time
+// order, which jumps back and forth between nearby records, much
+// cheaper.
 type bufferedSectionReader struct {
 	buf  []byte
 	rd   *io.SectionReader
 	r, w int // buf read and write positions
 	err  error
-	pos  int64 // file position of read
+	pos  int64 // file position of read; buf[0] is at pos-r
 }
 
+// bufferedSectionReaderSize is the buffer size of a
+// bufferedSectionReader. Larger buffers reduce the number of reads
+// from the underlying file, but in benchmarks more than 16K is slower
+// for data already in the page cache.
+const bufferedSectionReaderSize = 16 << 10
+
 func newBufferedSectionReader(rd *io.SectionReader) *bufferedSectionReader {
 	pos, err := rd.Seek(0, 1)
 	return &bufferedSectionReader{
-		buf: make([]byte, 16<<10),
+		buf: make([]byte, bufferedSectionReaderSize),
 		rd:  rd,
 		pos: pos,
 		err: err,
@@ -42,7 +54,15 @@ func (b *bufferedSectionReader) readErr() error {
 }
 
 func (b *bufferedSectionReader) Seek(offset int64, whence int) (int64, error) {
-	if whence == 0 && offset == b.pos || whence == 1 && offset == 0 {
+	if whence == 1 {
+		// b.rd's position is ahead of b.pos by the buffered
+		// data, so convert to an absolute seek.
+		offset, whence = b.pos+offset, 0
+	}
+	if start := b.pos - int64(b.r); whence == 0 && offset >= start && offset-start <= int64(b.w) {
+		// Seek within the buffer.
+		b.r = int(offset - start)
+		b.pos = offset
 		return b.pos, nil
 	}
 
@@ -70,6 +90,7 @@ func (b *bufferedSectionReader) Read(p []byte) (n int, err error) {
 			if n < 0 {
 				panic(errNegativeRead)
 			}
+			b.r, b.w = 0, 0
 			b.pos += int64(n)
 			return n, b.readErr()
 		}
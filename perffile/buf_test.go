@@ -0,0 +1,66 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestBufferedSectionReader(t *testing.T) {
+	data := make([]byte, 3*bufferedSectionReaderSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	const base = 100
+	sr := io.NewSectionReader(bytes.NewReader(data), base, int64(len(data)-base))
+	b := newBufferedSectionReader(io.NewSectionReader(bytes.NewReader(data), base, int64(len(data)-base)))
+
+	// Perform a random mix of reads and seeks on both readers and
+	// check that they agree.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		switch rng.Intn(4) {
+		case 0:
+			// Seek nearby, forward or back.
+			off := int64(rng.Intn(2*bufferedSectionReaderSize) - bufferedSectionReaderSize)
+			want, err1 := sr.Seek(off, 1)
+			if err1 != nil {
+				continue
+			}
+			got, err2 := b.Seek(off, 1)
+			if got != want || err2 != nil {
+				t.Fatalf("Seek(%d, 1) = %d, %v; want %d", off, got, err2, want)
+			}
+		case 1:
+			// Seek to an absolute position.
+			off := int64(rng.Intn(len(data) - base))
+			want, _ := sr.Seek(off, 0)
+			got, err := b.Seek(off, 0)
+			if got != want || err != nil {
+				t.Fatalf("Seek(%d, 0) = %d, %v; want %d", off, got, err, want)
+			}
+		default:
+			// Read, occasionally more than the buffer.
+			n := rng.Intn(512)
+			if rng.Intn(50) == 0 {
+				n = bufferedSectionReaderSize + rng.Intn(512)
+			}
+			want := make([]byte, n)
+			got := make([]byte, n)
+			nw, errw := io.ReadFull(sr, want)
+			ng, errg := io.ReadFull(b, got)
+			if nw != ng || errw != errg || !bytes.Equal(want[:nw], got[:ng]) {
+				t.Fatalf("ReadFull(%d) = %d, %v; want %d, %v", n, ng, errg, nw, errw)
+			}
+		}
+		pos, _ := sr.Seek(0, 1)
+		if got, _ := b.Seek(0, 1); got != pos {
+			t.Fatalf("position %d, want %d", got, pos)
+		}
+	}
+}
@@ -6,45 +6,104 @@ package perffile
 
 import "encoding/binary"
 
+// A bufDecoder decodes fields from the front of buf.
+//
+// If a read would run past the end of buf, the decoder sets overflow,
+// discards the rest of buf, and returns zero values. This way, a
+// sequence of reads from a short buffer can be checked once at the
+// end rather than after every read.
 type bufDecoder struct {
 	buf   []byte
 	order binary.ByteOrder
+
+	overflow bool
+}
+
+// fail marks the decoder as overflowed.
+func (b *bufDecoder) fail() {
+	b.overflow = true
+	b.buf = b.buf[len(b.buf):]
+}
+
+// need returns whether buf has at least n more bytes. If not, it
+// marks the decoder as overflowed.
+func (b *bufDecoder) need(n int) bool {
+	if n >= 0 && n <= len(b.buf) {
+		return true
+	}
+	b.fail()
+	return false
+}
+
+// count reads a u64 count of elements of size bytes each. If the
+// rest of buf is too short for that many elements, it marks the
+// decoder as overflowed and returns 0.
+func (b *bufDecoder) count(size int) int {
+	n := b.u64()
+	if n > uint64(len(b.buf)/size) {
+		b.fail()
+		return 0
+	}
+	return int(n)
 }
 
 func (b *bufDecoder) skip(n int) {
-	b.buf = b.buf[n:]
+	if b.need(n) {
+		b.buf = b.buf[n:]
+	}
 }
 
 func (b *bufDecoder) bytes(x []byte) {
-	copy(x, b.buf)
-	b.buf = b.buf[len(x):]
+	if b.need(len(x)) {
+		copy(x, b.buf)
+		b.buf = b.buf[len(x):]
+	}
+}
+
+func (b *bufDecoder) u8() uint8 {
+	if !b.need(1) {
+		return 0
+	}
+	x := b.buf[0]
+	b.buf = b.buf[1:]
+	return x
 }
 
 func (b *bufDecoder) u16() uint16 {
+	if !b.need(2) {
+		return 0
+	}
 	x := b.order.Uint16(b.buf)
 	b.buf = b.buf[2:]
 	return x
 }
 
 func (b *bufDecoder) u32() uint32 {
+	if !b.need(4) {
+		return 0
+	}
 	x := b.order.Uint32(b.buf)
 	b.buf = b.buf[4:]
 	return x
 }
 
 func (b *bufDecoder) i32() int32 {
-	x := int32(b.order.Uint32(b.buf))
-	b.buf = b.buf[4:]
-	return x
+	return int32(b.u32())
 }
 
 func (b *bufDecoder) u64() uint64 {
+	if !b.need(8) {
+		return 0
+	}
 	x := b.order.Uint64(b.buf)
 	b.buf = b.buf[8:]
 	return x
 }
 
 func (b *bufDecoder) u64s(x []uint64) {
+	if !b.need(len(x) * 8) {
+		return
+	}
 	for i := range x {
 		x[i] = b.order.Uint64(b.buf[i*8:])
 	}
@@ -82,7 +141,7 @@ func (b *bufDecoder) cstring() string {
 	}
 	// TODO: Error?
 	x := string(b.buf)
-	b.buf = b.buf[:1]
+	b.buf = b.buf[len(b.buf):]
 	return x
 }
 
@@ -92,7 +151,7 @@ func (b *bufDecoder) lenString() string {
 		// TODO: Error?
 		l = uint32(len(b.buf))
 	}
-	str := (&bufDecoder{b.buf[:l], nil}).cstring()
+	str := (&bufDecoder{buf: b.buf[:l]}).cstring()
 	b.buf = b.buf[l:]
 	return str
 }
@@ -100,7 +159,7 @@ func (b *bufDecoder) lenString() string {
 func (b *bufDecoder) stringList() []string {
 	out := []string{}
 	count := b.u32()
-	for i := uint32(0); i < count; i++ {
+	for i := uint32(0); i < count && !b.overflow; i++ {
 		out = append(out, b.lenString())
 	}
 	return out
@@ -0,0 +1,91 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+// WalkCallchain calls fn for each IP in r.Callchain, starting from the
+// sampled instruction. It skips the Callchain* context markers and
+// instead passes fn the CPU mode of the stack each IP was taken from,
+// along with the IP's index in r.Callchain. IPs that precede any
+// marker are assumed to be from r.CPUMode. If fn returns false,
+// WalkCallchain stops.
+func (r *RecordSample) WalkCallchain(fn func(i int, ip uint64, mode CPUMode) bool) {
+	mode := r.CPUMode
+	for i, ip := range r.Callchain {
+		if ip >= CallchainContextMax {
+			mode = callchainMode(ip)
+			continue
+		}
+		if !fn(i, ip, mode) {
+			return
+		}
+	}
+}
+
+// callchainMode returns the CPU mode of the stack that follows
+// context marker m.
+func callchainMode(m uint64) CPUMode {
+	switch m {
+	case CallchainHypervisor:
+		return CPUModeHypervisor
+	case CallchainKernel:
+		return CPUModeKernel
+	case CallchainUser:
+		return CPUModeUser
+	case CallchainGuestKernel:
+		return CPUModeGuestKernel
+	case CallchainGuestUser:
+		return CPUModeGuestUser
+	}
+	return CPUModeUnknown
+}
+
+// A CallchainSegment is a run of consecutive IPs in a callchain that
+// were all taken from the same type of stack.
+type CallchainSegment struct {
+	Mode CPUMode
+
+	// Start and End are the indexes in RecordSample.Callchain of
+	// the first IP in this segment and one past the last IP in
+	// this segment. Start never refers to a context marker.
+	Start, End int
+}
+
+// CallchainSegments splits r.Callchain into segments at the points
+// where it switches between stacks, such as from the kernel stack to
+// the user stack. This can be used to symbolize each part of the
+// callchain using the appropriate address space. Empty segments are
+// omitted.
+func (r *RecordSample) CallchainSegments() []CallchainSegment {
+	var segs []CallchainSegment
+	r.WalkCallchain(func(i int, ip uint64, mode CPUMode) bool {
+		if n := len(segs); n > 0 && segs[n-1].Mode == mode && segs[n-1].End == i {
+			segs[n-1].End++
+		} else {
+			segs = append(segs, CallchainSegment{mode, i, i + 1})
+		}
+		return true
+	})
+	return segs
+}
+
+// HasUsableCallchain returns whether r has a callchain with at least
+// one caller of the sampled instruction. It returns false if r does
+// not record a callchain at all, or if the callchain is empty,
+// consists only of context markers, or has only the sampled
+// instruction, which usually means stack unwinding failed.
+//
+// To distinguish these cases, check r.Format&SampleFormatCallchain,
+// which is set if the event recorded callchains.
+func (r *RecordSample) HasUsableCallchain() bool {
+	if r.Format&SampleFormatCallchain == 0 {
+		return false
+	}
+	n := 0
+	r.WalkCallchain(func(i int, ip uint64, mode CPUMode) bool {
+		n++
+		return n < 2
+	})
+	return n >= 2
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCallchainSegments(t *testing.T) {
+	tests := []struct {
+		mode CPUMode
+		cc   []uint64
+		want []CallchainSegment
+	}{
+		{CPUModeUser, nil, nil},
+		{CPUModeUser, []uint64{1, 2},
+			[]CallchainSegment{{CPUModeUser, 0, 2}}},
+		{CPUModeKernel, []uint64{CallchainKernel, 1, 2, CallchainUser, 3, 4, 5},
+			[]CallchainSegment{{CPUModeKernel, 1, 3}, {CPUModeUser, 4, 7}}},
+		// Empty kernel stack.
+		{CPUModeKernel, []uint64{CallchainKernel, CallchainUser, 3},
+			[]CallchainSegment{{CPUModeUser, 2, 3}}},
+		// Repeated markers for the same stack are split.
+		{CPUModeUser, []uint64{CallchainUser, 1, CallchainUser, 2},
+			[]CallchainSegment{{CPUModeUser, 1, 2}, {CPUModeUser, 3, 4}}},
+		{CPUModeGuestKernel, []uint64{CallchainGuest, CallchainGuestKernel, 1, CallchainGuestUser, 2},
+			[]CallchainSegment{{CPUModeGuestKernel, 2, 3}, {CPUModeGuestUser, 4, 5}}},
+	}
+	for _, tt := range tests {
+		r := &RecordSample{CPUMode: tt.mode, Callchain: tt.cc}
+		got := r.CallchainSegments()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%#x: got %v, want %v", tt.cc, got, tt.want)
+		}
+	}
+}
+
+func TestHasUsableCallchain(t *testing.T) {
+	tests := []struct {
+		format SampleFormat
+		cc     []uint64
+		want   bool
+	}{
+		{0, nil, false},
+		{SampleFormatCallchain, nil, false},
+		{SampleFormatCallchain, []uint64{CallchainKernel, CallchainUser}, false},
+		{SampleFormatCallchain, []uint64{CallchainUser, 1}, false},
+		{SampleFormatCallchain, []uint64{CallchainUser, 1, 2}, true},
+		{SampleFormatCallchain, []uint64{CallchainKernel, 1, CallchainUser, 2}, true},
+	}
+	for _, tt := range tests {
+		r := &RecordSample{RecordCommon: RecordCommon{Format: tt.format}, Callchain: tt.cc}
+		if got := r.HasUsableCallchain(); got != tt.want {
+			t.Errorf("%v %#x: got %v, want %v", tt.format, tt.cc, got, tt.want)
+		}
+	}
+}
@@ -52,6 +52,12 @@ func parseCPUSet(str string) (CPUSet, error) {
 	return out, nil
 }
 
+// Contains returns whether cpu is in c.
+func (c CPUSet) Contains(cpu int) bool {
+	i := sort.SearchInts(c, cpu)
+	return i < len(c) && c[i] == cpu
+}
+
 func (c CPUSet) String() string {
 	if len(c) == 0 {
 		return ""
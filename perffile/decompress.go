@@ -0,0 +1,101 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A decompressor decompresses the payloads of a sequence of
+// compressed records. perf compresses all compressed records in a
+// profile as a single stream, so a decompressor must retain its state
+// between calls to decompress.
+type decompressor interface {
+	// decompress appends to dst the data decompressed from src,
+	// the payload of the next compressed record. It returns an
+	// error rather than growing dst beyond max bytes.
+	decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+// decompressors maps from the name of a compression algorithm, as
+// reported in FileMeta.Compression, to a function that returns a new
+// decompressor for that algorithm.
+//
+// The core package has no compression dependencies. Support for zstd
+// is compiled in with the "zstd" build tag.
+var decompressors = map[string]func() decompressor{}
+
+// fileDecompressors maps from the name of a compression algorithm to
+// a function that returns a reader of the data decompressed from r.
+// OpenCompressed uses these to decompress whole perf.data files. As
+// with decompressors, support for zstd is compiled in with the "zstd"
+// build tag.
+var fileDecompressors = map[string]func(r io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+}
+
+// A bufferedRecord is a record that was decompressed from a
+// compressed record and saved so it can be read out of file order.
+type bufferedRecord struct {
+	offset    int64 // Offset of the compressed record
+	sampleKey int64
+	data      []byte
+}
+
+// decompress decompresses the payload of the compressed record at
+// offset and queues the records it contains to be returned by
+// subsequent calls to readRecord.
+func (r *Records) decompress(payload []byte, offset int64) {
+	if r.decomp == nil {
+		if r.noDecomp {
+			r.err = fmt.Errorf("compressed record at offset %d cannot be decompressed by a cloned iterator", offset)
+			return
+		}
+		name := r.f.Meta.Compression
+		if name == "" {
+			// zstd is the only compression perf supports.
+			name = "zstd"
+		}
+		newDecomp := decompressors[name]
+		if newDecomp == nil {
+			r.err = fmt.Errorf("compressed record at offset %d: %s decompression is not supported", offset, name)
+			return
+		}
+		r.decomp = newDecomp()
+	}
+
+	// A record may span compressed records, so move what's left
+	// of the last compressed record to the beginning of the
+	// buffer and append to it.
+	buf, err := r.decomp.decompress(append(r.innerBuf[:0], r.inner...), payload, r.recordLimit())
+	if err != nil {
+		r.err = fmt.Errorf("compressed record at offset %d: %v", offset, err)
+		return
+	}
+	r.innerBuf, r.inner, r.innerOffset = buf, buf, offset
+}
+
+// nextInner returns the next complete record queued by decompress, or
+// nil if there isn't one.
+func (r *Records) nextInner() []byte {
+	if len(r.inner) < 8 {
+		return nil
+	}
+	size := int(decodeRecordHeader(r.inner, binary.LittleEndian).Size)
+	if size < 8 {
+		// Let readRecord report the bad size.
+		size = 8
+	}
+	if size > len(r.inner) {
+		return nil
+	}
+	data := r.inner[:size]
+	r.inner = r.inner[size:]
+	r.innerPos += int64(size)
+	return data
+}
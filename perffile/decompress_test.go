@@ -0,0 +1,127 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// xorDecompressor is a test decompressor that inverts every byte. It
+// checks that it is used as a single stream.
+type xorDecompressor struct {
+	calls int
+}
+
+func (d *xorDecompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	d.calls++
+	if len(dst)+len(src) > max {
+		return dst, fmt.Errorf("decompressed data exceeds the limit of %d bytes", max)
+	}
+	for _, b := range src {
+		dst = append(dst, ^b)
+	}
+	return dst, nil
+}
+
+func xorCompress(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = ^b
+	}
+	return out
+}
+
+func TestCompressedRecords(t *testing.T) {
+	old, ok := decompressors["zstd"]
+	defer func() {
+		if ok {
+			decompressors["zstd"] = old
+		} else {
+			delete(decompressors, "zstd")
+		}
+	}()
+	var decomp *xorDecompressor
+	decompressors["zstd"] = func() decompressor {
+		decomp = new(xorDecompressor)
+		return decomp
+	}
+
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatTime,
+	}})
+	tf.addFeature(FeatureCompressed, encodeFields(uint32(0), uint32(1), uint32(3), uint32(0), uint32(0)))
+	// The second compressed sample spans two compressed records.
+	var inner testFile
+	inner.record(RecordTypeSample, 0, uint64(10))
+	inner.record(RecordTypeSample, 0, uint64(30))
+	payload := xorCompress(inner.data.Bytes())
+	tf.record(RecordTypeSample, 0, uint64(20))
+	tf.record(recordTypeCompressed, 0, payload[:20])
+	tf.record(recordTypeCompressed, 0, payload[20:])
+	tf.record(RecordTypeSample, 0, uint64(40))
+
+	f := tf.open(t)
+	if f.Meta.Compression != "zstd" || f.Meta.CompressionLevel != 3 {
+		t.Errorf("got compression %q level %d, want zstd level 3", f.Meta.Compression, f.Meta.CompressionLevel)
+	}
+	// Compressed records are at offsets 16 and 44 in the data
+	// section.
+	c1, c2 := int64(f.hdr.Data.Offset)+16, int64(f.hdr.Data.Offset)+44
+	for _, test := range []struct {
+		order   RecordsOrder
+		times   []uint64
+		offsets []int64
+	}{
+		{RecordsFileOrder, []uint64{20, 10, 30, 40}, []int64{0, c1, c2, 0}},
+		{RecordsTimeOrder, []uint64{10, 20, 30, 40}, []int64{c1, 0, c2, 0}},
+	} {
+		rs := f.Records(test.order)
+		var times []uint64
+		var offsets []int64
+		for rs.Next() {
+			s := rs.Record.(*RecordSample)
+			times = append(times, s.Time)
+			if s.Offset == c1 || s.Offset == c2 {
+				offsets = append(offsets, s.Offset)
+			} else {
+				offsets = append(offsets, 0)
+			}
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatalf("%v: %v", test.order, err)
+		}
+		if !reflect.DeepEqual(times, test.times) || !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%v: got times %v at %v, want %v at %v", test.order, times, offsets, test.times, test.offsets)
+		}
+	}
+	if decomp.calls != 2 {
+		t.Errorf("decompressor called %d times, want 2", decomp.calls)
+	}
+
+	// Compressed records pass OnlyTypes.
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	n := 0
+	for rs.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("with OnlyTypes, got %d samples, want 4", n)
+	}
+
+	// Without a decompressor, Next fails at the first compressed
+	// record.
+	delete(decompressors, "zstd")
+	rs = f.Records(RecordsFileOrder)
+	for rs.Next() {
+	}
+	if err := rs.Err(); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("without decompressor, got error %v, want not supported", err)
+	}
+}
@@ -5,6 +5,7 @@
 package perffile
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -23,7 +24,7 @@ type fileHeader struct {
 	Features [numFeatureBits / 64]uint64 // Bitmap of feature
 }
 
-func (h *fileHeader) hasFeature(f feature) bool {
+func (h *fileHeader) hasFeature(f FeatureID) bool {
 	return h.Features[f/64]&(1<<(uint(f)%64)) != 0
 }
 
@@ -45,35 +46,57 @@ func (s fileSection) data(r io.ReaderAt) ([]byte, error) {
 	return nil, err
 }
 
-// HEADER_* enum from tools/perf/util/header.h
-type feature int
+// A FeatureID identifies an optional metadata section in a perf.data
+// file. Most features are parsed into File.Meta.
+//
+// This corresponds to the HEADER_* enum from tools/perf/util/header.h
+type FeatureID int
+
+//go:generate stringer -type=FeatureID
 
 const (
-	featureReserved feature = iota // always cleared
-	featureTracingData
-	featureBuildID
-
-	featureHostname
-	featureOSRelease
-	featureVersion
-	featureArch
-	featureNrCpus
-	featureCPUDesc
-	featureCPUID
-	featureTotalMem
-	featureCmdline
-	featureEventDesc
-	featureCPUTopology
-	featureNUMATopology
-	featureBranchStack
-	featurePMUMappings
-	featureGroupDesc
+	FeatureReserved FeatureID = iota // always cleared
+	FeatureTracingData
+	FeatureBuildID
+
+	FeatureHostname
+	FeatureOSRelease
+	FeatureVersion
+	FeatureArch
+	FeatureNrCpus
+	FeatureCPUDesc
+	FeatureCPUID
+	FeatureTotalMem
+	FeatureCmdline
+	FeatureEventDesc
+	FeatureCPUTopology
+	FeatureNUMATopology
+	FeatureBranchStack
+	FeaturePMUMappings
+	FeatureGroupDesc
+	FeatureAuxtrace
+	FeatureStat
+	FeatureCache
+	FeatureSampleTime
+	FeatureMemTopology
+	FeatureClockID
+	FeatureDirFormat
+	FeatureBPFProgInfo
+	FeatureBPFBTF
+	FeatureCompressed
+	FeatureCPUPMUCaps
+	FeatureClockData
+	FeatureHybridTopology
+	FeaturePMUCaps
 )
 
 // perf_file_attr from tools/perf/util/header.c
 type fileAttr struct {
 	Attr EventAttr
 	IDs  fileSection // array of attrID, one per core/thread
+	ids  []uint64    // decoded IDs
+
+	raw fileSection // on-disk perf_event_attr
 }
 
 // eventAttrV0 is on-disk version 0 of the perf_event_attr structure.
@@ -101,7 +124,7 @@ type eventAttrVN struct {
 	BPLenOrConfig2 uint64
 
 	// ABI v2
-	BranchSampleType uint64
+	BranchSampleType BranchSampleType
 
 	// ABI v3
 	SampleRegsUser  uint64
@@ -177,7 +200,10 @@ type EventAttr struct {
 	BPAddr uint64
 	BPLen  uint64
 
-	BranchSampleType uint64 // TODO: PERF_SAMPLE_BRANCH_*
+	// BranchSampleType specifies which branches are recorded in
+	// RecordSample.BranchStack, and what information is
+	// recorded about each branch.
+	BranchSampleType BranchSampleType
 
 	// SampleRegsUser is a bitmask of user-space registers
 	// captured at each sample in RecordSample.RegsUser. The
@@ -200,6 +226,38 @@ type EventAttr struct {
 	AuxWatermark uint32
 }
 
+// A BranchSampleType is a bitmask of the branch filters and branch
+// information requested by a branch stack sampling event.
+//
+// This corresponds to the perf_branch_sample_type enum from
+// include/uapi/linux/perf_event.h
+type BranchSampleType uint64
+
+//go:generate go run ../cmd/bitstringer/main.go -type=BranchSampleType -strip=BranchSample
+
+const (
+	BranchSampleUser      BranchSampleType = 1 << iota // User branches
+	BranchSampleKernel                                 // Kernel branches
+	BranchSampleHV                                     // Hypervisor branches
+	BranchSampleAny                                    // Any branch types
+	BranchSampleAnyCall                                // Any call branch
+	BranchSampleAnyReturn                              // Any return branch
+	BranchSampleIndCall                                // Indirect calls
+	BranchSampleAbortTx                                // Transaction aborts
+	BranchSampleInTx                                   // In transaction
+	BranchSampleNoTx                                   // Not in transaction
+	BranchSampleCond                                   // Conditional branches
+	BranchSampleCallStack                              // Call/ret stack
+	BranchSampleIndJump                                // Indirect jumps
+	BranchSampleCall                                   // Direct calls
+	BranchSampleNoFlags                                // Don't record BranchFlags
+	BranchSampleNoCycles                               // Don't record Cycles
+	BranchSampleTypeSave                               // Record branch Type
+	BranchSampleHWIndex                                // Record BranchHWIndex
+	BranchSamplePrivSave                               // Record privilege level
+	BranchSampleCounters                               // Record branch Counters
+)
+
 // An EventType is a general class of perf event.
 //
 // This corresponds to the perf_type_id enum from
@@ -217,6 +275,132 @@ const (
 	EventTypeBreakpoint
 )
 
+// IsHardware returns whether a is a generalized hardware event, such
+// as CPU cycles or retired instructions.
+func (a *EventAttr) IsHardware() bool {
+	return a.Type == EventTypeHardware
+}
+
+// IsSoftware returns whether a is a software event provided by the
+// kernel, such as a CPU clock or page fault event.
+func (a *EventAttr) IsSoftware() bool {
+	return a.Type == EventTypeSoftware
+}
+
+// IsCache returns whether a is a generalized hardware cache event. Use
+// HWCacheEvent to decode which cache event it is.
+func (a *EventAttr) IsCache() bool {
+	return a.Type == EventTypeHWCache
+}
+
+// IsTracepoint returns whether a is a tracepoint event. For tracepoint
+// events, Config[0] is the tracepoint's ID.
+func (a *EventAttr) IsTracepoint() bool {
+	return a.Type == EventTypeTracepoint
+}
+
+// HWCacheEvent decodes the cache, operation, and result of a
+// generalized hardware cache event from a.Config[0]. ok is false if a
+// is not a cache event.
+//
+// On hybrid systems, the upper 32 bits of Config[0] select the PMU
+// that counts the event. These are ignored.
+func (a *EventAttr) HWCacheEvent() (ev HWCacheEvent, ok bool) {
+	if !a.IsCache() {
+		return HWCacheEvent{}, false
+	}
+	c := a.Config[0]
+	return HWCacheEvent{HWCacheID(c), HWCacheOp(c >> 8), HWCacheResult(c >> 16)}, true
+}
+
+// An HWCacheEvent is a generalized hardware cache event, which counts
+// the accesses or misses of one type of operation on one cache.
+//
+// This corresponds to the config of a PERF_TYPE_HW_CACHE event, as
+// described in include/uapi/linux/perf_event.h.
+type HWCacheEvent struct {
+	Cache  HWCacheID
+	Op     HWCacheOp
+	Result HWCacheResult
+}
+
+// String returns the name perf uses for e, such as
+// "L1-dcache-load-misses".
+func (e HWCacheEvent) String() string {
+	cache := e.Cache.String()
+	if int(e.Cache) < len(hwCacheNames) {
+		cache = hwCacheNames[e.Cache]
+	}
+	op := e.Op.String()
+	if int(e.Op) < len(hwCacheOpNames) {
+		op = hwCacheOpNames[e.Op]
+	}
+	switch e.Result {
+	case HWCacheResultAccess:
+		if e.Op == HWCacheOpPrefetch {
+			return cache + "-prefetches"
+		}
+		return cache + "-" + op + "s"
+	case HWCacheResultMiss:
+		return cache + "-" + op + "-misses"
+	}
+	return cache + "-" + op + "-" + e.Result.String()
+}
+
+// hwCacheNames are perf's names for each HWCacheID.
+var hwCacheNames = [...]string{"L1-dcache", "L1-icache", "LLC", "dTLB", "iTLB", "branch", "node"}
+
+// hwCacheOpNames are perf's names for each HWCacheOp.
+var hwCacheOpNames = [...]string{"load", "store", "prefetch"}
+
+// An HWCacheID identifies the cache counted by a generalized hardware
+// cache event.
+//
+// This corresponds to the perf_hw_cache_id enum from
+// include/uapi/linux/perf_event.h
+type HWCacheID uint8
+
+//go:generate stringer -type=HWCacheID
+
+const (
+	HWCacheL1D  HWCacheID = iota // Level 1 data cache
+	HWCacheL1I                   // Level 1 instruction cache
+	HWCacheLL                    // Last-level cache
+	HWCacheDTLB                  // Data TLB
+	HWCacheITLB                  // Instruction TLB
+	HWCacheBPU                   // Branch prediction unit
+	HWCacheNode                  // Local memory accesses
+)
+
+// An HWCacheOp is the type of cache operation counted by a
+// generalized hardware cache event.
+//
+// This corresponds to the perf_hw_cache_op_id enum from
+// include/uapi/linux/perf_event.h
+type HWCacheOp uint8
+
+//go:generate stringer -type=HWCacheOp
+
+const (
+	HWCacheOpRead HWCacheOp = iota
+	HWCacheOpWrite
+	HWCacheOpPrefetch
+)
+
+// An HWCacheResult is the outcome of the cache operations counted by
+// a generalized hardware cache event.
+//
+// This corresponds to the perf_hw_cache_op_result_id enum from
+// include/uapi/linux/perf_event.h
+type HWCacheResult uint8
+
+//go:generate stringer -type=HWCacheResult
+
+const (
+	HWCacheResultAccess HWCacheResult = iota
+	HWCacheResultMiss
+)
+
 // A SampleFormat is a bitmask of the fields recorded by a sample.
 //
 // This corresponds to the perf_event_sample_format enum from
@@ -245,6 +429,12 @@ const (
 	SampleFormatIdentifier
 	SampleFormatTransaction
 	SampleFormatRegsIntr
+	SampleFormatPhysAddr
+	SampleFormatAux
+	SampleFormatCgroup
+	SampleFormatDataPageSize
+	SampleFormatCodePageSize
+	SampleFormatWeightStruct
 )
 
 // sampleIDOffset returns the byte offset of the ID field within an
@@ -301,6 +491,11 @@ func (s SampleFormat) recordIDOffset() int {
 
 // trailerBytes returns the length in the sample_id trailer for
 // non-sample records.
+//
+// The trailer only ever includes these six fields. In particular,
+// even if SampleFormatCgroup is set, the kernel only records the
+// cgroup in samples, not in the trailer (see
+// __perf_event_header__init_id in kernel/events/core.c).
 func (s SampleFormat) trailerBytes() int {
 	s &= SampleFormatTID | SampleFormatTime | SampleFormatID | SampleFormatStreamID | SampleFormatCPU | SampleFormatIdentifier
 	return 8 * weight(uint64(s))
@@ -403,6 +598,15 @@ type recordHeader struct {
 	Size uint16
 }
 
+// decodeRecordHeader decodes an 8 byte perf_event_header from buf.
+func decodeRecordHeader(buf []byte, order binary.ByteOrder) recordHeader {
+	return recordHeader{
+		Type: RecordType(order.Uint32(buf[0:])),
+		Misc: recordMisc(order.Uint16(buf[4:])),
+		Size: order.Uint16(buf[6:]),
+	}
+}
+
 // A RecordType indicates the type of a record in a profile. A record
 // can either be a profiling sample or give information about changes
 // to system state, such as a process calling mmap.
@@ -423,6 +627,8 @@ const (
 	recordTypeMmap2 // internal extended RecordTypeMmap
 	RecordTypeAux
 
+	RecordTypeLostSamples RecordType = 13
+
 	recordTypeUserStart RecordType = 64
 )
 
@@ -438,22 +644,111 @@ const (
 	recordTypeHeaderBuildID
 	recordTypeHeaderFinishedRound
 	recordTypeHeaderIDIndex
+
+	// recordTypeCompressed is a container of other records,
+	// compressed by "perf record -z". Next decompresses these and
+	// returns the records they contain, so they never escape the
+	// API.
+	recordTypeCompressed RecordType = 81
+
+	// recordTypeFinishedInit marks the end of the records perf
+	// synthesizes at the beginning of a profile to describe the
+	// existing system state.
+	recordTypeFinishedInit RecordType = 82
 )
 
 // PERF_RECORD_MISC_* from include/uapi/linux/perf_event.h
 type recordMisc uint16
 
 const (
-	recordMiscCPUModeMask recordMisc = 7
-	recordMiscMmapData               = 1 << 13
-	recordMiscCommExec               = 1 << 13
-	recordMiscExactIP                = 1 << 14
+	recordMiscCPUModeMask         recordMisc = 7
+	recordMiscProcMapParseTimeout            = 1 << 12
+	recordMiscMmapData                       = 1 << 13
+	recordMiscCommExec                       = 1 << 13
+	recordMiscForkExec                       = 1 << 13
+	recordMiscSwitchOut                      = 1 << 13
+	recordMiscExactIP                        = 1 << 14
+	recordMiscSwitchOutPreempt               = 1 << 14
+	recordMiscMmapBuildID                    = 1 << 14
+	recordMiscExtReserved                    = 1 << 15
+	recordMiscLostSamplesBPF                 = 1 << 15
+)
+
+// Record types that are not decoded, but whose header misc bits are.
+const (
+	recordTypeSwitch        RecordType = 14
+	recordTypeSwitchCPUWide RecordType = 15
 )
 
+// MiscFlags is the decoded misc field of a record header. Bits 13
+// and 14 mean different things for different record types, so at
+// most one of the fields for each of these bits is set.
+type MiscFlags struct {
+	// CPUMode is the privilege level of the record.
+	CPUMode CPUMode
+
+	// ProcMapParseTimeout indicates that perf timed out while
+	// reading /proc/<pid>/maps when synthesizing this record, so
+	// the memory map of the process may be incomplete.
+	ProcMapParseTimeout bool
+
+	// Bit 13.
+	MmapData  bool // mmap of a non-executable mapping
+	CommExec  bool // comm caused by exec
+	ForkExec  bool // fork caused by exec
+	SwitchOut bool // context switch out of the task
+
+	// Bit 14.
+	ExactIP          bool // sample IP is exact; see EventAttr.Precise
+	SwitchOutPreempt bool // task was preempted when switched out
+	MmapBuildID      bool // mmap2 carries a build ID instead of device and inode
+
+	// ExtReserved is reserved for extending the misc field.
+	ExtReserved bool
+}
+
+// decodeMiscFlags decodes the misc field of a record header of type
+// typ.
+func decodeMiscFlags(typ RecordType, misc recordMisc) MiscFlags {
+	f := MiscFlags{
+		CPUMode:             CPUMode(misc & recordMiscCPUModeMask),
+		ProcMapParseTimeout: misc&recordMiscProcMapParseTimeout != 0,
+		ExtReserved:         misc&recordMiscExtReserved != 0,
+	}
+	bit13, bit14 := misc&(1<<13) != 0, misc&(1<<14) != 0
+	switch typ {
+	case RecordTypeMmap:
+		f.MmapData = bit13
+	case recordTypeMmap2:
+		f.MmapData, f.MmapBuildID = bit13, bit14
+	case RecordTypeComm:
+		f.CommExec = bit13
+	case RecordTypeFork:
+		f.ForkExec = bit13
+	case RecordTypeSample:
+		f.ExactIP = bit14
+	case recordTypeSwitch, recordTypeSwitchCPUWide:
+		f.SwitchOut, f.SwitchOutPreempt = bit13, bit14
+	}
+	return f
+}
+
 // Record is the common interface implemented by all profile record
 // types.
+//
+// Code that only needs to route records by kind, such as logging or
+// filtering, can switch on Type rather than on the concrete record
+// type. Record is not sealed: other packages may define their own
+// record types, for example to pass synthesized records through code
+// that consumes Records. Such types can embed RecordCommon to
+// implement Common.
 type Record interface {
+	// Type returns the type of this record. For record types
+	// defined by this package, this identifies the concrete
+	// Record* type.
 	Type() RecordType
+
+	// Common returns the fields shared by all record types.
 	Common() *RecordCommon
 }
 
@@ -461,8 +756,16 @@ type Record interface {
 // well as additional metadata. It is not itself a Record.
 //
 // Many fields are optional and their presence is determined by the
-// bitmask EventAttr.SampleFormat. Some record types guarantee that
-// some of these fields will be filled.
+// bitmask Format. Some record types guarantee that some of these
+// fields will be filled.
+//
+// For samples, these fields come from the sample itself. For other
+// kernel records, if the event has EventFlagSampleIDAll set, they
+// come from the sample_id trailer of the record, which records the
+// TID, Time, ID, StreamID, and CPU fields in the event's
+// SampleFormat. Hence, code that builds a timeline from many record
+// types can use Record.Common to get the time and CPU of any record
+// and check Format to see whether they are present.
 type RecordCommon struct {
 	// Offset is the byte offset of this event in the perf.data
 	// file.
@@ -480,8 +783,13 @@ type RecordCommon struct {
 	ID       attrID // if SampleFormatID or SampleFormatIdentifier
 	StreamID uint64 // if SampleFormatStreamID
 	CPU, Res uint32 // if SampleFormatCPU
+
+	// Misc is the decoded misc field of the record header.
+	Misc MiscFlags
 }
 
+// Common returns r. This allows types that embed RecordCommon to
+// implement Record.
 func (r *RecordCommon) Common() *RecordCommon {
 	return r
 }
@@ -503,7 +811,9 @@ func (r *RecordUnknown) Type() RecordType {
 // RecordMmaps can also occur at the beginning of a profile to
 // describe the existing memory layout.
 type RecordMmap struct {
-	// RecordCommon.PID and .TID will always be filled
+	// RecordCommon.PID and .TID will always be filled. For
+	// mappings in the kernel's address space, such as the kernel
+	// image and kernel modules, PID is -1. See IsKernel.
 	RecordCommon
 
 	Data bool // from header.misc
@@ -524,6 +834,23 @@ func (r *RecordMmap) Type() RecordType {
 	return RecordTypeMmap
 }
 
+// IsKernel returns whether r is a mapping in the kernel's address
+// space, such as the kernel image or a kernel module, rather than a
+// mapping in a process.
+func (r *RecordMmap) IsKernel() bool {
+	return r.PID == -1
+}
+
+// FileOffsetOf returns the byte offset in the mapped file that
+// corresponds to virtual address ip. It returns false if ip is not
+// within this mapping.
+func (r *RecordMmap) FileOffsetOf(ip uint64) (uint64, bool) {
+	if ip < r.Addr || ip-r.Addr >= r.Len {
+		return 0, false
+	}
+	return ip - r.Addr + r.FileOffset, true
+}
+
 // A RecordLost records that profiling events were lost because of a
 // buffer overflow.
 type RecordLost struct {
@@ -544,6 +871,14 @@ type RecordComm struct {
 	// RecordCommon.PID and .TID will always be filled
 	RecordCommon
 
+	// CPUMode is the privilege level the COMM event was
+	// generated in. For COMM records synthesized by perf at the
+	// beginning of a profile, this is typically CPUModeUser.
+	CPUMode CPUMode // from header.misc
+
+	// Exec indicates the COMM changed because the process called
+	// exec, rather than, for example, prctl(PR_SET_NAME). This is
+	// only set on kernels that support EventFlagCommExec.
 	Exec bool // from header.misc
 
 	Comm string
@@ -592,6 +927,24 @@ func (r *RecordFork) Type() RecordType {
 	return RecordTypeFork
 }
 
+// A RecordRead records the counter values of an inherited event in a
+// task when the task exits. The kernel only emits these for events
+// with EventFlagInheritStat set.
+type RecordRead struct {
+	// RecordCommon.PID and .TID will always be filled
+	RecordCommon
+
+	// Values records the values of the event's counter. If the
+	// event's ReadFormat includes ReadFormatGroup, this has one
+	// entry for each event in the event's group. Otherwise, it
+	// has exactly one entry.
+	Values []SampleRead
+}
+
+func (r *RecordRead) Type() RecordType {
+	return RecordTypeRead
+}
+
 // A RecordAux records the data was added to the AUX buffer.
 type RecordAux struct {
 	RecordCommon
@@ -618,6 +971,24 @@ const (
 	AuxFlagOverwrite
 )
 
+// A RecordLostSamples records that the kernel dropped samples of an
+// event without recording them. Unlike RecordLost, these samples were
+// not lost to a full ring buffer, but were generated and then
+// discarded, for example because the hardware reported them as lost.
+type RecordLostSamples struct {
+	RecordCommon
+
+	NumLost uint64
+
+	// BPF indicates that the samples were dropped by a BPF
+	// program filtering the event's samples.
+	BPF bool // from header.misc
+}
+
+func (r *RecordLostSamples) Type() RecordType {
+	return RecordTypeLostSamples
+}
+
 // A RecordSample records a profiling sample event.
 //
 // Typically only a subset of the fields are used. Which fields are
@@ -630,7 +1001,23 @@ type RecordSample struct {
 	RecordCommon
 
 	CPUMode CPUMode // from header.misc
-	ExactIP bool    // from header.misc
+
+	// ExactIP indicates that IP is the exact address of the
+	// sampled instruction. See PreciseIP.
+	ExactIP bool // from header.misc
+
+	// Identifier is the raw event ID recorded at the beginning of
+	// the sample. This is the same ID used to resolve EventAttr,
+	// but is recorded at a fixed position regardless of the
+	// sample format.
+	Identifier uint64 // if SampleFormatIdentifier
+
+	// ID is the raw event ID recorded in the sample's ID field.
+	// This can be used to correlate samples with the per-CPU or
+	// per-thread IDs of an event. Note that this shadows
+	// RecordCommon.ID, which is the ID used to resolve EventAttr
+	// from either ID or Identifier.
+	ID uint64 // if SampleFormatID
 
 	IP   uint64 // if SampleFormatIP
 	Addr uint64 // if SampleFormatAddr
@@ -654,8 +1041,20 @@ type RecordSample struct {
 	// constant indicating the stack type for the following IPs.
 	Callchain []uint64 // if SampleFormatCallchain
 
+	// Raw is the raw data recorded by the event. For a
+	// tracepoint event, this is the tracepoint's fields, which
+	// can be decoded using File.Tracepoint. It may be followed
+	// by padding.
+	Raw []byte // if SampleFormatRaw
+
 	BranchStack []BranchRecord // if SampleFormatBranchStack
 
+	// BranchHWIndex is the hardware index of the most recent
+	// entry in BranchStack in the hardware's circular branch
+	// buffer. For Intel LBRs, this can be used to stitch together
+	// branch stacks from consecutive samples.
+	BranchHWIndex uint64 // if SampleFormatBranchStack and BranchSampleHWIndex
+
 	// RegsUserABI and RegsUser record the ABI and values of
 	// user-space registers as of this sample. Note that these are
 	// the current user-space registers even if this sample
@@ -676,11 +1075,39 @@ type RecordSample struct {
 	StackUser        []byte // if SampleFormatStackUser
 	StackUserDynSize uint64 // if SampleFormatStackUser
 
-	Weight  uint64  // if SampleFormatWeight
+	// Weight is a hardware-specific cost of the sampled
+	// operation, such as the latency of a memory access. If the
+	// event uses SampleFormatWeightStruct, the weight is split in
+	// to components: Weight is the first 32 bits, and InsnLatency
+	// and RetireLatency are the instruction latency and retire
+	// latency (or pipeline stage cycles on some CPUs) in cycles.
+	Weight        uint64 // if SampleFormatWeight or SampleFormatWeightStruct
+	InsnLatency   uint16 // if SampleFormatWeightStruct
+	RetireLatency uint16 // if SampleFormatWeightStruct
+
 	DataSrc DataSrc // if SampleFormatDataSrc
 
 	Transaction Transaction // if SampleFormatTransaction
 	AbortCode   uint32      // if SampleFormatTransaction
+	// PhysAddr is the physical address corresponding to Addr, or
+	// 0 if the kernel could not determine it.
+	PhysAddr uint64 // if SampleFormatPhysAddr
+
+	// Cgroup is the ID of the cgroup of the sampled task. perf
+	// records the path of each cgroup ID in PERF_RECORD_CGROUP
+	// records, which this package does not yet decode.
+	Cgroup uint64 // if SampleFormatCgroup
+
+	// DataPageSize and CodePageSize are the sizes of the pages
+	// containing Addr and IP, respectively.
+	DataPageSize uint64 // if SampleFormatDataPageSize
+	CodePageSize uint64 // if SampleFormatCodePageSize
+
+	// Aux is a snapshot of the event's AUX area data taken at the
+	// time of this sample. For example, with Arm SPE this
+	// contains SPE packets, which can be decoded with
+	// NewSPEDecoder.
+	Aux []byte // if SampleFormatAux
 }
 
 func (r *RecordSample) Type() RecordType {
@@ -691,9 +1118,12 @@ func (r *RecordSample) String() string {
 	// TODO: Stringers for other record types
 	f := r.Format
 	s := fmt.Sprintf("{Offset:%v Format:%v EventAttr:%p CPUMode:%v ExactIP:%v", r.Offset, r.Format, r.EventAttr, r.CPUMode, r.ExactIP)
-	if f&(SampleFormatID|SampleFormatIdentifier) != 0 {
+	if f&SampleFormatID != 0 {
 		s += fmt.Sprintf(" ID:%d", r.ID)
 	}
+	if f&SampleFormatIdentifier != 0 {
+		s += fmt.Sprintf(" Identifier:%d", r.Identifier)
+	}
 	if f&SampleFormatIP != 0 {
 		s += fmt.Sprintf(" IP:%#x", r.IP)
 	}
@@ -721,8 +1151,14 @@ func (r *RecordSample) String() string {
 	if f&SampleFormatCallchain != 0 {
 		s += fmt.Sprintf(" Callchain:%#x", r.Callchain)
 	}
+	if f&SampleFormatRaw != 0 {
+		s += fmt.Sprintf(" Raw:[%d bytes]", len(r.Raw))
+	}
 	if f&SampleFormatBranchStack != 0 {
 		s += fmt.Sprintf(" BranchStack:%v", r.BranchStack)
+		if r.hasBranchHWIndex() {
+			s += fmt.Sprintf(" BranchHWIndex:%d", r.BranchHWIndex)
+		}
 	}
 	if f&SampleFormatRegsUser != 0 {
 		s += fmt.Sprintf(" RegsUserABI:%v RegsUser:%v", r.RegsUserABI, r.RegsUser)
@@ -736,23 +1172,48 @@ func (r *RecordSample) String() string {
 	if f&SampleFormatWeight != 0 {
 		s += fmt.Sprintf(" Weight:%d", r.Weight)
 	}
+	if f&SampleFormatWeightStruct != 0 {
+		s += fmt.Sprintf(" Weight:%d InsnLatency:%d RetireLatency:%d", r.Weight, r.InsnLatency, r.RetireLatency)
+	}
 	if f&SampleFormatDataSrc != 0 {
 		s += fmt.Sprintf(" DataSrc:%+v", r.DataSrc)
 	}
 	if f&SampleFormatTransaction != 0 {
 		s += fmt.Sprintf(" Transaction:%v AbortCode:%d", r.Transaction, r.AbortCode)
 	}
+	if f&SampleFormatPhysAddr != 0 {
+		s += fmt.Sprintf(" PhysAddr:%#x", r.PhysAddr)
+	}
+	if f&SampleFormatCgroup != 0 {
+		s += fmt.Sprintf(" Cgroup:%d", r.Cgroup)
+	}
+	if f&SampleFormatDataPageSize != 0 {
+		s += fmt.Sprintf(" DataPageSize:%d", r.DataPageSize)
+	}
+	if f&SampleFormatCodePageSize != 0 {
+		s += fmt.Sprintf(" CodePageSize:%d", r.CodePageSize)
+	}
+	if f&SampleFormatAux != 0 {
+		s += fmt.Sprintf(" Aux:[%d bytes]", len(r.Aux))
+	}
 	return s + "}"
 }
 
+func (r *RecordSample) hasBranchHWIndex() bool {
+	return r.EventAttr != nil && r.EventAttr.BranchSampleType&BranchSampleHWIndex != 0
+}
+
 // Fields returns the list of names of valid fields in r based on
 // r.Format. This is useful for writing custom printing functions.
 func (r *RecordSample) Fields() []string {
 	f := r.Format
 	fs := []string{"Offset", "Format", "EventAttr", "CPUMode", "ExactIP"}
-	if f&(SampleFormatID|SampleFormatIdentifier) != 0 {
+	if f&SampleFormatID != 0 {
 		fs = append(fs, "ID")
 	}
+	if f&SampleFormatIdentifier != 0 {
+		fs = append(fs, "Identifier")
+	}
 	if f&SampleFormatIP != 0 {
 		fs = append(fs, "IP")
 	}
@@ -780,8 +1241,14 @@ func (r *RecordSample) Fields() []string {
 	if f&SampleFormatCallchain != 0 {
 		fs = append(fs, "Callchain")
 	}
+	if f&SampleFormatRaw != 0 {
+		fs = append(fs, "Raw")
+	}
 	if f&SampleFormatBranchStack != 0 {
 		fs = append(fs, "BranchStack")
+		if r.hasBranchHWIndex() {
+			fs = append(fs, "BranchHWIndex")
+		}
 	}
 	if f&SampleFormatRegsUser != 0 {
 		fs = append(fs, "RegsUserABI", "RegsUser")
@@ -795,15 +1262,171 @@ func (r *RecordSample) Fields() []string {
 	if f&SampleFormatWeight != 0 {
 		fs = append(fs, "Weight")
 	}
+	if f&SampleFormatWeightStruct != 0 {
+		fs = append(fs, "Weight", "InsnLatency", "RetireLatency")
+	}
 	if f&SampleFormatDataSrc != 0 {
 		fs = append(fs, "DataSrc")
 	}
 	if f&SampleFormatTransaction != 0 {
 		fs = append(fs, "Transaction", "AbortCode")
 	}
+	if f&SampleFormatPhysAddr != 0 {
+		fs = append(fs, "PhysAddr")
+	}
+	if f&SampleFormatCgroup != 0 {
+		fs = append(fs, "Cgroup")
+	}
+	if f&SampleFormatDataPageSize != 0 {
+		fs = append(fs, "DataPageSize")
+	}
+	if f&SampleFormatCodePageSize != 0 {
+		fs = append(fs, "CodePageSize")
+	}
+	if f&SampleFormatAux != 0 {
+		fs = append(fs, "Aux")
+	}
 	return fs
 }
 
+// PreciseIP returns r.IP and whether it is the exact address of the
+// sampled instruction.
+//
+// Because of skid between an event and the PMU interrupt, IP may
+// be the address of an instruction some time after the instruction
+// that caused the event. Precise events (see EventAttr.Precise) can
+// eliminate skid. For example, with Intel PEBS, the kernel can
+// recover the exact instruction, in which case exact is true.
+// Otherwise, even for precise events, IP is typically the address of
+// the instruction following the sampled instruction. Tools that need
+// the sampled instruction itself may choose to treat inexact IPs
+// accordingly, for example by attributing the sample to the
+// preceding instruction.
+func (r *RecordSample) PreciseIP() (ip uint64, exact bool) {
+	return r.IP, r.ExactIP
+}
+
+// Copy returns a copy of r that does not share any slices with r.
+// Since Records.Next reuses the RecordSample it returns, and the
+// slices in it, callers that retain samples across calls to Next
+// must copy them.
+func (r *RecordSample) Copy() *RecordSample {
+	c := *r
+	if r.SampleRead != nil {
+		c.SampleRead = append([]SampleRead(nil), r.SampleRead...)
+	}
+	if r.Callchain != nil {
+		c.Callchain = append([]uint64(nil), r.Callchain...)
+	}
+	if r.BranchStack != nil {
+		c.BranchStack = append([]BranchRecord(nil), r.BranchStack...)
+	}
+	if r.RegsUser != nil {
+		c.RegsUser = append([]uint64(nil), r.RegsUser...)
+	}
+	if r.RegsIntr != nil {
+		c.RegsIntr = append([]uint64(nil), r.RegsIntr...)
+	}
+	if r.Raw != nil {
+		c.Raw = append([]byte(nil), r.Raw...)
+	}
+	if r.StackUser != nil {
+		c.StackUser = append([]byte(nil), r.StackUser...)
+	}
+	if r.Aux != nil {
+		c.Aux = append([]byte(nil), r.Aux...)
+	}
+	return &c
+}
+
+// CopyRecord returns a copy of r that does not share any memory with
+// r, other than its EventAttr. Since Records.Next reuses the records
+// it returns, callers that retain records of any type across calls to
+// Next must copy them. For samples, this is equivalent to
+// RecordSample.Copy.
+func CopyRecord(r Record) Record {
+	switch r := r.(type) {
+	case *RecordUnknown:
+		c := *r
+		if r.Data != nil {
+			c.Data = append([]byte(nil), r.Data...)
+		}
+		return &c
+	case *RecordMmap:
+		c := *r
+		return &c
+	case *RecordLost:
+		c := *r
+		return &c
+	case *RecordComm:
+		c := *r
+		return &c
+	case *RecordExit:
+		c := *r
+		return &c
+	case *RecordThrottle:
+		c := *r
+		return &c
+	case *RecordFork:
+		c := *r
+		return &c
+	case *RecordRead:
+		c := *r
+		if r.Values != nil {
+			c.Values = append([]SampleRead(nil), r.Values...)
+		}
+		return &c
+	case *RecordAux:
+		c := *r
+		return &c
+	case *RecordLostSamples:
+		c := *r
+		return &c
+	case *RecordSample:
+		return r.Copy()
+	}
+	panic(fmt.Sprintf("unknown record type %T", r))
+}
+
+// EstimatedCount returns the estimated number of events represented
+// by this sample. Summing EstimatedCount rather than counting samples
+// makes profiles recorded with different sampling periods or
+// frequencies comparable.
+//
+// The estimate is the sample's Period if recorded, or otherwise the
+// event's fixed SamplePeriod. If neither is known, EstimatedCount
+// returns 1, so the estimate degrades to counting samples. If the
+// sample records the event's enabled and running times, the estimate
+// is further scaled by their ratio to account for the event being
+// multiplexed with other events on the PMU.
+func (r *RecordSample) EstimatedCount() uint64 {
+	count := uint64(1)
+	if r.Format&SampleFormatPeriod != 0 {
+		count = r.Period
+	} else if r.EventAttr != nil && r.EventAttr.SamplePeriod != 0 {
+		count = r.EventAttr.SamplePeriod
+	}
+
+	if r.Format&SampleFormatRead == 0 || r.EventAttr == nil {
+		return count
+	}
+	const need = ReadFormatTotalTimeEnabled | ReadFormatTotalTimeRunning
+	if r.EventAttr.ReadFormat&need != need {
+		return count
+	}
+	for i := range r.SampleRead {
+		sr := &r.SampleRead[i]
+		if len(r.SampleRead) > 1 && sr.EventAttr != r.EventAttr {
+			continue
+		}
+		if sr.TimeRunning != 0 && sr.TimeRunning < sr.TimeEnabled {
+			count = uint64(float64(count) * float64(sr.TimeEnabled) / float64(sr.TimeRunning))
+		}
+		break
+	}
+	return count
+}
+
 // A CPUMode indicates the privilege level of a sample or event.
 //
 // This corresponds to PERF_RECORD_MISC_CPUMODE from
@@ -825,7 +1448,8 @@ const (
 //
 // Typically only a subset of the fields are used. Which fields are
 // set can be determined from the bitmask in the sample's
-// EventAttr.ReadFormat.
+// EventAttr.ReadFormat. For group reads, every SampleRead records
+// the enabled and running times of the whole group.
 //
 // This corresponds to perf_event_read_format from
 // include/uapi/linux/perf_event.h
@@ -840,8 +1464,116 @@ type SampleRead struct {
 type BranchRecord struct {
 	From, To uint64
 	Flags    BranchFlags
+
+	// Cycles is the number of cycles since the previous branch
+	// record, or 0 if not supported by the hardware.
+	Cycles uint16
+
+	// Type is the type of the branch, if the event's
+	// BranchSampleType includes BranchSampleTypeSave.
+	Type BranchType
+
+	// Spec is whether the branch was speculatively executed, if
+	// supported by the hardware.
+	Spec BranchSpec
+
+	// Priv is the privilege level of the branch target, if the
+	// event's BranchSampleType includes BranchSamplePrivSave.
+	Priv BranchPriv
+
+	// Counters records the occurrences of events in the event
+	// group between this branch and the previous branch, if the
+	// event's BranchSampleType includes BranchSampleCounters.
+	// The number of bits per counter and the number of counters
+	// are given by the FeaturePMUCaps "branch_counter_nr" and
+	// "branch_counter_width" capabilities.
+	Counters uint64
+}
+
+// decodeFlags decodes the perf_branch_entry bit fields in the
+// flags word x into r.
+func (r *BranchRecord) decodeFlags(x uint64) {
+	r.Flags = BranchFlags(x & 0xf)
+	r.Cycles = uint16(x >> 4)
+	typ, newType := (x>>20)&0xf, (x>>26)&0xf
+	if typ == branchTypeExtendABI {
+		r.Type = BranchType(branchTypeExtendABI + newType)
+	} else {
+		r.Type = BranchType(typ)
+	}
+	r.Spec = BranchSpec((x >> 24) & 0x3)
+	r.Priv = BranchPriv((x >> 30) & 0x7)
 }
 
+// A BranchSpec indicates whether a branch was speculatively executed.
+//
+// This corresponds to PERF_BR_SPEC_* from
+// include/uapi/linux/perf_event.h.
+type BranchSpec uint8
+
+//go:generate stringer -type=BranchSpec
+
+const (
+	BranchSpecNA                 BranchSpec = iota // Not available
+	BranchSpecWrongPath                            // Speculative but on wrong path
+	BranchSpecCorrectPath                          // Speculative and on correct path
+	BranchSpecNonSpecCorrectPath                   // Non-speculative but on correct path
+)
+
+// A BranchPriv is the privilege level of a branch target.
+//
+// This corresponds to PERF_BR_PRIV_* from
+// include/uapi/linux/perf_event.h.
+type BranchPriv uint8
+
+//go:generate stringer -type=BranchPriv
+
+const (
+	BranchPrivUnknown    BranchPriv = iota
+	BranchPrivUser                  // User mode
+	BranchPrivKernel                // Kernel mode
+	BranchPrivHypervisor            // Hypervisor mode
+)
+
+// A BranchType is the type of a branch recorded in a branch stack.
+//
+// This corresponds to PERF_BR_* from include/uapi/linux/perf_event.h.
+// Types that perf encodes using PERF_BR_EXTEND_ABI and new_type are
+// numbered following BranchTypeNoTx.
+type BranchType uint8
+
+//go:generate stringer -type=BranchType
+
+const (
+	BranchTypeUnknown    BranchType = iota
+	BranchTypeCond                  // Conditional
+	BranchTypeUncond                // Unconditional
+	BranchTypeInd                   // Indirect
+	BranchTypeCall                  // Function call
+	BranchTypeIndCall               // Indirect function call
+	BranchTypeRet                   // Function return
+	BranchTypeSyscall               // Syscall
+	BranchTypeSysret                // Syscall return
+	BranchTypeCondCall              // Conditional function call
+	BranchTypeCondRet               // Conditional function return
+	BranchTypeEret                  // Exception return
+	BranchTypeIRQ                   // IRQ
+	BranchTypeSError                // System error
+	BranchTypeNoTx                  // Not in transaction
+	BranchTypeFaultAlign            // Alignment fault
+	BranchTypeFaultData             // Data fault
+	BranchTypeFaultInst             // Instruction fault
+	BranchTypeArch1                 // Architecture specific
+	BranchTypeArch2                 // Architecture specific
+	BranchTypeArch3                 // Architecture specific
+	BranchTypeArch4                 // Architecture specific
+	BranchTypeArch5                 // Architecture specific
+)
+
+// branchTypeExtendABI is PERF_BR_EXTEND_ABI, which indicates the
+// branch type is in the new_type field.
+const branchTypeExtendABI = 15
+
 type BranchFlags uint64
 
 //go:generate go run ../cmd/bitstringer/main.go -type=BranchFlags -strip=BranchFlag
@@ -875,6 +1607,11 @@ const (
 	CallchainGuest       = 0xfffffffffffff800 // -2048
 	CallchainGuestKernel = 0xfffffffffffff780 // -2176
 	CallchainGuestUser   = 0xfffffffffffff600 // -2560
+
+	// CallchainContextMax is the lowest value in a callchain that
+	// is a context marker rather than an IP. This corresponds to
+	// -PERF_CONTEXT_MAX.
+	CallchainContextMax = 0xfffffffffffff001 // -4095
 )
 
 // SampleRegsABI indicates the register ABI of a given sample for
@@ -892,26 +1629,31 @@ const (
 	SampleRegsABI64
 )
 
+// A DataSrc describes the memory hierarchy source of a sampled data
+// access.
 type DataSrc struct {
-	Op     DataSrcOp
-	Miss   bool // if true, Level specifies miss, rather than hit
+	Op     DataSrcOp // Type of access, such as load or store
+	Miss   bool      // if true, Level specifies miss, rather than hit
 	Level  DataSrcLevel
 	Snoop  DataSrcSnoop
 	Locked DataSrcLock
 	TLB    DataSrcTLB
 }
 
+// DataSrcOp is a bit mask of the operation types of a memory access.
+// Most samples have exactly one bit set, so loads and stores can be
+// distinguished by testing for DataSrcOpLoad or DataSrcOpStore.
 type DataSrcOp int
 
 //go:generate go run ../cmd/bitstringer/main.go -type=DataSrcOp -strip=DataSrcOp
 
 const (
-	DataSrcOpLoad DataSrcOp = 1 << iota
-	DataSrcOpStore
-	DataSrcOpPrefetch
-	DataSrcOpExec
+	DataSrcOpLoad     DataSrcOp = 1 << iota // Load instruction
+	DataSrcOpStore                          // Store instruction
+	DataSrcOpPrefetch                       // Prefetch
+	DataSrcOpExec                           // Code execution
 
-	DataSrcOpNA DataSrcOp = 0
+	DataSrcOpNA DataSrcOp = 0 // Operation not available
 )
 
 type DataSrcLevel int
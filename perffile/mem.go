@@ -0,0 +1,255 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"sort"
+)
+
+// WeightHistogram returns a histogram of the Weight field of all
+// samples in f. For memory sampling events, the weight is the latency
+// of the sampled memory access in cycles.
+//
+// buckets gives the lower bound of each histogram bucket and must be
+// sorted in increasing order. The returned map maps the lower bound
+// of each bucket to the number of samples whose weight falls in that
+// bucket, that is, the bucket with the largest lower bound that is
+// <= the sample's weight. Samples with weights less than buckets[0]
+// are not counted.
+//
+// WeightHistogram returns an error if no event in f records sample
+// weights.
+func (f *File) WeightHistogram(buckets []uint64) (map[uint64]uint64, error) {
+	const weight = SampleFormatWeight | SampleFormatWeightStruct
+	if !f.hasSampleFormat(SampleFormatWeight) && !f.hasSampleFormat(SampleFormatWeightStruct) {
+		return nil, fmt.Errorf("no events record sample weights")
+	}
+
+	hist := make(map[uint64]uint64, len(buckets))
+	for _, b := range buckets {
+		hist[b] = 0
+	}
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		r, ok := rs.Record.(*RecordSample)
+		if !ok || r.Format&weight == 0 {
+			continue
+		}
+		i := sort.Search(len(buckets), func(i int) bool {
+			return r.Weight < buckets[i]
+		})
+		if i > 0 {
+			hist[buckets[i-1]]++
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+// A MemEvent combines the fields of a sample that describe a single
+// sampled memory access.
+type MemEvent struct {
+	// PID, TID, CPU, and Time identify the sample, if recorded
+	// by its event.
+	PID, TID int
+	CPU      uint32
+	Time     uint64
+
+	// IP is the address of the instruction that performed the
+	// access.
+	IP uint64
+
+	// Addr is the virtual address of the accessed data.
+	Addr uint64
+
+	// PhysAddr is the physical address of the accessed data, or 0
+	// if unknown.
+	PhysAddr uint64
+
+	// DataSrc describes the operation and where in the memory
+	// hierarchy the access was satisfied.
+	DataSrc DataSrc
+
+	// Weight is the latency of the access in cycles, or 0 if the
+	// event does not record sample weights.
+	Weight uint64
+
+	// Symbol is the name of the function containing the
+	// instruction that performed the access, or "" if unknown.
+	Symbol string
+}
+
+// A Symbolizer resolves the instruction addresses of samples to
+// symbol names.
+type Symbolizer interface {
+	// Update is called with every record in the file, in file
+	// order, so the Symbolizer can track state such as memory
+	// mappings.
+	Update(r Record)
+
+	// Symbol returns the name of the function containing the
+	// IP of sample r, or "" if unknown.
+	Symbol(r *RecordSample) string
+}
+
+// MemEvents returns the memory access samples in f. Only samples from
+// events that record both the data address and the data source are
+// returned. If sym is non-nil, it is used to fill in the Symbol field
+// of each MemEvent.
+//
+// MemEvents returns an error if no event in f records both the data
+// address and the data source of samples.
+func (f *File) MemEvents(sym Symbolizer) ([]MemEvent, error) {
+	const need = SampleFormatAddr | SampleFormatDataSrc
+	if !f.hasSampleFormat(need) {
+		return nil, fmt.Errorf("no events record sample address and data source")
+	}
+
+	var out []MemEvent
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if sym != nil {
+			sym.Update(rs.Record)
+		}
+		r, ok := rs.Record.(*RecordSample)
+		if !ok || r.Format&need != need {
+			continue
+		}
+		ev := MemEvent{
+			PID: r.PID, TID: r.TID, CPU: r.CPU, Time: r.Time,
+			IP:       r.IP,
+			Addr:     r.Addr,
+			PhysAddr: r.PhysAddr,
+			DataSrc:  r.DataSrc,
+			Weight:   r.Weight,
+		}
+		if sym != nil {
+			ev.Symbol = sym.Symbol(r)
+		}
+		out = append(out, ev)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// A CacheLineStat summarizes the sampled memory accesses to a single
+// cache line.
+type CacheLineStat struct {
+	// Line is the physical address of the cache line.
+	Line uint64
+
+	// Loads and Stores are the number of sampled loads and
+	// stores to this cache line.
+	Loads, Stores uint64
+
+	// HITM is the number of sampled accesses that hit a modified
+	// copy of this cache line in another core's cache. A large
+	// number of HITM accesses indicates contention between cores,
+	// such as false sharing.
+	HITM uint64
+
+	// Remote is the number of sampled accesses that were
+	// satisfied by a remote cache or remote memory.
+	Remote uint64
+
+	// PIDs is the sorted list of processes that accessed this
+	// cache line.
+	PIDs []int
+}
+
+// cacheLineShift is log2 of the cache line size assumed by
+// CacheLineContention.
+const cacheLineShift = 6
+
+// CacheLineContention aggregates the sampled memory accesses in f by
+// physical cache line. This is the basis of "perf c2c" and can be
+// used to find cache lines that are shared between cores, such as
+// falsely shared data.
+//
+// The result is sorted by decreasing HITM count, and then by
+// decreasing number of accesses. Samples with an unknown physical
+// address are ignored.
+//
+// CacheLineContention returns an error if no event in f records both
+// the physical address and the data source of samples.
+func (f *File) CacheLineContention() ([]CacheLineStat, error) {
+	const need = SampleFormatPhysAddr | SampleFormatDataSrc
+	if !f.hasSampleFormat(need) {
+		return nil, fmt.Errorf("no events record sample physical address and data source")
+	}
+
+	lines := make(map[uint64]*CacheLineStat)
+	pids := make(map[uint64]map[int]bool)
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		r, ok := rs.Record.(*RecordSample)
+		if !ok || r.Format&need != need || r.PhysAddr == 0 {
+			continue
+		}
+		line := r.PhysAddr >> cacheLineShift << cacheLineShift
+		st := lines[line]
+		if st == nil {
+			st = &CacheLineStat{Line: line}
+			lines[line] = st
+			pids[line] = make(map[int]bool)
+		}
+		src := r.DataSrc
+		if src.Op&DataSrcOpStore != 0 {
+			st.Stores++
+		} else if src.Op&DataSrcOpLoad != 0 {
+			st.Loads++
+		}
+		if src.Snoop&DataSrcSnoopHitM != 0 {
+			st.HITM++
+		}
+		const remote = DataSrcLevelRemoteRAM1 | DataSrcLevelRemoteRAM2 | DataSrcLevelRemoteCache1 | DataSrcLevelRemoteCache2
+		if src.Level&remote != 0 {
+			st.Remote++
+		}
+		if r.Format&SampleFormatTID != 0 {
+			pids[line][r.PID] = true
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]CacheLineStat, 0, len(lines))
+	for line, st := range lines {
+		for pid := range pids[line] {
+			st.PIDs = append(st.PIDs, pid)
+		}
+		sort.Ints(st.PIDs)
+		out = append(out, *st)
+	}
+	sort.Sort(cacheLineStatSorter(out))
+	return out, nil
+}
+
+type cacheLineStatSorter []CacheLineStat
+
+func (s cacheLineStatSorter) Len() int {
+	return len(s)
+}
+
+func (s cacheLineStatSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s cacheLineStatSorter) Less(i, j int) bool {
+	if s[i].HITM != s[j].HITM {
+		return s[i].HITM > s[j].HITM
+	}
+	ni, nj := s[i].Loads+s[i].Stores, s[j].Loads+s[j].Stores
+	if ni != nj {
+		return ni > nj
+	}
+	return s[i].Line < s[j].Line
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testSymbolizer struct {
+	comms map[int]string
+}
+
+func (s *testSymbolizer) Update(r Record) {
+	if r, ok := r.(*RecordComm); ok {
+		s.comms[r.PID] = r.Comm
+	}
+}
+
+func (s *testSymbolizer) Symbol(r *RecordSample) string {
+	return s.comms[r.PID]
+}
+
+func TestWeightHistogram(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatWeight,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+	}}, 2)
+	for _, w := range []uint64{5, 10, 50, 99, 100, 5000} {
+		tf.record(RecordTypeSample, 0, uint64(1), uint64(0x400), w)
+	}
+	tf.record(RecordTypeSample, 0, uint64(2), uint64(0x400))
+
+	got, err := tf.open(t).WeightHistogram([]uint64{10, 100, 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint64]uint64{10: 3, 100: 1, 1000: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tf = &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+	if _, err := tf.open(t).WeightHistogram([]uint64{0}); err == nil {
+		t.Errorf("want error for file without sample weights")
+	}
+}
+
+func TestMemEvents(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTID | SampleFormatAddr | SampleFormatWeight | SampleFormatDataSrc,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTID,
+	}}, 2)
+	tf.record(RecordTypeComm, 0, 10, 10, "a")
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x400), 10, 10, uint64(0x1008), uint64(42), uint64(0x04))
+	tf.record(RecordTypeSample, 0, uint64(2), uint64(0x500), 10, 10)
+
+	evs, err := tf.open(t).MemEvents(&testSymbolizer{make(map[int]string)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MemEvent{{PID: 10, TID: 10, IP: 0x400, Addr: 0x1008, Weight: 42,
+		DataSrc: DataSrc{Op: DataSrcOpStore, Locked: DataSrcLockUnlocked}, Symbol: "a"}}
+	if len(evs) != 1 || evs[0] != want[0] {
+		t.Errorf("got %+v, want %+v", evs, want)
+	}
+
+	tf = &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+	if _, err := tf.open(t).MemEvents(nil); err == nil {
+		t.Errorf("want error for file without memory samples")
+	}
+}
+
+func TestCacheLineContention(t *testing.T) {
+	// See perf_mem_data_src in include/uapi/linux/perf_event.h.
+	const (
+		load     = 0x2
+		store    = 0x4
+		l1Hit    = (0x2 | 0x8) << 5
+		remote   = (0x2 | 0x400) << 5
+		snoopHit = 0x10 << 19
+	)
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTID | SampleFormatAddr | SampleFormatDataSrc | SampleFormatPhysAddr,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTID | SampleFormatAddr | SampleFormatDataSrc,
+	}}, 2)
+	sample := func(pid int, src, phys uint64) {
+		tf.record(RecordTypeSample, 0, uint64(1), uint64(0x400), pid, pid, uint64(0x7000), src, phys)
+	}
+	// Two processes falsely sharing the line at 0x10000.
+	sample(20, store|snoopHit, 0x10008)
+	sample(10, load|snoopHit, 0x10030)
+	sample(20, load|l1Hit, 0x10010)
+	// A busier line without HITM accesses.
+	sample(30, load|l1Hit, 0x30000)
+	sample(30, load|l1Hit, 0x30008)
+	sample(30, store|l1Hit, 0x3003f)
+	// A line with a remote access.
+	sample(40, load|remote, 0x20040)
+	// Samples with unknown physical addresses or from events
+	// that don't record them are ignored.
+	sample(50, load|snoopHit, 0)
+	tf.record(RecordTypeSample, 0, uint64(2), uint64(0x400), 60, 60, uint64(0x7000), uint64(load|snoopHit))
+
+	f := tf.open(t)
+	got, err := f.CacheLineContention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CacheLineStat{
+		{Line: 0x10000, Loads: 2, Stores: 1, HITM: 2, PIDs: []int{10, 20}},
+		{Line: 0x30000, Loads: 2, Stores: 1, PIDs: []int{30}},
+		{Line: 0x20040, Loads: 1, Remote: 1, PIDs: []int{40}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// MemEvents passes through the physical address.
+	evs, err := f.MemEvents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 9 || evs[0].PhysAddr != 0x10008 || evs[7].PhysAddr != 0 || evs[8].PhysAddr != 0 {
+		t.Errorf("got %+v, want physical addresses from samples", evs)
+	}
+
+	tf = &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP | SampleFormatAddr | SampleFormatDataSrc}})
+	tf.record(RecordTypeSample, 0, uint64(0x400), uint64(0x7000), uint64(load))
+	if _, err := tf.open(t).CacheLineContention(); err == nil {
+		t.Errorf("want error for file without physical addresses")
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/bits"
 	"reflect"
+	"time"
 )
 
 type FileMeta struct {
@@ -79,6 +81,75 @@ type FileMeta struct {
 	// Groups is the descriptions of each perf event group in this
 	// profile, or nil if unknown.
 	Groups []GroupDesc
+
+	// MemBlockSize is the size in bytes of a memory block in
+	// MemNodes, or 0 if unknown.
+	MemBlockSize uint64
+
+	// MemNodes is the memory topology of the machine that
+	// recorded this profile, or nil if unknown. Unlike NUMANodes,
+	// this records which physical memory belongs to each node.
+	MemNodes []MemNode
+
+	// FirstSampleTime and LastSampleTime are the times of the
+	// first and last samples in this profile, as recorded by
+	// perf, or 0, 0 if unknown.
+	FirstSampleTime, LastSampleTime uint64
+
+	// Compression is the algorithm used to compress records in
+	// this profile, such as "zstd", or "" if records are not
+	// compressed. CompressionLevel is the compression level.
+	// Compressed records are decompressed transparently by
+	// Records if support for Compression is compiled in; see
+	// Records.Next.
+	Compression      string
+	CompressionLevel int
+
+	// Tracepoints maps from tracepoint ID to the format of each
+	// tracepoint on the machine that recorded this profile, or
+	// nil if unknown. See also File.Tracepoint.
+	Tracepoints map[uint64]*TracepointFormat
+
+	// ClockData relates the clock used for sample times to
+	// wall-clock time, or is nil if unknown. perf records this
+	// with "perf record -k".
+	ClockData *ClockData
+
+	// BPFBTF maps from BTF object ID to the raw BTF type
+	// information of BPF programs loaded while recording this
+	// profile, or nil if unknown. See also File.BPFProgInfo.
+	BPFBTF map[uint32][]byte
+
+	bpfProgs []bpfProg
+}
+
+// ClockData records simultaneous readings of the clock used for
+// sample times and the wall clock, which can be used to convert
+// between them.
+type ClockData struct {
+	// ClockID is the ID of the sample clock, such as 1 for
+	// CLOCK_MONOTONIC.
+	ClockID int
+
+	// Wall is the wall-clock time when the sample clock read
+	// Sample.
+	Wall   time.Time
+	Sample uint64
+}
+
+// WallTime converts time t from the sample clock to wall-clock time.
+func (c *ClockData) WallTime(t uint64) time.Time {
+	return c.Wall.Add(time.Duration(t - c.Sample))
+}
+
+// SampleTime converts wall-clock time t to the sample clock. Times
+// before the start of the sample clock are clamped to 0.
+func (c *ClockData) SampleTime(t time.Time) uint64 {
+	d := t.Sub(c.Wall)
+	if d < 0 && uint64(-d) > c.Sample {
+		return 0
+	}
+	return c.Sample + uint64(d)
 }
 
 // A BuildIDInfo records the mapping between a single build ID and the
@@ -109,6 +180,20 @@ type NUMANode struct {
 	CPUs CPUSet
 }
 
+// A MemNode describes the physical memory of a NUMA node.
+type MemNode struct {
+	// Node is the system identifier of this NUMA node.
+	Node int
+
+	// Size is the total bytes of memory in this node.
+	Size uint64
+
+	// Blocks lists the indexes of the memory blocks in this node,
+	// in increasing order. Block i spans physical addresses
+	// [i*MemBlockSize, (i+1)*MemBlockSize).
+	Blocks []int
+}
+
 // A GroupDesc describes a group of PMU events that are scheduled
 // together.
 //
@@ -120,24 +205,52 @@ type GroupDesc struct {
 	NumMembers int
 }
 
-var featureParsers = map[feature]func(*FileMeta, bufDecoder) error{
-	featureBuildID:      (*FileMeta).parseBuildID,
-	featureHostname:     stringFeature("Hostname"),
-	featureOSRelease:    stringFeature("OSRelease"),
-	featureVersion:      stringFeature("Version"),
-	featureArch:         stringFeature("Arch"),
-	featureNrCpus:       (*FileMeta).parseNrCPUs,
-	featureCPUDesc:      stringFeature("CPUDesc"),
-	featureCPUID:        stringFeature("CPUID"),
-	featureTotalMem:     (*FileMeta).parseTotalMem,
-	featureCmdline:      (*FileMeta).parseCmdLine,
-	featureCPUTopology:  (*FileMeta).parseCPUTopology,
-	featureNUMATopology: (*FileMeta).parseNUMATopology,
-	featurePMUMappings:  (*FileMeta).parsePMUMappings,
-	featureGroupDesc:    (*FileMeta).parseGroupDesc,
+var featureParsers = map[FeatureID]func(*FileMeta, bufDecoder) error{
+	FeatureTracingData:  (*FileMeta).parseTracingData,
+	FeatureBuildID:      (*FileMeta).parseBuildID,
+	FeatureHostname:     stringFeature("Hostname"),
+	FeatureOSRelease:    stringFeature("OSRelease"),
+	FeatureVersion:      stringFeature("Version"),
+	FeatureArch:         stringFeature("Arch"),
+	FeatureNrCpus:       (*FileMeta).parseNrCPUs,
+	FeatureCPUDesc:      stringFeature("CPUDesc"),
+	FeatureCPUID:        stringFeature("CPUID"),
+	FeatureTotalMem:     (*FileMeta).parseTotalMem,
+	FeatureCmdline:      (*FileMeta).parseCmdLine,
+	FeatureCPUTopology:  (*FileMeta).parseCPUTopology,
+	FeatureNUMATopology: (*FileMeta).parseNUMATopology,
+	FeaturePMUMappings:  (*FileMeta).parsePMUMappings,
+	FeatureGroupDesc:    (*FileMeta).parseGroupDesc,
+	FeatureSampleTime:   (*FileMeta).parseSampleTime,
+	FeatureMemTopology:  (*FileMeta).parseMemTopology,
+	FeatureCompressed:   (*FileMeta).parseCompressed,
+	FeatureClockData:    (*FileMeta).parseClockData,
+	FeatureBPFProgInfo:  (*FileMeta).parseBPFProgInfo,
+	FeatureBPFBTF:       (*FileMeta).parseBPFBTF,
 }
 
-func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
+// ValidCPU returns whether cpu is a possible CPU index on the machine
+// that recorded this profile. If the number of available CPUs is
+// unknown, it only checks that cpu is non-negative.
+func (m *FileMeta) ValidCPU(cpu int) bool {
+	return cpu >= 0 && (m.CPUsAvail == 0 || cpu < m.CPUsAvail)
+}
+
+// Socket returns the index in CoreGroups of the CPU package
+// containing cpu, or -1 if the CPU topology is unknown or cpu is not
+// in it. perf records the topology of the CPUs that were online when
+// recording started, so CPUs that were offline then, even if they
+// were brought online later, have no socket.
+func (m *FileMeta) Socket(cpu int) int {
+	for i, cpus := range m.CoreGroups {
+		if cpus.Contains(cpu) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *FileMeta) parse(f FeatureID, sec fileSection, r io.ReaderAt) error {
 	parser := featureParsers[f]
 	if parser == nil {
 		return nil
@@ -148,7 +261,7 @@ func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
 	if err != nil {
 		return err
 	}
-	bd := bufDecoder{data, binary.LittleEndian}
+	bd := bufDecoder{buf: data, order: binary.LittleEndian}
 
 	// Parse the section.
 	return parser(m, bd)
@@ -163,20 +276,37 @@ func stringFeature(name string) func(*FileMeta, bufDecoder) error {
 	}
 }
 
+// recordMiscBuildIDSize indicates that a build ID record in
+// HEADER_BUILD_ID records the size of its build ID. Otherwise, the
+// build ID is 20 bytes.
+const recordMiscBuildIDSize = 1 << 15
+
 func (m *FileMeta) parseBuildID(bd bufDecoder) error {
+	// See struct perf_record_header_build_id in
+	// tools/lib/perf/include/perf/event.h.
 	m.BuildIDs = make([]BuildIDInfo, 0)
 	for len(bd.buf) > 0 {
 		var bid BuildIDInfo
 		start := bd.buf
 		// This starts with a recordHeader.
 		_ = bd.u32() // type, unused
-		bid.CPUMode = CPUMode(bd.u16() & uint16(recordMiscCPUModeMask))
-		size := bd.u16()
+		misc := bd.u16()
+		bid.CPUMode = CPUMode(misc & uint16(recordMiscCPUModeMask))
+		size := int(bd.u16())
+		if size < 8 || size > len(start) {
+			return fmt.Errorf("build ID record has bad size %d", size)
+		}
+		bd.buf = start[8:size]
 		bid.PID = int(bd.i32())
-		// The build ID is 20 bytes, but padded to 8 bytes.
+		// The build ID is up to 20 bytes, followed by its
+		// size, and padded to 8 bytes.
 		buildID := make([]byte, 24)
 		bd.bytes(buildID)
-		bid.BuildID = BuildID(buildID[:20])
+		idLen := 20
+		if misc&recordMiscBuildIDSize != 0 && int(buildID[20]) < idLen {
+			idLen = int(buildID[20])
+		}
+		bid.BuildID = BuildID(buildID[:idLen])
 		bid.Filename = bd.cstring()
 		m.BuildIDs = append(m.BuildIDs, bid)
 		bd.buf = start[size:]
@@ -185,7 +315,9 @@ func (m *FileMeta) parseBuildID(bd bufDecoder) error {
 }
 
 func (m *FileMeta) parseNrCPUs(bd bufDecoder) error {
-	m.CPUsOnline, m.CPUsAvail = int(bd.u32()), int(bd.u32())
+	// See write_nrcpus in tools/perf/util/header.c. The number of
+	// available CPUs comes first, followed by the number online.
+	m.CPUsAvail, m.CPUsOnline = int(bd.u32()), int(bd.u32())
 	return nil
 }
 
@@ -194,12 +326,80 @@ func (m *FileMeta) parseTotalMem(bd bufDecoder) error {
 	return nil
 }
 
+func (m *FileMeta) parseSampleTime(bd bufDecoder) error {
+	m.FirstSampleTime, m.LastSampleTime = bd.u64(), bd.u64()
+	return nil
+}
+
+func (m *FileMeta) parseCompressed(bd bufDecoder) error {
+	// See write_compressed in tools/perf/util/header.c.
+	if version := bd.u32(); version != 0 {
+		return fmt.Errorf("unknown compression version %d", version)
+	}
+	switch typ := bd.u32(); typ {
+	case 0:
+		// PERF_COMP_NONE
+	case 1:
+		m.Compression = "zstd"
+	default:
+		m.Compression = fmt.Sprintf("unknown(%d)", typ)
+	}
+	m.CompressionLevel = int(bd.u32())
+	return nil
+}
+
+func (m *FileMeta) parseClockData(bd bufDecoder) error {
+	// See write_clock_data in tools/perf/util/header.c.
+	if version := bd.u32(); version != 1 {
+		return fmt.Errorf("unknown clock data version %d", version)
+	}
+	c := &ClockData{ClockID: int(bd.u32())}
+	wall := bd.u64()
+	c.Wall, c.Sample = time.Unix(0, int64(wall)), bd.u64()
+	if bd.overflow {
+		return fmt.Errorf("clock data is truncated")
+	}
+	m.ClockData = c
+	return nil
+}
+
+func (m *FileMeta) parseMemTopology(bd bufDecoder) error {
+	// See write_mem_topology in tools/perf/util/header.c.
+	if version := bd.u64(); version != 1 {
+		return fmt.Errorf("unknown memory topology version %d", version)
+	}
+	blockSize := bd.u64()
+	n := bd.count(3 * 8)
+	nodes := make([]MemNode, 0, n)
+	for i := 0; i < n; i++ {
+		node := MemNode{Node: int(bd.u64())}
+		bd.u64() // Number of blocks, repeated in bitmap
+		nbits := bd.u64()
+		if nbits > uint64(len(bd.buf))*8 {
+			bd.fail()
+			break
+		}
+		for w := 0; w < int(nbits+63)/64; w++ {
+			for word := bd.u64(); word != 0; word &= word - 1 {
+				node.Blocks = append(node.Blocks, w*64+bits.TrailingZeros64(word))
+			}
+		}
+		node.Size = uint64(len(node.Blocks)) * blockSize
+		nodes = append(nodes, node)
+	}
+	if bd.overflow {
+		return fmt.Errorf("memory topology is truncated")
+	}
+	m.MemBlockSize, m.MemNodes = blockSize, nodes
+	return nil
+}
+
 func (m *FileMeta) parseCmdLine(bd bufDecoder) error {
 	m.CmdLine = bd.stringList()
 	return nil
 }
 
-// TODO: Implement featureEventDesc. This isn't useful unless we also
+// TODO: Implement FeatureEventDesc. This isn't useful unless we also
 // expose attribute IDs or something to make it possible to match up
 // the event descriptions with the samples. Probably we should hide
 // this as a feature section and just expose the set of events in the
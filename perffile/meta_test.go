@@ -0,0 +1,108 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMemTopology(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	tf.addFeature(FeatureTotalMem, encodeFields(uint64(16<<20)))
+	tf.addFeature(FeatureMemTopology, encodeFields(
+		uint64(1),       // version
+		uint64(128<<20), // block size
+		uint64(2),       // nodes
+		uint64(0), uint64(4), uint64(4), uint64(0xf),
+		uint64(1), uint64(66), uint64(66), uint64(0), uint64(3),
+	))
+	tf.record(RecordTypeSample, 0)
+
+	f := tf.open(t)
+	if f.Meta.TotalMem != 16<<30 {
+		t.Errorf("got TotalMem %d, want %d", f.Meta.TotalMem, 16<<30)
+	}
+	if f.Meta.MemBlockSize != 128<<20 {
+		t.Errorf("got MemBlockSize %d, want %d", f.Meta.MemBlockSize, 128<<20)
+	}
+	want := []MemNode{
+		{Node: 0, Size: 4 * 128 << 20, Blocks: []int{0, 1, 2, 3}},
+		{Node: 1, Size: 2 * 128 << 20, Blocks: []int{64, 65}},
+	}
+	if !reflect.DeepEqual(f.Meta.MemNodes, want) {
+		t.Errorf("got MemNodes %+v, want %+v", f.Meta.MemNodes, want)
+	}
+}
+
+func TestNrCPUs(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	// write_nrcpus writes nr_cpus_avail, then nr_cpus_online.
+	tf.addFeature(FeatureNrCpus, encodeFields(uint32(16), uint32(12)))
+	tf.record(RecordTypeSample, 0)
+
+	f := tf.open(t)
+	if f.Meta.CPUsAvail != 16 || f.Meta.CPUsOnline != 12 {
+		t.Errorf("got CPUsAvail %d, CPUsOnline %d; want 16, 12", f.Meta.CPUsAvail, f.Meta.CPUsOnline)
+	}
+}
+
+func TestFeatureBytes(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	tf.addFeature(FeatureTotalMem, encodeFields(uint64(16<<20)))
+	unknown := FeatureID(60)
+	tf.addFeature(unknown, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	tf.record(RecordTypeSample, 0)
+
+	f := tf.open(t)
+	for _, test := range []struct {
+		id   FeatureID
+		want []byte
+	}{
+		{FeatureTotalMem, encodeFields(uint64(16 << 20))},
+		{unknown, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	} {
+		got, err := f.FeatureBytes(test.id)
+		if err != nil {
+			t.Errorf("%v: %v", test.id, err)
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("%v: got %x, want %x", test.id, got, test.want)
+		}
+	}
+	if _, err := f.FeatureBytes(FeatureCmdline); err == nil {
+		t.Errorf("want error for missing feature")
+	}
+}
+
+func TestBuildIDs(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	bid20 := []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14\x00\x00\x00\x00")
+	bid16 := []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x00\x00\x00\x00\x10\x00\x00\x00")
+	var data []byte
+	data = append(data, encodeFields(uint32(0), uint16(CPUModeKernel), uint16(8+4+24+24), -1, bid20, "[kernel.kallsyms]")...)
+	data = append(data, encodeFields(uint32(0), uint16(CPUModeUser|recordMiscBuildIDSize), uint16(8+4+24+8), 10, bid16, "/bin/a")...)
+	tf.addFeature(FeatureBuildID, data)
+	tf.record(RecordTypeSample, 0)
+
+	want := []BuildIDInfo{
+		{CPUModeKernel, -1, BuildID(bid20[:20]), "[kernel.kallsyms]"},
+		{CPUModeUser, 10, BuildID(bid16[:16]), "/bin/a"},
+	}
+	if got := tf.open(t).Meta.BuildIDs; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A record whose size exceeds the section must not panic.
+	data = encodeFields(uint32(0), uint16(0), uint16(200), -1, bid20, "x")
+	tf.addFeature(FeatureBuildID, data)
+	if got := tf.open(t).Meta.BuildIDs; len(got) != 0 {
+		t.Errorf("got %+v for corrupt build IDs, want none", got)
+	}
+}
@@ -5,9 +5,11 @@
 package perffile
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"sort"
@@ -34,13 +36,26 @@ type File struct {
 	idToAttr map[attrID]*EventAttr
 
 	sampleIDOffset int // byte offset of AttrID in sample
+	// sampleIDOffsets and recordIDOffsets, if non-nil, are the
+	// distinct ID offsets of events whose ID offsets differ.
+	sampleIDOffsets, recordIDOffsets []int
 
 	sampleIDAll    bool // non-samples have sample_id trailer
 	recordIDOffset int  // byte offset of AttrID in non-sample, from end
+
+	featureSecs map[FeatureID]fileSection
+
+	// timeBounds caches the result of TimeBounds.
+	timeBounds *[2]uint64
 }
 
 // New reads a "perf.data" file from r.
 //
+// New reads only the file header, the event descriptions, and the
+// metadata sections; it does not read any records. Hence, f.Events,
+// f.Meta, and methods such as Features and DataRange are cheap even
+// for very large profiles. Records are only read by Records.
+//
 // The caller must keep r open as long as it is using the returned
 // *File.
 func New(r io.ReaderAt) (*File, error) {
@@ -65,12 +80,21 @@ func New(r io.ReaderAt) (*File, error) {
 		// TODO: Support big endian profiles.
 		return nil, fmt.Errorf("big endian profiles not supported")
 	case "PERFFILE":
-		// Version 1 file.
-		return nil, fmt.Errorf("version 1 profiles not supported")
+		// Version 1 file. This has the same layout as
+		// version 2, but was always written in host byte
+		// order, which we assume is little endian.
+		break
 	default:
 		return nil, fmt.Errorf("bad or unsupported file magic %q", string(file.hdr.Magic[:]))
 	}
-	if file.hdr.Size != uint64(binary.Size(&file.hdr)) {
+	switch file.hdr.Size {
+	case uint64(binary.Size(&file.hdr)):
+		break
+	case uint64(binary.Size(&file.hdr)) - numFeatureBits/8:
+		// Old version 1 files don't have the feature bitmap.
+		// We read part of the data section into it.
+		file.hdr.Features = [numFeatureBits / 64]uint64{}
+	default:
 		return nil, fmt.Errorf("bad header size %d", file.hdr.Size)
 	}
 
@@ -95,26 +119,40 @@ func New(r io.ReaderAt) (*File, error) {
 	file.attrs = make([]fileAttr, nAttrs)
 	attrSR := file.hdr.Attrs.sectionReader(r)
 	for i := 0; i < nAttrs; i++ {
+		start, _ := attrSR.Seek(0, 1)
 		if err := readFileAttr(attrSR, &file.attrs[i]); err != nil {
 			return nil, err
 		}
+		end, _ := attrSR.Seek(0, 1)
+		idsSize := int64(binary.Size(fileSection{}))
+		file.attrs[i].raw = fileSection{file.hdr.Attrs.Offset + uint64(start), uint64(end - start - idsSize)}
 		file.Events = append(file.Events, &file.attrs[i].Attr)
 	}
 
 	// Read EventAttr IDs and create ID -> EventAttr map
 	file.idToAttr = make(map[attrID]*EventAttr)
-	for _, attr := range file.attrs {
+	for i := range file.attrs {
+		attr := &file.attrs[i]
 		var ids []attrID
 		if err := readSlice(attr.IDs.sectionReader(r), &ids); err != nil {
 			return nil, err
 		}
-		for _, id := range ids {
+		attr.ids = make([]uint64, len(ids))
+		for i, id := range ids {
 			file.idToAttr[id] = &attr.Attr
+			attr.ids[i] = uint64(id)
 		}
 	}
 
 	// Check that sample formats are consistent across all event
 	// types and record cross-event sample format information.
+	//
+	// Records identify their event by an ID field, but the
+	// position of that field depends on the event's sample
+	// format, which isn't known until the event is found. perf
+	// requires all events to put the ID at the same position. We
+	// also accept events that put the ID at different positions,
+	// in which case Records tries each position; see resolveID.
 	firstEvent := &file.attrs[0].Attr
 	file.sampleIDOffset = firstEvent.SampleFormat.sampleIDOffset()
 	file.recordIDOffset = firstEvent.SampleFormat.recordIDOffset()
@@ -128,16 +166,14 @@ func New(r io.ReaderAt) (*File, error) {
 			x := attr.Attr.SampleFormat.sampleIDOffset()
 			if x == -1 {
 				return nil, fmt.Errorf("multiple events, but samples have no event ID field")
-			} else if file.sampleIDOffset != x {
-				return nil, fmt.Errorf("events have incompatible ID offsets %d and %d", file.sampleIDOffset, x)
 			}
+			file.sampleIDOffsets = addOffset(file.sampleIDOffsets, x)
 
 			x = attr.Attr.SampleFormat.recordIDOffset()
 			if x == -1 {
 				return nil, fmt.Errorf("multiple events, but records have no event ID field")
-			} else if file.recordIDOffset != x {
-				return nil, fmt.Errorf("records have incompatible ID offsets %d and %d", file.recordIDOffset, x)
 			}
+			file.recordIDOffsets = addOffset(file.recordIDOffsets, x)
 
 			// See perf_evlist__valid_sample_id_all.
 			idAll := attr.Attr.Flags&EventFlagSampleIDAll != 0
@@ -150,6 +186,12 @@ func New(r io.ReaderAt) (*File, error) {
 				return nil, fmt.Errorf("events have incompatible read formats")
 			}
 		}
+		if len(file.sampleIDOffsets) == 1 {
+			file.sampleIDOffsets = nil
+		}
+		if len(file.recordIDOffsets) == 1 {
+			file.recordIDOffsets = nil
+		}
 		if firstEvent.SampleFormat&SampleFormatRead != 0 &&
 			firstEvent.ReadFormat&ReadFormatID == 0 {
 			return nil, fmt.Errorf("bad event read format")
@@ -157,8 +199,9 @@ func New(r io.ReaderAt) (*File, error) {
 	}
 
 	// Load feature sections.
+	file.featureSecs = make(map[FeatureID]fileSection)
 	sr = io.NewSectionReader(r, int64(file.hdr.Data.Offset+file.hdr.Data.Size), int64(numFeatureBits*binary.Size(fileSection{})))
-	for bit := feature(0); bit < feature(numFeatureBits); bit++ {
+	for bit := FeatureID(0); bit < FeatureID(numFeatureBits); bit++ {
 		if !file.hdr.hasFeature(bit) {
 			continue
 		}
@@ -166,6 +209,7 @@ func New(r io.ReaderAt) (*File, error) {
 		if err := binary.Read(sr, binary.LittleEndian, &sec); err != nil {
 			return nil, err
 		}
+		file.featureSecs[bit] = sec
 		file.Meta.parse(bit, sec, file.r)
 	}
 
@@ -190,6 +234,80 @@ func Open(name string) (*File, error) {
 	return ff, nil
 }
 
+// EventIDs returns the IDs assigned to event ev by the kernel, which
+// identify the event in the ID field of records. perf opens one file
+// descriptor for an event per CPU or thread it monitors, and each file
+// descriptor has its own ID, so IDs are listed in the order perf
+// opened them, ordered by CPU and then by thread. EventIDs returns nil
+// if ev is not in f.Events or the profile did not record IDs, which is
+// usually the case for single-event profiles.
+func (f *File) EventIDs(ev *EventAttr) []uint64 {
+	for i := range f.attrs {
+		if &f.attrs[i].Attr == ev {
+			if len(f.attrs[i].ids) == 0 {
+				return nil
+			}
+			return append([]uint64(nil), f.attrs[i].ids...)
+		}
+	}
+	return nil
+}
+
+// OpenCompressed is like Open, but if the named file is compressed as
+// a whole, such as a "perf.data.gz" file, it decompresses it in
+// memory before parsing it. Uncompressed files are opened as with
+// Open. OpenCompressed detects gzip and zstd compression from the
+// file's magic number. Like compressed records, zstd-compressed files
+// are only supported if the package is built with the "zstd" build
+// tag; otherwise OpenCompressed returns an error for them.
+//
+// This is distinct from compressed records within a perf.data file,
+// which are recorded by "perf record -z" and decompressed by
+// Records.Next.
+func OpenCompressed(name string) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var magic [4]byte
+	n, _ := io.ReadFull(f, magic[:])
+	var algo string
+	switch {
+	case n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		algo = "gzip"
+	case n == 4 && string(magic[:]) == "\x28\xb5\x2f\xfd":
+		algo = "zstd"
+	}
+	if algo != "" {
+		defer f.Close()
+		newReader := fileDecompressors[algo]
+		if newReader == nil {
+			return nil, fmt.Errorf("%s: %s-compressed files are not supported", name, algo)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		zr, err := newReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		defer zr.Close()
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return New(bytes.NewReader(data))
+	}
+
+	ff, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ff.closer = f
+	return ff, nil
+}
+
 func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	// See read_attr in tools/perf/util/header.c.
 
@@ -201,8 +319,8 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	if attr.Size == 0 {
 		// Assume ABI v0
 		attr.Size = 64
-	} else if attr.Size > uint32(binary.Size(&attr)) {
-		return fmt.Errorf("event attr size %d too large; more recent and unsupported format", attr.Size)
+	} else if attr.Size < uint32(binary.Size(&attr.eventAttrV0)) {
+		return fmt.Errorf("event attr size %d too small", attr.Size)
 	} else {
 		// Read whatever's left. There are specific versions
 		// of this structure, but perf doesn't try to
@@ -217,6 +335,13 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 			}
 			left -= binary.Size(field)
 		}
+		// If this attr is from a newer kernel, skip the
+		// fields we don't know about.
+		if left > 0 {
+			if _, err := sr.Seek(int64(left), 1); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Convert on-disk perf_event_attr in to EventAttr.
@@ -244,8 +369,10 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 		fa.Attr.Config[1] = attr.BPAddrOrConfig1
 		fa.Attr.Config[2] = attr.BPLenOrConfig2
 	}
+	fa.Attr.BranchSampleType = attr.BranchSampleType
 	fa.Attr.SampleRegsUser = attr.SampleRegsUser
 	fa.Attr.SampleStackUser = attr.SampleStackUser
+	fa.Attr.SampleRegsIntr = attr.SampleRegsIntr
 	fa.Attr.AuxWatermark = attr.AuxWatermark
 
 	// Finally, read IDs fileSection, which follows the eventAttr.
@@ -340,18 +467,29 @@ func (f *File) Records(order RecordsOrder) *Records {
 		// performing separately buffered reads of each
 		// sub-stream.
 
+		// Records decompressed from compressed records can't
+		// be re-read by seeking, so they're kept in memory.
+
 		rs := f.Records(RecordsFileOrder)
+		rs.KeepRaw()
 		pos, ts := make([]int64, 0), make([]uint64, 0)
+		var decompressed []bufferedRecord
 		for rs.Next() {
 			c := rs.Record.Common()
-			pos = append(pos, c.Offset)
+			if rs.sampleKey < 0 {
+				raw := append([]byte(nil), rs.RawRecord()...)
+				decompressed = append(decompressed, bufferedRecord{c.Offset, rs.sampleKey, raw})
+				pos = append(pos, -int64(len(decompressed)))
+			} else {
+				pos = append(pos, c.Offset)
+			}
 			ts = append(ts, c.Time)
 		}
 		if rs.Err() != nil {
 			return &Records{err: rs.Err()}
 		}
 		sort.Stable(&timeSorter{pos, ts})
-		return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r)), order: pos}
+		return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r)), order: pos, orderAll: pos, orderTimes: ts, decompressed: decompressed}
 	}
 
 	return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))}
@@ -374,3 +512,56 @@ func (s *timeSorter) Swap(i, j int) {
 	s.pos[i], s.pos[j] = s.pos[j], s.pos[i]
 	s.ts[i], s.ts[j] = s.ts[j], s.ts[i]
 }
+
+// hasSampleFormat returns whether any event in f records the sample
+// fields in mask.
+func (f *File) hasSampleFormat(mask SampleFormat) bool {
+	for _, attr := range f.Events {
+		if attr.SampleFormat&mask == mask {
+			return true
+		}
+	}
+	return false
+}
+
+// DataRange returns the range of byte offsets [start, end) of the
+// records in f's file. Together with RecordCommon.Offset, this can be
+// used to report progress while reading the records of a large file.
+func (f *File) DataRange() (start, end int64) {
+	return int64(f.hdr.Data.Offset), int64(f.hdr.Data.Offset + f.hdr.Data.Size)
+}
+
+// Features returns the list of optional metadata sections present
+// in f, in increasing order. Most features are parsed into f.Meta,
+// but this can be used to check which metadata f has, such as
+// whether it has build IDs.
+func (f *File) Features() []FeatureID {
+	var out []FeatureID
+	for bit := FeatureID(0); bit < FeatureID(numFeatureBits); bit++ {
+		if f.hdr.hasFeature(bit) {
+			out = append(out, bit)
+		}
+	}
+	return out
+}
+
+// FeatureBytes returns the raw contents of feature section id. This
+// is useful for decoding features that are not parsed into f.Meta.
+// It returns an error if f does not have feature id.
+func (f *File) FeatureBytes(id FeatureID) ([]byte, error) {
+	sec, ok := f.featureSecs[id]
+	if !ok {
+		return nil, fmt.Errorf("file has no %v section", id)
+	}
+	return sec.data(f.r)
+}
+
+// addOffset adds off to the set of offsets offs.
+func addOffset(offs []int, off int) []int {
+	for _, x := range offs {
+		if x == off {
+			return offs
+		}
+	}
+	return append(offs, off)
+}
@@ -6,8 +6,11 @@ package perffile
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"time"
 )
 
 // A Records is an iterator over the records in a "perf.data" file.
@@ -34,12 +37,94 @@ type Records struct {
 
 	// order specifies the seek order to read records in. If nil,
 	// records are read in file order until EOF. If non-nil,
-	// records are read in this order.
-	order []int64
+	// records are read in this order. Negative positions -i-1
+	// refer to decompressed[i]. order is a suffix of orderAll,
+	// and orderTimes are the times of the records in orderAll,
+	// which are in increasing order.
+	order      []int64
+	orderAll   []int64
+	orderTimes []uint64
+
+	// decompressed holds records decompressed from compressed
+	// records for reading in order.
+	decompressed []bufferedRecord
+
+	// decomp is the decompressor for compressed records, created
+	// when the first compressed record is read. noDecomp
+	// indicates that this is a clone that started partway
+	// through the compressed stream, so it cannot decompress
+	// further compressed records.
+	decomp   decompressor
+	noDecomp bool
+
+	// inner is the decompressed data waiting to be decoded,
+	// which is a suffix of innerBuf. innerOffset is the offset of
+	// the compressed record it came from and innerPos is the
+	// number of bytes of decompressed data consumed so far.
+	inner, innerBuf []byte
+	innerOffset     int64
+	innerPos        int64
+
+	// sampleKey identifies the current record for sampling. It is
+	// the record's offset, or a negative value for a record that
+	// was decompressed from a compressed record.
+	sampleKey int64
 
 	// Read buffer.  Reused (and resized) by Next.
 	buf []byte
 
+	// keepRaw indicates that Next should retain the raw bytes of
+	// the current record in raw.
+	keepRaw bool
+	raw     []byte
+
+	// sampleRaw, if non-nil, is the predicate set by
+	// KeepSampleRaw. sampleRawKeep caches its result for each
+	// event.
+	sampleRaw     func(*EventAttr) bool
+	sampleRawKeep map[*EventAttr]bool
+
+	// onlyTypes, if non-nil, is the set of record types to
+	// decode. Other records are skipped without decoding.
+	onlyTypes map[RecordType]bool
+
+	// sampleThreshold, if sampling is set, is the threshold of
+	// sampleHash below which samples are kept.
+	sampling        bool
+	sampleThreshold uint64
+
+	// strict indicates that Next should check that each record
+	// was decoded in its entirety.
+	strict bool
+
+	// maxRecordSize is the limit set by MaxRecordSize, or 0 for
+	// DefaultMaxRecordSize.
+	maxRecordSize int
+
+	// rejectUnknown indicates that Next should fail on records
+	// of types this package does not decode.
+	rejectUnknown bool
+
+	// bestEffort indicates that Next should skip records that
+	// fail to decode, recording the failures in errors.
+	bestEffort bool
+	errors     []*RecordError
+
+	// stats accumulates the counts reported by Stats.
+	stats recordStats
+
+	// peeked indicates that Peek has decoded the record to be
+	// returned by the next call to Next into peekRecord, peekRaw,
+	// and peekOK.
+	peeked     bool
+	peekRecord Record
+	peekRaw    []byte
+	peekOK     bool
+
+	// filters are predicates applied to each record by Next.
+	// Records for which any filter returns false are skipped.
+	filters []func(Record) bool
+
 	// Cache for common record types
 	recordMmap   RecordMmap
 	recordComm   RecordComm
@@ -54,6 +139,264 @@ func (r *Records) Err() error {
 	return r.err
 }
 
+// Clone returns a new iterator positioned at the same record as r.
+// The two iterators share the underlying File, but are otherwise
+// independent: advancing the clone does not affect r, so the clone
+// can be used to scan ahead and then discarded.
+//
+// The clone's Record field is nil until the first call to its Next
+// method. If Peek has been called on r, the clone's first call to
+// Next returns the peeked record, which shares storage with r until
+// r's next call to Next. Because decompression state cannot be
+// copied, a clone made after r has begun decompressing compressed
+// records fails when it reaches the next compressed record.
+func (r *Records) Clone() *Records {
+	c := &Records{f: r.f, err: r.err, order: r.order, orderAll: r.orderAll, orderTimes: r.orderTimes, decompressed: r.decompressed, keepRaw: r.keepRaw, sampleRaw: r.sampleRaw, onlyTypes: r.onlyTypes, sampling: r.sampling, sampleThreshold: r.sampleThreshold, strict: r.strict, rejectUnknown: r.rejectUnknown, maxRecordSize: r.maxRecordSize, bestEffort: r.bestEffort}
+	c.filters = append([]func(Record) bool(nil), r.filters...)
+	c.inner, c.innerOffset, c.innerPos = append([]byte(nil), r.inner...), r.innerOffset, r.innerPos
+	c.noDecomp = r.decomp != nil || r.noDecomp
+	c.peeked, c.peekRecord, c.peekRaw, c.peekOK = r.peeked, r.peekRecord, r.peekRaw, r.peekOK
+	c.stats = r.stats
+	if r.stats.otherCounts != nil {
+		c.stats.otherCounts = make(map[RecordType]uint64, len(r.stats.otherCounts))
+		for typ, n := range r.stats.otherCounts {
+			c.stats.otherCounts[typ] = n
+		}
+	}
+	if r.sr == nil || r.err != nil {
+		return c
+	}
+	pos, _ := r.sr.Seek(0, 1)
+	c.sr = newBufferedSectionReader(r.f.hdr.Data.sectionReader(r.f.r))
+	_, c.err = c.sr.Seek(pos, 0)
+	return c
+}
+
+// Filter restricts r to records for which keep returns true. If
+// Filter is called multiple times, Next only returns records that
+// satisfy all of the filters. Filter should be called before the
+// first call to Next.
+func (r *Records) Filter(keep func(Record) bool) {
+	r.filters = append(r.filters, keep)
+}
+
+// FilterCPUMode restricts r to samples whose CPUMode is mode. If
+// keepOther is true, records other than samples are passed through
+// unfiltered; otherwise they are skipped.
+func (r *Records) FilterCPUMode(mode CPUMode, keepOther bool) {
+	r.Filter(func(rec Record) bool {
+		if s, ok := rec.(*RecordSample); ok {
+			return s.CPUMode == mode
+		}
+		return keepOther
+	})
+}
+
+// FilterStreamID restricts r to records whose StreamID is id. This
+// follows the data of a single counter, such as one inherited child
+// counter of an event. Non-sample records only carry a stream ID if
+// their event has EventFlagSampleIDAll set; records without a stream
+// ID are skipped.
+func (r *Records) FilterStreamID(id uint64) {
+	r.Filter(func(rec Record) bool {
+		c := rec.Common()
+		return c.Format&SampleFormatStreamID != 0 && c.StreamID == id
+	})
+}
+
+// KeepRaw causes r to retain the raw bytes of each record, which can
+// then be retrieved with RawRecord. KeepRaw should be called before
+// the first call to Next.
+func (r *Records) KeepRaw() {
+	r.keepRaw = true
+}
+
+// RawRecord returns the raw bytes of the current record, including
+// its header, exactly as they appear in the file. This can be used to
+// copy records verbatim to another file. RawRecord returns nil unless
+// KeepRaw has been called.
+//
+// The returned slice is only valid until the next call to Next.
+func (r *Records) RawRecord() []byte {
+	return r.raw
+}
+
+// KeepSampleRaw restricts which samples retain their Raw data. For
+// samples of events for which keep returns false, the raw data is
+// skipped and RecordSample.Raw is nil. keep is called at most once
+// for each event. By default, samples of all events with
+// SampleFormatRaw retain their raw data.
+//
+// This is useful for recordings that mix tracepoint events, whose raw
+// data holds the tracepoint's fields, with hardware events, whose raw
+// data is meaningless. KeepSampleRaw should be called before the first
+// call to Next.
+func (r *Records) KeepSampleRaw(keep func(*EventAttr) bool) {
+	r.sampleRaw = keep
+	r.sampleRawKeep = nil
+}
+
+// keepSampleRaw returns whether samples of attr should retain their
+// raw data.
+func (r *Records) keepSampleRaw(attr *EventAttr) bool {
+	if r.sampleRaw == nil {
+		return true
+	}
+	keep, ok := r.sampleRawKeep[attr]
+	if !ok {
+		if r.sampleRawKeep == nil {
+			r.sampleRawKeep = make(map[*EventAttr]bool)
+		}
+		keep = r.sampleRaw(attr)
+		r.sampleRawKeep[attr] = keep
+	}
+	return keep
+}
+
+// OnlyTypes restricts r to records of the given types. Unlike Filter,
+// records of other types are skipped without being decoded, which
+// makes passes that only need a few record types, such as mmap
+// records, much faster. OnlyTypes should be called before the first
+// call to Next.
+func (r *Records) OnlyTypes(types ...RecordType) {
+	r.onlyTypes = make(map[RecordType]bool, len(types))
+	for _, t := range types {
+		r.onlyTypes[t] = true
+		if t == RecordTypeMmap {
+			// Extended mmap records are also RecordMmaps.
+			r.onlyTypes[recordTypeMmap2] = true
+		}
+	}
+}
+
+// Sample restricts r to a fraction rate of the sample records, for
+// quickly computing an approximate profile of a large file. Records
+// other than samples, such as mmap and comm records, are not
+// affected. Samples that are dropped are skipped without being
+// decoded.
+//
+// Whether a sample is kept depends only on its offset in the file, so
+// the same samples are kept every time a file is read with the same
+// rate. Sample should be called before the first call to Next.
+func (r *Records) Sample(rate float64) {
+	r.sampling = true
+	switch {
+	case rate >= 1:
+		r.sampling = false
+	case rate <= 0:
+		r.sampleThreshold = 0
+	default:
+		r.sampleThreshold = uint64(rate * (1 << 64))
+	}
+}
+
+// sampleHash returns a well-mixed hash of a record offset. This is
+// the finalizer of SplitMix64.
+func sampleHash(offset int64) uint64 {
+	x := uint64(offset)
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Strict puts r in strict mode. In this mode, Next checks that
+// decoding each record consumed exactly the bytes in the record, and
+// returns an error if any bytes are left over. Leftover bytes usually
+// indicate that the record layout does not match the event's sample
+// format, for example because the file uses a format feature this
+// package does not understand. Strict should be called before the
+// first call to Next.
+func (r *Records) Strict() {
+	r.strict = true
+}
+
+// RejectUnknown causes Next to fail with an error giving the record's
+// type and offset if it encounters a record of a type this package
+// does not decode, which Next would otherwise return as a
+// RecordUnknown. This is useful for checking that no data in a file
+// is being ignored. Records skipped by OnlyTypes and perf's
+// FINISHED_ROUND and FINISHED_INIT markers, which carry no data, are
+// not errors. In best-effort mode, unknown records are skipped and
+// reported by Errors like other records that fail to decode.
+//
+// RejectUnknown should be called before the first call to Next.
+func (r *Records) RejectUnknown() {
+	r.rejectUnknown = true
+}
+
+// DefaultMaxRecordSize is the default limit on the size of a record
+// set by Records.MaxRecordSize.
+const DefaultMaxRecordSize = 64 << 20
+
+// MaxRecordSize limits the records read by r to n bytes. If a record
+// is larger, Next returns an error rather than allocating memory for
+// it. This protects programs that read untrusted files from corrupt
+// or malicious records. The size of a record in a file is limited to
+// 64 KB by its header, but a compressed record can decompress to
+// arbitrarily large data, which Next must hold in memory, so this
+// limit also applies to the data decompressed from each compressed
+// record. The default limit is DefaultMaxRecordSize. MaxRecordSize
+// should be called before the first call to Next.
+//
+// For RecordsCausalOrder and RecordsTimeOrder, the records are first
+// read in file order with the default limit to sort them.
+func (r *Records) MaxRecordSize(n int) {
+	r.maxRecordSize = n
+}
+
+func (r *Records) recordLimit() int {
+	if r.maxRecordSize == 0 {
+		return DefaultMaxRecordSize
+	}
+	return r.maxRecordSize
+}
+
+// GroupByThread reads the remaining records from r and calls fn for
+// each sample with the sample's thread ID. This can be used to build
+// per-thread profiles without materializing all samples. Records
+// other than samples are skipped. As with Next, the sample passed to
+// fn may be reused after fn returns.
+//
+// GroupByThread returns r.Err().
+func (r *Records) GroupByThread(fn func(tid int, s *RecordSample)) error {
+	for r.Next() {
+		if s, ok := r.Record.(*RecordSample); ok {
+			fn(s.TID, s)
+		}
+	}
+	return r.Err()
+}
+
+// BestEffort puts r in best-effort mode. In this mode, if a record
+// cannot be decoded, Next records the error, skips over the record
+// using the size in its header, and continues with the next record.
+// This is useful for recovering as much as possible from a corrupt
+// file, such as one written by a "perf record" that was killed.
+// Errors that leave the record boundaries unknown still stop
+// iteration and are reported by Err.
+//
+// BestEffort should be called before the first call to Next.
+func (r *Records) BestEffort() {
+	r.bestEffort = true
+}
+
+// A RecordError describes a record that was skipped in best-effort
+// mode because it could not be decoded.
+type RecordError struct {
+	Offset int64 // File offset of the record
+	Size   int   // Size of the record in bytes, including its header
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("skipped %d byte record at offset %d: %v", e.Size, e.Offset, e.Err)
+}
+
+// Errors returns the records skipped so far in best-effort mode.
+func (r *Records) Errors() []*RecordError {
+	return r.errors
+}
+
 // Next fetches the next record into r.Record.  It returns true if
 // successful, and false if it reaches the end of the record stream or
 // encounters an error.
@@ -61,47 +404,316 @@ func (r *Records) Err() error {
 // The record stored in r.Record may be reused by later invocations of
 // Next, so if the caller may need the record after another call to
 // Next, it must make its own copy.
+//
+// Next decompresses records compressed by "perf record -z" and
+// returns the records they contain in place of the compressed record.
+// The Offset of each such record is the offset of the compressed
+// record in which it ends. Decompression requires support for the
+// algorithm in FileMeta.Compression; zstd support is only compiled in
+// with the "zstd" build tag, since it requires an external package.
 func (r *Records) Next() bool {
+	if r.peeked {
+		r.Record, r.raw = r.peekRecord, r.peekRaw
+		r.peeked, r.peekRecord, r.peekRaw = false, nil, nil
+		return r.peekOK
+	}
+	for r.next() {
+		if r.keep(r.Record) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrTooManyRecords is returned by Records.All if there are more
+// records than its limit.
+var ErrTooManyRecords = errors.New("too many records")
+
+// All returns copies of all remaining records in r, up to limit
+// records, or all records if limit < 0. The records are copied with
+// CopyRecord, so unlike the records returned by Next, they remain
+// valid.
+//
+// If there are more than limit records, All returns the first limit
+// records and ErrTooManyRecords. Callers that want to truncate the
+// stream rather than fail can ignore this error.
+//
+// This is meant for small profiles and tests. For large profiles,
+// iterate over r with Next instead.
+func (r *Records) All(limit int) ([]Record, error) {
+	var out []Record
+	for r.Next() {
+		if limit >= 0 && len(out) == limit {
+			return out, ErrTooManyRecords
+		}
+		out = append(out, CopyRecord(r.Record))
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RecordStats summarizes the records read by a Records iterator.
+type RecordStats struct {
+	// Records is the number of records of each type read so
+	// far, including records that were skipped because of
+	// OnlyTypes, Filter, or Sample. Compressed records are
+	// counted, as are the records decompressed from them.
+	Records map[RecordType]uint64
+
+	// Samples is the number of sample records read so far. This
+	// is Records[RecordTypeSample].
+	Samples uint64
+
+	// Lost is the total number of records the kernel reported
+	// lost in the lost records decoded so far.
+	Lost uint64
+
+	// LostSamples is the total number of samples the kernel
+	// reported dropped in the lost samples records decoded so
+	// far.
+	LostSamples uint64
+
+	// Bytes is the total size of the records read so far from
+	// the file. This does not include records decompressed from
+	// compressed records.
+	Bytes int64
+}
+
+// recordStats is the internal form of RecordStats, which is cheap to
+// update for each record.
+type recordStats struct {
+	// counts is the number of records of each type. Types that
+	// don't fit are counted in otherCounts.
+	counts      [128]uint64
+	otherCounts map[RecordType]uint64
+	lost        uint64
+	lostSamples uint64
+	bytes       int64
+}
+
+func (s *recordStats) add(typ RecordType, size int, inFile bool) {
+	if int(typ) < len(s.counts) {
+		s.counts[typ]++
+	} else {
+		if s.otherCounts == nil {
+			s.otherCounts = make(map[RecordType]uint64)
+		}
+		s.otherCounts[typ]++
+	}
+	if inFile {
+		s.bytes += int64(size)
+	}
+}
+
+// Stats returns counts of the records read by r so far. After Next
+// returns false, this summarizes the whole pass, which can be used to
+// check that the pass read the expected records.
+func (r *Records) Stats() RecordStats {
+	st := RecordStats{
+		Records:     make(map[RecordType]uint64),
+		Samples:     r.stats.counts[RecordTypeSample],
+		Lost:        r.stats.lost,
+		LostSamples: r.stats.lostSamples,
+		Bytes:       r.stats.bytes,
+	}
+	for typ, n := range r.stats.counts {
+		if n != 0 {
+			st.Records[RecordType(typ)] = n
+		}
+	}
+	for typ, n := range r.stats.otherCounts {
+		st.Records[typ] = n
+	}
+	return st
+}
+
+// Peek returns the record that will be returned by the next call to
+// Next without consuming it, and whether there is such a record. Like
+// Next, Peek applies r's filters and other options. Calling Peek again
+// before Next returns the same record.
+//
+// Peek decodes the next record into storage that may be shared with
+// r.Record, so a caller that needs the current record after calling
+// Peek must make its own copy first. The current record's raw bytes
+// are similarly invalidated. r.Record itself is not changed until the
+// next call to Next.
+func (r *Records) Peek() (Record, bool) {
+	if !r.peeked {
+		cur, raw := r.Record, r.raw
+		r.peekOK = r.Next()
+		r.peekRecord, r.peekRaw = r.Record, r.raw
+		if !r.peekOK {
+			r.peekRecord = nil
+		}
+		r.Record, r.raw = cur, raw
+		r.peeked = true
+	}
+	return r.peekRecord, r.peekOK
+}
+
+// SeekWallClock advances r so the next call to Next returns the first
+// record at or after wall-clock time t. This requires the profile to
+// record the relation between its sample clock and wall-clock time;
+// see FileMeta.ClockData.
+//
+// If r iterates in time or causal order, SeekWallClock can seek
+// forward or backward, and jumps directly to the record using the
+// time index built for that order. In file order, records are not
+// sorted by time, so SeekWallClock can only scan forward to the next
+// record at or after t.
+func (r *Records) SeekWallClock(t time.Time) error {
+	if r.f.Meta.ClockData == nil {
+		return fmt.Errorf("profile has no clock data")
+	}
+	ts := r.f.Meta.ClockData.SampleTime(t)
+	if r.orderAll != nil {
+		i := sort.Search(len(r.orderTimes), func(i int) bool {
+			return r.orderTimes[i] >= ts
+		})
+		r.order = r.orderAll[i:]
+		r.peeked, r.peekRecord, r.peekRaw = false, nil, nil
+		return nil
+	}
+	for {
+		rec, ok := r.Peek()
+		if !ok {
+			return r.Err()
+		}
+		if c := rec.Common(); c.Format&SampleFormatTime != 0 && c.Time >= ts {
+			return nil
+		}
+		r.Next()
+	}
+}
+
+// keep returns whether rec passes all of r's filters.
+func (r *Records) keep(rec Record) bool {
+	for _, f := range r.filters {
+		if !f(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// next fetches the next record into r.Record, regardless of filters.
+func (r *Records) next() bool {
+	for r.readRecord() {
+		if r.Record != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readRecord reads and decodes the next record into r.Record. If the
+// record is skipped because of r.onlyTypes or sampling, or because r
+// is in best-effort mode and the record cannot be decoded, it sets
+// r.Record to nil and returns true.
+func (r *Records) readRecord() bool {
 	// See perf_evsel__parse_sample
 	if r.err != nil {
 		return false
 	}
 
-	if r.order != nil {
+	var common RecordCommon
+	// data is the raw record if it is already in memory because
+	// it was decompressed from a compressed record.
+	var data []byte
+	if key := -1 - r.innerPos; len(r.inner) > 0 {
+		if data = r.nextInner(); data != nil {
+			common.Offset, r.sampleKey = r.innerOffset, key
+		}
+	}
+
+	if data == nil && r.order != nil {
 		if len(r.order) == 0 {
 			return false
 		}
 		pos := r.order[0]
 		r.order = r.order[1:]
-		_, r.err = r.sr.Seek(pos-int64(r.f.hdr.Data.Offset), 0)
-		if r.err != nil {
-			return false
+		if pos < 0 {
+			b := &r.decompressed[-pos-1]
+			data, common.Offset, r.sampleKey = b.data, b.offset, b.sampleKey
+		} else {
+			_, r.err = r.sr.Seek(pos-int64(r.f.hdr.Data.Offset), 0)
+			if r.err != nil {
+				return false
+			}
 		}
 	}
 
-	var common RecordCommon
-	offset, _ := r.sr.Seek(0, 1)
-	common.Offset = offset + int64(r.f.hdr.Data.Offset)
-
-	// Read record header
 	var hdr recordHeader
-	if err := binary.Read(r.sr, binary.LittleEndian, &hdr); err != nil {
-		if err != io.EOF {
-			r.err = err
+	if data != nil {
+		hdr = decodeRecordHeader(data, binary.LittleEndian)
+	} else {
+		offset, _ := r.sr.Seek(0, 1)
+		common.Offset = offset + int64(r.f.hdr.Data.Offset)
+		r.sampleKey = common.Offset
+
+		// Read record header. This is decoded by hand because
+		// binary.Read uses reflection, which is a significant
+		// fraction of the cost of reading small records.
+		if len(r.buf) < 8 {
+			r.buf = make([]byte, 64)
 		}
-		return false
+		if _, err := io.ReadFull(r.sr, r.buf[:8]); err != nil {
+			if err != io.EOF {
+				r.err = err
+			} else if len(r.inner) > 0 {
+				r.err = fmt.Errorf("compressed record at offset %d ends with a partial record", r.innerOffset)
+			}
+			return false
+		}
+		hdr = decodeRecordHeader(r.buf[:8], binary.LittleEndian)
 	}
 
 	// Read record data
-	rlen := int(hdr.Size - 8)
-	if rlen > len(r.buf) {
-		r.buf = make([]byte, rlen)
+	if hdr.Size < 8 {
+		r.err = fmt.Errorf("record at offset %d has bad size %d", common.Offset, hdr.Size)
+		return false
 	}
-	var bd = &bufDecoder{r.buf[:rlen], binary.LittleEndian}
-	if _, err := io.ReadFull(r.sr, bd.buf); err != nil {
-		r.err = err
+	if limit := r.recordLimit(); int(hdr.Size) > limit {
+		r.err = fmt.Errorf("record at offset %d has size %d, which exceeds the limit of %d bytes", common.Offset, hdr.Size, limit)
 		return false
 	}
+	r.stats.add(hdr.Type, int(hdr.Size), r.sampleKey >= 0)
+	skip := r.onlyTypes != nil && !r.onlyTypes[hdr.Type] && hdr.Type != recordTypeCompressed
+	if r.sampling && hdr.Type == RecordTypeSample && sampleHash(r.sampleKey) >= r.sampleThreshold {
+		skip = true
+	}
+	if skip {
+		if data == nil {
+			if _, r.err = r.sr.Seek(int64(hdr.Size-8), 1); r.err != nil {
+				return false
+			}
+		}
+		r.Record = nil
+		return true
+	}
+
+	if data == nil {
+		// The body is read after the header so the raw record
+		// is contiguous if requested.
+		if int(hdr.Size) > len(r.buf) {
+			buf := make([]byte, hdr.Size)
+			copy(buf, r.buf[:8])
+			r.buf = buf
+		}
+		data = r.buf[:hdr.Size]
+		if _, err := io.ReadFull(r.sr, data[8:]); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	var bd = &bufDecoder{buf: data[8:hdr.Size], order: binary.LittleEndian}
+	if r.keepRaw {
+		r.raw = data
+	}
+
+	common.Misc = decodeMiscFlags(hdr.Type, hdr.Misc)
 
 	// Parse common sample_id fields
 	if r.f.sampleIDAll && hdr.Type != RecordTypeSample && hdr.Type < recordTypeUserStart {
@@ -109,51 +721,122 @@ func (r *Records) Next() bool {
 		// in recent perf versions, but that's okay.
 		//
 		// TODO: When is perf okay with missing eventAttrs?
-		r.parseCommon(bd, &common, hdr.Type == RecordTypeMmap)
+		r.parseCommon(bd, &hdr, &common, hdr.Type == RecordTypeMmap)
 	}
 
 	// Parse record
-	// TODO: Don't array out-of-bounds on short records
 	switch hdr.Type {
 	default:
-		// As far as I can tell, RecordTypeRead can never
-		// appear in a perf.data file.
 		r.Record = &RecordUnknown{hdr, common, bd.buf}
+		if r.rejectUnknown && hdr.Type != recordTypeHeaderFinishedRound && hdr.Type != recordTypeFinishedInit {
+			r.err = fmt.Errorf("record at offset %d has unknown type %d", common.Offset, hdr.Type)
+		}
 
-	case RecordTypeMmap:
-		r.Record = r.parseMmap(bd, &hdr, &common, false)
+	case RecordTypeMmap, RecordTypeLost, RecordTypeComm, RecordTypeExit, RecordTypeThrottle, RecordTypeUnthrottle, RecordTypeFork, RecordTypeRead, recordTypeMmap2, RecordTypeAux, RecordTypeLostSamples:
+		r.Record = r.parseKernel(bd, &hdr, &common)
+		switch lost := r.Record.(type) {
+		case *RecordLost:
+			r.stats.lost += lost.NumLost
+		case *RecordLostSamples:
+			r.stats.lostSamples += lost.NumLost
+		}
 
-	case RecordTypeLost:
-		r.Record = r.parseLost(bd, &hdr, &common)
+	case RecordTypeSample:
+		r.Record = r.parseSample(bd, &hdr, &common)
 
-	case RecordTypeComm:
-		r.Record = r.parseComm(bd, &hdr, &common)
+	case recordTypeCompressed:
+		// Return the records in the compressed record instead
+		// of the compressed record itself.
+		r.Record = nil
+		if r.sampleKey < 0 {
+			r.err = fmt.Errorf("compressed record at offset %d contains a compressed record", common.Offset)
+			break
+		}
+		r.decompress(bd.buf, common.Offset)
+	}
+	if bd.overflow && r.err == nil {
+		r.err = fmt.Errorf("%v record at offset %d is truncated", hdr.Type, common.Offset)
+	}
+	if r.strict && r.err == nil {
+		r.checkConsumed(bd, &hdr, &common)
+	}
+	if r.err != nil {
+		if !r.bestEffort {
+			return false
+		}
+		// The whole record has been consumed, so we can
+		// continue with the next one.
+		r.errors = append(r.errors, &RecordError{common.Offset, int(hdr.Size), r.err})
+		r.err, r.Record = nil, nil
+	}
+	return true
+}
 
+// parseKernel decodes the body of a kernel record other than a
+// sample. It returns nil if r does not decode records of type
+// hdr.Type.
+func (r *Records) parseKernel(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
+	switch hdr.Type {
+	case RecordTypeMmap:
+		return r.parseMmap(bd, hdr, common, false)
+	case RecordTypeLost:
+		return r.parseLost(bd, hdr, common)
+	case RecordTypeComm:
+		return r.parseComm(bd, hdr, common)
 	case RecordTypeExit:
-		r.Record = r.parseExit(bd, &hdr, &common)
-
+		return r.parseExit(bd, hdr, common)
 	case RecordTypeThrottle:
-		r.Record = r.parseThrottle(bd, &hdr, &common, true)
-
+		return r.parseThrottle(bd, hdr, common, true)
 	case RecordTypeUnthrottle:
-		r.Record = r.parseThrottle(bd, &hdr, &common, false)
-
+		return r.parseThrottle(bd, hdr, common, false)
 	case RecordTypeFork:
-		r.Record = r.parseFork(bd, &hdr, &common)
-
-	case RecordTypeSample:
-		r.Record = r.parseSample(bd, &hdr, &common)
-
+		return r.parseFork(bd, hdr, common)
+	case RecordTypeRead:
+		return r.parseRead(bd, hdr, common)
 	case recordTypeMmap2:
-		r.Record = r.parseMmap(bd, &hdr, &common, true)
-
+		return r.parseMmap(bd, hdr, common, true)
 	case RecordTypeAux:
-		r.Record = r.parseAux(bd, &hdr, &common)
+		return r.parseAux(bd, hdr, common)
+	case RecordTypeLostSamples:
+		return r.parseLostSamples(bd, hdr, common)
 	}
-	if r.err != nil {
-		return false
+	return nil
+}
+
+// recordSlack returns the number of bytes a decoded record of type t
+// may have left over for padding, or false if r does not decode
+// records of type t.
+func recordSlack(t RecordType) (int, bool) {
+	switch t {
+	case RecordTypeSample, RecordTypeLost, RecordTypeExit, RecordTypeThrottle, RecordTypeUnthrottle, RecordTypeFork, RecordTypeAux, RecordTypeLostSamples:
+		return 0, true
+	case RecordTypeMmap, recordTypeMmap2, RecordTypeComm:
+		// Strings are padded to 8 bytes.
+		return 7, true
+	}
+	// Not decoded.
+	return 0, false
+}
+
+// checkConsumed checks that bd has no bytes left over after decoding
+// a record other than the record's sample_id trailer and string
+// padding. If there are, it sets r.err.
+func (r *Records) checkConsumed(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) {
+	slack, ok := recordSlack(hdr.Type)
+	if !ok {
+		return
+	}
+	left := len(bd.buf)
+	if r.f.sampleIDAll && hdr.Type != RecordTypeSample {
+		if common.EventAttr == nil {
+			// Trailer size unknown.
+			return
+		}
+		left -= common.EventAttr.SampleFormat.trailerBytes()
+	}
+	if left < 0 || left > slack {
+		r.err = fmt.Errorf("%v record at offset %d has %d bytes that were not decoded", hdr.Type, common.Offset, left)
 	}
-	return true
 }
 
 func (r *Records) getAttr(id attrID, nilOk bool) *EventAttr {
@@ -163,7 +846,10 @@ func (r *Records) getAttr(id attrID, nilOk bool) *EventAttr {
 	if len(r.f.attrs) == 1 {
 		return &r.f.attrs[0].Attr
 	}
-	// Otherwise, look up the event by ID.
+	// Otherwise, look up the event by ID. Records from tasks
+	// that inherited an event carry the ID of the parent's
+	// counter (see primary_event_id in kernel/events/core.c), so
+	// these resolve like the parent's records.
 	if attr, ok := r.f.idToAttr[id]; ok {
 		return attr
 	}
@@ -173,12 +859,108 @@ func (r *Records) getAttr(id attrID, nilOk bool) *EventAttr {
 	return nil
 }
 
+// resolveID finds the event ID in a record when events put their IDs
+// at different offsets. offsets are the possible offsets, computed by
+// idOffset from each event's sample format, where negative offsets are
+// relative to the end of the record. An offset matches if the ID
+// there identifies an event whose own ID offset is that offset.
+//
+// If no offset matches, resolveID returns 0, which getAttr will
+// report as unknown. If offsets match different events, resolveID
+// uses fits to check which of those events' formats decodes to
+// exactly the record's size. If that still doesn't narrow it down to
+// one event, the record's event is ambiguous, so resolveID sets r.err
+// and returns false.
+func (r *Records) resolveID(bd *bufDecoder, offsets []int, idOffset func(SampleFormat) int, fits func(*EventAttr) bool) (attrID, bool) {
+	var ids []attrID
+	var attrs []*EventAttr
+	for _, off := range offsets {
+		pos := off
+		if off < 0 {
+			pos += len(bd.buf)
+		}
+		if pos < 0 || pos+8 > len(bd.buf) {
+			continue
+		}
+		x := attrID(bd.order.Uint64(bd.buf[pos:]))
+		attr := r.f.idToAttr[x]
+		if attr == nil || idOffset(attr.SampleFormat) != off {
+			continue
+		}
+		if len(attrs) > 0 && attrs[len(attrs)-1] == attr {
+			continue
+		}
+		ids, attrs = append(ids, x), append(attrs, attr)
+	}
+	if len(ids) <= 1 {
+		if len(ids) == 0 {
+			return 0, true
+		}
+		return ids[0], true
+	}
+
+	// Try decoding the record with each event's format. Decoding
+	// with the wrong format may set r.err, which isn't an error
+	// in the record.
+	var id attrID
+	var matches []attrID
+	err := r.err
+	for i, attr := range attrs {
+		if fits(attr) && r.err == nil {
+			id = ids[i]
+			matches = append(matches, ids[i])
+		}
+		r.err = err
+	}
+	if len(matches) == 1 {
+		return id, true
+	}
+	if len(matches) == 0 {
+		matches = ids
+	}
+	r.err = fmt.Errorf("record matches events with IDs %d and %d", matches[0], matches[1])
+	return 0, false
+}
+
+// sampleFits returns whether a sample record in bd decodes to exactly
+// its size with attr's sample format.
+func (r *Records) sampleFits(bd *bufDecoder, attr *EventAttr) bool {
+	bd = &bufDecoder{buf: bd.buf, order: bd.order}
+	o := &r.recordSample
+	o.EventAttr = attr
+	r.decodeSample(bd, o)
+	return !bd.overflow && len(bd.buf) == 0
+}
+
+// trailerFits returns whether a non-sample record in bd decodes to
+// exactly its size, less padding, with a sample_id trailer in attr's
+// sample format.
+func (r *Records) trailerFits(bd *bufDecoder, hdr *recordHeader, attr *EventAttr) bool {
+	slack, ok := recordSlack(hdr.Type)
+	if !ok {
+		// The body size is unknown, so any trailer fits.
+		return true
+	}
+	bd = &bufDecoder{buf: bd.buf, order: bd.order}
+	r.parseKernel(bd, hdr, &RecordCommon{EventAttr: attr})
+	left := len(bd.buf) - attr.SampleFormat.trailerBytes()
+	return !bd.overflow && 0 <= left && left <= slack
+}
+
 // parseCommon parses the common sample_id structure in the trailer of
 // non-sample records.
-func (r *Records) parseCommon(bd *bufDecoder, o *RecordCommon, missingOk bool) bool {
+func (r *Records) parseCommon(bd *bufDecoder, hdr *recordHeader, o *RecordCommon, missingOk bool) bool {
 	// Get EventAttr ID
-	if r.f.recordIDOffset == -1 {
+	if r.f.recordIDOffsets != nil {
+		fits := func(attr *EventAttr) bool { return r.trailerFits(bd, hdr, attr) }
+		var ok bool
+		if o.ID, ok = r.resolveID(bd, r.f.recordIDOffsets, SampleFormat.recordIDOffset, fits); !ok {
+			return false
+		}
+	} else if r.f.recordIDOffset == -1 {
 		o.ID = 0
+	} else if !bd.need(-r.f.recordIDOffset) {
+		return false
 	} else {
 		o.ID = attrID(bd.order.Uint64(bd.buf[len(bd.buf)+r.f.recordIDOffset:]))
 	}
@@ -189,7 +971,10 @@ func (r *Records) parseCommon(bd *bufDecoder, o *RecordCommon, missingOk bool) b
 
 	// Narrow decoder to the trailer
 	commonLen := o.EventAttr.SampleFormat.trailerBytes()
-	bd = &bufDecoder{bd.buf[len(bd.buf)-commonLen:], bd.order}
+	if !bd.need(commonLen) {
+		return false
+	}
+	bd = &bufDecoder{buf: bd.buf[len(bd.buf)-commonLen:], order: bd.order}
 
 	// Decode trailer
 	t := o.EventAttr.SampleFormat
@@ -242,7 +1027,10 @@ func (r *Records) parseComm(bd *bufDecoder, hdr *recordHeader, common *RecordCom
 	o.RecordCommon = *common
 	o.Format |= SampleFormatTID
 
-	// Decode hdr.Misc
+	// Decode hdr.Misc. Bit 13 means different things for
+	// different record types, so only interpret the bits defined
+	// for COMM records and ignore the rest.
+	o.CPUMode = CPUMode(hdr.Misc & recordMiscCPUModeMask)
 	o.Exec = (hdr.Misc&recordMiscCommExec != 0)
 
 	// Decode fields
@@ -295,6 +1083,30 @@ func (r *Records) parseFork(bd *bufDecoder, hdr *recordHeader, common *RecordCom
 	return o
 }
 
+func (r *Records) parseRead(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
+	o := &RecordRead{RecordCommon: *common}
+	o.Format |= SampleFormatTID
+
+	o.PID, o.TID = int(bd.i32()), int(bd.i32())
+
+	// The layout of the values depends on the event's read
+	// format. Without a sample_id trailer, this is only known if
+	// there is a single event.
+	attr := o.EventAttr
+	if attr == nil {
+		attr = r.getAttr(0, true)
+	}
+	if attr == nil {
+		if r.err == nil {
+			r.err = fmt.Errorf("read record at offset %d has unknown event", o.Offset)
+		}
+		return o
+	}
+	r.parseReadFormat(bd, attr.ReadFormat, &o.Values)
+
+	return o
+}
+
 func (r *Records) parseAux(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
 	o := &r.recordAux
 	o.RecordCommon = *common
@@ -305,17 +1117,34 @@ func (r *Records) parseAux(bd *bufDecoder, hdr *recordHeader, common *RecordComm
 	return o
 }
 
+func (r *Records) parseLostSamples(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
+	o := &RecordLostSamples{RecordCommon: *common}
+
+	o.NumLost = bd.u64()
+	o.BPF = hdr.Misc&recordMiscLostSamplesBPF != 0
+
+	return o
+}
+
 func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
 	o := &r.recordSample
 	o.RecordCommon = *common
 
 	// Get sample EventAttr ID
-	if r.f.sampleIDOffset == -1 {
-		o.ID = 0
+	if r.f.sampleIDOffsets != nil {
+		var ok bool
+		fits := func(attr *EventAttr) bool { return r.sampleFits(bd, attr) }
+		if o.RecordCommon.ID, ok = r.resolveID(bd, r.f.sampleIDOffsets, SampleFormat.sampleIDOffset, fits); !ok {
+			return nil
+		}
+	} else if r.f.sampleIDOffset == -1 {
+		o.RecordCommon.ID = 0
+	} else if !bd.need(r.f.sampleIDOffset + 8) {
+		return nil
 	} else {
-		o.ID = attrID(bd.order.Uint64(bd.buf[r.f.sampleIDOffset:]))
+		o.RecordCommon.ID = attrID(bd.order.Uint64(bd.buf[r.f.sampleIDOffset:]))
 	}
-	o.EventAttr = r.getAttr(o.ID, false)
+	o.EventAttr = r.getAttr(o.RecordCommon.ID, false)
 	if o.EventAttr == nil {
 		return nil
 	}
@@ -324,16 +1153,22 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 	o.CPUMode = CPUMode(hdr.Misc & recordMiscCPUModeMask)
 	o.ExactIP = (hdr.Misc&recordMiscExactIP != 0)
 
-	// Decode the rest of the sample
+	r.decodeSample(bd, o)
+	return o
+}
+
+// decodeSample decodes the body of a sample record into o using the
+// format of o.EventAttr.
+func (r *Records) decodeSample(bd *bufDecoder, o *RecordSample) {
 	t := o.EventAttr.SampleFormat
 	o.Format = t
-	bd.u64If(t&SampleFormatIdentifier != 0)
+	o.Identifier = bd.u64If(t&SampleFormatIdentifier != 0)
 	o.IP = bd.u64If(t&SampleFormatIP != 0)
 	o.PID = int(bd.i32If(t&SampleFormatTID != 0))
 	o.TID = int(bd.i32If(t&SampleFormatTID != 0))
 	o.Time = bd.u64If(t&SampleFormatTime != 0)
 	o.Addr = bd.u64If(t&SampleFormatAddr != 0)
-	bd.u64If(t&SampleFormatID != 0)
+	o.ID = bd.u64If(t&SampleFormatID != 0)
 	o.StreamID = bd.u64If(t&SampleFormatStreamID != 0)
 	o.CPU = bd.u32If(t&SampleFormatCPU != 0)
 	o.Res = bd.u32If(t&SampleFormatCPU != 0)
@@ -341,10 +1176,12 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 
 	if t&SampleFormatRead != 0 {
 		r.parseReadFormat(bd, o.EventAttr.ReadFormat, &o.SampleRead)
+	} else {
+		o.SampleRead = nil
 	}
 
 	if t&SampleFormatCallchain != 0 {
-		callchainLen := int(bd.u64())
+		callchainLen := bd.count(8)
 		if o.Callchain == nil || cap(o.Callchain) < callchainLen {
 			o.Callchain = make([]uint64, callchainLen)
 		} else {
@@ -355,11 +1192,31 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		o.Callchain = nil
 	}
 
-	rawSize := bd.u32If(t&SampleFormatRaw != 0)
-	bd.skip(int(rawSize))
+	if t&SampleFormatRaw != 0 {
+		size := int(bd.u32())
+		if size > len(bd.buf) {
+			bd.fail()
+			size = 0
+		}
+		if !r.keepSampleRaw(o.EventAttr) {
+			bd.skip(size)
+			o.Raw = nil
+		} else {
+			if o.Raw == nil || cap(o.Raw) < size {
+				o.Raw = make([]byte, size)
+			} else {
+				o.Raw = o.Raw[:size]
+			}
+			bd.bytes(o.Raw)
+		}
+	} else {
+		o.Raw = nil
+	}
 
 	if t&SampleFormatBranchStack != 0 {
-		count := int(bd.u64())
+		bst := o.EventAttr.BranchSampleType
+		count := bd.count(24)
+		o.BranchHWIndex = bd.u64If(bst&BranchSampleHWIndex != 0)
 		if o.BranchStack == nil || cap(o.BranchStack) < count {
 			o.BranchStack = make([]BranchRecord, count)
 		} else {
@@ -368,8 +1225,17 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		for i := range o.BranchStack {
 			o.BranchStack[i].From = bd.u64()
 			o.BranchStack[i].To = bd.u64()
-			o.BranchStack[i].Flags = BranchFlags(bd.u64())
+			o.BranchStack[i].decodeFlags(bd.u64())
+			o.BranchStack[i].Counters = 0
+		}
+		if bst&BranchSampleCounters != 0 {
+			for i := range o.BranchStack {
+				o.BranchStack[i].Counters = bd.u64()
+			}
 		}
+	} else {
+		o.BranchStack = nil
+		o.BranchHWIndex = 0
 	}
 
 	if t&SampleFormatRegsUser != 0 {
@@ -385,10 +1251,12 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		} else {
 			bd.u64s(o.RegsUser)
 		}
+	} else {
+		o.RegsUserABI, o.RegsUser = SampleRegsABINone, nil
 	}
 
 	if t&SampleFormatStackUser != 0 {
-		size := int(bd.u64())
+		size := bd.count(1)
 		if o.StackUser == nil || cap(o.StackUser) < size {
 			o.StackUser = make([]byte, size)
 		} else {
@@ -401,10 +1269,20 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		o.StackUserDynSize = 0
 	}
 
-	o.Weight = bd.u64If(t&SampleFormatWeight != 0)
+	// The kernel rejects events with both SampleFormatWeight and
+	// SampleFormatWeightStruct, since they occupy the same field.
+	o.Weight = bd.u64If(t&(SampleFormatWeight|SampleFormatWeightStruct) != 0)
+	o.InsnLatency, o.RetireLatency = 0, 0
+	if t&SampleFormatWeightStruct != 0 {
+		o.InsnLatency = uint16(o.Weight >> 32)
+		o.RetireLatency = uint16(o.Weight >> 48)
+		o.Weight &= 0xffffffff
+	}
 
 	if t&SampleFormatDataSrc != 0 {
 		o.DataSrc = decodeDataSrc(bd.u64())
+	} else {
+		o.DataSrc = DataSrc{}
 	}
 
 	transaction := bd.u64If(t&SampleFormatTransaction != 0)
@@ -424,15 +1302,32 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 		} else {
 			bd.u64s(o.RegsIntr)
 		}
+	} else {
+		o.RegsIntrABI, o.RegsIntr = SampleRegsABINone, nil
 	}
 
-	return o
+	o.PhysAddr = bd.u64If(t&SampleFormatPhysAddr != 0)
+	o.Cgroup = bd.u64If(t&SampleFormatCgroup != 0)
+	o.DataPageSize = bd.u64If(t&SampleFormatDataPageSize != 0)
+	o.CodePageSize = bd.u64If(t&SampleFormatCodePageSize != 0)
+
+	if t&SampleFormatAux != 0 {
+		size := bd.count(1)
+		if o.Aux == nil || cap(o.Aux) < size {
+			o.Aux = make([]byte, size)
+		} else {
+			o.Aux = o.Aux[:size]
+		}
+		bd.bytes(o.Aux)
+	} else {
+		o.Aux = nil
+	}
 }
 
 func (r *Records) parseReadFormat(bd *bufDecoder, f ReadFormat, out *[]SampleRead) {
 	n := 1
 	if f&ReadFormatGroup != 0 {
-		n = int(bd.u64())
+		n = bd.count(8)
 	}
 
 	if *out == nil || cap(*out) < n {
@@ -452,10 +1347,13 @@ func (r *Records) parseReadFormat(bd *bufDecoder, f ReadFormat, out *[]SampleRea
 			o.EventAttr = nil
 		}
 	} else {
+		// The enabled and running times are recorded once
+		// for the whole group. See perf_output_read_group.
+		enabled := bd.u64If(f&ReadFormatTotalTimeEnabled != 0)
+		running := bd.u64If(f&ReadFormatTotalTimeRunning != 0)
 		for i := range *out {
 			o := &(*out)[i]
-			o.TimeEnabled = bd.u64If(f&ReadFormatTotalTimeEnabled != 0)
-			o.TimeRunning = bd.u64If(f&ReadFormatTotalTimeRunning != 0)
+			o.TimeEnabled, o.TimeRunning = enabled, running
 			o.Value = bd.u64()
 			if f&ReadFormatID != 0 {
 				o.EventAttr = r.getAttr(attrID(bd.u64()), false)
@@ -0,0 +1,1672 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmptyRecords(t *testing.T) {
+	tests := []struct {
+		typ     RecordType
+		wantErr bool
+	}{
+		{RecordTypeMmap, true},
+		{RecordTypeLost, true},
+		{RecordTypeComm, true},
+		{RecordTypeExit, true},
+		{RecordTypeThrottle, true},
+		{RecordTypeUnthrottle, true},
+		{RecordTypeFork, true},
+		{RecordTypeSample, true},
+		{recordTypeMmap2, true},
+		{RecordTypeAux, true},
+		{RecordTypeRead, true},
+		{RecordTypeLostSamples, true},
+		{99, false},
+	}
+	attrs := []eventAttrVN{
+		{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime | SampleFormatCallchain,
+		}},
+		{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTime | SampleFormatCPU,
+			Flags:        EventFlagSampleIDAll,
+		}},
+	}
+	for _, attr := range attrs {
+		for _, tt := range tests {
+			tf := &testFile{}
+			tf.addAttr(attr)
+			tf.record(tt.typ, 0)
+			rs := tf.open(t).Records(RecordsFileOrder)
+			for rs.Next() {
+			}
+			err := rs.Err()
+			// With SampleIDAll, all kernel records have
+			// a sample_id trailer.
+			wantErr := tt.wantErr || attr.Flags&EventFlagSampleIDAll != 0 && tt.typ < recordTypeUserStart
+			if !wantErr {
+				if err != nil {
+					t.Errorf("%v with format %v: unexpected error %v", tt.typ, attr.SampleFormat, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "truncated") {
+				t.Errorf("%v with format %v: want truncated record error, got %v", tt.typ, attr.SampleFormat, err)
+			}
+		}
+	}
+}
+
+func TestShortRecordHeader(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	tf.data.Write([]byte{1, 0, 0, 0, 0, 0, 4, 0})
+	rs := tf.open(t).Records(RecordsFileOrder)
+	if rs.Next() || rs.Err() == nil {
+		t.Errorf("want error for record with bad size")
+	}
+}
+
+func TestMixedSampleFormats(t *testing.T) {
+	// Two events whose samples share an ID offset but otherwise
+	// have different layouts.
+	const (
+		idA = 10
+		idB = 20
+	)
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatCallchain | SampleFormatBranchStack,
+	}}, idA)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTime | SampleFormatPeriod,
+	}}, idB)
+	tf.record(RecordTypeSample, 0, uint64(idA), uint64(0x1000),
+		uint64(2), uint64(0x1000), uint64(0x2000),
+		uint64(1), uint64(0x1000), uint64(0x3000), uint64(0))
+	tf.record(RecordTypeSample, 0, uint64(idB), uint64(0x4000), uint64(123), uint64(7))
+	tf.record(RecordTypeSample, 0, uint64(idA), uint64(0x5000),
+		uint64(1), uint64(0x5000),
+		uint64(0))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	var got []RecordSample
+	for rs.Next() {
+		r := rs.Record.(*RecordSample)
+		got = append(got, *r)
+		got[len(got)-1].Callchain = append([]uint64(nil), r.Callchain...)
+		got[len(got)-1].BranchStack = append([]BranchRecord(nil), r.BranchStack...)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d samples, want 3", len(got))
+	}
+
+	a, b, a2 := &got[0], &got[1], &got[2]
+	if a.EventAttr != &f.attrs[0].Attr || b.EventAttr != &f.attrs[1].Attr || a2.EventAttr != &f.attrs[0].Attr {
+		t.Errorf("samples resolved to wrong events")
+	}
+	if a.IP != 0x1000 || len(a.Callchain) != 2 || a.Callchain[1] != 0x2000 ||
+		len(a.BranchStack) != 1 || a.BranchStack[0].To != 0x3000 {
+		t.Errorf("bad first sample %+v", a)
+	}
+	if b.IP != 0x4000 || b.Time != 123 || b.Period != 7 || len(b.Callchain) != 0 || len(b.BranchStack) != 0 {
+		t.Errorf("bad second sample %+v", b)
+	}
+	if a2.IP != 0x5000 || a2.Time != 0 || a2.Period != 0 || len(a2.Callchain) != 1 || len(a2.BranchStack) != 0 {
+		t.Errorf("bad third sample %+v", a2)
+	}
+}
+
+func TestIncompatibleIDOffsets(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatID,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTime | SampleFormatID,
+	}}, 2)
+	if _, err := New(bytes.NewReader(tf.bytes())); err == nil {
+		t.Errorf("want error for events with different sample ID offsets")
+	}
+}
+
+func TestInheritedSamples(t *testing.T) {
+	// With inherit, the kernel creates a new counter with its own
+	// ID for each child task, but child samples carry the ID of
+	// the parent's counter. The child counter's ID is only in the
+	// stream ID.
+	tf := &testFile{}
+	format := SampleFormatIP | SampleFormatTID | SampleFormatID | SampleFormatStreamID
+	for _, ids := range [][]uint64{{1, 2}, {3, 4}} {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: format,
+			Flags:        EventFlagInherit | EventFlagSampleIDAll,
+		}}, ids...)
+	}
+	tf.record(RecordTypeSample, 0, uint64(0x1000), 100, 100, uint64(1), uint64(1))
+	tf.record(RecordTypeFork, 0, 200, 100, 200, 100, uint64(0), 200, 200, uint64(2), uint64(57))
+	tf.record(RecordTypeFork, 0, 200, 200, 201, 200, uint64(0), 200, 201, uint64(4), uint64(58))
+	tf.record(RecordTypeSample, 0, uint64(0x2000), 200, 201, uint64(2), uint64(57))
+	tf.record(RecordTypeSample, 0, uint64(0x3000), 200, 200, uint64(3), uint64(59))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	for i, want := range []struct {
+		typ      RecordType
+		pid, tid int
+		event    int
+	}{
+		{RecordTypeSample, 100, 100, 0},
+		{RecordTypeFork, 200, 200, 0},
+		{RecordTypeFork, 200, 201, 1},
+		{RecordTypeSample, 200, 201, 0},
+		{RecordTypeSample, 200, 200, 1},
+	} {
+		if !rs.Next() {
+			t.Fatalf("record %d: %v", i, rs.Err())
+		}
+		c := rs.Record.Common()
+		if rs.Record.Type() != want.typ || c.PID != want.pid || c.TID != want.tid || c.EventAttr != f.Events[want.event] {
+			t.Errorf("record %d: got %v PID %d TID %d event %p; want %v PID %d TID %d event %d", i, rs.Record.Type(), c.PID, c.TID, c.EventAttr, want.typ, want.pid, want.tid, want.event)
+		}
+	}
+	if rs.Next() || rs.Err() != nil {
+		t.Errorf("want end of records, got %v, %v", rs.Record, rs.Err())
+	}
+}
+
+func TestFilterStreamID(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatStreamID,
+		Flags:        EventFlagSampleIDAll,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(0x1000), uint64(1))
+	tf.record(RecordTypeSample, 0, uint64(0x2000), uint64(2))
+	tf.record(RecordTypeComm, 0, 100, 100, "a", uint64(2))
+	tf.record(RecordTypeSample, 0, uint64(0x3000), uint64(1))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.FilterStreamID(2)
+	var got []RecordType
+	for rs.Next() {
+		got = append(got, rs.Record.Type())
+		if c := rs.Record.Common(); c.StreamID != 2 {
+			t.Errorf("got stream ID %d, want 2", c.StreamID)
+		}
+	}
+	if rs.Err() != nil {
+		t.Fatal(rs.Err())
+	}
+	if want := []RecordType{RecordTypeSample, RecordTypeComm}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+}
+
+func TestFilterCPUMode(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	tf.record(RecordTypeSample, recordMisc(CPUModeUser), uint64(0x1000))
+	tf.record(RecordTypeComm, 0, 100, 100, "a")
+	tf.record(RecordTypeSample, recordMisc(CPUModeKernel), uint64(0xffffffff81000000))
+	tf.record(RecordTypeSample, recordMisc(CPUModeUser), uint64(0x2000))
+
+	for _, keepOther := range []bool{false, true} {
+		rs := tf.open(t).Records(RecordsFileOrder)
+		rs.FilterCPUMode(CPUModeUser, keepOther)
+		var got []RecordType
+		for rs.Next() {
+			got = append(got, rs.Record.Type())
+			if s, ok := rs.Record.(*RecordSample); ok && s.CPUMode != CPUModeUser {
+				t.Errorf("keepOther=%v: got sample with CPU mode %v", keepOther, s.CPUMode)
+			}
+		}
+		if rs.Err() != nil {
+			t.Fatal(rs.Err())
+		}
+		want := []RecordType{RecordTypeSample, RecordTypeSample}
+		if keepOther {
+			want = []RecordType{RecordTypeSample, RecordTypeComm, RecordTypeSample}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("keepOther=%v: got records %v, want %v", keepOther, got, want)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatCallchain,
+	}})
+	tf.record(RecordTypeComm, 0, 1, 1, "a")
+	tf.record(RecordTypeSample, 0, uint64(0x100), uint64(1), uint64(0x100))
+	tf.record(RecordTypeComm, 0, 2, 2, "b")
+	tf.record(RecordTypeSample, 0, uint64(0x200), uint64(1), uint64(0x200))
+	f := tf.open(t)
+
+	all, err := f.Records(RecordsFileOrder).All(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("got %d records, want 4", len(all))
+	}
+	// The records must not be reused by later calls to Next.
+	if c := all[0].(*RecordComm); c.Comm != "a" || c.PID != 1 {
+		t.Errorf("got first record %+v, want comm a", c)
+	}
+	if s := all[1].(*RecordSample); s.IP != 0x100 || !reflect.DeepEqual(s.Callchain, []uint64{0x100}) {
+		t.Errorf("got second record %+v, want sample at 0x100", s)
+	}
+
+	all, err = f.Records(RecordsFileOrder).All(4)
+	if len(all) != 4 || err != nil {
+		t.Errorf("with limit 4, got %d records, %v; want 4, nil", len(all), err)
+	}
+	all, err = f.Records(RecordsFileOrder).All(3)
+	if len(all) != 3 || err != ErrTooManyRecords {
+		t.Errorf("with limit 3, got %d records, %v; want 3, %v", len(all), err, ErrTooManyRecords)
+	}
+}
+
+func TestRawRecord(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}})
+	tf.record(RecordTypeComm, recordMiscCommExec, 1, 2, "comm")
+	tf.record(RecordTypeSample, recordMisc(CPUModeUser), uint64(0x1000), 1, 2)
+	data := tf.data.Bytes()
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.KeepRaw()
+	var got []byte
+	for rs.Next() {
+		got = append(got, rs.RawRecord()...)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("raw records %x, want %x", got, data)
+	}
+}
+
+func TestKeepSampleRaw(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		Type:         EventTypeTracepoint,
+		SampleFormat: SampleFormatIdentifier | SampleFormatRaw,
+	}}, 10)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		Type:         EventTypeHardware,
+		SampleFormat: SampleFormatIdentifier | SampleFormatRaw,
+	}}, 20)
+	tf.record(RecordTypeSample, 0, uint64(10), uint32(4), [4]byte{1, 2, 3, 4})
+	tf.record(RecordTypeSample, 0, uint64(20), uint32(4), [4]byte{5, 6, 7, 8})
+	tf.record(RecordTypeSample, 0, uint64(10), uint32(4), [4]byte{9, 10, 11, 12})
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.Strict()
+	calls := 0
+	rs.KeepSampleRaw(func(attr *EventAttr) bool {
+		calls++
+		return attr.Type == EventTypeTracepoint
+	})
+	var got [][]byte
+	for rs.Next() {
+		got = append(got, rs.Record.(*RecordSample).Raw)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{{1, 2, 3, 4}, nil, {9, 10, 11, 12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got raw data %x, want %x", got, want)
+	}
+	if calls != 2 {
+		t.Errorf("keep called %d times, want 2", calls)
+	}
+}
+
+func TestDecodeDataSrc(t *testing.T) {
+	// Raw values are perf_mem_data_src encodings.
+	tests := []struct {
+		raw  uint64
+		want DataSrc
+	}{
+		{0x01, DataSrc{Op: DataSrcOpNA, Locked: DataSrcLockUnlocked}},
+		{0x00, DataSrc{Op: DataSrcOpNA, Locked: DataSrcLockUnlocked}},
+		{0x02, DataSrc{Op: DataSrcOpLoad, Locked: DataSrcLockUnlocked}},
+		{0x04, DataSrc{Op: DataSrcOpStore, Locked: DataSrcLockUnlocked}},
+		{0x08, DataSrc{Op: DataSrcOpPrefetch, Locked: DataSrcLockUnlocked}},
+		{0x10, DataSrc{Op: DataSrcOpExec, Locked: DataSrcLockUnlocked}},
+		// Store that hit L1, with the other fields N/A.
+		{0x04 | (0x02|0x08)<<5 | 0x01<<19 | 0x01<<24 | 0x01<<26,
+			DataSrc{Op: DataSrcOpStore, Level: DataSrcLevelL1}},
+		// Locked load that missed L3, snoop HitM, TLB L2 hit.
+		{0x02 | (0x04|0x40)<<5 | 0x10<<19 | 0x02<<24 | (0x02|0x10)<<26,
+			DataSrc{Op: DataSrcOpLoad, Miss: true, Level: DataSrcLevelL3,
+				Snoop: DataSrcSnoopHitM, Locked: DataSrcLockLocked,
+				TLB: DataSrcTLBHit | DataSrcTLBL2}},
+	}
+	for _, tt := range tests {
+		if got := decodeDataSrc(tt.raw); got != tt.want {
+			t.Errorf("decodeDataSrc(%#x) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestSampleAux(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatPhysAddr | SampleFormatCgroup | SampleFormatDataPageSize | SampleFormatCodePageSize | SampleFormatAux,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(0x400), uint64(0x9000), uint64(7), uint64(4096), uint64(2<<20),
+		uint64(8), []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	r := rs.Record.(*RecordSample)
+	if r.IP != 0x400 || r.PhysAddr != 0x9000 || r.Cgroup != 7 || r.DataPageSize != 4096 || r.CodePageSize != 2<<20 {
+		t.Errorf("bad sample %v", r)
+	}
+	if !bytes.Equal(r.Aux, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("got Aux %v", r.Aux)
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatCallchain,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(0x100), uint64(0))
+	// Callchain length runs past the end of the record.
+	tf.record(RecordTypeSample, 0, uint64(0x200), uint64(100))
+	tf.record(RecordTypeSample, 0, uint64(0x300), uint64(0))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+	}
+	if rs.Err() == nil {
+		t.Fatal("want error without best-effort mode")
+	}
+
+	rs = f.Records(RecordsFileOrder)
+	rs.BestEffort()
+	var ips []uint64
+	for rs.Next() {
+		ips = append(ips, rs.Record.(*RecordSample).IP)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0] != 0x100 || ips[1] != 0x300 {
+		t.Errorf("got IPs %#x, want [0x100 0x300]", ips)
+	}
+	errs := rs.Errors()
+	if len(errs) != 1 || errs[0].Size != 8+16 || errs[0].Offset != int64(f.hdr.Data.Offset)+8+16 {
+		t.Errorf("got errors %v", errs)
+	}
+}
+
+func TestOldFormats(t *testing.T) {
+	// perf_event_attr sizes of various ABI versions.
+	for _, size := range []uint32{64, 72, 80, 96, 104, 112} {
+		for _, v1 := range []bool{false, true} {
+			tf := &testFile{v1: v1}
+			attr := eventAttrVN{eventAttrV0: eventAttrV0{
+				SampleFormat: SampleFormatIP | SampleFormatTID,
+				Size:         size,
+			}}
+			attr.SampleRegsUser = 0xff
+			tf.addAttr(attr)
+			tf.record(RecordTypeSample, 0, uint64(0x400), 1, 2)
+
+			f := tf.open(t)
+			wantRegs := uint64(0)
+			if size >= 96 {
+				wantRegs = 0xff
+			}
+			if got := f.Events[0].SampleRegsUser; got != wantRegs {
+				t.Errorf("size %d, v1 %v: got SampleRegsUser %#x, want %#x", size, v1, got, wantRegs)
+			}
+			rs := f.Records(RecordsFileOrder)
+			if !rs.Next() {
+				t.Fatalf("size %d, v1 %v: %v", size, v1, rs.Err())
+			}
+			if r := rs.Record.(*RecordSample); r.IP != 0x400 || r.PID != 1 || r.TID != 2 {
+				t.Errorf("size %d, v1 %v: bad sample %v", size, v1, r)
+			}
+		}
+	}
+}
+
+func TestNewerAttrSize(t *testing.T) {
+	// An attr from a newer kernel with fields we don't know.
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+			Size:         uint32(binary.Size(eventAttrVN{})) + 24,
+		}}, id)
+	}
+	tf.record(RecordTypeSample, 0, uint64(2), uint64(0x400))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	if r := rs.Record.(*RecordSample); r.EventAttr != f.Events[1] || r.IP != 0x400 {
+		t.Errorf("bad sample %v", r)
+	}
+}
+
+func TestOpenCompressed(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+
+	dir, err := ioutil.TempDir("", "perffile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(tf.bytes())
+	zw.Close()
+	for name, data := range map[string][]byte{"perf.data": tf.bytes(), "perf.data.gz": gz.Bytes()} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		f, err := OpenCompressed(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		rs := f.Records(RecordsFileOrder)
+		if !rs.Next() || rs.Record.(*RecordSample).IP != 0x400 {
+			t.Errorf("%s: bad records: %v", name, rs.Err())
+		}
+		f.Close()
+	}
+
+	// zstd-compressed files need a zstd decompressor, which is
+	// only built in with the zstd build tag. Stand in for it with
+	// one that strips the magic number.
+	path := filepath.Join(dir, "perf.data.zst")
+	if err := ioutil.WriteFile(path, append([]byte("\x28\xb5\x2f\xfd"), tf.bytes()...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	old, ok := fileDecompressors["zstd"]
+	defer func() {
+		if ok {
+			fileDecompressors["zstd"] = old
+		} else {
+			delete(fileDecompressors, "zstd")
+		}
+	}()
+	delete(fileDecompressors, "zstd")
+	if _, err := OpenCompressed(path); err == nil || !strings.Contains(err.Error(), "zstd-compressed files are not supported") {
+		t.Errorf("want unsupported zstd error, got %v", err)
+	}
+	fileDecompressors["zstd"] = func(r io.Reader) (io.ReadCloser, error) {
+		var magic [4]byte
+		if _, err := io.ReadFull(r, magic[:]); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	}
+	f, err := OpenCompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() || rs.Record.(*RecordSample).IP != 0x400 {
+		t.Errorf("zstd: bad records: %v", rs.Err())
+	}
+}
+
+func TestBranchStackExtensions(t *testing.T) {
+	tf := &testFile{}
+	attr := eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatBranchStack,
+	}}
+	attr.BranchSampleType = BranchSampleHWIndex | BranchSampleCounters
+	tf.addAttr(attr)
+	flags := func(f BranchFlags, cycles, typ, spec, newType, priv uint64) uint64 {
+		return uint64(f) | cycles<<4 | typ<<20 | spec<<24 | newType<<26 | priv<<30
+	}
+	tf.record(RecordTypeSample, 0, uint64(0x400),
+		uint64(2), uint64(7),
+		uint64(0x10), uint64(0x20), flags(BranchFlagPredicted, 12, 4, 2, 0, 1),
+		uint64(0x30), uint64(0x40), flags(BranchFlagMispredicted, 3, 15, 1, 1, 2),
+		uint64(5), uint64(6))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	r := rs.Record.(*RecordSample)
+	want := []BranchRecord{
+		{From: 0x10, To: 0x20, Flags: BranchFlagPredicted, Cycles: 12, Type: BranchTypeCall, Spec: BranchSpecCorrectPath, Priv: BranchPrivUser, Counters: 5},
+		{From: 0x30, To: 0x40, Flags: BranchFlagMispredicted, Cycles: 3, Type: BranchTypeFaultData, Spec: BranchSpecWrongPath, Priv: BranchPrivKernel, Counters: 6},
+	}
+	if r.BranchHWIndex != 7 || !reflect.DeepEqual(r.BranchStack, want) {
+		t.Errorf("got hw index %d, branch stack %+v; want 7, %+v", r.BranchHWIndex, r.BranchStack, want)
+	}
+}
+
+func TestOnlyTypes(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	for i := 0; i < 1000; i++ {
+		tf.record(RecordTypeComm, 0, i, i, "comm")
+		tf.record(RecordTypeSample, 0, uint64(i))
+		// An undecodable sample that must be skipped.
+		tf.record(RecordTypeSample, 0, uint32(i))
+		tf.record(recordTypeMmap2, 0, i, i, uint64(0x1000), uint64(0x1000), uint64(0),
+			uint32(0), uint32(0), uint64(0), uint64(0), uint32(0), uint32(0), "file")
+	}
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeComm, RecordTypeMmap)
+	n := 0
+	for rs.Next() {
+		var pid int
+		switch r := rs.Record.(type) {
+		case *RecordComm:
+			pid = r.PID
+		case *RecordMmap:
+			pid = r.PID
+		default:
+			t.Fatalf("unexpected record %v", r)
+		}
+		if pid != n/2 {
+			t.Fatalf("record %d has PID %d, want %d", n, pid, n/2)
+		}
+		n++
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2000 {
+		t.Errorf("got %d records, want 2000", n)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	attr := eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+		Flags:        EventFlagSampleIDAll,
+	}}
+	trailer := []interface{}{1, 1, uint64(1000)}
+	withTrailer := func(fields ...interface{}) []interface{} {
+		return append(fields, trailer...)
+	}
+
+	tf := &testFile{}
+	tf.addAttr(attr)
+	tf.record(RecordTypeComm, 0, withTrailer(1, 1, "a")...)
+	tf.record(RecordTypeComm, 0, withTrailer(1, 1, "longer comm")...)
+	tf.record(RecordTypeMmap, 0, withTrailer(1, 1, uint64(0x1000), uint64(0x1000), uint64(0), "/bin/true")...)
+	tf.record(RecordTypeFork, 0, withTrailer(2, 1, 2, 1, uint64(1000))...)
+	tf.record(RecordTypeSample, 0, uint64(0x400), 1, 1, uint64(1000))
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.Strict()
+	n := 0
+	for rs.Next() {
+		n++
+	}
+	if err := rs.Err(); err != nil || n != 5 {
+		t.Fatalf("got %d records and error %v; want 5 records", n, err)
+	}
+
+	// A sample with more fields than its format.
+	tf = &testFile{}
+	tf.addAttr(attr)
+	tf.record(RecordTypeSample, 0, uint64(0x400), 1, 1, uint64(1000), uint64(0))
+	rs = tf.open(t).Records(RecordsFileOrder)
+	rs.Strict()
+	for rs.Next() {
+	}
+	if err := rs.Err(); err == nil || !strings.Contains(err.Error(), "not decoded") {
+		t.Errorf("want error for undecoded bytes, got %v", err)
+	}
+}
+
+func TestRejectUnknown(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+	tf.record(recordTypeHeaderFinishedRound, 0)
+	tf.record(recordTypeFinishedInit, 0)
+	tf.record(recordTypeSwitch, recordMiscSwitchOut)
+	tf.record(RecordTypeSample, 0, uint64(0x500))
+	f := tf.open(t)
+
+	// By default, unknown records are returned.
+	rs := f.Records(RecordsFileOrder)
+	n := 0
+	for rs.Next() {
+		n++
+	}
+	if err := rs.Err(); err != nil || n != 5 {
+		t.Fatalf("got %d records and error %v; want 5 records", n, err)
+	}
+
+	rs = f.Records(RecordsFileOrder)
+	rs.RejectUnknown()
+	n = 0
+	for rs.Next() {
+		n++
+	}
+	if err := rs.Err(); n != 3 || err == nil || !strings.Contains(err.Error(), "unknown type 14") {
+		t.Errorf("got %d records and error %v; want 3 records and unknown type error", n, err)
+	}
+
+	// In best-effort mode, the unknown record is skipped.
+	rs = f.Records(RecordsFileOrder)
+	rs.RejectUnknown()
+	rs.BestEffort()
+	n = 0
+	for rs.Next() {
+		if _, ok := rs.Record.(*RecordSample); ok {
+			n++
+		}
+	}
+	if err := rs.Err(); err != nil || n != 2 || len(rs.Errors()) != 1 {
+		t.Errorf("got %d samples, error %v, and %d record errors; want 2, nil, 1", n, err, len(rs.Errors()))
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	tf.record(RecordTypeComm, 0, 1, 1, "short")
+	tf.record(RecordTypeComm, 0, 1, 1, "a much longer comm")
+	f := tf.open(t)
+
+	rs := f.Records(RecordsFileOrder)
+	rs.MaxRecordSize(24)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	if rs.Next() {
+		t.Fatalf("got record %v, want error for record larger than limit", rs.Record)
+	}
+	if err := rs.Err(); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("got error %v, want limit exceeded", err)
+	}
+
+	// The default limit allows any record.
+	rs = f.Records(RecordsFileOrder)
+	for rs.Next() {
+	}
+	if err := rs.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordStats(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeComm, 0, 1, 1, "comm")
+	tf.record(RecordTypeSample, 0, uint64(0x100))
+	tf.record(RecordTypeLost, 0, uint64(0), uint64(5))
+	tf.record(RecordTypeSample, 0, uint64(0x200))
+	tf.record(RecordTypeLost, 0, uint64(0), uint64(7))
+	tf.record(RecordType(200), 0, uint64(0))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeLost)
+	for rs.Next() {
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := RecordStats{
+		Records: map[RecordType]uint64{
+			RecordTypeComm:   1,
+			RecordTypeSample: 2,
+			RecordTypeLost:   2,
+			RecordType(200):  1,
+		},
+		Samples: 2,
+		Lost:    12,
+		Bytes:   24 + 2*16 + 2*24 + 16,
+	}
+	if got := rs.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLostSamples(t *testing.T) {
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+			Flags:        EventFlagSampleIDAll,
+		}}, id)
+	}
+	tf.record(RecordTypeLostSamples, 0, uint64(3), uint64(2))
+	tf.record(RecordTypeLostSamples, recordMiscLostSamplesBPF, uint64(4), uint64(1))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	rs.Strict()
+	for i, want := range []RecordLostSamples{
+		{RecordCommon: RecordCommon{EventAttr: f.Events[1]}, NumLost: 3},
+		{RecordCommon: RecordCommon{EventAttr: f.Events[0]}, NumLost: 4, BPF: true},
+	} {
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+		r, ok := rs.Record.(*RecordLostSamples)
+		if !ok {
+			t.Fatalf("record %d: got %T, want *RecordLostSamples", i, rs.Record)
+		}
+		if r.EventAttr != want.EventAttr || r.NumLost != want.NumLost || r.BPF != want.BPF {
+			t.Errorf("record %d: got %+v, want %+v", i, r, want)
+		}
+	}
+	if rs.Next() || rs.Err() != nil {
+		t.Fatalf("want end of records, got %v, %v", rs.Record, rs.Err())
+	}
+	if got := rs.Stats().LostSamples; got != 7 {
+		t.Errorf("got %d lost samples, want 7", got)
+	}
+}
+
+func TestSampleIDTrailer(t *testing.T) {
+	const format = SampleFormatTID | SampleFormatTime | SampleFormatID | SampleFormatStreamID | SampleFormatCPU | SampleFormatIdentifier
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: format,
+			Flags:        EventFlagSampleIDAll,
+		}}, id)
+	}
+	trailer := func(cpu int, time uint64) []interface{} {
+		return []interface{}{1, 2, time, uint64(2), uint64(77), cpu, 0, uint64(2)}
+	}
+	tf.record(RecordTypeMmap, 0, append([]interface{}{1, 2, uint64(0x1000), uint64(0x1000), uint64(0), "f"}, trailer(3, 100)...)...)
+	tf.record(RecordTypeComm, 0, append([]interface{}{1, 2, "comm"}, trailer(4, 200)...)...)
+	tf.record(RecordTypeLost, 0, append([]interface{}{uint64(2), uint64(5)}, trailer(5, 300)...)...)
+	tf.record(RecordTypeSample, 0, uint64(2), 1, 2, uint64(400), uint64(2), uint64(77), 6, 0)
+	tf.record(RecordTypeExit, 0, append([]interface{}{1, 1, 2, 2, uint64(500)}, trailer(7, 500)...)...)
+	tf.record(RecordType(15), 0, append([]interface{}{uint64(0)}, trailer(8, 600)...)...)
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	cpu, time := uint32(3), uint64(100)
+	for rs.Next() {
+		c := rs.Record.Common()
+		if c.Format&format != format {
+			t.Errorf("%v: got format %v, want %v", rs.Record.Type(), c.Format, format)
+		}
+		if c.EventAttr != f.Events[1] || c.PID != 1 || c.TID != 2 || c.Time != time || c.StreamID != 77 || c.CPU != cpu {
+			t.Errorf("%v: bad common fields %+v", rs.Record.Type(), c)
+		}
+		cpu, time = cpu+1, time+100
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu != 9 {
+		t.Errorf("got %d records, want 6", cpu-3)
+	}
+}
+
+func TestSampleIDTrailerCgroup(t *testing.T) {
+	// The kernel does not include the cgroup in the sample_id
+	// trailer, so it must not be decoded from non-sample records.
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatTID | SampleFormatTime | SampleFormatCgroup,
+		Flags:        EventFlagSampleIDAll,
+	}})
+	tf.record(RecordTypeComm, 0, 1, 2, "comm", 1, 2, uint64(100))
+	tf.record(RecordTypeSample, 0, 1, 2, uint64(200), uint64(7))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.Strict()
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	if c := rs.Record.Common(); c.PID != 1 || c.TID != 2 || c.Time != 100 {
+		t.Errorf("bad comm common fields %+v", c)
+	}
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	if s := rs.Record.(*RecordSample); s.Time != 200 || s.Cgroup != 7 {
+		t.Errorf("got sample time %d cgroup %d, want 200, 7", s.Time, s.Cgroup)
+	}
+}
+
+// benchFile returns a file with n samples from a few processes, with
+// interleaved comm and mmap records, similar to a typical profile.
+func benchFile(b testing.TB, n int) *File {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime | SampleFormatID | SampleFormatCPU | SampleFormatPeriod | SampleFormatCallchain,
+		Flags:        EventFlagSampleIDAll,
+	}}, 1)
+	trailer := []interface{}{1, 1, uint64(0), uint64(1), 0, 0}
+	for i := 0; i < n; i++ {
+		if i%100 == 0 {
+			pid := i / 100
+			tf.record(RecordTypeComm, 0, append([]interface{}{pid, pid, "process"}, trailer...)...)
+			tf.record(RecordTypeMmap, 0, append([]interface{}{pid, pid, uint64(0x400000), uint64(0x100000), uint64(0), "/usr/bin/process"}, trailer...)...)
+		}
+		pid := i / 100
+		tf.record(RecordTypeSample, recordMisc(CPUModeUser), uint64(0x400000+i), pid, pid, uint64(i), uint64(1), i%8, 0, uint64(1000),
+			uint64(5), uint64(CallchainUser), uint64(0x400100), uint64(0x400200), uint64(0x400300), uint64(0x400400))
+	}
+	return tf.open(b)
+}
+
+func benchmarkRecords(b *testing.B, order RecordsOrder) {
+	f := benchFile(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs := f.Records(order)
+		for rs.Next() {
+		}
+		if err := rs.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecordsFileOrder(b *testing.B) {
+	benchmarkRecords(b, RecordsFileOrder)
+}
+
+func BenchmarkRecordsTimeOrder(b *testing.B) {
+	benchmarkRecords(b, RecordsTimeOrder)
+}
+
+// BenchmarkRecordHeaders measures the cost of reading record headers
+// by skipping every record body.
+func BenchmarkRecordHeaders(b *testing.B) {
+	f := benchFile(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs := f.Records(RecordsFileOrder)
+		rs.OnlyTypes(RecordTypeExit)
+		for rs.Next() {
+		}
+		if err := rs.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNextAllocs(t *testing.T) {
+	// Once its buffers have grown, Next should not allocate to
+	// read samples, though comm and mmap records allocate their
+	// strings.
+	f := benchFile(t, 1000)
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	for i := 0; i < 10; i++ {
+		rs.Next()
+	}
+	allocs := testing.AllocsPerRun(500, func() {
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Next allocated %v times per sample, want 0", allocs)
+	}
+}
+
+func TestSampleStreamIDCPU(t *testing.T) {
+	// Check every combination of the fields around StreamID and
+	// CPU in both samples and sample_id trailers. See
+	// perf_output_sample and __perf_event_header__init_id in
+	// kernel/events/core.c for the order of these fields.
+	optional := []SampleFormat{SampleFormatTime, SampleFormatAddr, SampleFormatID, SampleFormatStreamID, SampleFormatCPU, SampleFormatPeriod}
+	for mask := 0; mask < 1<<len(optional); mask++ {
+		format := SampleFormatIP | SampleFormatTID
+		for i, f := range optional {
+			if mask&(1<<i) != 0 {
+				format |= f
+			}
+		}
+		if format&(SampleFormatStreamID|SampleFormatCPU) == 0 {
+			continue
+		}
+
+		tf := &testFile{}
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: format,
+			Flags:        EventFlagSampleIDAll,
+		}}, 1)
+		fields := []interface{}{uint64(0x400), 10, 11}
+		var trailer []interface{}
+		trailer = append(trailer, 10, 11)
+		if format&SampleFormatTime != 0 {
+			fields = append(fields, uint64(100))
+			trailer = append(trailer, uint64(100))
+		}
+		if format&SampleFormatAddr != 0 {
+			fields = append(fields, uint64(0x800))
+		}
+		if format&SampleFormatID != 0 {
+			fields = append(fields, uint64(1))
+			trailer = append(trailer, uint64(1))
+		}
+		if format&SampleFormatStreamID != 0 {
+			fields = append(fields, uint64(77))
+			trailer = append(trailer, uint64(77))
+		}
+		if format&SampleFormatCPU != 0 {
+			fields = append(fields, 5, 0)
+			trailer = append(trailer, 5, 0)
+		}
+		if format&SampleFormatPeriod != 0 {
+			fields = append(fields, uint64(1000))
+		}
+		tf.record(RecordTypeSample, 0, fields...)
+		tf.record(RecordTypeExit, 0, append([]interface{}{10, 1, 11, 1, uint64(100)}, trailer...)...)
+
+		rs := tf.open(t).Records(RecordsFileOrder)
+		rs.Strict()
+		n := 0
+		for ; rs.Next(); n++ {
+			c := rs.Record.Common()
+			want := RecordCommon{PID: 10, TID: 11}
+			if format&SampleFormatStreamID != 0 {
+				want.StreamID = 77
+			}
+			if format&SampleFormatCPU != 0 {
+				want.CPU = 5
+			}
+			if c.PID != want.PID || c.TID != want.TID || c.StreamID != want.StreamID || c.CPU != want.CPU {
+				t.Errorf("%v: %v: got PID %d TID %d StreamID %d CPU %d; want %d %d %d %d", format, rs.Record.Type(), c.PID, c.TID, c.StreamID, c.CPU, want.PID, want.TID, want.StreamID, want.CPU)
+			}
+			if s, ok := rs.Record.(*RecordSample); ok {
+				if format&SampleFormatAddr != 0 && s.Addr != 0x800 || format&SampleFormatPeriod != 0 && s.Period != 1000 {
+					t.Errorf("%v: got Addr %#x Period %d", format, s.Addr, s.Period)
+				}
+			}
+		}
+		if err := rs.Err(); err != nil {
+			t.Errorf("%v: %v", format, err)
+		} else if n != 2 {
+			t.Errorf("%v: got %d records, want 2", format, n)
+		}
+	}
+}
+
+func TestSampleRegsIntr(t *testing.T) {
+	tf := &testFile{}
+	attr := eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatRegsIntr | SampleFormatPhysAddr,
+	}}
+	attr.SampleRegsIntr = 0x1011
+	tf.addAttr(attr)
+	tf.record(RecordTypeSample, 0, uint64(0x400), uint64(SampleRegsABI64), uint64(1), uint64(2), uint64(3), uint64(0x5000))
+	tf.record(RecordTypeSample, 0, uint64(0x404), uint64(SampleRegsABINone), uint64(0x6000))
+
+	f := tf.open(t)
+	if got := f.Events[0].SampleRegsIntr; got != 0x1011 {
+		t.Fatalf("got SampleRegsIntr %#x, want 0x1011", got)
+	}
+	rs := f.Records(RecordsFileOrder)
+	rs.Strict()
+	for i, want := range []struct {
+		abi  SampleRegsABI
+		regs []uint64
+		phys uint64
+	}{
+		{SampleRegsABI64, []uint64{1, 2, 3}, 0x5000},
+		{SampleRegsABINone, []uint64{}, 0x6000},
+	} {
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+		r := rs.Record.(*RecordSample)
+		if r.RegsIntrABI != want.abi || !reflect.DeepEqual(r.RegsIntr, want.regs) || r.PhysAddr != want.phys {
+			t.Errorf("sample %d: got ABI %v, regs %v, phys %#x; want %v, %v, %#x", i, r.RegsIntrABI, r.RegsIntr, r.PhysAddr, want.abi, want.regs, want.phys)
+		}
+	}
+	if rs.Next() || rs.Err() != nil {
+		t.Errorf("unexpected record or error %v", rs.Err())
+	}
+}
+
+func TestSampleWeightDataSrcTransaction(t *testing.T) {
+	// perf_output_sample writes weight, data_src, and transaction
+	// in that order, followed by regs_intr and phys_addr.
+	const dataSrc = 0x68100142
+	const txn = 0x1234<<32 | uint64(TransactionTransaction|TransactionConflict)
+	for _, weightFormat := range []SampleFormat{SampleFormatWeight, SampleFormatWeightStruct} {
+		tf := &testFile{}
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIP | weightFormat | SampleFormatDataSrc | SampleFormatTransaction | SampleFormatPhysAddr,
+		}})
+		weight := uint64(300)
+		if weightFormat == SampleFormatWeightStruct {
+			weight |= 20<<32 | 10<<48
+		}
+		tf.record(RecordTypeSample, 0, uint64(0x400), weight, uint64(dataSrc), txn, uint64(0x5000))
+
+		rs := tf.open(t).Records(RecordsFileOrder)
+		rs.Strict()
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+		r := rs.Record.(*RecordSample)
+		if r.IP != 0x400 || r.Weight != 300 || r.DataSrc != decodeDataSrc(dataSrc) || r.Transaction != TransactionTransaction|TransactionConflict || r.AbortCode != 0x1234 || r.PhysAddr != 0x5000 {
+			t.Errorf("%v: bad sample %v", weightFormat, r)
+		}
+		var insnLat, retireLat uint16
+		if weightFormat == SampleFormatWeightStruct {
+			insnLat, retireLat = 20, 10
+		}
+		if r.InsnLatency != insnLat || r.RetireLatency != retireLat {
+			t.Errorf("%v: got latencies %d, %d; want %d, %d", weightFormat, r.InsnLatency, r.RetireLatency, insnLat, retireLat)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	const n = 10000
+	for i := 0; i < n; i++ {
+		if i%1000 == 0 {
+			tf.record(RecordTypeComm, 0, i, i, "comm")
+		}
+		tf.record(RecordTypeSample, 0, uint64(i))
+	}
+	f := tf.open(t)
+
+	read := func(rate float64) (comms int, ips []uint64) {
+		rs := f.Records(RecordsFileOrder)
+		rs.Sample(rate)
+		for rs.Next() {
+			switch r := rs.Record.(type) {
+			case *RecordComm:
+				comms++
+			case *RecordSample:
+				ips = append(ips, r.IP)
+			}
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		comms, ips := read(rate)
+		if comms != n/1000 {
+			t.Errorf("rate %v: got %d comm records, want %d", rate, comms, n/1000)
+		}
+		if want := rate * n; math.Abs(float64(len(ips))-want) > 0.05*n {
+			t.Errorf("rate %v: got %d samples, want about %v", rate, len(ips), want)
+		}
+		if _, ips2 := read(rate); !reflect.DeepEqual(ips, ips2) {
+			t.Errorf("rate %v: sampling is not reproducible", rate)
+		}
+	}
+}
+
+func TestEstimatedCount(t *testing.T) {
+	fixed := &EventAttr{SamplePeriod: 500}
+	freq := &EventAttr{SampleFreq: 4000}
+	times := &EventAttr{ReadFormat: ReadFormatTotalTimeEnabled | ReadFormatTotalTimeRunning}
+	other := &EventAttr{}
+	for i, test := range []struct {
+		r    RecordSample
+		want uint64
+	}{
+		{RecordSample{RecordCommon: RecordCommon{Format: SampleFormatPeriod, EventAttr: fixed}, Period: 1000}, 1000},
+		{RecordSample{RecordCommon: RecordCommon{EventAttr: fixed}}, 500},
+		{RecordSample{RecordCommon: RecordCommon{EventAttr: freq}}, 1},
+		{RecordSample{}, 1},
+		// Multiplexed for half of the time it was enabled.
+		{RecordSample{RecordCommon: RecordCommon{Format: SampleFormatPeriod | SampleFormatRead, EventAttr: times}, Period: 1000,
+			SampleRead: []SampleRead{{EventAttr: times, TimeEnabled: 200, TimeRunning: 100}}}, 2000},
+		// Only the sampled event's entry in a group is used.
+		{RecordSample{RecordCommon: RecordCommon{Format: SampleFormatPeriod | SampleFormatRead, EventAttr: times}, Period: 1000,
+			SampleRead: []SampleRead{{EventAttr: other, TimeEnabled: 400, TimeRunning: 100}, {EventAttr: times, TimeEnabled: 300, TimeRunning: 100}}}, 3000},
+		// Never running is not scaled.
+		{RecordSample{RecordCommon: RecordCommon{Format: SampleFormatPeriod | SampleFormatRead, EventAttr: times}, Period: 1000,
+			SampleRead: []SampleRead{{EventAttr: times, TimeEnabled: 200}}}, 1000},
+	} {
+		if got := test.r.EstimatedCount(); got != test.want {
+			t.Errorf("%d: got %d, want %d", i, got, test.want)
+		}
+	}
+}
+
+func TestRecordRead(t *testing.T) {
+	// Group read with sample_id trailers.
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatTID | SampleFormatTime | SampleFormatIdentifier,
+			ReadFormat:   ReadFormatGroup | ReadFormatID | ReadFormatTotalTimeEnabled | ReadFormatTotalTimeRunning,
+			Flags:        EventFlagSampleIDAll | EventFlagInherit | EventFlagInheritStat,
+		}}, id)
+	}
+	tf.record(RecordTypeRead, 0, 10, 11, uint64(2), uint64(1000), uint64(500), uint64(42), uint64(1), uint64(43), uint64(2), 10, 11, uint64(123), uint64(2))
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	rs.Strict()
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	r, ok := rs.Record.(*RecordRead)
+	if !ok {
+		t.Fatalf("got %T, want *RecordRead", rs.Record)
+	}
+	want := []SampleRead{
+		{Value: 42, TimeEnabled: 1000, TimeRunning: 500, EventAttr: f.Events[0]},
+		{Value: 43, TimeEnabled: 1000, TimeRunning: 500, EventAttr: f.Events[1]},
+	}
+	if r.PID != 10 || r.TID != 11 || r.Time != 123 || r.EventAttr != f.Events[1] || !reflect.DeepEqual(r.Values, want) {
+		t.Errorf("bad group read record %+v", r)
+	}
+
+	// Single value without sample_id trailers.
+	tf = &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		ReadFormat: ReadFormatTotalTimeEnabled,
+		Flags:      EventFlagInherit | EventFlagInheritStat,
+	}})
+	tf.record(RecordTypeRead, 0, 10, 11, uint64(42), uint64(1000))
+	rs = tf.open(t).Records(RecordsFileOrder)
+	rs.Strict()
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	r = rs.Record.(*RecordRead)
+	want = []SampleRead{{Value: 42, TimeEnabled: 1000}}
+	if r.PID != 10 || r.TID != 11 || !reflect.DeepEqual(r.Values, want) {
+		t.Errorf("bad read record %+v", r)
+	}
+}
+
+// guardedReader is an io.ReaderAt that fails reads that overlap
+// [start, end).
+type guardedReader struct {
+	r          *bytes.Reader
+	start, end int64
+}
+
+func (g *guardedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < g.end && off+int64(len(p)) > g.start {
+		return 0, fmt.Errorf("read of [%d, %d) overlaps guarded range", off, off+int64(len(p)))
+	}
+	return g.r.ReadAt(p, off)
+}
+
+func TestHeaderOnly(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	tf.addFeature(FeatureHostname, []byte("\x05\x00\x00\x00host\x00"))
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+	tf.record(RecordTypeSample, 0, uint64(0x404))
+	data := tf.bytes()
+
+	start, end := tf.open(t).DataRange()
+	if end-start != 32 {
+		t.Fatalf("got data range [%d, %d), want 32 bytes", start, end)
+	}
+
+	// Reading metadata must not touch the records.
+	f, err := New(&guardedReader{bytes.NewReader(data), start, end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Events) != 1 || f.Events[0].SampleFormat != SampleFormatIP {
+		t.Errorf("bad events %v", f.Events)
+	}
+	if f.Meta.Hostname != "host" {
+		t.Errorf("got hostname %q, want host", f.Meta.Hostname)
+	}
+	if got := f.Features(); !reflect.DeepEqual(got, []FeatureID{FeatureHostname}) {
+		t.Errorf("got features %v", got)
+	}
+	rs := f.Records(RecordsFileOrder)
+	if rs.Next() || rs.Err() == nil {
+		t.Errorf("reading records of guarded file succeeded")
+	}
+}
+
+func TestKernelMmap(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	tf.record(RecordTypeMmap, recordMisc(CPUModeKernel), -1, 0, uint64(0xffffffff81000000), uint64(0x1000000), uint64(0xffffffff81000000), "[kernel.kallsyms]_text")
+	tf.record(recordTypeMmap2, recordMisc(CPUModeKernel), -1, 0, uint64(0xffffffffc0000000), uint64(0x1000), uint64(0), 0, 0, uint64(0), uint64(0), 0, 0, "[nvme]")
+	tf.record(RecordTypeMmap, recordMisc(CPUModeUser), 100, 100, uint64(0x400000), uint64(0x1000), uint64(0), "/bin/true")
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	for i, want := range []struct {
+		pid, tid int
+		kernel   bool
+	}{
+		{-1, 0, true},
+		{-1, 0, true},
+		{100, 100, false},
+	} {
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+		r := rs.Record.(*RecordMmap)
+		if r.PID != want.pid || r.TID != want.tid || r.IsKernel() != want.kernel {
+			t.Errorf("mmap %d: got PID %d, TID %d, IsKernel %v; want %d, %d, %v", i, r.PID, r.TID, r.IsKernel(), want.pid, want.tid, want.kernel)
+		}
+	}
+}
+
+func TestFileOffsetOf(t *testing.T) {
+	m := &RecordMmap{Addr: 0x400000, Len: 0x2000, FileOffset: 0x1000}
+	for _, test := range []struct {
+		ip  uint64
+		off uint64
+		ok  bool
+	}{
+		{0x3fffff, 0, false},
+		{0x400000, 0x1000, true},
+		{0x401234, 0x2234, true},
+		{0x401fff, 0x2fff, true},
+		{0x402000, 0, false},
+	} {
+		off, ok := m.FileOffsetOf(test.ip)
+		if off != test.off || ok != test.ok {
+			t.Errorf("FileOffsetOf(%#x) = %#x, %v; want %#x, %v", test.ip, off, ok, test.off, test.ok)
+		}
+	}
+
+	// A mapping that reaches the top of the address space.
+	m = &RecordMmap{Addr: 0xfffffffffffff000, Len: 0x1000}
+	if off, ok := m.FileOffsetOf(0xffffffffffffffff); off != 0xfff || !ok {
+		t.Errorf("FileOffsetOf at top of address space = %#x, %v; want 0xfff, true", off, ok)
+	}
+}
+
+func TestMiscFlags(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	user := recordMisc(CPUModeUser)
+	tf.record(RecordTypeMmap, user|recordMiscProcMapParseTimeout|recordMiscMmapData, 1, 1, uint64(0x1000), uint64(0x1000), uint64(0), "f")
+	tf.record(RecordTypeComm, user|recordMiscCommExec, 1, 1, "comm")
+	tf.record(RecordTypeSample, recordMisc(CPUModeKernel)|recordMiscExactIP, uint64(0x1234))
+	tf.record(recordTypeSwitch, recordMiscSwitchOut|recordMiscSwitchOutPreempt)
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	for i, want := range []MiscFlags{
+		{CPUMode: CPUModeUser, ProcMapParseTimeout: true, MmapData: true},
+		{CPUMode: CPUModeUser, CommExec: true},
+		{CPUMode: CPUModeKernel, ExactIP: true},
+		{SwitchOut: true, SwitchOutPreempt: true},
+	} {
+		if !rs.Next() {
+			t.Fatal(rs.Err())
+		}
+		if got := rs.Record.Common().Misc; got != want {
+			t.Errorf("record %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(1))
+	tf.record(RecordTypeComm, 0, 1, 1, "comm")
+	tf.record(RecordTypeSample, 0, uint64(2))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	rs.KeepRaw()
+	rs.OnlyTypes(RecordTypeSample)
+	for _, ip := range []uint64{1, 2} {
+		for i := 0; i < 2; i++ {
+			r, ok := rs.Peek()
+			if !ok {
+				t.Fatalf("Peek failed: %v", rs.Err())
+			}
+			if got := r.(*RecordSample).IP; got != ip {
+				t.Fatalf("Peek returned IP %#x, want %#x", got, ip)
+			}
+		}
+		peeked, _ := rs.Peek()
+		if !rs.Next() {
+			t.Fatalf("Next failed: %v", rs.Err())
+		}
+		if rs.Record != peeked {
+			t.Errorf("Next returned %v, want peeked %v", rs.Record, peeked)
+		}
+		if raw := rs.RawRecord(); len(raw) != 16 || raw[8] != byte(ip) {
+			t.Errorf("RawRecord after Peek is %x", raw)
+		}
+	}
+	if r, ok := rs.Peek(); ok || r != nil {
+		t.Errorf("Peek at end returned %v, %v", r, ok)
+	}
+	if rs.Next() {
+		t.Errorf("Next at end returned %v", rs.Record)
+	}
+}
+
+func TestClone(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	for ip := 1; ip <= 4; ip++ {
+		tf.record(RecordTypeSample, 0, uint64(ip))
+	}
+	ips := func(rs *Records) []uint64 {
+		var got []uint64
+		for rs.Next() {
+			got = append(got, rs.Record.(*RecordSample).IP)
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	// Scanning ahead in a clone doesn't move rs.
+	c := rs.Clone()
+	if c.Record != nil {
+		t.Errorf("clone's Record is %v before Next, want nil", c.Record)
+	}
+	if got, want := ips(c), []uint64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clone got IPs %v, want %v", got, want)
+	}
+	if got := rs.Record.(*RecordSample).IP; got != 1 {
+		t.Errorf("after advancing clone, Record has IP %d, want 1", got)
+	}
+
+	// A clone made after Peek starts with the peeked record.
+	if _, ok := rs.Peek(); !ok {
+		t.Fatal(rs.Err())
+	}
+	c = rs.Clone()
+	if got, want := ips(c), []uint64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clone after Peek got IPs %v, want %v", got, want)
+	}
+	if got, want := ips(rs), []uint64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("original got IPs %v, want %v", got, want)
+	}
+}
+
+func TestMixedIDOffsets(t *testing.T) {
+	// Event 1 puts its ID first in samples and last in the
+	// sample_id trailer. Event 2 puts its ID after the IP and TID
+	// in samples and before the CPU in the trailer.
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+		Flags:        EventFlagSampleIDAll,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatID | SampleFormatCPU,
+		Flags:        EventFlagSampleIDAll,
+	}}, 2)
+	tf.record(RecordTypeComm, 0, 10, 10, "one", uint64(1))
+	tf.record(RecordTypeComm, 0, 20, 20, "two", 20, 20, uint64(2), uint32(3), uint32(0))
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x1000))
+	tf.record(RecordTypeSample, 0, uint64(0x2000), 20, 20, uint64(2), uint32(3), uint32(0))
+
+	f := tf.open(t)
+	rs := f.Records(RecordsFileOrder)
+	var got []string
+	for rs.Next() {
+		c := rs.Record.Common()
+		got = append(got, fmt.Sprintf("%v %d", rs.Record.Type(), c.ID))
+		if c.EventAttr != f.Events[c.ID-1] {
+			t.Errorf("%v record has wrong EventAttr", rs.Record.Type())
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"RecordTypeComm 1", "RecordTypeComm 2", "RecordTypeSample 1", "RecordTypeSample 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A sample whose IP happens to be event 1's ID and a comm
+	// whose CPU happens to be event 1's ID match both events,
+	// but only fit event 2's format.
+	tf.data.Reset()
+	tf.record(RecordTypeComm, 0, 20, 20, "two", 20, 20, uint64(2), uint32(1), uint32(0))
+	tf.record(RecordTypeSample, 0, uint64(1), 20, 20, uint64(2), uint32(3), uint32(0))
+	rs = tf.open(t).Records(RecordsFileOrder)
+	got = nil
+	for rs.Next() {
+		got = append(got, fmt.Sprintf("%v %d", rs.Record.Type(), rs.Record.Common().ID))
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"RecordTypeComm 2", "RecordTypeSample 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// If both events' formats have the same size, a sample that
+	// matches both is ambiguous.
+	tf = &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatPeriod,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatID | SampleFormatPeriod,
+	}}, 2)
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(2), uint64(100))
+	rs = tf.open(t).Records(RecordsFileOrder)
+	if rs.Next() {
+		t.Errorf("ambiguous sample decoded as %v", rs.Record)
+	} else if err := rs.Err(); err == nil || !strings.Contains(err.Error(), "matches events") {
+		t.Errorf("want ambiguous event error, got %v", err)
+	}
+}
+
+type testVisitor struct {
+	BaseVisitor
+	comms []string
+	ips   []uint64
+}
+
+func (v *testVisitor) VisitComm(r *RecordComm) error {
+	v.comms = append(v.comms, r.Comm)
+	return nil
+}
+
+func (v *testVisitor) VisitSample(r *RecordSample) error {
+	if r.IP == 0 {
+		return fmt.Errorf("zero IP")
+	}
+	v.ips = append(v.ips, r.IP)
+	return nil
+}
+
+func TestVisit(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	tf.record(RecordTypeComm, 0, 1, 1, "a")
+	tf.record(RecordTypeSample, 0, uint64(0x10))
+	tf.record(RecordTypeExit, 0, 1, 1, 1, 1, uint64(0))
+	tf.record(RecordTypeSample, 0, uint64(0x20))
+	tf.record(RecordTypeSample, 0, uint64(0))
+	tf.record(RecordTypeComm, 0, 2, 2, "b")
+
+	v := new(testVisitor)
+	err := tf.open(t).Records(RecordsFileOrder).Visit(v)
+	if err == nil || err.Error() != "zero IP" {
+		t.Errorf("got error %v, want zero IP", err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(v.comms, want) {
+		t.Errorf("got comms %v, want %v", v.comms, want)
+	}
+	if want := []uint64{0x10, 0x20}; !reflect.DeepEqual(v.ips, want) {
+		t.Errorf("got IPs %v, want %v", v.ips, want)
+	}
+}
+
+func TestEventAttrIDs(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatCPU,
+	}}, 10, 11, 12)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatCPU,
+	}}, 20, 21)
+	tf.record(RecordTypeSample, 0, uint64(21), uint32(1), uint32(0))
+	f := tf.open(t)
+
+	for i, want := range [][]uint64{{10, 11, 12}, {20, 21}} {
+		if got := f.EventIDs(f.Events[i]); !reflect.DeepEqual(got, want) {
+			t.Errorf("event %d: got IDs %v, want %v", i, got, want)
+		}
+	}
+
+	// A sample's ID identifies the file descriptor it came from.
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	s := rs.Record.(*RecordSample)
+	ids := f.EventIDs(s.EventAttr)
+	id := uint64(s.RecordCommon.ID)
+	if s.EventAttr != f.Events[1] || len(ids) != 2 || ids[s.CPU] != id {
+		t.Errorf("sample with ID %d on CPU %d does not match event IDs %v", id, s.CPU, ids)
+	}
+}
+
+func TestHWCacheEvent(t *testing.T) {
+	for _, test := range []struct {
+		attr EventAttr
+		ok   bool
+		want string
+	}{
+		{EventAttr{Type: EventTypeHWCache, Config: [3]uint64{0x10000}}, true, "L1-dcache-load-misses"},
+		{EventAttr{Type: EventTypeHWCache, Config: [3]uint64{0x102}}, true, "LLC-stores"},
+		{EventAttr{Type: EventTypeHWCache, Config: [3]uint64{0x203}}, true, "dTLB-prefetches"},
+		// A hybrid PMU type in the upper bits is ignored.
+		{EventAttr{Type: EventTypeHWCache, Config: [3]uint64{8<<32 | 0x10005}}, true, "branch-load-misses"},
+		{EventAttr{Type: EventTypeHWCache, Config: [3]uint64{0x20009}}, true, "HWCacheID(9)-load-HWCacheResult(2)"},
+		{EventAttr{Type: EventTypeHardware}, false, ""},
+	} {
+		ev, ok := test.attr.HWCacheEvent()
+		if ok != test.ok || ok && ev.String() != test.want {
+			t.Errorf("%+v: got %v, %v, want %v, %v", test.attr, ev, ok, test.want, test.ok)
+		}
+		if test.attr.IsCache() != test.ok || test.attr.IsHardware() == test.ok {
+			t.Errorf("%+v: wrong type predicates", test.attr)
+		}
+	}
+}
+
+func TestSeekWallClock(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatTime,
+	}})
+	wall := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tf.addFeature(FeatureClockData, encodeFields(uint32(1), uint32(1), uint64(wall.UnixNano()), uint64(1000)))
+	for _, ts := range []uint64{1100, 1300, 1200, 1500, 1400} {
+		tf.record(RecordTypeSample, 0, ts)
+	}
+	f := tf.open(t)
+	if c := f.Meta.ClockData; c == nil || c.ClockID != 1 || !c.Wall.Equal(wall) || c.Sample != 1000 {
+		t.Fatalf("got clock data %+v", c)
+	}
+	if got := f.Meta.ClockData.WallTime(900); !got.Equal(wall.Add(-100)) {
+		t.Errorf("WallTime(900) = %v, want %v", got, wall.Add(-100))
+	}
+
+	times := func(rs *Records) []uint64 {
+		var out []uint64
+		for rs.Next() {
+			out = append(out, rs.Record.(*RecordSample).Time)
+		}
+		if err := rs.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	for _, test := range []struct {
+		order RecordsOrder
+		seek  []time.Duration
+		want  []uint64
+	}{
+		{RecordsTimeOrder, []time.Duration{250}, []uint64{1300, 1400, 1500}},
+		// Seeking backward in time order.
+		{RecordsTimeOrder, []time.Duration{450, 150}, []uint64{1200, 1300, 1400, 1500}},
+		{RecordsTimeOrder, []time.Duration{-time.Hour}, []uint64{1100, 1200, 1300, 1400, 1500}},
+		// In file order, seeking stops at the first later record.
+		{RecordsFileOrder, []time.Duration{250}, []uint64{1300, 1200, 1500, 1400}},
+		{RecordsFileOrder, []time.Duration{time.Hour}, nil},
+	} {
+		rs := f.Records(test.order)
+		for _, d := range test.seek {
+			if err := rs.SeekWallClock(wall.Add(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := times(rs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: after seeking to %v, got %v, want %v", test.order, test.seek, got, test.want)
+		}
+	}
+}
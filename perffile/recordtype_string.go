@@ -6,12 +6,16 @@ import "fmt"
 
 const (
 	_RecordType_name_0 = "RecordTypeMmapRecordTypeLostRecordTypeCommRecordTypeExitRecordTypeThrottleRecordTypeUnthrottleRecordTypeForkRecordTypeReadRecordTypeSamplerecordTypeMmap2RecordTypeAux"
-	_RecordType_name_1 = "recordTypeUserStartrecordTypeHeaderEventTyperecordTypeHeaderTracingDatarecordTypeHeaderBuildIDrecordTypeHeaderFinishedRoundrecordTypeHeaderIDIndex"
+	_RecordType_name_1 = "RecordTypeLostSamplesrecordTypeSwitchrecordTypeSwitchCPUWide"
+	_RecordType_name_2 = "recordTypeUserStartrecordTypeHeaderEventTyperecordTypeHeaderTracingDatarecordTypeHeaderBuildIDrecordTypeHeaderFinishedRoundrecordTypeHeaderIDIndex"
+	_RecordType_name_3 = "recordTypeCompressedrecordTypeFinishedInit"
 )
 
 var (
 	_RecordType_index_0 = [...]uint8{0, 14, 28, 42, 56, 74, 94, 108, 122, 138, 153, 166}
-	_RecordType_index_1 = [...]uint8{0, 19, 44, 71, 94, 123, 146}
+	_RecordType_index_1 = [...]uint8{0, 21, 37, 60}
+	_RecordType_index_2 = [...]uint8{0, 19, 44, 71, 94, 123, 146}
+	_RecordType_index_3 = [...]uint8{0, 20, 42}
 )
 
 func (i RecordType) String() string {
@@ -19,9 +23,15 @@ func (i RecordType) String() string {
 	case 1 <= i && i <= 11:
 		i -= 1
 		return _RecordType_name_0[_RecordType_index_0[i]:_RecordType_index_0[i+1]]
+	case 13 <= i && i <= 15:
+		i -= 13
+		return _RecordType_name_1[_RecordType_index_1[i]:_RecordType_index_1[i+1]]
 	case 64 <= i && i <= 69:
 		i -= 64
-		return _RecordType_name_1[_RecordType_index_1[i]:_RecordType_index_1[i+1]]
+		return _RecordType_name_2[_RecordType_index_2[i]:_RecordType_index_2[i+1]]
+	case 81 <= i && i <= 82:
+		i -= 81
+		return _RecordType_name_3[_RecordType_index_3[i]:_RecordType_index_3[i+1]]
 	default:
 		return fmt.Sprintf("RecordType(%d)", i)
 	}
@@ -12,6 +12,9 @@ func (i SampleFormat) String() string {
 	if i&SampleFormatAddr != 0 {
 		s += "Addr|"
 	}
+	if i&SampleFormatAux != 0 {
+		s += "Aux|"
+	}
 	if i&SampleFormatBranchStack != 0 {
 		s += "BranchStack|"
 	}
@@ -21,6 +24,15 @@ func (i SampleFormat) String() string {
 	if i&SampleFormatCallchain != 0 {
 		s += "Callchain|"
 	}
+	if i&SampleFormatCgroup != 0 {
+		s += "Cgroup|"
+	}
+	if i&SampleFormatCodePageSize != 0 {
+		s += "CodePageSize|"
+	}
+	if i&SampleFormatDataPageSize != 0 {
+		s += "DataPageSize|"
+	}
 	if i&SampleFormatDataSrc != 0 {
 		s += "DataSrc|"
 	}
@@ -36,6 +48,9 @@ func (i SampleFormat) String() string {
 	if i&SampleFormatPeriod != 0 {
 		s += "Period|"
 	}
+	if i&SampleFormatPhysAddr != 0 {
+		s += "PhysAddr|"
+	}
 	if i&SampleFormatRaw != 0 {
 		s += "Raw|"
 	}
@@ -66,7 +81,10 @@ func (i SampleFormat) String() string {
 	if i&SampleFormatWeight != 0 {
 		s += "Weight|"
 	}
-	i &^= 524287
+	if i&SampleFormatWeightStruct != 0 {
+		s += "WeightStruct|"
+	}
+	i &^= 33554431
 	if i == 0 {
 		return s[:len(s)-1]
 	}
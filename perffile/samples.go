@@ -0,0 +1,655 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EventActivity returns the number of samples in f for each event.
+// Every event in f.Events has an entry in the result, so events that
+// were configured but never produced a sample map to 0.
+func (f *File) EventActivity() (map[*EventAttr]uint64, error) {
+	counts := make(map[*EventAttr]uint64, len(f.Events))
+	for _, ev := range f.Events {
+		counts[ev] = 0
+	}
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if r, ok := rs.Record.(*RecordSample); ok {
+			counts[r.EventAttr]++
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// A Gap is a period of time with no samples.
+type Gap struct {
+	// Start and End are the times of the samples on either side
+	// of the gap.
+	Start, End uint64
+}
+
+// SampleGaps returns the periods longer than threshold nanoseconds
+// between consecutive samples of event attr. For a CPU-time event,
+// these typically indicate periods when the profiled workload was
+// idle or off-CPU.
+//
+// SampleGaps returns an error if attr does not record sample times.
+func (f *File) SampleGaps(attr *EventAttr, threshold uint64) ([]Gap, error) {
+	if attr.SampleFormat&SampleFormatTime == 0 {
+		return nil, fmt.Errorf("event does not record sample times")
+	}
+
+	var gaps []Gap
+	var last uint64
+	first := true
+	rs := f.Records(RecordsTimeOrder)
+	rs.Filter(func(r Record) bool {
+		s, ok := r.(*RecordSample)
+		return ok && s.EventAttr == attr
+	})
+	for rs.Next() {
+		t := rs.Record.(*RecordSample).Time
+		if !first && t-last > threshold {
+			gaps = append(gaps, Gap{last, t})
+		}
+		last, first = t, false
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return gaps, nil
+}
+
+// TimeBounds returns the earliest and latest sample times in f. If f
+// has no samples, it returns 0, 0.
+//
+// The first call to TimeBounds scans the samples in f, but the
+// result is cached, so later calls are cheap.
+//
+// TimeBounds returns an error if no event in f records sample times.
+func (f *File) TimeBounds() (min, max uint64, err error) {
+	if f.timeBounds != nil {
+		return f.timeBounds[0], f.timeBounds[1], nil
+	}
+	if !f.hasSampleFormat(SampleFormatTime) {
+		return 0, 0, fmt.Errorf("no events record sample times")
+	}
+
+	first := true
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	for rs.Next() {
+		r := rs.Record.(*RecordSample)
+		if r.Format&SampleFormatTime == 0 {
+			continue
+		}
+		if first || r.Time < min {
+			min = r.Time
+		}
+		if first || r.Time > max {
+			max = r.Time
+		}
+		first = false
+	}
+	if err := rs.Err(); err != nil {
+		return 0, 0, err
+	}
+	f.timeBounds = &[2]uint64{min, max}
+	return min, max, nil
+}
+
+// A LossSummary summarizes the data lost while recording a profile.
+type LossSummary struct {
+	// Lost is the number of records lost for each event because
+	// the kernel's ring buffer was full. Events that lost no
+	// records are omitted.
+	Lost map[*EventAttr]uint64
+
+	// TotalLost is the sum of Lost.
+	TotalLost uint64
+
+	// LostSamples is the number of samples of each event that
+	// the kernel generated but then dropped, such as samples the
+	// hardware reported as lost or that a BPF filter rejected.
+	// Events that dropped no samples are omitted. Lost samples
+	// records only identify their event if the event has
+	// EventFlagSampleIDAll set; other lost samples are counted
+	// under a nil key.
+	LostSamples map[*EventAttr]uint64
+
+	// TotalLostSamples is the sum of LostSamples.
+	TotalLostSamples uint64
+
+	// AuxTruncated is the number of AUX records whose data was
+	// truncated to fit in the AUX buffer.
+	AuxTruncated int
+
+	// Throttled is the number of times the kernel throttled an
+	// event because it was generating samples too quickly.
+	// During throttling, no samples are recorded for that event.
+	Throttled int
+}
+
+// LossSummary summarizes the data lost in f. If any data was lost, the
+// profile underrepresents the periods of time where it was lost.
+func (f *File) LossSummary() (LossSummary, error) {
+	sum := LossSummary{Lost: make(map[*EventAttr]uint64), LostSamples: make(map[*EventAttr]uint64)}
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeLost, RecordTypeLostSamples, RecordTypeAux, RecordTypeThrottle)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordLost:
+			sum.Lost[r.EventAttr] += r.NumLost
+			sum.TotalLost += r.NumLost
+		case *RecordLostSamples:
+			sum.LostSamples[r.EventAttr] += r.NumLost
+			sum.TotalLostSamples += r.NumLost
+		case *RecordAux:
+			if r.Flags&AuxFlagTruncated != 0 {
+				sum.AuxTruncated++
+			}
+		case *RecordThrottle:
+			if r.Enable {
+				sum.Throttled++
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return LossSummary{}, err
+	}
+	return sum, nil
+}
+
+// SampleTimeBounds returns the times of the first and last samples in
+// f. If f records these times in its metadata, this does not read any
+// records. Otherwise, it falls back to TimeBounds. ok is false if the
+// bounds cannot be determined.
+func (f *File) SampleTimeBounds() (first, last uint64, ok bool) {
+	if f.Meta.FirstSampleTime != 0 || f.Meta.LastSampleTime != 0 {
+		return f.Meta.FirstSampleTime, f.Meta.LastSampleTime, true
+	}
+	first, last, err := f.TimeBounds()
+	return first, last, err == nil
+}
+
+// A Summary gives an overview of a profile, such as a report prints
+// at the top.
+type Summary struct {
+	// Start and End are the times of the first and last samples,
+	// and Duration is the time between them. These are 0 if no
+	// event records sample times.
+	Start, End uint64
+	Duration   time.Duration
+
+	// Samples is the total number of samples and EventSamples is
+	// the number of samples of each event, as returned by
+	// EventActivity.
+	Samples      uint64
+	EventSamples map[*EventAttr]uint64
+
+	// SampleRate is the achieved number of samples per second of
+	// each event over Duration. This may be well below an
+	// event's requested EventAttr.SampleFreq if the event was
+	// throttled or the workload was idle. SampleRate is nil if
+	// Duration is 0.
+	SampleRate map[*EventAttr]float64
+
+	// CPUs is the number of online CPUs of the recording
+	// machine. If the profile doesn't record this, it is the
+	// number of distinct CPUs with samples.
+	CPUs int
+
+	// Threads is the number of distinct threads with samples.
+	// It is 0 if no event records sample TIDs.
+	Threads int
+}
+
+// Summary returns an overview of f, combining its time bounds, the
+// activity of each event, and the number of CPUs and threads. This
+// reads all of the samples in f.
+func (f *File) Summary() (Summary, error) {
+	sum := Summary{EventSamples: make(map[*EventAttr]uint64, len(f.Events))}
+	for _, ev := range f.Events {
+		sum.EventSamples[ev] = 0
+	}
+	cpus, tids := make(map[uint32]bool), make(map[int]bool)
+	haveTime := false
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	for rs.Next() {
+		r := rs.Record.(*RecordSample)
+		sum.Samples++
+		sum.EventSamples[r.EventAttr]++
+		if r.Format&SampleFormatTime != 0 {
+			if !haveTime || r.Time < sum.Start {
+				sum.Start = r.Time
+			}
+			if !haveTime || r.Time > sum.End {
+				sum.End = r.Time
+			}
+			haveTime = true
+		}
+		if r.Format&SampleFormatCPU != 0 {
+			cpus[r.CPU] = true
+		}
+		if r.Format&SampleFormatTID != 0 {
+			tids[r.TID] = true
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return Summary{}, err
+	}
+
+	sum.Duration = time.Duration(sum.End - sum.Start)
+	if sum.Duration > 0 {
+		sum.SampleRate = make(map[*EventAttr]float64, len(sum.EventSamples))
+		for ev, n := range sum.EventSamples {
+			sum.SampleRate[ev] = float64(n) / sum.Duration.Seconds()
+		}
+	}
+	sum.CPUs = f.Meta.CPUsOnline
+	if sum.CPUs == 0 {
+		sum.CPUs = len(cpus)
+	}
+	sum.Threads = len(tids)
+	return sum, nil
+}
+
+// DSOs returns the sorted, unique filenames of the binaries and
+// libraries mapped in f, as recorded by mmap records. This is the set
+// of files needed to symbolize f. Unless includePseudo is true, it
+// omits pseudo-mappings that have no backing binary, such as
+// anonymous memory, the stack, the heap, and the vDSO. Kernel
+// mappings, such as "[kernel.kallsyms]_text", are always included.
+func (f *File) DSOs(includePseudo bool) ([]string, error) {
+	seen := make(map[string]bool)
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeMmap)
+	for rs.Next() {
+		r := rs.Record.(*RecordMmap)
+		if includePseudo || !isPseudoMapping(r) {
+			seen[r.Filename] = true
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	dsos := make([]string, 0, len(seen))
+	for name := range seen {
+		dsos = append(dsos, name)
+	}
+	sort.Strings(dsos)
+	return dsos, nil
+}
+
+// isPseudoMapping returns whether r maps memory with no backing
+// binary.
+func isPseudoMapping(r *RecordMmap) bool {
+	if r.IsKernel() {
+		return false
+	}
+	name := r.Filename
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		// [heap], [stack], [vdso], etc.
+		return true
+	}
+	// See is_anon_memory and is_no_dso_memory in
+	// tools/perf/util/map.c.
+	for _, prefix := range []string{"//anon", "/dev/zero", "/anon_hugepage", "/SYSV", "/memfd:"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return name == ""
+}
+
+// CPUSamples counts the samples in a profile by CPU and by socket.
+type CPUSamples struct {
+	// CPUs maps from CPU index to the number of samples on that
+	// CPU. It only includes valid CPUs; see FileMeta.ValidCPU.
+	CPUs map[int]uint64
+
+	// Sockets maps from socket index, which is an index into
+	// FileMeta.CoreGroups, to the number of samples on CPUs in
+	// that socket. It is nil if the profile has no CPU topology.
+	Sockets map[int]uint64
+
+	// Invalid maps from CPU index to the number of samples with
+	// that CPU index that are not valid CPUs on the recording
+	// machine. These usually indicate corrupt CPU fields.
+	Invalid map[int]uint64
+
+	// Offline maps from CPU index to the number of samples on
+	// valid CPUs that are missing from the CPU topology, usually
+	// because they were brought online during the recording.
+	// These samples are counted in CPUs, but not in Sockets. It
+	// is nil if the profile has no CPU topology.
+	Offline map[int]uint64
+}
+
+// SamplesPerCPU counts the samples in f by CPU and socket, validating
+// each sample's CPU against the CPU count and topology in f.Meta.
+//
+// SamplesPerCPU returns an error if no event in f records sample
+// CPUs.
+func (f *File) SamplesPerCPU() (CPUSamples, error) {
+	if !f.hasSampleFormat(SampleFormatCPU) {
+		return CPUSamples{}, fmt.Errorf("no events record sample CPUs")
+	}
+	out := CPUSamples{CPUs: make(map[int]uint64), Invalid: make(map[int]uint64)}
+	topology := len(f.Meta.CoreGroups) > 0
+	if topology {
+		out.Sockets, out.Offline = make(map[int]uint64), make(map[int]uint64)
+	}
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	for rs.Next() {
+		r := rs.Record.(*RecordSample)
+		if r.Format&SampleFormatCPU == 0 {
+			continue
+		}
+		cpu := int(r.CPU)
+		if !f.Meta.ValidCPU(cpu) {
+			out.Invalid[cpu]++
+			continue
+		}
+		out.CPUs[cpu]++
+		if topology {
+			if socket := f.Meta.Socket(cpu); socket >= 0 {
+				out.Sockets[socket]++
+			} else {
+				out.Offline[cpu]++
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return CPUSamples{}, err
+	}
+	return out, nil
+}
+
+// OffCPUTime returns the total time in nanoseconds that each thread
+// spent switched out, keyed by TID. This is computed from the
+// sched:sched_switch tracepoint samples in f as the time between each
+// switch away from a thread and the next switch back to it. Time
+// before a thread's first switch in and after its last switch out is
+// not counted, since the recording does not show when it started or
+// ended. The idle task (TID 0) is ignored.
+//
+// OffCPUTime returns an error if f does not record sched:sched_switch
+// events with raw data and times, such as recorded by
+// "perf record -e sched:sched_switch".
+func (f *File) OffCPUTime() (map[int]uint64, error) {
+	var attr *EventAttr
+	var tp *TracepointFormat
+	for _, ev := range f.Events {
+		if tp = f.Tracepoint(ev); tp != nil && tp.System == "sched" && tp.Name == "sched_switch" {
+			attr = ev
+			break
+		}
+	}
+	if attr == nil {
+		return nil, fmt.Errorf("profile has no sched:sched_switch events")
+	}
+	if attr.SampleFormat&(SampleFormatRaw|SampleFormatTime) != SampleFormatRaw|SampleFormatTime {
+		return nil, fmt.Errorf("sched:sched_switch events do not record raw data and times")
+	}
+
+	offCPU := make(map[int]uint64)
+	switchedOut := make(map[int]uint64)
+	rs := f.Records(RecordsTimeOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	rs.Filter(func(r Record) bool {
+		return r.(*RecordSample).EventAttr == attr
+	})
+	for rs.Next() {
+		r := rs.Record.(*RecordSample)
+		prev, err := tp.Int(r.Raw, "prev_pid")
+		if err != nil {
+			return nil, err
+		}
+		next, err := tp.Int(r.Raw, "next_pid")
+		if err != nil {
+			return nil, err
+		}
+		if prev != 0 {
+			switchedOut[int(prev)] = r.Time
+		}
+		if t, ok := switchedOut[int(next)]; ok && next != 0 {
+			offCPU[int(next)] += r.Time - t
+			delete(switchedOut, int(next))
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return offCPU, nil
+}
+
+// Generic hardware event IDs from perf_hw_id in
+// include/uapi/linux/perf_event.h.
+const (
+	hwCPUCycles    = 0
+	hwInstructions = 1
+)
+
+// IPC returns the instructions per cycle of f, computed from the
+// counter values recorded by samples of the "cycles" and
+// "instructions" hardware events. Typically these events are recorded
+// as a group with SampleFormatRead, for example with
+// "perf record -e '{cycles,instructions}:S'", so each sample of the
+// group leader records the values of both counters.
+//
+// Counter values are cumulative, so IPC uses the difference between
+// the last and first value of each counter, identified by its event
+// and the sample's stream ID (or event ID, if the samples don't record
+// the stream ID). A system-wide recording has one counter per CPU,
+// which counts all of the threads that run on that CPU. If the samples
+// record the counters' enabled and running times, the differences
+// are scaled to account for the counters being multiplexed with other
+// events on the PMU.
+//
+// IPC returns an error if f does not record both events or no samples
+// record their counter values.
+func (f *File) IPC() (float64, error) {
+	var cycles, insns *EventAttr
+	for _, ev := range f.Events {
+		if ev.Type != EventTypeHardware {
+			continue
+		}
+		// The upper 32 bits of the config select the PMU on
+		// systems with hybrid CPUs.
+		switch ev.Config[0] & 0xffffffff {
+		case hwCPUCycles:
+			cycles = ev
+		case hwInstructions:
+			insns = ev
+		}
+	}
+	if cycles == nil || insns == nil {
+		return 0, fmt.Errorf("profile does not record both cycles and instructions events")
+	}
+	if !f.hasSampleFormat(SampleFormatRead) {
+		return 0, fmt.Errorf("no events record counter values")
+	}
+
+	type counter struct {
+		attr     *EventAttr
+		streamID uint64
+	}
+	first := make(map[counter]SampleRead)
+	last := make(map[counter]SampleRead)
+	rs := f.Records(RecordsFileOrder)
+	rs.OnlyTypes(RecordTypeSample)
+	for rs.Next() {
+		s := rs.Record.(*RecordSample)
+		if s.Format&SampleFormatRead == 0 {
+			continue
+		}
+		streamID := s.StreamID
+		if s.Format&SampleFormatStreamID == 0 {
+			// This is resolved from either the ID or the
+			// Identifier field.
+			streamID = uint64(s.RecordCommon.ID)
+		}
+		for _, sr := range s.SampleRead {
+			attr := sr.EventAttr
+			if attr == nil && len(s.SampleRead) == 1 {
+				attr = s.EventAttr
+			}
+			if attr != cycles && attr != insns {
+				continue
+			}
+			c := counter{attr, streamID}
+			if _, ok := first[c]; !ok {
+				first[c] = sr
+			}
+			last[c] = sr
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return 0, err
+	}
+
+	var nCycles, nInsns float64
+	for c, sr := range last {
+		sr0 := first[c]
+		val := float64(sr.Value - sr0.Value)
+		enabled, running := sr.TimeEnabled-sr0.TimeEnabled, sr.TimeRunning-sr0.TimeRunning
+		if running != 0 && running < enabled {
+			val *= float64(enabled) / float64(running)
+		}
+		if c.attr == cycles {
+			nCycles += val
+		} else {
+			nInsns += val
+		}
+	}
+	if nCycles == 0 {
+		return 0, fmt.Errorf("no two samples record the same cycles counter")
+	}
+	return nInsns / nCycles, nil
+}
+
+// CollectSamples returns the samples of event attr in f in time
+// order, up to max samples, or all samples if max < 0. The returned
+// samples are copies, so unlike the records returned by
+// Records.Next, they remain valid.
+//
+// This is meant for small profiles and tests. For large profiles,
+// iterate over Records instead.
+func (f *File) CollectSamples(attr *EventAttr, max int) ([]RecordSample, error) {
+	var samples []RecordSample
+	rs := f.Records(RecordsTimeOrder)
+	rs.Filter(func(r Record) bool {
+		s, ok := r.(*RecordSample)
+		return ok && s.EventAttr == attr
+	})
+	for (max < 0 || len(samples) < max) && rs.Next() {
+		samples = append(samples, *rs.Record.(*RecordSample).Copy())
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// PeriodStats returns the minimum, maximum, and mean sampling period
+// of the samples of event attr in f. If f has no samples of attr, it
+// returns 0, 0, 0.
+//
+// For an event sampled at a fixed frequency (see
+// EventAttr.SampleFreq), the kernel continually adjusts the period to
+// approximate the requested rate. A wide range of periods indicates
+// the event occurs too irregularly to sample accurately, which can
+// bias the profile.
+//
+// PeriodStats returns an error if attr does not record sample
+// periods.
+func (f *File) PeriodStats(attr *EventAttr) (min, max, mean uint64, err error) {
+	if attr.SampleFormat&SampleFormatPeriod == 0 {
+		return 0, 0, 0, fmt.Errorf("event does not record sample periods")
+	}
+
+	var n, sum uint64
+	rs := f.Records(RecordsFileOrder)
+	rs.Filter(func(r Record) bool {
+		s, ok := r.(*RecordSample)
+		return ok && s.EventAttr == attr
+	})
+	for rs.Next() {
+		p := rs.Record.(*RecordSample).Period
+		if n == 0 || p < min {
+			min = p
+		}
+		if p > max {
+			max = p
+		}
+		n, sum = n+1, sum+p
+	}
+	if err := rs.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	if n == 0 {
+		return 0, 0, 0, nil
+	}
+	return min, max, sum / n, nil
+}
+
+// A MapBuilder tracks the memory mappings of processes from the
+// records of a profile. perfsession.Session is a MapBuilder.
+type MapBuilder interface {
+	// Update updates the mappings to reflect record r.
+	Update(r Record)
+
+	// MappedFile returns the name of the file mapped at address
+	// ip in process pid, or "", false if ip is not in any known
+	// mapping.
+	MappedFile(pid int, ip uint64) (string, bool)
+}
+
+// UnknownDSO is the name under which SamplesPerDSO counts samples
+// whose IP is not in any known mapping.
+const UnknownDSO = "[unknown]"
+
+// SamplesPerDSO returns the number of samples in f whose IP falls in
+// each mapped file, such as a binary, a shared library, or the
+// kernel. Only the sample's leaf IP is considered, not its call
+// chain. Samples without an IP are ignored.
+//
+// SamplesPerDSO passes the mmap, comm, fork, exit, and sample records
+// of f to mb in causal order and looks up each sample's IP in mb. mb
+// should be new, such as perfsession.New(f). This only tracks memory
+// mappings and does not read any of the mapped files, so it is a
+// cheap way to find which files are worth symbolizing.
+func (f *File) SamplesPerDSO(mb MapBuilder) (map[string]uint64, error) {
+	counts := make(map[string]uint64)
+	rs := f.Records(RecordsCausalOrder)
+	rs.OnlyTypes(RecordTypeMmap, RecordTypeComm, RecordTypeExit, RecordTypeFork, RecordTypeSample)
+	for rs.Next() {
+		mb.Update(rs.Record)
+		r, ok := rs.Record.(*RecordSample)
+		if !ok || r.Format&SampleFormatIP == 0 {
+			continue
+		}
+		name, ok := mb.MappedFile(r.PID, r.IP)
+		if !ok {
+			name = UnknownDSO
+		}
+		counts[name]++
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
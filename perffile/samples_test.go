@@ -0,0 +1,495 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventActivity(t *testing.T) {
+	tf := &testFile{}
+	for id := uint64(1); id <= 3; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+		}}, id)
+	}
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x100))
+	tf.record(RecordTypeSample, 0, uint64(3), uint64(0x100))
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x100))
+
+	f := tf.open(t)
+	counts, err := f.EventActivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{2, 0, 1}
+	if len(counts) != len(want) {
+		t.Fatalf("got %d events, want %d", len(counts), len(want))
+	}
+	for i, ev := range f.Events {
+		if counts[ev] != want[i] {
+			t.Errorf("event %d has %d samples, want %d", i, counts[ev], want[i])
+		}
+	}
+}
+
+func TestSampleGaps(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatTime,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatTime,
+	}}, 2)
+	for _, s := range []struct{ id, time uint64 }{
+		{1, 100}, {1, 150}, {2, 300}, {1, 1000}, {1, 1010}, {1, 5000},
+	} {
+		tf.record(RecordTypeSample, 0, s.id, s.time)
+	}
+
+	f := tf.open(t)
+	gaps, err := f.SampleGaps(f.Events[0], 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Gap{{150, 1000}, {1010, 5000}}
+	if !reflect.DeepEqual(gaps, want) {
+		t.Errorf("got gaps %v, want %v", gaps, want)
+	}
+}
+
+func TestGroupByThread(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}})
+	tf.record(RecordTypeComm, 0, 1, 1, "a")
+	tf.record(RecordTypeSample, 0, uint64(0x100), 1, 1)
+	tf.record(RecordTypeSample, 0, uint64(0x200), 1, 2)
+	tf.record(RecordTypeSample, 0, uint64(0x300), 1, 1)
+
+	got := make(map[int][]uint64)
+	err := tf.open(t).Records(RecordsFileOrder).GroupByThread(func(tid int, s *RecordSample) {
+		got[tid] = append(got[tid], s.IP)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]uint64{1: {0x100, 0x300}, 2: {0x200}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#x, want %#x", got, want)
+	}
+}
+
+func TestSampleCopy(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatCallchain,
+	}})
+	tf.record(RecordTypeSample, 0, uint64(0x100), uint64(2), uint64(0x100), uint64(0x200))
+	tf.record(RecordTypeSample, 0, uint64(0x300), uint64(2), uint64(0x300), uint64(0x400))
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	var samples []*RecordSample
+	for rs.Next() {
+		samples = append(samples, rs.Record.(*RecordSample).Copy())
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]uint64{{0x100, 0x200}, {0x300, 0x400}}
+	for i, s := range samples {
+		if !reflect.DeepEqual(s.Callchain, want[i]) {
+			t.Errorf("sample %d has callchain %#x, want %#x", i, s.Callchain, want[i])
+		}
+	}
+}
+
+func TestTimeBounds(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatTime,
+		Flags:        EventFlagSampleIDAll,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIdentifier | SampleFormatTime,
+		Flags:        EventFlagSampleIDAll,
+	}}, 2)
+	// Non-sample records outside the sample time range should be
+	// ignored.
+	tf.record(RecordTypeComm, 0, 1, 1, "a", uint64(10), uint64(1))
+	for _, s := range []struct{ id, time uint64 }{
+		{1, 300}, {2, 200}, {1, 1000}, {2, 900},
+	} {
+		tf.record(RecordTypeSample, 0, s.id, s.time)
+	}
+	tf.record(RecordTypeExit, 0, 1, 1, 1, 1, uint64(2000), uint64(2000), uint64(1))
+
+	f := tf.open(t)
+	for i := 0; i < 2; i++ {
+		min, max, err := f.TimeBounds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if min != 200 || max != 1000 {
+			t.Errorf("got bounds [%d, %d], want [200, 1000]", min, max)
+		}
+	}
+}
+
+func TestLossSummary(t *testing.T) {
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP,
+		}}, id)
+	}
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x100))
+	tf.record(RecordTypeLost, 0, uint64(2), uint64(10))
+	tf.record(RecordTypeLost, 0, uint64(2), uint64(5))
+	// Without EventFlagSampleIDAll, lost samples have no event.
+	tf.record(RecordTypeLostSamples, 0, uint64(3))
+	tf.record(RecordTypeAux, 0, uint64(0), uint64(100), uint64(AuxFlagTruncated))
+	tf.record(RecordTypeAux, 0, uint64(100), uint64(100), uint64(0))
+	tf.record(RecordTypeThrottle, 0, uint64(1000), uint64(1), uint64(1))
+	tf.record(RecordTypeUnthrottle, 0, uint64(2000), uint64(1), uint64(1))
+
+	f := tf.open(t)
+	sum, err := f.LossSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LossSummary{
+		Lost:             map[*EventAttr]uint64{f.Events[1]: 15},
+		TotalLost:        15,
+		LostSamples:      map[*EventAttr]uint64{nil: 3},
+		TotalLostSamples: 3,
+		AuxTruncated:     1,
+		Throttled:        1,
+	}
+	if !reflect.DeepEqual(sum, want) {
+		t.Errorf("got %+v, want %+v", sum, want)
+	}
+}
+
+func TestSampleTimeBounds(t *testing.T) {
+	for _, feature := range []bool{false, true} {
+		tf := &testFile{}
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatTime,
+		}})
+		if feature {
+			tf.addFeature(FeatureSampleTime, encodeFields(uint64(50), uint64(5000)))
+		}
+		tf.record(RecordTypeSample, 0, uint64(100))
+		tf.record(RecordTypeSample, 0, uint64(1000))
+
+		first, last, ok := tf.open(t).SampleTimeBounds()
+		wantFirst, wantLast := uint64(100), uint64(1000)
+		if feature {
+			wantFirst, wantLast = 50, 5000
+		}
+		if !ok || first != wantFirst || last != wantLast {
+			t.Errorf("with feature %v: got %d, %d, %v; want %d, %d, true", feature, first, last, ok, wantFirst, wantLast)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	for _, nrCPUs := range []bool{false, true} {
+		tf := &testFile{}
+		for id := uint64(1); id <= 3; id++ {
+			tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+				SampleFormat: SampleFormatIdentifier | SampleFormatTID | SampleFormatTime | SampleFormatCPU,
+			}}, id)
+		}
+		if nrCPUs {
+			tf.addFeature(FeatureNrCpus, encodeFields(uint32(8), uint32(4)))
+		}
+		for _, s := range []struct {
+			id   uint64
+			tid  int
+			time uint64
+			cpu  uint32
+		}{
+			{1, 10, 1e9, 0}, {2, 11, 2e9, 1}, {1, 10, 3e9, 1}, {1, 12, 5e9, 2},
+		} {
+			tf.record(RecordTypeSample, 0, s.id, 1, s.tid, s.time, s.cpu, uint32(0))
+		}
+
+		f := tf.open(t)
+		sum, err := f.Summary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantCPUs := 3
+		if nrCPUs {
+			wantCPUs = 4
+		}
+		if sum.Start != 1e9 || sum.End != 5e9 || sum.Duration != 4*time.Second ||
+			sum.Samples != 4 || sum.CPUs != wantCPUs || sum.Threads != 3 {
+			t.Errorf("got %+v", sum)
+		}
+		for i, want := range []float64{0.75, 0.25, 0} {
+			ev := f.Events[i]
+			if sum.SampleRate[ev] != want {
+				t.Errorf("event %d: got %v samples/sec, want %v", i, sum.SampleRate[ev], want)
+			}
+		}
+		if _, ok := sum.EventSamples[f.Events[2]]; !ok {
+			t.Errorf("missing idle event in EventSamples")
+		}
+	}
+}
+
+func TestDSOs(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{})
+	for _, m := range []struct {
+		pid  int
+		name string
+	}{
+		{-1, "[kernel.kallsyms]_text"},
+		{-1, "[nvme]"},
+		{1, "/bin/true"},
+		{1, "/lib/libc.so.6"},
+		{1, "//anon"},
+		{1, "[stack]"},
+		{1, "[vdso]"},
+		{2, "/lib/libc.so.6"},
+		{2, "/memfd:jit (deleted)"},
+	} {
+		tf.record(RecordTypeMmap, 0, m.pid, m.pid, uint64(0x1000), uint64(0x1000), uint64(0), m.name)
+	}
+	f := tf.open(t)
+
+	for _, test := range []struct {
+		pseudo bool
+		want   []string
+	}{
+		{false, []string{"/bin/true", "/lib/libc.so.6", "[kernel.kallsyms]_text", "[nvme]"}},
+		{true, []string{"//anon", "/bin/true", "/lib/libc.so.6", "/memfd:jit (deleted)", "[kernel.kallsyms]_text", "[nvme]", "[stack]", "[vdso]"}},
+	} {
+		got, err := f.DSOs(test.pseudo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("DSOs(%v) = %q, want %q", test.pseudo, got, test.want)
+		}
+	}
+}
+
+func TestSamplesPerCPU(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatCPU,
+	}})
+	tf.addFeature(FeatureNrCpus, encodeFields(uint32(8), uint32(4)))
+	lenString := func(s string) []byte {
+		b := encodeFields(s)
+		return append(encodeFields(uint32(len(b))), b...)
+	}
+	var topo []byte
+	topo = append(topo, encodeFields(uint32(2))...)
+	topo = append(topo, lenString("0-1")...)
+	topo = append(topo, lenString("2-3")...)
+	topo = append(topo, encodeFields(uint32(0))...)
+	tf.addFeature(FeatureCPUTopology, topo)
+	for _, cpu := range []uint32{0, 1, 1, 3, 5, 100} {
+		tf.record(RecordTypeSample, 0, cpu, uint32(0))
+	}
+	f := tf.open(t)
+	if f.Meta.CPUsAvail != 8 || f.Meta.CPUsOnline != 4 {
+		t.Errorf("got %d available and %d online CPUs, want 8 and 4", f.Meta.CPUsAvail, f.Meta.CPUsOnline)
+	}
+
+	got, err := f.SamplesPerCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CPUSamples{
+		CPUs:    map[int]uint64{0: 1, 1: 2, 3: 1, 5: 1},
+		Sockets: map[int]uint64{0: 3, 1: 1},
+		Invalid: map[int]uint64{100: 1},
+		Offline: map[int]uint64{5: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestIPC(t *testing.T) {
+	// A system-wide recording with a cycles and instructions
+	// counter on each of two CPUs. IDs 1 and 2 are on CPU 0, and
+	// IDs 3 and 4 are on CPU 1. The samples identify their
+	// counter either by the ID field or by the Identifier.
+	for _, idFormat := range []SampleFormat{SampleFormatID, SampleFormatIdentifier} {
+		tf := &testFile{}
+		for ev := uint64(0); ev < 2; ev++ {
+			tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+				Type:         EventTypeHardware,
+				Config:       ev, // cycles, then instructions
+				SampleFormat: SampleFormatIP | SampleFormatTID | idFormat | SampleFormatCPU | SampleFormatRead,
+				ReadFormat:   ReadFormatGroup | ReadFormatID | ReadFormatTotalTimeEnabled | ReadFormatTotalTimeRunning,
+			}}, 1+ev, 3+ev)
+		}
+		sample := func(cpu, tid int, enabled, running, cycles, insns uint64) {
+			id := uint64(1 + 2*cpu)
+			read := []interface{}{uint64(2), enabled, running, cycles, id, insns, id + 1}
+			if idFormat == SampleFormatID {
+				tf.record(RecordTypeSample, 0, append([]interface{}{uint64(0x1000), tid, tid, id, cpu, 0}, read...)...)
+			} else {
+				tf.record(RecordTypeSample, 0, append([]interface{}{id, uint64(0x1000), tid, tid, cpu, 0}, read...)...)
+			}
+		}
+		// Two threads run on CPU 0. Both of their samples read
+		// the same counters.
+		sample(0, 10, 1000, 1000, 100, 150)
+		sample(0, 11, 1500, 1500, 150, 250)
+		sample(0, 10, 2000, 2000, 300, 450)
+		// CPU 1's counters run half the time, so are scaled by 2.
+		sample(1, 12, 1000, 500, 100, 100)
+		sample(1, 12, 2000, 1000, 200, 300)
+
+		got, err := tf.open(t).IPC()
+		if err != nil {
+			t.Fatalf("%v: %v", idFormat, err)
+		}
+		if want := (300.0 + 400.0) / (200.0 + 200.0); got != want {
+			t.Errorf("%v: got IPC %v, want %v", idFormat, got, want)
+		}
+	}
+
+	// Without an instructions event, IPC fails.
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{Type: EventTypeHardware}})
+	tf.record(RecordTypeSample, 0)
+	if _, err := tf.open(t).IPC(); err == nil {
+		t.Errorf("want error without instructions event")
+	}
+}
+
+func TestCollectSamples(t *testing.T) {
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIP | SampleFormatTime | SampleFormatID | SampleFormatCallchain,
+		}}, id)
+	}
+	tf.record(RecordTypeSample, 0, uint64(0x100), uint64(20), uint64(1), uint64(1), uint64(0x100))
+	tf.record(RecordTypeSample, 0, uint64(0x200), uint64(10), uint64(1), uint64(1), uint64(0x200))
+	tf.record(RecordTypeSample, 0, uint64(0x300), uint64(30), uint64(2), uint64(1), uint64(0x300))
+	tf.record(RecordTypeSample, 0, uint64(0x400), uint64(40), uint64(1), uint64(1), uint64(0x400))
+	f := tf.open(t)
+
+	for _, test := range []struct {
+		max  int
+		want []uint64
+	}{
+		{-1, []uint64{0x200, 0x100, 0x400}},
+		{2, []uint64{0x200, 0x100}},
+		{0, nil},
+	} {
+		samples, err := f.CollectSamples(f.Events[0], test.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []uint64
+		for _, s := range samples {
+			if len(s.Callchain) != 1 || s.Callchain[0] != s.IP {
+				t.Errorf("max %d: sample at %#x has callchain %#x", test.max, s.IP, s.Callchain)
+			}
+			ips = append(ips, s.IP)
+		}
+		if !reflect.DeepEqual(ips, test.want) {
+			t.Errorf("max %d: got IPs %#x, want %#x", test.max, ips, test.want)
+		}
+	}
+}
+
+func TestPeriodStats(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat:       SampleFormatID | SampleFormatPeriod,
+		SamplePeriodOrFreq: 4000,
+		Flags:              EventFlagFreq,
+	}}, 1)
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatID,
+	}}, 2)
+	for _, period := range []uint64{1000, 50, 200000, 950} {
+		tf.record(RecordTypeSample, 0, uint64(1), period)
+	}
+	tf.record(RecordTypeSample, 0, uint64(2))
+	f := tf.open(t)
+
+	min, max, mean, err := f.PeriodStats(f.Events[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min != 50 || max != 200000 || mean != 50500 {
+		t.Errorf("got min %d, max %d, mean %d; want 50, 200000, 50500", min, max, mean)
+	}
+	if _, _, _, err := f.PeriodStats(f.Events[1]); err == nil {
+		t.Errorf("want error for event without periods")
+	}
+}
+
+// testMapBuilder is a minimal MapBuilder that tracks mmaps and forks.
+type testMapBuilder map[int][]RecordMmap
+
+func (mb testMapBuilder) Update(r Record) {
+	switch r := r.(type) {
+	case *RecordMmap:
+		mb[r.PID] = append(mb[r.PID], *r)
+	case *RecordFork:
+		if r.PID == r.TID {
+			mb[r.PID] = append([]RecordMmap(nil), mb[r.PPID]...)
+		}
+	}
+}
+
+func (mb testMapBuilder) MappedFile(pid int, ip uint64) (string, bool) {
+	for _, m := range mb[pid] {
+		if m.Addr <= ip && ip-m.Addr < m.Len {
+			return m.Filename, true
+		}
+	}
+	return "", false
+}
+
+func TestSamplesPerDSO(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}})
+	sample := func(pid int, ip uint64) {
+		tf.record(RecordTypeSample, 0, ip, pid, pid)
+	}
+	tf.record(RecordTypeMmap, 0, 1, 1, uint64(0x400000), uint64(0x1000), uint64(0), "/bin/a")
+	sample(1, 0x400010)
+	sample(1, 0x10)
+	tf.record(RecordTypeFork, 0, 2, 1, 2, 1, uint64(0))
+	tf.record(RecordTypeMmap, 0, 2, 2, uint64(0x7f0000000000), uint64(0x1000), uint64(0), "/lib/libc.so.6")
+	sample(2, 0x400020)
+	sample(2, 0x7f0000000010)
+	sample(1, 0x7f0000000010)
+
+	got, err := tf.open(t).SamplesPerDSO(make(testMapBuilder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{
+		"/bin/a":         2,
+		"/lib/libc.so.6": 1,
+		UnknownDSO:       2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
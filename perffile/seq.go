@@ -0,0 +1,43 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package perffile
+
+import "iter"
+
+// Seq returns an iterator over the records in f in file order, for
+// use with range:
+//
+//	for rec, err := range f.Seq() {
+//		if err != nil { ... }
+//		...
+//	}
+//
+// Like Records.Next, the iterator reuses records, so a record is only
+// valid until the next iteration. Callers that retain records must
+// copy them with CopyRecord. If reading fails, the final iteration
+// yields a nil record and the error.
+//
+// To iterate in another order or with filters, use Records.Seq.
+func (f *File) Seq() iter.Seq2[Record, error] {
+	return f.Records(RecordsFileOrder).Seq()
+}
+
+// Seq returns an iterator over the remaining records in r. It is
+// equivalent to calling Next until it returns false; see File.Seq.
+func (r *Records) Seq() iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		for r.Next() {
+			if !yield(r.Record, nil) {
+				return
+			}
+		}
+		if err := r.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
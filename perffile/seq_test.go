@@ -0,0 +1,57 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package perffile
+
+import "testing"
+
+func TestSeq(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP,
+	}})
+	for ip := uint64(1); ip <= 3; ip++ {
+		tf.record(RecordTypeSample, 0, ip)
+	}
+	f := tf.open(t)
+
+	var ips []uint64
+	for rec, err := range f.Seq() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, rec.(*RecordSample).IP)
+	}
+	if len(ips) != 3 || ips[0] != 1 || ips[2] != 3 {
+		t.Errorf("got IPs %v, want [1 2 3]", ips)
+	}
+
+	// Breaking out of the loop stops the iteration.
+	n := 0
+	for range f.Seq() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("got %d iterations, want 1", n)
+	}
+
+	// Errors are yielded at the end.
+	tf.data.Write([]byte{1, 0, 0, 0, 0, 0, 4, 0})
+	var errs int
+	for rec, err := range tf.open(t).Seq() {
+		if err != nil {
+			if rec != nil {
+				t.Errorf("got record %v with error", rec)
+			}
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("got %d errors, want 1", errs)
+	}
+}
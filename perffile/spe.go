@@ -0,0 +1,392 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// An SPEDecoder is an iterator over the packets in an ARM Statistical
+// Profiling Extension (SPE) trace. SPE traces are recorded in the AUX
+// area rather than as RecordSamples. Each SPE sample is a sequence of
+// packets, typically terminated by an SPEPacketEnd or
+// SPEPacketTimestamp packet.
+//
+// Typical usage is
+//
+//	d := perffile.NewSPEDecoder(auxData)
+//	for d.Next() {
+//	  switch p := d.Packet.(type) {
+//	  case *perffile.SPEPacketAddress:
+//	    ...
+//	  }
+//	}
+//	if d.Err() { ... }
+//
+// See tools/perf/util/arm-spe-decoder/arm-spe-pkt-decoder.c.
+type SPEDecoder struct {
+	// The current packet. The concrete type of this will be one
+	// of the SPEPacket* types.
+	Packet SPEPacket
+
+	// Offset is the byte offset of Packet in the trace.
+	Offset int
+
+	data []byte
+	off  int
+	err  error
+}
+
+// NewSPEDecoder returns a decoder for the SPE trace in data.
+func NewSPEDecoder(data []byte) *SPEDecoder {
+	return &SPEDecoder{data: data}
+}
+
+// Err returns the first error encountered by the SPEDecoder.
+func (d *SPEDecoder) Err() error {
+	return d.err
+}
+
+// Next decodes the next packet into d.Packet. It returns true if
+// successful, and false if it reaches the end of the trace or
+// encounters an error. Padding packets are skipped.
+func (d *SPEDecoder) Next() bool {
+	for d.err == nil && d.off < len(d.data) {
+		d.Offset = d.off
+		n, p := d.decode(d.data[d.off:])
+		if d.err != nil {
+			return false
+		}
+		d.off += n
+		if p != nil {
+			d.Packet = p
+			return true
+		}
+	}
+	return false
+}
+
+// SPE packet headers from arm-spe-pkt-decoder.h.
+const (
+	speHeader0Pad       = 0x00
+	speHeader0End       = 0x01
+	speHeader0Timestamp = 0x71
+	speHeader0Mask1     = 0xcf
+	speHeader0Events    = 0x42
+	speHeader0Source    = 0x43
+	speHeader0Mask2     = 0xfc
+	speHeader0Context   = 0x64
+	speHeader0OpType    = 0x48
+	speHeader0Extended  = 0x20
+	speHeader0Mask3     = 0xf8
+	speHeader0Address   = 0xb0
+	speHeader0Counter   = 0x98
+	speHeader1Alignment = 0x00
+)
+
+// decode decodes the packet at the beginning of buf. It returns the
+// length of the packet and the decoded packet, or nil if this is a
+// padding packet.
+func (d *SPEDecoder) decode(buf []byte) (int, SPEPacket) {
+	hdr := buf[0]
+	switch {
+	case hdr == speHeader0Pad:
+		return 1, nil
+	case hdr == speHeader0End:
+		return 1, &SPEPacketEnd{}
+	case hdr == speHeader0Timestamp:
+		n, x := d.payload(buf, 0)
+		return n, &SPEPacketTimestamp{Timestamp: x}
+	case hdr&speHeader0Mask1 == speHeader0Events:
+		n, x := d.payload(buf, 0)
+		return n, &SPEPacketEvents{Events: SPEEvents(x)}
+	case hdr&speHeader0Mask1 == speHeader0Source:
+		n, x := d.payload(buf, 0)
+		return n, &SPEPacketDataSource{Source: x}
+	case hdr&speHeader0Mask2 == speHeader0Context:
+		n, x := d.payload(buf, 0)
+		return n, &SPEPacketContext{EL2: hdr&0x3 != 0, ID: uint32(x)}
+	case hdr&speHeader0Mask2 == speHeader0OpType:
+		n, x := d.payload(buf, 0)
+		return n, &SPEPacketOp{Class: SPEOpClass(hdr & 0x3), Subclass: uint8(x)}
+	}
+
+	// Address and counter packets may have a 16-bit extended
+	// header, which extends the packet index.
+	ext, index := 0, int(hdr&0x7)
+	if hdr&speHeader0Mask2 == speHeader0Extended {
+		if len(buf) < 2 {
+			d.err = fmt.Errorf("truncated SPE packet at offset %d", d.off)
+			return 0, nil
+		}
+		ext, hdr = 1, buf[1]
+		if hdr == speHeader1Alignment {
+			align := 1 << ((buf[0] & 0xf) + 1)
+			return align - d.off&(align-1), nil
+		}
+		index = int(buf[0]&0x3)<<3 | int(hdr&0x7)
+	}
+	switch hdr & speHeader0Mask3 {
+	case speHeader0Address:
+		n, x := d.payload(buf, ext)
+		return n, decodeSPEAddress(SPEAddressIndex(index), x)
+	case speHeader0Counter:
+		n, x := d.payload(buf, ext)
+		return n, &SPEPacketCounter{Index: SPECounterIndex(index), Count: uint16(x)}
+	}
+	d.err = fmt.Errorf("bad SPE packet header %#x at offset %d", buf[0], d.off)
+	return 0, nil
+}
+
+// payload decodes the payload of the packet at the beginning of buf,
+// where ext is the number of extended header bytes. It returns the
+// total length of the packet and the payload value.
+func (d *SPEDecoder) payload(buf []byte, ext int) (int, uint64) {
+	size := 1 << ((buf[ext] & 0x30) >> 4)
+	n := 1 + ext + size
+	if len(buf) < n {
+		d.err = fmt.Errorf("truncated SPE packet at offset %d", d.off)
+		return 0, 0
+	}
+	p := buf[1+ext : n]
+	switch size {
+	case 1:
+		return n, uint64(p[0])
+	case 2:
+		return n, uint64(binary.LittleEndian.Uint16(p))
+	case 4:
+		return n, uint64(binary.LittleEndian.Uint32(p))
+	}
+	return n, binary.LittleEndian.Uint64(p)
+}
+
+func decodeSPEAddress(index SPEAddressIndex, x uint64) *SPEPacketAddress {
+	const low56 = 1<<56 - 1
+	o := &SPEPacketAddress{Index: index}
+	switch index {
+	case SPEAddressInstruction, SPEAddressBranchTarget, SPEAddressPrevBranchTarget:
+		o.NS = x>>63 != 0
+		o.EL = uint8(x>>61) & 0x3
+		o.Addr = x & low56
+		// Kernel addresses have the top byte set.
+		if o.NS && (o.EL == 1 || o.EL == 2) {
+			o.Addr |= 0xff << 56
+		}
+	case SPEAddressDataVirtual:
+		// The top byte holds the tag. Kernel addresses have
+		// bits 55:52 set, so fill in the top byte.
+		o.Tag = uint8(x >> 56)
+		o.Addr = x & low56
+		if (x>>52)&0xf == 0xf {
+			o.Addr |= 0xff << 56
+		}
+	case SPEAddressDataPhysical:
+		o.NS = x>>63 != 0
+		o.CH = (x>>62)&1 != 0
+		o.PAT = uint8(x>>56) & 0xf
+		o.Addr = x & low56
+	default:
+		o.Addr = x
+	}
+	return o
+}
+
+// An SPEPacket is a single packet in an SPE trace. Each packet will
+// be one of the SPEPacket* types.
+type SPEPacket interface {
+	Type() SPEPacketType
+}
+
+// An SPEPacketType indicates the type of a packet in an SPE trace.
+type SPEPacketType int
+
+//go:generate stringer -type=SPEPacketType
+
+const (
+	SPEPacketTypeEnd SPEPacketType = iota
+	SPEPacketTypeTimestamp
+	SPEPacketTypeEvents
+	SPEPacketTypeDataSource
+	SPEPacketTypeContext
+	SPEPacketTypeOp
+	SPEPacketTypeAddress
+	SPEPacketTypeCounter
+)
+
+// An SPEPacketEnd marks the end of an SPE sample that has no
+// timestamp.
+type SPEPacketEnd struct{}
+
+func (p *SPEPacketEnd) Type() SPEPacketType {
+	return SPEPacketTypeEnd
+}
+
+// An SPEPacketTimestamp gives the time of an SPE sample. It also
+// marks the end of the sample.
+type SPEPacketTimestamp struct {
+	// Timestamp is the value of the generic timer when this
+	// sample was recorded.
+	Timestamp uint64
+}
+
+func (p *SPEPacketTimestamp) Type() SPEPacketType {
+	return SPEPacketTypeTimestamp
+}
+
+// An SPEPacketEvents gives the events that occurred for a sampled
+// operation.
+type SPEPacketEvents struct {
+	Events SPEEvents
+}
+
+func (p *SPEPacketEvents) Type() SPEPacketType {
+	return SPEPacketTypeEvents
+}
+
+// SPEEvents is a bitmask of the events recorded for a sampled
+// operation.
+type SPEEvents uint64
+
+//go:generate go run ../cmd/bitstringer/main.go -type=SPEEvents -strip=SPEEvent
+
+const (
+	SPEEventExceptionGen SPEEvents = 1 << iota
+	SPEEventRetired
+	SPEEventL1DAccess
+	SPEEventL1DRefill
+	SPEEventTLBAccess
+	SPEEventTLBWalk
+	SPEEventNotTaken
+	SPEEventMispredicted
+	SPEEventLLCAccess
+	SPEEventLLCMiss
+	SPEEventRemoteAccess
+	SPEEventMisaligned
+
+	SPEEventPartialPredicate SPEEvents = 1 << 17
+	SPEEventEmptyPredicate   SPEEvents = 1 << 18
+)
+
+// An SPEPacketDataSource gives the source of the data for a sampled
+// load operation. The encoding of Source is implementation defined.
+type SPEPacketDataSource struct {
+	Source uint64
+}
+
+func (p *SPEPacketDataSource) Type() SPEPacketType {
+	return SPEPacketTypeDataSource
+}
+
+// An SPEPacketContext gives the value of a CONTEXTIDR register at
+// the time of a sampled operation. On Linux, this is typically the
+// PID of the running process.
+type SPEPacketContext struct {
+	// EL2 indicates ID is from CONTEXTIDR_EL2 rather than
+	// CONTEXTIDR_EL1.
+	EL2 bool
+	ID  uint32
+}
+
+func (p *SPEPacketContext) Type() SPEPacketType {
+	return SPEPacketTypeContext
+}
+
+// An SPEPacketOp gives the type of a sampled operation.
+type SPEPacketOp struct {
+	Class SPEOpClass
+
+	// Subclass gives Class-specific details of the operation.
+	// For example, for SPEOpClassLoadStore, bit 0 indicates a
+	// store.
+	Subclass uint8
+}
+
+func (p *SPEPacketOp) Type() SPEPacketType {
+	return SPEPacketTypeOp
+}
+
+// An SPEOpClass is the general class of a sampled operation.
+type SPEOpClass uint8
+
+//go:generate stringer -type=SPEOpClass
+
+const (
+	SPEOpClassOther SPEOpClass = iota
+	SPEOpClassLoadStore
+	SPEOpClassBranch
+)
+
+// An SPEPacketAddress gives an address associated with a sampled
+// operation.
+type SPEPacketAddress struct {
+	Index SPEAddressIndex
+
+	// Addr is the address. For virtual addresses, this has been
+	// sign-extended as necessary to form a canonical address.
+	Addr uint64
+
+	// NS indicates the address is in the non-secure state. This
+	// is only valid for instruction and physical addresses.
+	NS bool
+
+	// EL is the exception level of an instruction address.
+	EL uint8
+
+	// Tag is the top byte of a virtual data address.
+	Tag uint8
+
+	// CH and PAT are the checked bit and physical address tag of
+	// a physical data address.
+	CH  bool
+	PAT uint8
+}
+
+func (p *SPEPacketAddress) Type() SPEPacketType {
+	return SPEPacketTypeAddress
+}
+
+// An SPEAddressIndex indicates the meaning of an SPEPacketAddress.
+type SPEAddressIndex int
+
+//go:generate stringer -type=SPEAddressIndex
+
+const (
+	SPEAddressInstruction SPEAddressIndex = iota
+	SPEAddressBranchTarget
+	SPEAddressDataVirtual
+	SPEAddressDataPhysical
+	SPEAddressPrevBranchTarget
+)
+
+// An SPEPacketCounter gives a cycle count associated with a sampled
+// operation.
+type SPEPacketCounter struct {
+	Index SPECounterIndex
+	Count uint16
+}
+
+func (p *SPEPacketCounter) Type() SPEPacketType {
+	return SPEPacketTypeCounter
+}
+
+// An SPECounterIndex indicates the meaning of an SPEPacketCounter.
+type SPECounterIndex int
+
+//go:generate stringer -type=SPECounterIndex
+
+const (
+	// SPECounterTotalLatency is the number of cycles from
+	// dispatch to completion of the operation.
+	SPECounterTotalLatency SPECounterIndex = iota
+
+	// SPECounterIssueLatency is the number of cycles from
+	// dispatch to issue of the operation.
+	SPECounterIssueLatency
+
+	// SPECounterTranslationLatency is the number of cycles spent
+	// in address translation for the operation.
+	SPECounterTranslationLatency
+)
@@ -0,0 +1,81 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSPEDecoder(t *testing.T) {
+	data := []byte{
+		// Instruction address, EL1, NS.
+		0xb0, 0x00, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0xa0,
+		// Padding.
+		0x00,
+		// Issue latency counter.
+		0x99, 0x2a, 0x00,
+		// Events: retired, L1D access.
+		0x52, 0x06, 0x00,
+		// Load operation.
+		0x49, 0x00,
+		// Extended physical data address.
+		0x20, 0xb3, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80,
+		// Timestamp.
+		0x71, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	want := []SPEPacket{
+		&SPEPacketAddress{Index: SPEAddressInstruction, Addr: 0xff60504030201000, NS: true, EL: 1},
+		&SPEPacketCounter{Index: SPECounterIssueLatency, Count: 42},
+		&SPEPacketEvents{Events: SPEEventRetired | SPEEventL1DAccess},
+		&SPEPacketOp{Class: SPEOpClassLoadStore},
+		&SPEPacketAddress{Index: SPEAddressDataPhysical, Addr: 0x1000, NS: true},
+		&SPEPacketTimestamp{Timestamp: 1},
+	}
+
+	d := NewSPEDecoder(data)
+	var got []SPEPacket
+	for d.Next() {
+		got = append(got, d.Packet)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	d = NewSPEDecoder([]byte{0xb0, 0x00})
+	if d.Next() || d.Err() == nil {
+		t.Errorf("want error for truncated packet")
+	}
+}
+
+func TestDecodeSPEAddress(t *testing.T) {
+	for _, test := range []struct {
+		index SPEAddressIndex
+		x     uint64
+		want  SPEPacketAddress
+	}{
+		// User and kernel instruction addresses.
+		{SPEAddressInstruction, 0x8000aaaab0001000, SPEPacketAddress{Addr: 0xaaaab0001000, NS: true}},
+		{SPEAddressInstruction, 0xa0ffc00008001000, SPEPacketAddress{Addr: 0xffffc00008001000, NS: true, EL: 1}},
+		{SPEAddressBranchTarget, 0xc0ffc00008001000, SPEPacketAddress{Addr: 0xffffc00008001000, NS: true, EL: 2}},
+		// Data virtual addresses, with and without tags.
+		{SPEAddressDataVirtual, 0x0000ffffe0001000, SPEPacketAddress{Addr: 0xffffe0001000}},
+		{SPEAddressDataVirtual, 0x2a00ffffe0001000, SPEPacketAddress{Addr: 0xffffe0001000, Tag: 0x2a}},
+		{SPEAddressDataVirtual, 0x00ffc00008001000, SPEPacketAddress{Addr: 0xffffc00008001000}},
+		{SPEAddressDataVirtual, 0xf4f0c00008001000, SPEPacketAddress{Addr: 0xfff0c00008001000, Tag: 0xf4}},
+		{SPEAddressDataVirtual, 0x00ef000000001000, SPEPacketAddress{Addr: 0x00ef000000001000}},
+		// Physical data addresses.
+		{SPEAddressDataPhysical, 0x8000000080001000, SPEPacketAddress{Addr: 0x80001000, NS: true}},
+		{SPEAddressDataPhysical, 0x4300000080001000, SPEPacketAddress{Addr: 0x80001000, CH: true, PAT: 3}},
+	} {
+		test.want.Index = test.index
+		if got := decodeSPEAddress(test.index, test.x); *got != test.want {
+			t.Errorf("decodeSPEAddress(%v, %#x) = %+v, want %+v", test.index, test.x, *got, test.want)
+		}
+	}
+}
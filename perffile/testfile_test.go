@@ -0,0 +1,147 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// A testFile builds a synthetic perf.data file for tests.
+type testFile struct {
+	attrs    []testAttr
+	data     bytes.Buffer
+	features map[FeatureID][]byte
+
+	// v1 indicates to write a version 1 file header without a
+	// feature bitmap, as written by perf before Linux 2.6.35.
+	v1 bool
+}
+
+type testAttr struct {
+	attr eventAttrVN
+	ids  []uint64
+}
+
+// addAttr adds an event to the file. If attr.Size is 0, it is set to
+// the size of the latest perf_event_attr version. Otherwise, the
+// encoded attr is truncated or zero-extended to attr.Size bytes. All
+// attrs in a file must have the same size.
+func (tf *testFile) addAttr(attr eventAttrVN, ids ...uint64) {
+	if attr.Size == 0 {
+		attr.Size = uint32(binary.Size(&attr))
+	}
+	tf.attrs = append(tf.attrs, testAttr{attr, ids})
+}
+
+// addFeature adds a feature section to the file.
+func (tf *testFile) addFeature(f FeatureID, data []byte) {
+	if tf.features == nil {
+		tf.features = make(map[FeatureID][]byte)
+	}
+	tf.features[f] = data
+}
+
+// record appends a record to the data section. Each field must be an
+// integer type, a []byte, or a string. Strings are written
+// NUL-terminated and padded to 8 bytes, like perf does.
+func (tf *testFile) record(typ RecordType, misc recordMisc, fields ...interface{}) {
+	body := encodeFields(fields...)
+	hdr := recordHeader{typ, misc, uint16(8 + len(body))}
+	binary.Write(&tf.data, binary.LittleEndian, &hdr)
+	tf.data.Write(body)
+}
+
+func encodeFields(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			b := make([]byte, (len(f)+8)&^7)
+			copy(b, f)
+			buf.Write(b)
+		case int:
+			binary.Write(&buf, binary.LittleEndian, int32(f))
+		default:
+			if err := binary.Write(&buf, binary.LittleEndian, f); err != nil {
+				panic(fmt.Sprintf("bad field %#v: %v", f, err))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// bytes returns the encoded perf.data file.
+func (tf *testFile) bytes() []byte {
+	var hdr fileHeader
+	copy(hdr.Magic[:], "PERFILE2")
+	hdr.Size = uint64(binary.Size(&hdr))
+	if tf.v1 {
+		copy(hdr.Magic[:], "PERFFILE")
+		hdr.Size -= numFeatureBits / 8
+	}
+	hdr.AttrSize = uint64(tf.attrs[0].attr.Size) + uint64(binary.Size(fileSection{}))
+
+	// Lay out the attrs, their IDs, and the data section.
+	off := hdr.Size
+	if tf.v1 && len(tf.features) > 0 {
+		panic("v1 files cannot have features")
+	}
+	hdr.Attrs = fileSection{off, hdr.AttrSize * uint64(len(tf.attrs))}
+	off += hdr.Attrs.Size
+	idSecs := make([]fileSection, len(tf.attrs))
+	for i, a := range tf.attrs {
+		idSecs[i] = fileSection{off, uint64(8 * len(a.ids))}
+		off += idSecs[i].Size
+	}
+	hdr.Data = fileSection{off, uint64(tf.data.Len())}
+	off += hdr.Data.Size
+
+	// Feature sections follow the data section.
+	var fsecs []fileSection
+	var fdata [][]byte
+	for f := FeatureID(0); f < numFeatureBits; f++ {
+		if data, ok := tf.features[f]; ok {
+			hdr.Features[f/64] |= 1 << (uint(f) % 64)
+			fsecs = append(fsecs, fileSection{Size: uint64(len(data))})
+			fdata = append(fdata, data)
+		}
+	}
+	off += uint64(len(fsecs) * binary.Size(fileSection{}))
+	for i := range fsecs {
+		fsecs[i].Offset = off
+		off += fsecs[i].Size
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &hdr)
+	buf.Truncate(int(hdr.Size))
+	for i, a := range tf.attrs {
+		attr := encodeFields(&a.attr)
+		attr = append(attr, make([]byte, int(a.attr.Size))...)[:a.attr.Size]
+		buf.Write(attr)
+		binary.Write(&buf, binary.LittleEndian, &idSecs[i])
+	}
+	for _, a := range tf.attrs {
+		binary.Write(&buf, binary.LittleEndian, a.ids)
+	}
+	buf.Write(tf.data.Bytes())
+	binary.Write(&buf, binary.LittleEndian, fsecs)
+	for _, data := range fdata {
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// open parses the encoded file.
+func (tf *testFile) open(t testing.TB) *File {
+	f, err := New(bytes.NewReader(tf.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
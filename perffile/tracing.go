@@ -0,0 +1,280 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A TracepointFormat describes the layout of the raw data recorded by
+// a tracepoint event, as reported by the kernel in
+// /sys/kernel/tracing/events/<system>/<name>/format.
+type TracepointFormat struct {
+	// System and Name identify the tracepoint, such as "sched"
+	// and "sched_switch".
+	System, Name string
+
+	// ID is the tracepoint's ID, which is also the Config[0] of
+	// its EventAttr.
+	ID uint64
+
+	// Fields are the fields of the tracepoint's raw data, in
+	// order. These include the "common_" fields shared by all
+	// tracepoints.
+	Fields []TracepointField
+
+	order binary.ByteOrder
+}
+
+// A TracepointField describes a single field of a tracepoint.
+type TracepointField struct {
+	// Name is the name of the field, such as "prev_pid".
+	Name string
+
+	// Type is the C type of the field, such as "pid_t" or
+	// "char[16]".
+	Type string
+
+	// Offset and Size are the byte offset and size of the field
+	// in the raw data.
+	Offset, Size int
+
+	// Signed indicates that the field is a signed integer.
+	Signed bool
+
+	// DataLoc indicates that the field is a "__data_loc" or
+	// "__rel_loc" reference to dynamically sized data, such as a
+	// string, stored after the fixed fields. The field itself is
+	// a 32-bit word giving the data's offset in the low 16 bits
+	// and its length in the high 16 bits. For __rel_loc fields,
+	// the offset is relative to the end of the field. String
+	// returns the referenced data.
+	DataLoc bool
+}
+
+// Tracepoint returns the format of the raw data of tracepoint event
+// attr, or nil if attr is not a tracepoint event or f does not record
+// its format.
+func (f *File) Tracepoint(attr *EventAttr) *TracepointFormat {
+	if attr.Type != EventTypeTracepoint {
+		return nil
+	}
+	return f.Meta.Tracepoints[attr.Config[0]]
+}
+
+// Field returns the field of t named name, or nil if there is no such
+// field.
+func (t *TracepointFormat) Field(name string) *TracepointField {
+	for i := range t.Fields {
+		if t.Fields[i].Name == name {
+			return &t.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Int returns the value of integer field name in raw, the raw data of
+// a sample of this tracepoint. Signed fields are sign-extended.
+func (t *TracepointFormat) Int(raw []byte, name string) (int64, error) {
+	f, data, err := t.fieldData(raw, name)
+	if err != nil {
+		return 0, err
+	}
+	if f.DataLoc {
+		return 0, fmt.Errorf("tracepoint field %s is not an integer", name)
+	}
+	switch f.Size {
+	case 1:
+		if f.Signed {
+			return int64(int8(data[0])), nil
+		}
+		return int64(data[0]), nil
+	case 2:
+		if f.Signed {
+			return int64(int16(t.order.Uint16(data))), nil
+		}
+		return int64(t.order.Uint16(data)), nil
+	case 4:
+		if f.Signed {
+			return int64(int32(t.order.Uint32(data))), nil
+		}
+		return int64(t.order.Uint32(data)), nil
+	case 8:
+		return int64(t.order.Uint64(data)), nil
+	}
+	return 0, fmt.Errorf("tracepoint field %s has non-integer size %d", name, f.Size)
+}
+
+// String returns the value of the NUL-terminated string field name,
+// such as a "char[16]" or "__data_loc char[]" field, in raw, the raw
+// data of a sample of this tracepoint.
+func (t *TracepointFormat) String(raw []byte, name string) (string, error) {
+	_, data, err := t.fieldData(raw, name)
+	if err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data), nil
+}
+
+func (t *TracepointFormat) fieldData(raw []byte, name string) (*TracepointField, []byte, error) {
+	f := t.Field(name)
+	if f == nil {
+		return nil, nil, fmt.Errorf("tracepoint %s:%s has no field %s", t.System, t.Name, name)
+	}
+	if f.Offset < 0 || f.Offset+f.Size > len(raw) {
+		return nil, nil, fmt.Errorf("tracepoint %s:%s data is too short for field %s", t.System, t.Name, name)
+	}
+	data := raw[f.Offset : f.Offset+f.Size]
+	if !f.DataLoc {
+		return f, data, nil
+	}
+	if f.Size != 4 {
+		return nil, nil, fmt.Errorf("tracepoint %s:%s field %s has bad data location size %d", t.System, t.Name, name, f.Size)
+	}
+	// See __get_dynamic_array and __get_rel_dynamic_array in
+	// include/trace/stages/stage5_get_offsets.h.
+	loc := t.order.Uint32(data)
+	off, l := int(loc&0xffff), int(loc>>16)
+	if strings.HasPrefix(f.Type, "__rel_loc") {
+		off += f.Offset + f.Size
+	}
+	if off+l > len(raw) {
+		return nil, nil, fmt.Errorf("tracepoint %s:%s data is too short for field %s", t.System, t.Name, name)
+	}
+	return f, raw[off : off+l], nil
+}
+
+func (m *FileMeta) parseTracingData(bd bufDecoder) error {
+	// See read_tracing_data in tools/perf/util/trace-event-read.c.
+	magic := make([]byte, 10)
+	bd.bytes(magic)
+	if string(magic) != "\x17\x08\x44tracing" {
+		return fmt.Errorf("bad tracing data magic %q", magic)
+	}
+	bd.cstring() // Version
+	if bd.u8() != 0 {
+		bd.order = binary.BigEndian
+	}
+	bd.u8()  // Size of long
+	bd.u32() // Page size
+
+	// Skip the ring buffer header formats.
+	for _, name := range []string{"header_page", "header_event"} {
+		if got := bd.cstring(); got != name {
+			return fmt.Errorf("bad tracing data: want %s, got %q", name, got)
+		}
+		bd.skip(int(bd.u64()))
+	}
+
+	// Skip the ftrace event formats.
+	for n := bd.u32(); n > 0 && !bd.overflow; n-- {
+		bd.skip(int(bd.u64()))
+	}
+
+	// Parse the event formats.
+	m.Tracepoints = make(map[uint64]*TracepointFormat)
+	for n := bd.u32(); n > 0 && !bd.overflow; n-- {
+		system := bd.cstring()
+		for n := bd.u32(); n > 0 && !bd.overflow; n-- {
+			size := bd.u64()
+			if size > uint64(len(bd.buf)) {
+				bd.fail()
+				break
+			}
+			t, err := parseTracepointFormat(string(bd.buf[:size]))
+			if err != nil {
+				return err
+			}
+			bd.skip(int(size))
+			t.System, t.order = system, bd.order
+			m.Tracepoints[t.ID] = t
+		}
+	}
+	if bd.overflow {
+		return fmt.Errorf("tracing data is truncated")
+	}
+	// The remaining kallsyms and printk formats are not needed.
+	return nil
+}
+
+// parseTracepointFormat parses the text format of a tracepoint, which
+// looks like
+//
+//	name: sched_switch
+//	ID: 316
+//	format:
+//		field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+//		...
+//
+//	print fmt: ...
+func parseTracepointFormat(text string) (*TracepointFormat, error) {
+	t := new(TracepointFormat)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			t.Name = strings.TrimSpace(line[len("name:"):])
+
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.ParseUint(strings.TrimSpace(line[len("ID:"):]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad tracepoint ID: %v", err)
+			}
+			t.ID = id
+
+		case strings.HasPrefix(line, "field:"):
+			var f TracepointField
+			for _, part := range strings.Split(line, ";") {
+				part = strings.TrimSpace(part)
+				i := strings.Index(part, ":")
+				if i < 0 {
+					continue
+				}
+				key, val := part[:i], part[i+1:]
+				var err error
+				switch key {
+				case "field":
+					f.Name, f.Type = splitFieldDecl(val)
+					f.DataLoc = strings.HasPrefix(f.Type, "__data_loc ") || strings.HasPrefix(f.Type, "__rel_loc ")
+				case "offset":
+					f.Offset, err = strconv.Atoi(val)
+				case "size":
+					f.Size, err = strconv.Atoi(val)
+				case "signed":
+					f.Signed = val == "1"
+				}
+				if err != nil {
+					return nil, fmt.Errorf("bad tracepoint field %q: %v", line, err)
+				}
+			}
+			t.Fields = append(t.Fields, f)
+		}
+	}
+	if t.Name == "" {
+		return nil, fmt.Errorf("tracepoint format has no name")
+	}
+	return t, nil
+}
+
+// splitFieldDecl splits a C field declaration like "char prev_comm[16]"
+// into its name, "prev_comm", and type, "char[16]". Dynamic arrays
+// are declared with the brackets before the name, as in
+// "__data_loc char[] filename", whose type is "__data_loc char[]".
+func splitFieldDecl(decl string) (name, typ string) {
+	decl = strings.TrimSpace(decl)
+	var array string
+	if i := strings.Index(decl, "["); i >= 0 && strings.HasSuffix(decl, "]") {
+		decl, array = strings.TrimSpace(decl[:i]), decl[i:]
+	}
+	i := strings.LastIndexAny(decl, " *")
+	return decl[i+1:], strings.TrimSpace(decl[:i+1]) + array
+}
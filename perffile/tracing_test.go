@@ -0,0 +1,211 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+const schedSwitchFormat = `name: sched_switch
+ID: 316
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:char prev_comm[16];	offset:8;	size:16;	signed:0;
+	field:pid_t prev_pid;	offset:24;	size:4;	signed:1;
+	field:int prev_prio;	offset:28;	size:4;	signed:1;
+	field:long prev_state;	offset:32;	size:8;	signed:1;
+	field:char next_comm[16];	offset:40;	size:16;	signed:0;
+	field:pid_t next_pid;	offset:56;	size:4;	signed:1;
+	field:int next_prio;	offset:60;	size:4;	signed:1;
+
+print fmt: "prev_comm=%s prev_pid=%d prev_prio=%d prev_state=%s%s ==> next_comm=%s next_pid=%d next_prio=%d"
+`
+
+// tracingData returns a HEADER_TRACING_DATA section containing the
+// given event formats of the "sched" system.
+func tracingData(formats ...string) []byte {
+	var buf bytes.Buffer
+	w := func(x interface{}) { binary.Write(&buf, binary.LittleEndian, x) }
+	buf.WriteString("\x17\x08\x44tracing0.6\x00")
+	w([]uint8{0, 8})
+	w(uint32(4096))
+	buf.WriteString("header_page\x00")
+	w(uint64(4))
+	buf.WriteString("page")
+	buf.WriteString("header_event\x00")
+	w(uint64(0))
+	w(uint32(0)) // ftrace formats
+	w(uint32(1)) // systems
+	buf.WriteString("sched\x00")
+	w(uint32(len(formats)))
+	for _, f := range formats {
+		w(uint64(len(f)))
+		buf.WriteString(f)
+	}
+	w(uint32(0)) // kallsyms
+	w(uint32(0)) // printk formats
+	return buf.Bytes()
+}
+
+// schedSwitch returns the raw data of a sched_switch tracepoint.
+func schedSwitch(prevComm string, prevPID int32, nextComm string, nextPID int32) []byte {
+	raw := make([]byte, 68)
+	binary.LittleEndian.PutUint16(raw, 316)
+	copy(raw[8:24], prevComm)
+	binary.LittleEndian.PutUint32(raw[24:], uint32(prevPID))
+	copy(raw[40:56], nextComm)
+	binary.LittleEndian.PutUint32(raw[56:], uint32(nextPID))
+	return raw
+}
+
+func TestTracepointFormat(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		Type:         EventTypeTracepoint,
+		Config:       316,
+		SampleFormat: SampleFormatRaw,
+	}})
+	tf.addFeature(FeatureTracingData, tracingData(schedSwitchFormat))
+	raw := schedSwitch("a", 10, "b", -1)
+	tf.record(RecordTypeSample, 0, uint32(len(raw)), raw)
+	f := tf.open(t)
+
+	tp := f.Tracepoint(f.Events[0])
+	if tp == nil {
+		t.Fatal("no tracepoint format")
+	}
+	if tp.System != "sched" || tp.Name != "sched_switch" || tp.ID != 316 || len(tp.Fields) != 11 {
+		t.Errorf("got %s:%s ID %d with %d fields", tp.System, tp.Name, tp.ID, len(tp.Fields))
+	}
+	want := TracepointField{Name: "prev_comm", Type: "char[16]", Offset: 8, Size: 16}
+	if got := tp.Field("prev_comm"); got == nil || *got != want {
+		t.Errorf("got field %+v, want %+v", got, want)
+	}
+
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	s := rs.Record.(*RecordSample)
+	if !bytes.Equal(s.Raw, raw) {
+		t.Fatalf("got raw data %x, want %x", s.Raw, raw)
+	}
+	if comm, err := tp.String(s.Raw, "prev_comm"); err != nil || comm != "a" {
+		t.Errorf("prev_comm: got %q, %v; want a", comm, err)
+	}
+	for field, want := range map[string]int64{"common_type": 316, "prev_pid": 10, "next_pid": -1} {
+		if got, err := tp.Int(s.Raw, field); err != nil || got != want {
+			t.Errorf("%s: got %d, %v; want %d", field, got, err, want)
+		}
+	}
+	if _, err := tp.Int(s.Raw, "bogus"); err == nil {
+		t.Errorf("want error for unknown field")
+	}
+}
+
+const schedProcessExecFormat = `name: sched_process_exec
+ID: 310
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] filename;	offset:8;	size:4;	signed:0;
+	field:pid_t pid;	offset:12;	size:4;	signed:1;
+	field:pid_t old_pid;	offset:16;	size:4;	signed:1;
+
+print fmt: "filename=%s pid=%d old_pid=%d", __get_str(filename), REC->pid, REC->old_pid
+`
+
+func TestTracepointDataLoc(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		Type:         EventTypeTracepoint,
+		Config:       310,
+		SampleFormat: SampleFormatRaw,
+	}})
+	tf.addFeature(FeatureTracingData, tracingData(schedProcessExecFormat))
+	// The filename follows the fixed fields at offset 20.
+	raw := make([]byte, 20, 32)
+	raw = append(raw, "/bin/true\x00"...)
+	binary.LittleEndian.PutUint16(raw, 310)
+	binary.LittleEndian.PutUint32(raw[8:], 10<<16|20)
+	binary.LittleEndian.PutUint32(raw[12:], 42)
+	tf.record(RecordTypeSample, 0, uint32(len(raw)), raw)
+	f := tf.open(t)
+
+	tp := f.Tracepoint(f.Events[0])
+	if tp == nil {
+		t.Fatal("no tracepoint format")
+	}
+	want := TracepointField{Name: "filename", Type: "__data_loc char[]", Offset: 8, Size: 4, DataLoc: true}
+	if got := tp.Field("filename"); got == nil || *got != want {
+		t.Errorf("got field %+v, want %+v", got, want)
+	}
+
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() {
+		t.Fatal(rs.Err())
+	}
+	raw = rs.Record.(*RecordSample).Raw
+	if got, err := tp.String(raw, "filename"); err != nil || got != "/bin/true" {
+		t.Errorf("filename: got %q, %v; want /bin/true", got, err)
+	}
+	if got, err := tp.Int(raw, "pid"); err != nil || got != 42 {
+		t.Errorf("pid: got %d, %v; want 42", got, err)
+	}
+	if _, err := tp.Int(raw, "filename"); err == nil {
+		t.Errorf("want error for Int of data location field")
+	}
+	raw = append([]byte(nil), raw...)
+	binary.LittleEndian.PutUint32(raw[8:], 64<<16|20)
+	if _, err := tp.String(raw, "filename"); err == nil {
+		t.Errorf("want error for out of range data location")
+	}
+}
+
+func TestOffCPUTime(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		Type:         EventTypeTracepoint,
+		Config:       316,
+		SampleFormat: SampleFormatTime | SampleFormatRaw,
+	}})
+	tf.addFeature(FeatureTracingData, tracingData(schedSwitchFormat))
+	for _, sw := range []struct {
+		time       uint64
+		prev, next int32
+	}{
+		{100, 0, 1},
+		{150, 1, 2},
+		{200, 2, 0},
+		{250, 0, 1},
+		{400, 1, 2},
+		{500, 2, 1},
+		{600, 1, 0},
+	} {
+		raw := schedSwitch("x", sw.prev, "y", sw.next)
+		tf.record(RecordTypeSample, 0, sw.time, uint32(len(raw)), raw)
+	}
+
+	got, err := tf.open(t).OffCPUTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Thread 1 is off-CPU from 150 to 250 and 400 to 500. Thread 2
+	// is off-CPU from 200 to 400.
+	want := map[int]uint64{1: 200, 2: 200}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
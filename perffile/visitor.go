@@ -0,0 +1,88 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+// A RecordVisitor handles records by type. It is an alternative to a
+// type switch on Records.Record; see Records.Visit.
+//
+// Implementations should embed BaseVisitor, which ignores all
+// records, and override the methods for the record types they
+// handle. This way, visitors continue to compile if methods are added
+// to RecordVisitor for new record types.
+//
+// If a method returns a non-nil error, Visit stops and returns that
+// error. As with Next, the record passed to a method may be reused
+// after the method returns.
+type RecordVisitor interface {
+	VisitMmap(*RecordMmap) error
+	VisitLost(*RecordLost) error
+	VisitComm(*RecordComm) error
+	VisitExit(*RecordExit) error
+	VisitThrottle(*RecordThrottle) error
+	VisitFork(*RecordFork) error
+	VisitRead(*RecordRead) error
+	VisitSample(*RecordSample) error
+	VisitAux(*RecordAux) error
+	VisitLostSamples(*RecordLostSamples) error
+	VisitUnknown(*RecordUnknown) error
+
+	// Embedding BaseVisitor is required to implement
+	// RecordVisitor.
+	baseVisitor()
+}
+
+// BaseVisitor implements RecordVisitor by ignoring all records. It is
+// meant to be embedded in other RecordVisitor implementations.
+type BaseVisitor struct{}
+
+func (BaseVisitor) VisitMmap(*RecordMmap) error               { return nil }
+func (BaseVisitor) VisitLost(*RecordLost) error               { return nil }
+func (BaseVisitor) VisitComm(*RecordComm) error               { return nil }
+func (BaseVisitor) VisitExit(*RecordExit) error               { return nil }
+func (BaseVisitor) VisitThrottle(*RecordThrottle) error       { return nil }
+func (BaseVisitor) VisitFork(*RecordFork) error               { return nil }
+func (BaseVisitor) VisitRead(*RecordRead) error               { return nil }
+func (BaseVisitor) VisitSample(*RecordSample) error           { return nil }
+func (BaseVisitor) VisitAux(*RecordAux) error                 { return nil }
+func (BaseVisitor) VisitLostSamples(*RecordLostSamples) error { return nil }
+func (BaseVisitor) VisitUnknown(*RecordUnknown) error         { return nil }
+func (BaseVisitor) baseVisitor()                              {}
+
+// Visit calls the method of v for the type of each remaining record
+// in r. It stops at the first error returned by v and returns it.
+// Otherwise, it returns r.Err().
+func (r *Records) Visit(v RecordVisitor) error {
+	for r.Next() {
+		var err error
+		switch rec := r.Record.(type) {
+		case *RecordMmap:
+			err = v.VisitMmap(rec)
+		case *RecordLost:
+			err = v.VisitLost(rec)
+		case *RecordComm:
+			err = v.VisitComm(rec)
+		case *RecordExit:
+			err = v.VisitExit(rec)
+		case *RecordThrottle:
+			err = v.VisitThrottle(rec)
+		case *RecordFork:
+			err = v.VisitFork(rec)
+		case *RecordRead:
+			err = v.VisitRead(rec)
+		case *RecordSample:
+			err = v.VisitSample(rec)
+		case *RecordAux:
+			err = v.VisitAux(rec)
+		case *RecordLostSamples:
+			err = v.VisitLostSamples(rec)
+		case *RecordUnknown:
+			err = v.VisitUnknown(rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
@@ -0,0 +1,236 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CopyOptions specifies how File.Copy transforms a perf.data file.
+type CopyOptions struct {
+	// Keep, if non-nil, selects the records to copy. Records for
+	// which Keep returns false are omitted, except that mmap,
+	// comm, fork, and exit records are always copied because
+	// they are needed to interpret samples. Keep must return the
+	// same result for a record each time it is called.
+	Keep func(Record) bool
+
+	// Comm, if non-nil, maps each command name in comm records
+	// to the name to write in its place.
+	Comm func(comm string) string
+
+	// Filename, if non-nil, maps each file name in mmap records
+	// and in the build ID table to the name to write in its
+	// place. Since file offsets and build IDs are preserved, the
+	// result can still be symbolized using binaries stored
+	// under the new names.
+	Filename func(name string) string
+}
+
+// CopyFiltered writes a new perf.data file to w containing the
+// events, metadata, and a subset of the records of f. Records for
+// which keep returns false are omitted, except that mmap, comm, fork,
+// and exit records are always copied because they are needed to
+// interpret samples. Records are copied verbatim.
+//
+// CopyFiltered reads the records of f twice, so keep must return the
+// same result for a record both times it is called.
+//
+// Feature sections, such as build IDs, are copied as-is. Feature
+// sections that refer to offsets in the data section, such as
+// FeatureAuxtrace, will not be correct in the new file.
+func (f *File) CopyFiltered(w io.Writer, keep func(Record) bool) error {
+	return f.Copy(w, CopyOptions{Keep: keep})
+}
+
+// Copy writes a new perf.data file to w containing the events,
+// metadata, and records of f, transformed according to opts. For
+// example, Copy can be used to anonymize a profile before sharing it
+// by renaming processes and files. Records that are not transformed
+// are copied verbatim.
+//
+// Feature sections are copied as-is, except for the build ID table
+// if opts.Filename is set. In particular, other feature sections may
+// contain sensitive information, such as the host name and the
+// command line. Use File.Features to check for these. Feature
+// sections that refer to offsets in the data section, such as
+// FeatureAuxtrace, will not be correct in the new file.
+func (f *File) Copy(w io.Writer, opts CopyOptions) error {
+	// Compute the size of the data section.
+	var dataSize uint64
+	err := f.copyRecords(opts, func(raw []byte) error {
+		dataSize += uint64(len(raw))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Read the raw attrs, IDs, and features.
+	attrs := make([][]byte, len(f.attrs))
+	ids := make([][]byte, len(f.attrs))
+	for i := range f.attrs {
+		if attrs[i], err = f.attrs[i].raw.data(f.r); err != nil {
+			return err
+		}
+		if ids[i], err = f.attrs[i].IDs.data(f.r); err != nil {
+			return err
+		}
+	}
+	var features []FeatureID
+	var featureData [][]byte
+	for _, id := range f.Features() {
+		data, err := f.FeatureBytes(id)
+		if err != nil {
+			return err
+		}
+		if id == FeatureBuildID && opts.Filename != nil {
+			if data, err = renameBuildIDs(data, opts.Filename); err != nil {
+				return err
+			}
+		}
+		features = append(features, id)
+		featureData = append(featureData, data)
+	}
+
+	// Lay out the new file.
+	hdr := fileHeader{AttrSize: f.hdr.AttrSize, Features: f.hdr.Features}
+	copy(hdr.Magic[:], "PERFILE2")
+	hdr.Size = uint64(binary.Size(&hdr))
+	off := hdr.Size
+	hdr.Attrs.Offset = off
+	for i := range attrs {
+		hdr.Attrs.Size += uint64(len(attrs[i]) + binary.Size(fileSection{}))
+	}
+	off += hdr.Attrs.Size
+	idSecs := make([]fileSection, len(ids))
+	for i := range ids {
+		idSecs[i] = fileSection{off, uint64(len(ids[i]))}
+		off += idSecs[i].Size
+	}
+	hdr.Data = fileSection{off, dataSize}
+	off += dataSize
+	featureSecs := make([]fileSection, len(features))
+	off += uint64(len(features) * binary.Size(fileSection{}))
+	for i := range features {
+		featureSecs[i] = fileSection{off, uint64(len(featureData[i]))}
+		off += featureSecs[i].Size
+	}
+
+	// Write the new file.
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.LittleEndian, &hdr)
+	for i := range attrs {
+		bw.Write(attrs[i])
+		binary.Write(bw, binary.LittleEndian, &idSecs[i])
+	}
+	for i := range ids {
+		bw.Write(ids[i])
+	}
+	err = f.copyRecords(opts, func(raw []byte) error {
+		_, err := bw.Write(raw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	binary.Write(bw, binary.LittleEndian, featureSecs)
+	for _, data := range featureData {
+		bw.Write(data)
+	}
+	return bw.Flush()
+}
+
+// copyRecords calls fn with the raw bytes of each record in f that
+// Copy should write, after applying the transformations in opts.
+func (f *File) copyRecords(opts CopyOptions, fn func(raw []byte) error) error {
+	var buf []byte
+	rs := f.Records(RecordsFileOrder)
+	rs.KeepRaw()
+	for rs.Next() {
+		raw := rs.RawRecord()
+		switch r := rs.Record.(type) {
+		case *RecordMmap:
+			if opts.Filename != nil {
+				// The filename follows the fixed fields
+				// of mmap or mmap2 records.
+				fixed := 8 + 32
+				if RecordType(binary.LittleEndian.Uint32(raw)) == recordTypeMmap2 {
+					fixed += 32
+				}
+				buf = f.replaceString(buf[:0], raw, &r.RecordCommon, fixed, opts.Filename(r.Filename))
+				raw = buf
+			}
+		case *RecordComm:
+			if opts.Comm != nil {
+				buf = f.replaceString(buf[:0], raw, &r.RecordCommon, 8+8, opts.Comm(r.Comm))
+				raw = buf
+			}
+		case *RecordFork, *RecordExit:
+		default:
+			if opts.Keep != nil && !opts.Keep(rs.Record) {
+				continue
+			}
+		}
+		if len(raw) > 0xffff {
+			return fmt.Errorf("rewritten %v record at offset %d is too large", rs.Record.Type(), rs.Record.Common().Offset)
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+// replaceString appends to buf a copy of raw record raw with the
+// string at byte offset off replaced with s, and returns the result.
+// The string extends to the record's sample_id trailer, if any.
+func (f *File) replaceString(buf, raw []byte, common *RecordCommon, off int, s string) []byte {
+	trailer := 0
+	if f.sampleIDAll {
+		attr := common.EventAttr
+		if attr == nil {
+			attr = &f.attrs[0].Attr
+		}
+		trailer = attr.SampleFormat.trailerBytes()
+	}
+	buf = append(buf, raw[:off]...)
+	buf = append(buf, s...)
+	buf = append(buf, make([]byte, 8-len(s)%8)...)
+	buf = append(buf, raw[len(raw)-trailer:]...)
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(buf)))
+	return buf
+}
+
+// renameBuildIDs rewrites the file names in a FeatureBuildID
+// section using rename.
+func renameBuildIDs(data []byte, rename func(string) string) ([]byte, error) {
+	// See parseBuildID. Each entry is a record header, a PID, a
+	// 24 byte build ID, and a file name padded to 64 bytes.
+	const fixed = 8 + 4 + 24
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < fixed {
+			return nil, fmt.Errorf("build ID table is truncated")
+		}
+		size := int(binary.LittleEndian.Uint16(data[6:]))
+		if size < fixed || size > len(data) {
+			return nil, fmt.Errorf("build ID entry has bad size %d", size)
+		}
+		bd := &bufDecoder{buf: data[fixed:size], order: binary.LittleEndian}
+		name := rename(bd.cstring())
+
+		start := len(out)
+		out = append(out, data[:fixed]...)
+		out = append(out, name...)
+		out = append(out, make([]byte, 64-len(name)%64)...)
+		binary.LittleEndian.PutUint16(out[start+6:], uint16(len(out)-start))
+		data = data[size:]
+	}
+	return out, nil
+}
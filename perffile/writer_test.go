@@ -0,0 +1,138 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCopyFiltered(t *testing.T) {
+	tf := &testFile{}
+	for id := uint64(1); id <= 2; id++ {
+		tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+			SampleFormat: SampleFormatIdentifier | SampleFormatIP | SampleFormatTID,
+		}}, id, id+10)
+	}
+	tf.addFeature(FeatureHostname, []byte("\x05\x00\x00\x00host\x00"))
+	tf.addFeature(FeatureClockID, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	tf.record(RecordTypeComm, 0, 1, 1, "a")
+	tf.record(RecordTypeSample, 0, uint64(1), uint64(0x100), 1, 1)
+	tf.record(RecordTypeSample, 0, uint64(12), uint64(0x200), 1, 1)
+	tf.record(RecordTypeSample, 0, uint64(11), uint64(0x300), 1, 1)
+	f := tf.open(t)
+
+	var buf bytes.Buffer
+	err := f.CopyFiltered(&buf, func(r Record) bool {
+		s, ok := r.(*RecordSample)
+		return ok && s.IP != 0x200
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := New(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f2.Events) != 2 || *f2.Events[1] != *f.Events[1] {
+		t.Errorf("events not preserved: %v", f2.Events)
+	}
+	if f2.Meta.Hostname != "host" {
+		t.Errorf("got hostname %q, want host", f2.Meta.Hostname)
+	}
+	if b, err := f2.FeatureBytes(FeatureClockID); err != nil || !bytes.Equal(b, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("got clock ID section %v, %v", b, err)
+	}
+
+	var got []string
+	rs := f2.Records(RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordComm:
+			got = append(got, r.Comm)
+		case *RecordSample:
+			ev := 0
+			if r.EventAttr == f2.Events[1] {
+				ev = 1
+			}
+			got = append(got, fmt.Sprintf("%d %#x", ev, r.IP))
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "0 0x100", "0 0x300"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+}
+
+func TestCopyRename(t *testing.T) {
+	buildID := func(name string) []byte {
+		b := encodeFields(uint32(0), uint16(CPUModeUser), uint16(0), int32(1), [24]byte{1, 2, 3})
+		b = append(b, name...)
+		b = append(b, make([]byte, 64-len(name)%64)...)
+		binary.LittleEndian.PutUint16(b[6:], uint16(len(b)))
+		return b
+	}
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+		Flags:        EventFlagSampleIDAll,
+	}})
+	tf.addFeature(FeatureBuildID, append(buildID("/secret/bin"), buildID("/lib/libc.so")...))
+	tf.record(RecordTypeComm, 0, 1, 1, "secret", 1, 1, uint64(10))
+	tf.record(RecordTypeMmap, 0, 1, 1, uint64(0x1000), uint64(0x1000), uint64(0x200), "/secret/bin", 1, 1, uint64(20))
+	tf.record(recordTypeMmap2, 0, 1, 1, uint64(0x8000), uint64(0x1000), uint64(0),
+		uint32(8), uint32(1), uint64(99), uint64(0), uint32(5), uint32(2), "/lib/libc.so", 1, 1, uint64(30))
+	tf.record(RecordTypeSample, 0, uint64(0x1100), 1, 1, uint64(40))
+	f := tf.open(t)
+
+	names := map[string]string{"secret": "p1", "/secret/bin": "/anon/file-with-a-longer-name", "/lib/libc.so": "/lib/libc.so"}
+	rename := func(s string) string { return names[s] }
+	var buf bytes.Buffer
+	if err := f.Copy(&buf, CopyOptions{Comm: rename, Filename: rename}); err != nil {
+		t.Fatal(err)
+	}
+	f2, err := New(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	rs := f2.Records(RecordsFileOrder)
+	rs.Strict()
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordComm:
+			got = append(got, fmt.Sprintf("comm %s %d", r.Comm, r.Time))
+		case *RecordMmap:
+			got = append(got, fmt.Sprintf("mmap %s %#x %#x %d %d", r.Filename, r.Addr, r.FileOffset, r.Ino, r.Time))
+		case *RecordSample:
+			got = append(got, fmt.Sprintf("sample %#x %d", r.IP, r.Time))
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"comm p1 10",
+		"mmap /anon/file-with-a-longer-name 0x1000 0x200 0 20",
+		"mmap /lib/libc.so 0x8000 0x0 99 30",
+		"sample 0x1100 40",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %q, want %q", got, want)
+	}
+
+	bids := f2.Meta.BuildIDs
+	if len(bids) != 2 || bids[0].Filename != "/anon/file-with-a-longer-name" || bids[1].Filename != "/lib/libc.so" || bids[0].BuildID[0] != 1 {
+		t.Errorf("got build IDs %+v", bids)
+	}
+}
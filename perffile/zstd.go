@@ -0,0 +1,169 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build zstd
+// +build zstd
+
+package perffile
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	decompressors["zstd"] = newZstdDecompressor
+	fileDecompressors["zstd"] = newZstdFileReader
+}
+
+// zstdFileReader decompresses a whole zstd-compressed file.
+type zstdFileReader struct {
+	*zstd.Decoder
+}
+
+func newZstdFileReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zstdFileReader{dec}, nil
+}
+
+func (z zstdFileReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// zstdDecompressor decompresses the zstd stream formed by the payloads
+// of a sequence of compressed records. perf flushes the stream at the
+// end of each record but does not end the frame, so the decoder state
+// must be kept across records.
+//
+// The zstd package only provides a pull-based stream decoder, so this
+// runs the decoder in a goroutine that reads payloads from in and
+// sends decompressed data to out. Every channel operation of the
+// goroutine also selects on done, so closing done stops the goroutine
+// wherever it is blocked.
+type zstdDecompressor struct {
+	*zstdStream
+}
+
+type zstdStream struct {
+	in      chan []byte
+	out     chan zstdOutput
+	done    chan struct{}
+	stop    sync.Once
+	src     []byte // Unread part of the current payload
+	started bool
+}
+
+type zstdOutput struct {
+	data []byte
+	done bool // The decoder needs more input
+	err  error
+}
+
+func newZstdDecompressor() decompressor {
+	s := &zstdStream{in: make(chan []byte, 1), out: make(chan zstdOutput), done: make(chan struct{})}
+	go s.run()
+	d := &zstdDecompressor{s}
+	// Stop the decoder goroutine when d is no longer used. The
+	// goroutine only refers to s, so it doesn't keep d alive.
+	runtime.SetFinalizer(d, func(d *zstdDecompressor) { d.close() })
+	return d
+}
+
+// close stops the decoder goroutine.
+func (s *zstdStream) close() {
+	s.stop.Do(func() { close(s.done) })
+}
+
+func (d *zstdDecompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	select {
+	case d.in <- src:
+	case <-d.done:
+		return dst, fmt.Errorf("zstd decoder was stopped by an earlier error")
+	}
+	for {
+		var out zstdOutput
+		select {
+		case out = <-d.out:
+		case <-d.done:
+			return dst, fmt.Errorf("zstd decoder was stopped by an earlier error")
+		}
+		if out.err != nil {
+			d.close()
+			return dst, out.err
+		}
+		if out.done {
+			return dst, nil
+		}
+		if len(dst)+len(out.data) > max {
+			// The rest of this payload is never read, so
+			// the stream can't be resumed.
+			d.close()
+			return dst, fmt.Errorf("decompressed data exceeds the limit of %d bytes", max)
+		}
+		dst = append(dst, out.data...)
+	}
+}
+
+// send sends out to decompress. It returns false if s was stopped.
+func (s *zstdStream) send(out zstdOutput) bool {
+	select {
+	case s.out <- out:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *zstdStream) run() {
+	dec, err := zstd.NewReader(s, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		s.send(zstdOutput{err: err})
+		return
+	}
+	defer dec.Close()
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := dec.Read(buf)
+		if n > 0 && !s.send(zstdOutput{data: append([]byte(nil), buf[:n]...)}) {
+			return
+		}
+		if err == io.EOF {
+			// s was stopped.
+			return
+		} else if err != nil {
+			s.send(zstdOutput{err: err})
+			return
+		}
+	}
+}
+
+// Read supplies the decoder with input. The decoder only reads more
+// input once it has returned all of the data it could decode, so when
+// the current payload is exhausted, Read tells decompress that it is
+// done and waits for the next payload. Read returns io.EOF once s is
+// stopped.
+func (s *zstdStream) Read(p []byte) (int, error) {
+	for len(s.src) == 0 {
+		if s.started && !s.send(zstdOutput{done: true}) {
+			return 0, io.EOF
+		}
+		s.started = true
+		select {
+		case s.src = <-s.in:
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.src)
+	s.src = s.src[n:]
+	return n, nil
+}
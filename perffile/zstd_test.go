@@ -0,0 +1,132 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build zstd
+// +build zstd
+
+package perffile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdPayloads compresses each of chunks as perf does: as a single
+// stream that is flushed, but not ended, after each chunk. It returns
+// the compressed bytes written for each chunk.
+func zstdPayloads(t *testing.T, chunks ...[]byte) [][]byte {
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads [][]byte
+	for _, chunk := range chunks {
+		if _, err := enc.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return payloads
+}
+
+func TestZstdRecords(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{
+		SampleFormat: SampleFormatTime,
+	}})
+	tf.addFeature(FeatureCompressed, encodeFields(uint32(0), uint32(1), uint32(3), uint32(0), uint32(0)))
+	// The second compressed sample spans two compressed records.
+	var inner testFile
+	inner.record(RecordTypeSample, 0, uint64(10))
+	inner.record(RecordTypeSample, 0, uint64(30))
+	data := inner.data.Bytes()
+	for _, payload := range zstdPayloads(t, data[:20], data[20:]) {
+		tf.record(recordTypeCompressed, 0, payload)
+	}
+
+	rs := tf.open(t).Records(RecordsFileOrder)
+	var times []uint64
+	for rs.Next() {
+		times = append(times, rs.Record.(*RecordSample).Time)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || times[0] != 10 || times[1] != 30 {
+		t.Errorf("got times %v, want [10 30]", times)
+	}
+}
+
+func TestZstdStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	payloads := zstdPayloads(t, bytes.Repeat([]byte("x"), 1<<20), []byte("y"))
+
+	// Exceeding the limit stops the decoder goroutine, which is
+	// blocked sending the rest of the payload.
+	d := newZstdDecompressor()
+	_, err := d.decompress(nil, payloads[0], 1000)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("got error %v, want limit error", err)
+	}
+	if _, err := d.decompress(nil, payloads[1], 1<<30); err == nil {
+		t.Errorf("want error after decoder was stopped")
+	}
+
+	// An abandoned decompressor stops when it is collected.
+	d = newZstdDecompressor()
+	if _, err := d.decompress(nil, payloads[0], 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	d = nil
+
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d decoder goroutines still running", runtime.NumGoroutine()-before)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestZstdOpenCompressed(t *testing.T) {
+	tf := &testFile{}
+	tf.addAttr(eventAttrVN{eventAttrV0: eventAttrV0{SampleFormat: SampleFormatIP}})
+	tf.record(RecordTypeSample, 0, uint64(0x400))
+
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(tf.bytes())
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "perf.data.zst")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenCompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rs := f.Records(RecordsFileOrder)
+	if !rs.Next() || rs.Record.(*RecordSample).IP != 0x400 {
+		t.Errorf("bad records: %v", rs.Err())
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import "github.com/aclements/go-perf/perffile"
+
+// A CallTree is a calling context tree. Each node in the tree
+// represents a call stack, and records the number of samples with
+// exactly that stack (its self count) and the number of samples with
+// that stack as a prefix (its total count). This is the model behind
+// flame graphs and call graph reports.
+//
+// The zero value is an empty CallTree ready to use.
+type CallTree struct {
+	// Collapse controls how recursive calls are merged when
+	// adding samples. It should be set before the first call to
+	// Add.
+	Collapse CollapseMode
+
+	// nodes stores the tree. nodes[0] is the root, which
+	// represents the empty stack. Children are linked through
+	// child and sibling indexes, which is much more compact than
+	// per-node maps for large trees.
+	nodes []callNode
+
+	// names interns the symbol names of nodes.
+	names   []string
+	nameIdx map[string]int32
+
+	stack   []int32  // Scratch space for Add
+	repeats []uint64 // Scratch space for Add
+}
+
+type callNode struct {
+	name           int32
+	child, sibling int32 // 0 if none
+	self, total    uint64
+	repeat         uint64
+}
+
+// A CollapseMode specifies how CallTree merges the repeated frames of
+// recursive calls. Deeply recursive code produces very deep stacks
+// that make flame graphs hard to read and the tree large; collapsing
+// them folds each recursion into a single frame, and the number of
+// frames folded into a node is reported by WalkRepeat.
+type CollapseMode int
+
+const (
+	// CollapseNone keeps every frame.
+	CollapseNone CollapseMode = iota
+
+	// CollapseAdjacent merges runs of consecutive frames with
+	// the same name, such as a function that calls itself
+	// directly, into a single frame.
+	CollapseAdjacent
+
+	// CollapseAll also merges indirect recursion. If a frame's
+	// name already appears further out in the stack, the frames
+	// in between are dropped and the frame is merged with the
+	// outer one. For example, the stack a;b;a;b;c becomes a;b;c.
+	CollapseAll
+)
+
+// Add adds sample to t. resolve is used to map each IP in the sample's
+// call chain to a node name, such as a function name. If the sample
+// has no call chain, only the sample's IP is used.
+//
+// Callchain context markers (perffile.Callchain*) are skipped.
+func (t *CallTree) Add(sample *perffile.RecordSample, resolve func(ip uint64) string) {
+	if t.nodes == nil {
+		t.nodes = []callNode{{name: -1}}
+		t.nameIdx = make(map[string]int32)
+	}
+
+	// Resolve the stack, outermost frame first.
+	t.stack, t.repeats = t.stack[:0], t.repeats[:0]
+	if len(sample.Callchain) == 0 {
+		t.push(t.intern(resolve(sample.IP)))
+	} else {
+		for i := len(sample.Callchain) - 1; i >= 0; i-- {
+			ip := sample.Callchain[i]
+			if ip >= perffile.CallchainContextMax {
+				continue
+			}
+			t.push(t.intern(resolve(ip)))
+		}
+	}
+
+	node := int32(0)
+	t.nodes[0].total++
+	for i, name := range t.stack {
+		node = t.child(node, name)
+		n := &t.nodes[node]
+		n.total++
+		if t.repeats[i] > n.repeat {
+			n.repeat = t.repeats[i]
+		}
+	}
+	t.nodes[node].self++
+}
+
+// push adds frame name to the inner end of t.stack, collapsing it
+// with an outer frame according to t.Collapse.
+func (t *CallTree) push(name int32) {
+	switch t.Collapse {
+	case CollapseAdjacent:
+		if n := len(t.stack); n > 0 && t.stack[n-1] == name {
+			t.repeats[n-1]++
+			return
+		}
+	case CollapseAll:
+		for i, outer := range t.stack {
+			if outer == name {
+				t.stack, t.repeats = t.stack[:i+1], t.repeats[:i+1]
+				t.repeats[i]++
+				return
+			}
+		}
+	}
+	t.stack = append(t.stack, name)
+	t.repeats = append(t.repeats, 1)
+}
+
+func (t *CallTree) intern(name string) int32 {
+	if i, ok := t.nameIdx[name]; ok {
+		return i
+	}
+	i := int32(len(t.names))
+	t.names = append(t.names, name)
+	t.nameIdx[name] = i
+	return i
+}
+
+// child returns the child of node with the given name, creating it if
+// necessary.
+func (t *CallTree) child(node, name int32) int32 {
+	last := int32(0)
+	for c := t.nodes[node].child; c != 0; c = t.nodes[c].sibling {
+		if t.nodes[c].name == name {
+			return c
+		}
+		last = c
+	}
+	c := int32(len(t.nodes))
+	t.nodes = append(t.nodes, callNode{name: name})
+	if last == 0 {
+		t.nodes[node].child = c
+	} else {
+		t.nodes[last].sibling = c
+	}
+	return c
+}
+
+// Total returns the total number of samples added to t.
+func (t *CallTree) Total() uint64 {
+	if t.nodes == nil {
+		return 0
+	}
+	return t.nodes[0].total
+}
+
+// Walk calls visit for each node of t in depth-first order, visiting
+// each node before its children and visiting children in the order
+// they were first added. stack is the call stack represented by the
+// node, outermost frame first. It is only valid for the duration of
+// the call to visit. If visit returns false, Walk does not visit the
+// node's children.
+func (t *CallTree) Walk(visit func(stack []string, self, total uint64) bool) {
+	t.WalkRepeat(func(stack []string, self, total, repeat uint64) bool {
+		return visit(stack, self, total)
+	})
+}
+
+// WalkRepeat is like Walk, but also passes the number of frames that
+// were collapsed into each node (see CallTree.Collapse). repeat is
+// the largest number of frames collapsed into the node by any one
+// sample, or 1 if no frames were collapsed.
+func (t *CallTree) WalkRepeat(visit func(stack []string, self, total, repeat uint64) bool) {
+	if t.nodes == nil {
+		return
+	}
+	var stack []string
+	var walk func(node int32)
+	walk = func(node int32) {
+		for c := t.nodes[node].child; c != 0; c = t.nodes[c].sibling {
+			n := &t.nodes[c]
+			stack = append(stack, t.names[n.name])
+			if visit(stack, n.self, n.total, n.repeat) {
+				walk(c)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	walk(0)
+}
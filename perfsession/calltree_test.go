@@ -0,0 +1,98 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestCallTree(t *testing.T) {
+	names := map[uint64]string{1: "main", 2: "f", 3: "g", 4: "h"}
+	resolve := func(ip uint64) string { return names[ip] }
+
+	var tree CallTree
+	for _, cc := range [][]uint64{
+		{perffile.CallchainUser, 3, 2, 1},
+		{perffile.CallchainUser, 3, 2, 1},
+		{perffile.CallchainUser, 2, 1},
+		{perffile.CallchainUser, 4, 1},
+	} {
+		tree.Add(&perffile.RecordSample{Callchain: cc}, resolve)
+	}
+	tree.Add(&perffile.RecordSample{IP: 4}, resolve)
+
+	var got []string
+	tree.Walk(func(stack []string, self, total uint64) bool {
+		got = append(got, fmt.Sprintf("%s %d %d", strings.Join(stack, ";"), self, total))
+		return true
+	})
+	want := []string{
+		"main 0 4",
+		"main;f 1 3",
+		"main;f;g 2 2",
+		"main;h 1 1",
+		"h 1 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if tree.Total() != 5 {
+		t.Errorf("got total %d, want 5", tree.Total())
+	}
+}
+
+func TestCallTreeCollapse(t *testing.T) {
+	names := map[uint64]string{1: "main", 2: "f", 3: "g", 4: "h"}
+	resolve := func(ip uint64) string { return names[ip] }
+
+	for _, test := range []struct {
+		mode CollapseMode
+		want []string
+	}{
+		{CollapseNone, []string{
+			"main 0 2 1",
+			"main;f 0 2 1",
+			"main;f;f 0 2 1",
+			"main;f;f;f 1 1 1",
+			"main;f;f;g 0 1 1",
+			"main;f;f;g;f 0 1 1",
+			"main;f;f;g;f;h 1 1 1",
+		}},
+		{CollapseAdjacent, []string{
+			"main 0 2 1",
+			"main;f 1 2 3",
+			"main;f;g 0 1 1",
+			"main;f;g;f 0 1 1",
+			"main;f;g;f;h 1 1 1",
+		}},
+		{CollapseAll, []string{
+			"main 0 2 1",
+			"main;f 1 2 3",
+			"main;f;h 1 1 1",
+		}},
+	} {
+		tree := CallTree{Collapse: test.mode}
+		for _, cc := range [][]uint64{
+			{perffile.CallchainUser, 2, 2, 2, 1},
+			{perffile.CallchainUser, 4, 2, 3, 2, 2, 1},
+		} {
+			tree.Add(&perffile.RecordSample{Callchain: cc}, resolve)
+		}
+
+		var got []string
+		tree.WalkRepeat(func(stack []string, self, total, repeat uint64) bool {
+			got = append(got, fmt.Sprintf("%s %d %d %d", strings.Join(stack, ";"), self, total, repeat))
+			return true
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mode %d: got %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// DebuginfodSymbols is a SymbolSource that downloads the debug info
+// files of binaries from debuginfod servers by build ID. This makes
+// it possible to symbolize profiles of stripped binaries, such as
+// those installed by Linux distributions, that have debug info
+// available from a debuginfod server.
+//
+// Downloaded files are cached, so each file is only downloaded once.
+// Binaries without a build ID in the profile are not looked up.
+//
+// DebuginfodSymbols is also a DWARFSource, so when it is
+// Session.SymbolSource, Symbolize reports line numbers and
+// SymbolizeInline expands inlined calls from the downloaded debug info.
+// Setting Session.DWARFSource to it does the same for binaries whose
+// symbols come from elsewhere.
+type DebuginfodSymbols struct {
+	// URLs are the base URLs of the debuginfod servers to query,
+	// in order. If URLs is empty, the servers are taken from the
+	// space-separated DEBUGINFOD_URLS environment variable.
+	URLs []string
+
+	// CacheDir is the directory to cache downloaded files in. If
+	// CacheDir is "", files are cached in debuginfod_client in
+	// the user's cache directory, which is shared with other
+	// debuginfod clients.
+	CacheDir string
+
+	// Client is the HTTP client used to query servers. If Client
+	// is nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (d *DebuginfodSymbols) Symbols(buildID perffile.BuildID, filename string) ([]Symbol, error) {
+	if len(buildID) == 0 {
+		return nil, nil
+	}
+	path, err := d.fetch(buildID.String())
+	if path == "" || err != nil {
+		return nil, err
+	}
+	elff, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer elff.Close()
+	return elfSymbols(elff)
+}
+
+// DWARF returns the downloaded debug info file of the binary with the
+// given build ID. See DWARFSource.
+func (d *DebuginfodSymbols) DWARF(buildID perffile.BuildID, filename string) (*elf.File, error) {
+	if len(buildID) == 0 {
+		return nil, nil
+	}
+	path, err := d.fetch(buildID.String())
+	if path == "" || err != nil {
+		return nil, err
+	}
+	return elf.Open(path)
+}
+
+// fetch returns the path of the cached debug info file for build ID
+// bid, downloading it if necessary. Servers are tried in order until
+// one returns the file. If no server has the file, it returns "" and
+// the error from the first server that failed, if any.
+func (d *DebuginfodSymbols) fetch(bid string) (string, error) {
+	// This follows the cache layout of debuginfod-client.c in
+	// elfutils.
+	dir := d.CacheDir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cache, "debuginfod_client")
+	}
+	dir = filepath.Join(dir, bid)
+	path := filepath.Join(dir, "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	urls := d.URLs
+	if len(urls) == 0 {
+		urls = strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var firstErr error
+	for _, url := range urls {
+		resp, err := client.Get(strings.TrimSuffix(url, "/") + "/buildid/" + bid + "/debuginfo")
+		if err == nil && resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			continue
+		}
+		if err == nil {
+			err = saveDebugInfo(dir, path, resp)
+			resp.Body.Close()
+		}
+		if err == nil {
+			return path, nil
+		}
+		// Try the remaining servers, but report this error if
+		// none of them has the file.
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
+
+// saveDebugInfo saves the debug info file in resp to path in dir. The
+// file is written to a temporary file first so other processes never
+// see a partial file.
+func saveDebugInfo(dir, path string, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", resp.Request.URL, resp.Status)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "debuginfo.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("fetching %s: %s", resp.Request.URL, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestDebuginfodSymbols(t *testing.T) {
+	// Serve the test binary as the debug info for build ID abcd.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	want, err := LocalSymbols{}.Symbols(nil, exe)
+	if err != nil || len(want) == 0 {
+		t.Skipf("test binary has no symbols: %v", err)
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/buildid/abcd/debuginfo" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, exe)
+	}))
+	defer srv.Close()
+
+	d := &DebuginfodSymbols{URLs: []string{srv.URL + "/"}, CacheDir: t.TempDir()}
+	for i := 0; i < 2; i++ {
+		got, err := d.Symbols(perffile.BuildID{0xab, 0xcd}, "/bin/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %d symbols, want %d", len(got), len(want))
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1 because of caching", requests)
+	}
+
+	if got, err := d.Symbols(perffile.BuildID{0x12}, "/bin/y"); got != nil || err != nil {
+		t.Errorf("for unknown build ID, got %d symbols, %v; want nil, nil", len(got), err)
+	}
+	if got, err := d.Symbols(nil, "/bin/z"); got != nil || err != nil || requests != 2 {
+		t.Errorf("without build ID, got %d symbols, %v after %d requests; want nil, nil, 2", len(got), err, requests)
+	}
+
+	// The same files supply DWARF.
+	var _ DWARFSource = d
+	if elff, err := d.DWARF(perffile.BuildID{0xab, 0xcd}, "/bin/x"); err != nil || elff == nil {
+		t.Errorf("DWARF returned %v, %v; want file", elff, err)
+	} else {
+		elff.Close()
+	}
+	if elff, err := d.DWARF(perffile.BuildID{0x12}, "/bin/y"); elff != nil || err != nil {
+		t.Errorf("for unknown build ID, DWARF returned %v, %v; want nil, nil", elff, err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	// Servers that fail are skipped in favor of later servers.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	d = &DebuginfodSymbols{URLs: []string{down.URL, broken.URL, srv.URL}, CacheDir: t.TempDir()}
+	if got, err := d.Symbols(perffile.BuildID{0xab, 0xcd}, "/bin/x"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("with failing servers first, got %d symbols, %v; want %d symbols", len(got), err, len(want))
+	}
+	// If no server has the file, the first failure is reported.
+	d = &DebuginfodSymbols{URLs: []string{srv.URL, down.URL, broken.URL}, CacheDir: t.TempDir()}
+	if got, err := d.Symbols(perffile.BuildID{0x12}, "/bin/y"); got != nil || err == nil || strings.Contains(err.Error(), "500") {
+		t.Errorf("with failing servers, got %d symbols, %v; want connection error", len(got), err)
+	}
+}
+
+func TestDebuginfodLines(t *testing.T) {
+	// Serve a C binary with DWARF as the debug info of a binary
+	// that isn't on the local file system.
+	bin, leaf, seg := buildInlineC(t, "-fPIE", "-pie")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/buildid/abcd/debuginfo" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, bin)
+	}))
+	defer srv.Close()
+
+	const filename = "/nonexistent/x"
+	f := &perffile.File{}
+	f.Meta.BuildIDs = []perffile.BuildIDInfo{{Filename: filename, BuildID: perffile.BuildID{0xab, 0xcd}}}
+	s := New(f)
+	s.SymbolSource = &DebuginfodSymbols{URLs: []string{srv.URL}, CacheDir: t.TempDir()}
+	r := mmapRecord(1, 0x555500000000, seg.Filesz, filename)
+	r.FileOffset = seg.Off
+	s.Update(r)
+	ip := r.Addr + leaf.lowpc - seg.Vaddr
+	mmap := s.LookupPID(1).LookupMmap(ip)
+
+	var sym Symbolic
+	if !Symbolize(s, mmap, ip, &sym) {
+		t.Fatal("failed to symbolize")
+	}
+	// The code of leaf is on line 2.
+	if sym.FuncName != "outer" || sym.Line.File == nil || !strings.HasSuffix(sym.Line.File.Name, "x.c") || sym.Line.Line != 2 {
+		t.Errorf("got %s at %+v, want outer at x.c:2", sym.FuncName, sym.Line)
+	}
+	syms := SymbolizeInline(s, mmap, ip)
+	if len(syms) != 2 || syms[0].FuncName != "leaf" || syms[1].FuncName != "outer" {
+		t.Fatalf("got %+v, want leaf inlined in outer", syms)
+	}
+	if line := syms[1].Line.Line; line != leaf.callLine.Line {
+		t.Errorf("got call at line %d, want line %d", line, leaf.callLine.Line)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"math"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A FuncDiff is the change in the share of a profile spent in a
+// function between two profiles.
+type FuncDiff struct {
+	Func string
+
+	// A and B are the fractions of profiles a and b spent in
+	// Func, between 0 and 1.
+	A, B float64
+
+	// Delta is B - A. A positive Delta means b spent more of its
+	// time in Func than a, such as after a regression.
+	Delta float64
+}
+
+// DiffProfiles compares the functions that samples fall in between
+// profiles a and b, such as profiles of a program before and after a
+// change. Each sample is weighted by its EstimatedCount and each
+// function's share is normalized by the total weight of its profile,
+// so profiles of different lengths or sampling rates are comparable.
+// The result is sorted by decreasing magnitude of Delta, so the
+// largest changes come first.
+//
+// symbolize returns the function that a sample should be attributed
+// to. It is called with a Session that tracks the state of the
+// sample's profile. If symbolize is nil, DiffProfiles uses the
+// function containing the sample's IP, as found by Symbolize.
+func DiffProfiles(a, b *perffile.File, symbolize func(*Session, *perffile.RecordSample) string) ([]FuncDiff, error) {
+	if symbolize == nil {
+		symbolize = symbolizeIP
+	}
+	wa, err := funcWeights(a, symbolize)
+	if err != nil {
+		return nil, err
+	}
+	wb, err := funcWeights(b, symbolize)
+	if err != nil {
+		return nil, err
+	}
+	return diffWeights(wa, wb), nil
+}
+
+// funcWeights returns the total EstimatedCount of the samples in f
+// attributed to each function by symbolize.
+func funcWeights(f *perffile.File, symbolize func(*Session, *perffile.RecordSample) string) (map[string]uint64, error) {
+	s := New(f)
+	weights := make(map[string]uint64)
+	rs := f.Records(perffile.RecordsCausalOrder)
+	rs.OnlyTypes(perffile.RecordTypeMmap, perffile.RecordTypeComm, perffile.RecordTypeExit, perffile.RecordTypeFork, perffile.RecordTypeSample)
+	for rs.Next() {
+		s.Update(rs.Record)
+		if r, ok := rs.Record.(*perffile.RecordSample); ok {
+			weights[symbolize(s, r)] += r.EstimatedCount()
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// symbolizeIP returns the name of the function containing r's IP, or
+// the name of the mapped file if the function is unknown.
+func symbolizeIP(s *Session, r *perffile.RecordSample) string {
+	pidInfo := s.LookupPID(r.PID)
+	if pidInfo == nil {
+		return perffile.UnknownDSO
+	}
+	mmap := pidInfo.LookupMmap(r.IP)
+	if mmap == nil {
+		return perffile.UnknownDSO
+	}
+	var sym Symbolic
+	if Symbolize(s, mmap, r.IP, &sym) && sym.FuncName != "" {
+		return sym.FuncName
+	}
+	return mmap.Filename
+}
+
+// diffWeights compares the per-function weights of two profiles.
+func diffWeights(a, b map[string]uint64) []FuncDiff {
+	total := func(w map[string]uint64) float64 {
+		var t uint64
+		for _, n := range w {
+			t += n
+		}
+		return float64(t)
+	}
+	ta, tb := total(a), total(b)
+	frac := func(n uint64, t float64) float64 {
+		if t == 0 {
+			return 0
+		}
+		return float64(n) / t
+	}
+
+	diffs := make([]FuncDiff, 0, len(a)+len(b))
+	add := func(fn string) {
+		d := FuncDiff{Func: fn, A: frac(a[fn], ta), B: frac(b[fn], tb)}
+		d.Delta = d.B - d.A
+		diffs = append(diffs, d)
+	}
+	for fn := range a {
+		add(fn)
+	}
+	for fn := range b {
+		if _, ok := a[fn]; !ok {
+			add(fn)
+		}
+	}
+	sort.Sort(funcDiffSorter(diffs))
+	return diffs
+}
+
+// funcDiffSorter sorts FuncDiffs by decreasing magnitude of Delta,
+// and then by function name.
+type funcDiffSorter []FuncDiff
+
+func (s funcDiffSorter) Len() int {
+	return len(s)
+}
+
+func (s funcDiffSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s funcDiffSorter) Less(i, j int) bool {
+	di, dj := math.Abs(s[i].Delta), math.Abs(s[j].Delta)
+	if di != dj {
+		return di > dj
+	}
+	return s[i].Func < s[j].Func
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestDiffWeights(t *testing.T) {
+	a := map[string]uint64{"f": 4, "g": 2, "h": 2}
+	b := map[string]uint64{"f": 8, "g": 2, "i": 6}
+	got := diffWeights(a, b)
+	want := []FuncDiff{
+		{"i", 0, 0.375, 0.375},
+		{"h", 0.25, 0, -0.25},
+		{"g", 0.25, 0.125, -0.125},
+		{"f", 0.5, 0.5, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSymbolizeIP(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/bin/x"))
+	s.Update(mmapRecord(1, 0x2000, 0x1000, "/bin/y"))
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{
+		"/bin/x": {functab: []funcRange{{"f", 0x1000, 0x1010, true}}},
+		"/bin/y": nil,
+	}
+	for _, test := range []struct {
+		ip   uint64
+		want string
+	}{
+		{0x1004, "f"},
+		{0x1020, "/bin/x"},
+		{0x2000, "/bin/y"},
+		{0x3000, perffile.UnknownDSO},
+	} {
+		r := &perffile.RecordSample{RecordCommon: perffile.RecordCommon{PID: 1, TID: 1}, IP: test.ip}
+		if got := symbolizeIP(s, r); got != test.want {
+			t.Errorf("%#x: got %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import "sort"
+
+// MappedFile returns the name of the file mapped at address ip in
+// process pid, or "", false if ip is not in any known mapping. With
+// Update, this makes s a perffile.MapBuilder.
+func (s *Session) MappedFile(pid int, ip uint64) (string, bool) {
+	pidInfo := s.LookupPID(pid)
+	if pidInfo == nil {
+		return "", false
+	}
+	m := pidInfo.LookupMmap(ip)
+	if m == nil {
+		return "", false
+	}
+	return m.Filename, true
+}
+
+// A DSO is a file mapped into an address space, such as an executable
+// or a shared library, together with all of its mappings. The loader
+// maps each PT_LOAD segment of a binary separately, so a single DSO
+// usually has several mappings with different permissions and file
+// offsets.
+type DSO struct {
+	// Filename, Major, Minor, and Ino identify the mapped file.
+	// For mappings recorded without a device and inode, such as
+	// MMAP records and MMAP2 records with a build ID, these are
+	// 0 and the file is identified by name alone.
+	Filename     string
+	Major, Minor uint32
+	Ino          uint64
+
+	// Segments are the mappings of the file, in address order.
+	Segments []*Mmap
+}
+
+// Segment returns the mapping of d that contains ip, or nil if none
+// does.
+func (d *DSO) Segment(ip uint64) *Mmap {
+	for _, m := range d.Segments {
+		if m.Addr <= ip && ip-m.Addr < m.Len {
+			return m
+		}
+	}
+	return nil
+}
+
+// FileOffsetOf returns the byte offset in d's file that corresponds to
+// virtual address ip, using the segment that contains ip. It returns
+// false if ip is not in any segment of d.
+func (d *DSO) FileOffsetOf(ip uint64) (uint64, bool) {
+	m := d.Segment(ip)
+	if m == nil {
+		return 0, false
+	}
+	return m.FileOffsetOf(ip)
+}
+
+// sameFile returns whether m maps the file identified by d.
+func (d *DSO) sameFile(m *Mmap) bool {
+	return m.Filename == d.Filename && m.Major == d.Major && m.Minor == d.Minor && m.Ino == d.Ino
+}
+
+// DSOs returns the files mapped in p's address space, grouping the
+// mappings of each file into a single DSO. Anonymous mappings and
+// special regions such as the stack are omitted. The kernel's
+// mappings are not included; use the kernel's PIDInfo (PID -1) for
+// those. DSOs are ordered by the address of their first segment.
+func (p *PIDInfo) DSOs() []*DSO {
+	var dsos []*DSO
+	for _, m := range p.sortedMaps() {
+		if !mapsFile(m) {
+			continue
+		}
+		var dso *DSO
+		for _, d := range dsos {
+			if d.sameFile(m) {
+				dso = d
+				break
+			}
+		}
+		if dso == nil {
+			dso = &DSO{Filename: m.Filename, Major: m.Major, Minor: m.Minor, Ino: m.Ino}
+			dsos = append(dsos, dso)
+		}
+		dso.Segments = append(dso.Segments, m)
+	}
+	return dsos
+}
+
+// LookupDSO returns the DSO whose mappings include addr, or nil if
+// addr is not in a mapped file. Like LookupMmap, this falls back to
+// the kernel's mappings.
+func (p *PIDInfo) LookupDSO(addr uint64) *DSO {
+	m := p.LookupMmap(addr)
+	if m == nil || !mapsFile(m) {
+		return nil
+	}
+	owner := p
+	if p.mapFind(addr) == nil {
+		owner = p.kernel
+	}
+	dso := &DSO{Filename: m.Filename, Major: m.Major, Minor: m.Minor, Ino: m.Ino}
+	for _, m2 := range owner.sortedMaps() {
+		if dso.sameFile(m2) {
+			dso.Segments = append(dso.Segments, m2)
+		}
+	}
+	return dso
+}
+
+// mapsFile returns whether m maps a file, rather than anonymous memory
+// or a special region.
+func mapsFile(m *Mmap) bool {
+	return !m.Anonymous() && !m.Special()
+}
+
+// sortedMaps returns p's mappings in address order.
+func (p *PIDInfo) sortedMaps() []*Mmap {
+	maps := make([]*Mmap, len(p.maps))
+	copy(maps, p.maps)
+	sort.Sort(mmapSorter(maps))
+	return maps
+}
+
+// mmapSorter sorts Mmaps by address.
+type mmapSorter []*Mmap
+
+func (s mmapSorter) Len() int {
+	return len(s)
+}
+
+func (s mmapSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s mmapSorter) Less(i, j int) bool {
+	return s[i].Addr < s[j].Addr
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestMappedFile(t *testing.T) {
+	var _ perffile.MapBuilder = New(nil)
+
+	s := New(nil)
+	for _, r := range []perffile.Record{
+		mmapRecord(-1, 0xffffffff81000000, 0x1000000, "[kernel.kallsyms]_text"),
+		mmapRecord(1, 0x400000, 0x1000, "/bin/a"),
+		mmapRecord(1, 0x7f0000000000, 0x1000, "/lib/libc.so.6"),
+	} {
+		s.Update(r)
+	}
+	for _, test := range []struct {
+		pid  int
+		ip   uint64
+		want string
+	}{
+		{1, 0x400010, "/bin/a"},
+		{1, 0x7f0000000010, "/lib/libc.so.6"},
+		{1, 0xffffffff81000010, "[kernel.kallsyms]_text"},
+		{1, 0x10, ""},
+		{2, 0x400010, ""},
+	} {
+		got, ok := s.MappedFile(test.pid, test.ip)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("MappedFile(%d, %#x) = %q, %v, want %q", test.pid, test.ip, got, ok, test.want)
+		}
+	}
+}
+
+func TestDSOs(t *testing.T) {
+	seg := func(addr, len, off uint64, filename string, ino uint64) *perffile.RecordMmap {
+		r := mmapRecord(1, addr, len, filename)
+		r.FileOffset, r.Ino = off, ino
+		return r
+	}
+	s := New(nil)
+	for _, r := range []perffile.Record{
+		// libc's text segment is mapped before its read-only
+		// segment, and its data segment is not adjacent.
+		seg(0x7f0000001000, 0x1000, 0x1000, "/lib/libc.so.6", 7),
+		seg(0x7f0000000000, 0x1000, 0, "/lib/libc.so.6", 7),
+		seg(0x7f0000010000, 0x1000, 0x3000, "/lib/libc.so.6", 7),
+		seg(0x400000, 0x2000, 0, "/bin/a", 3),
+		// The same path with a different inode is a different
+		// file, such as a binary replaced while running.
+		seg(0x500000, 0x1000, 0, "/bin/a", 4),
+		seg(0x600000, 0x1000, 0, "//anon", 0),
+		seg(0x7ffe0000, 0x1000, 0, "[stack]", 0),
+	} {
+		s.Update(r)
+	}
+
+	var got []string
+	for _, d := range s.LookupPID(1).DSOs() {
+		var addrs []uint64
+		for _, m := range d.Segments {
+			addrs = append(addrs, m.Addr)
+		}
+		got = append(got, fmt.Sprintf("%s %d %#x", d.Filename, d.Ino, addrs))
+	}
+	want := []string{
+		"/bin/a 3 [0x400000]",
+		"/bin/a 4 [0x500000]",
+		"/lib/libc.so.6 7 [0x7f0000000000 0x7f0000001000 0x7f0000010000]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	d := s.LookupPID(1).LookupDSO(0x7f0000010010)
+	if d == nil || len(d.Segments) != 3 {
+		t.Fatalf("got DSO %+v, want libc with 3 segments", d)
+	}
+	for _, test := range []struct {
+		ip, off uint64
+		ok      bool
+	}{
+		{0x7f0000000010, 0x10, true},
+		{0x7f0000001010, 0x1010, true},
+		{0x7f0000010010, 0x3010, true},
+		{0x7f0000002000, 0, false},
+	} {
+		off, ok := d.FileOffsetOf(test.ip)
+		if off != test.off || ok != test.ok {
+			t.Errorf("%#x: got %#x, %v, want %#x, %v", test.ip, off, ok, test.off, test.ok)
+		}
+	}
+	if d := s.LookupPID(1).LookupDSO(0x600010); d != nil {
+		t.Errorf("got DSO %+v for anonymous mapping", d)
+	}
+}
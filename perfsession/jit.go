@@ -0,0 +1,205 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// JitdumpSource is a SymbolSource for code generated by just-in-time
+// compilers, such as the JVM, V8, or Python's perf trampolines. JITs
+// report the code they generate to perf by writing either a perf map
+// file, /tmp/perf-<pid>.map, or a jitdump file, jit-<pid>.dump. See
+// tools/perf/Documentation/jit-interface.txt and
+// jitdump-specification.txt in the Linux source.
+//
+// Unlike other SymbolSources, the Offsets of the symbols returned by
+// JitdumpSource are virtual addresses in the JIT process, since JIT
+// code has no backing file. Hence, it should be used as a Session's
+// JITSymbolSource, not as its SymbolSource.
+type JitdumpSource struct {
+	// Dir, if non-empty, is the directory to look for perf map
+	// and jitdump files in, rather than where they were when the
+	// profile was recorded. This is useful for analyzing a
+	// profile on a different machine.
+	Dir string
+}
+
+// Symbols returns the symbols in filename, which is either a perf map
+// file or, if it ends in ".dump", a jitdump file. buildID is ignored.
+func (j JitdumpSource) Symbols(buildID perffile.BuildID, filename string) ([]Symbol, error) {
+	if j.Dir != "" {
+		filename = filepath.Join(j.Dir, filepath.Base(filename))
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(filename, ".dump") {
+		return parseJitdump(f)
+	}
+	return parsePerfMap(f)
+}
+
+// parsePerfMap parses a perf map file. Each line of a perf map is the
+// hex start address and size of a function followed by its name,
+// which may contain spaces.
+func parsePerfMap(r io.Reader) ([]Symbol, error) {
+	syms := []Symbol{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		start, err1 := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		size, err2 := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		syms = append(syms, Symbol{Name: fields[2], Offset: start, Size: size})
+	}
+	return syms, scanner.Err()
+}
+
+// jitdump record types.
+const (
+	jitCodeLoad = 0
+	jitCodeMove = 1
+)
+
+// parseJitdump parses a jitdump file. Code that is moved by a
+// JIT_CODE_MOVE record is reported at its new address.
+func parseJitdump(r io.Reader) ([]Symbol, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header starts with the magic "JiTD" as a u32 in the
+	// byte order of the JIT process.
+	var order binary.ByteOrder = binary.LittleEndian
+	if len(data) < 12 {
+		return nil, fmt.Errorf("jitdump header is truncated")
+	}
+	switch order.Uint32(data) {
+	case 0x4A695444:
+	case 0x4454694A:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad jitdump magic %#x", order.Uint32(data))
+	}
+	hdrSize := order.Uint32(data[8:])
+	if uint64(hdrSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("jitdump header is truncated")
+	}
+	data = data[hdrSize:]
+
+	syms := []Symbol{}
+	byIndex := make(map[uint64]int)
+	for len(data) > 0 {
+		// Each record starts with its type, total size, and
+		// timestamp.
+		if len(data) < 16 {
+			return nil, fmt.Errorf("jitdump record header is truncated")
+		}
+		id, size := order.Uint32(data), order.Uint32(data[4:])
+		if size < 16 || uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("jitdump record has bad size %d", size)
+		}
+		rec := data[16:size]
+		data = data[size:]
+
+		switch id {
+		case jitCodeLoad:
+			// pid, tid, vma, code_addr, code_size,
+			// code_index, name, code.
+			if len(rec) < 40 {
+				return nil, fmt.Errorf("jitdump code load record is truncated")
+			}
+			addr, codeSize, index := order.Uint64(rec[16:]), order.Uint64(rec[24:]), order.Uint64(rec[32:])
+			name := rec[40:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			byIndex[index] = len(syms)
+			syms = append(syms, Symbol{Name: string(name), Offset: addr, Size: codeSize})
+
+		case jitCodeMove:
+			// pid, tid, vma, old_code_addr,
+			// new_code_addr, code_size, code_index.
+			if len(rec) < 48 {
+				return nil, fmt.Errorf("jitdump code move record is truncated")
+			}
+			if i, ok := byIndex[order.Uint64(rec[40:])]; ok {
+				syms[i].Offset, syms[i].Size = order.Uint64(rec[24:]), order.Uint64(rec[32:])
+			}
+		}
+		// Other records, such as debug and unwinding info,
+		// are ignored.
+	}
+	return syms, nil
+}
+
+// jitdumpPID returns the PID whose jitdump file is filename, or 0 if
+// filename is not a jitdump file. JITs mmap their jitdump file so
+// that perf records its path.
+func jitdumpPID(filename string) int {
+	var pid int
+	base := filepath.Base(filename)
+	if n, err := fmt.Sscanf(base, "jit-%d.dump", &pid); n != 1 || err != nil || base != fmt.Sprintf("jit-%d.dump", pid) {
+		return 0
+	}
+	return pid
+}
+
+// getJITSymbolicExtra returns the symbol tables for the JIT code of
+// process pid, or nil if they cannot be loaded. These come from
+// session.JITSymbolSource, using the process's jitdump file if the
+// profile recorded one, or otherwise its perf map file.
+func getJITSymbolicExtra(session *Session, pid int) *symbolicExtra {
+	if session.JITSymbolSource == nil {
+		return nil
+	}
+	filename, ok := session.jitdumps[pid]
+	if !ok {
+		filename = fmt.Sprintf("/tmp/perf-%d.map", pid)
+	}
+
+	tables, ok := session.Extra[symbolicExtraKey].(map[string]*symbolicExtra)
+	if !ok {
+		tables = make(map[string]*symbolicExtra)
+		session.Extra[symbolicExtraKey] = tables
+	}
+	if extra, ok := tables[filename]; ok {
+		return extra
+	}
+	syms, err := session.JITSymbolSource.Symbols(nil, filename)
+	if err != nil {
+		log.Printf("error loading JIT symbols from %s: %s", filename, err)
+	}
+	var extra *symbolicExtra
+	if syms != nil {
+		// functab is indexed by virtual address.
+		extra = &symbolicExtra{functab: symbolFuncTable(syms)}
+	}
+	tables[filename] = extra
+	return extra
+}
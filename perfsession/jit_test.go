@@ -0,0 +1,100 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestParsePerfMap(t *testing.T) {
+	syms, err := parsePerfMap(bytes.NewReader([]byte(`7f0000001000 40 LazyCompile:~f a.js:1
+0x7f0000001040 0x20 g
+bad line
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Symbol{
+		{"LazyCompile:~f a.js:1", 0x7f0000001000, 0x40},
+		{"g", 0x7f0000001040, 0x20},
+	}
+	if !reflect.DeepEqual(syms, want) {
+		t.Errorf("got %+v, want %+v", syms, want)
+	}
+}
+
+// jitdump returns a jitdump file containing a code load record for
+// each of funcs, followed by moves.
+func jitdump(funcs []Symbol, moves [][2]uint64) []byte {
+	var buf bytes.Buffer
+	w := func(x interface{}) { binary.Write(&buf, binary.LittleEndian, x) }
+	w([]uint32{0x4A695444, 1, 40, 62, 0, 42})
+	w([]uint64{0, 0})
+	for i, fn := range funcs {
+		w([]uint32{jitCodeLoad, uint32(16 + 40 + len(fn.Name) + 1 + 4)})
+		w(uint64(0))
+		w([]uint32{42, 42})
+		w([]uint64{fn.Offset, fn.Offset, fn.Size, uint64(i)})
+		buf.WriteString(fn.Name + "\x00")
+		buf.Write([]byte{0x90, 0x90, 0x90, 0xc3})
+	}
+	for _, mv := range moves {
+		w([]uint32{jitCodeMove, 16 + 48})
+		w(uint64(0))
+		w([]uint32{42, 42})
+		w([]uint64{0, 0, mv[1], 0x10, mv[0]})
+	}
+	// A debug info record, which should be ignored.
+	w([]uint32{2, 24})
+	w([]uint64{0, 0})
+	return buf.Bytes()
+}
+
+func TestParseJitdump(t *testing.T) {
+	data := jitdump([]Symbol{{"f", 0x1000, 0x10}, {"g", 0x2000, 0x20}}, [][2]uint64{{0, 0x3000}})
+	syms, err := parseJitdump(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Symbol{{"f", 0x3000, 0x10}, {"g", 0x2000, 0x20}}
+	if !reflect.DeepEqual(syms, want) {
+		t.Errorf("got %+v, want %+v", syms, want)
+	}
+
+	if _, err := parseJitdump(bytes.NewReader(data[:len(data)-4])); err == nil {
+		t.Errorf("want error for truncated jitdump")
+	}
+}
+
+func TestSymbolizeJIT(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "perf-41.map"), []byte("1000 10 mapfn\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "jit-42.dump"), jitdump([]Symbol{{"dumpfn", 0x1000, 0x10}}, nil), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(&perffile.File{})
+	s.JITSymbolSource = JitdumpSource{Dir: dir}
+	s.Update(mmapRecord(41, 0x1000, 0x1000, "//anon"))
+	s.Update(mmapRecord(42, 0x1000, 0x1000, "//anon"))
+	s.Update(mmapRecord(42, 0x10000, 0x1000, "/home/u/.debug/jit/java-jit-1/jit-42.dump"))
+	for pid, want := range map[int]string{41: "mapfn", 42: "dumpfn"} {
+		var sym Symbolic
+		if !Symbolize(s, s.LookupPID(pid).LookupMmap(0x1004), 0x1004, &sym) || sym.FuncName != want {
+			t.Errorf("PID %d: got %q, want %q", pid, sym.FuncName, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import "github.com/aclements/go-perf/perffile"
+
+// A ProcessTree records the parent/child relationships between
+// processes over the course of a recording, as reconstructed from
+// fork, exit, and comm records.
+//
+// Because PIDs may be reused during a recording, a process is
+// identified by both its PID and a time. Each PID maps to a sequence
+// of Process instances with disjoint lifetimes.
+//
+// The zero value is an empty ProcessTree ready to use.
+type ProcessTree struct {
+	procs map[int][]*Process
+}
+
+// A Process is a single process in a ProcessTree.
+type Process struct {
+	PID  int
+	Comm string
+
+	// Start and End are the times at which this process was
+	// forked and exited. Start is 0 if the process was created
+	// before the recording began and End is 0 if the process did
+	// not exit before the recording ended.
+	Start, End uint64
+
+	// Parent is the process that forked this process, or nil if
+	// unknown.
+	Parent *Process
+
+	// Children are the processes forked by this process, in the
+	// order they were forked.
+	Children []*Process
+}
+
+// NewProcessTree reconstructs the process tree of f.
+func NewProcessTree(f *perffile.File) (*ProcessTree, error) {
+	t := new(ProcessTree)
+	rs := f.Records(perffile.RecordsTimeOrder)
+	rs.OnlyTypes(perffile.RecordTypeFork, perffile.RecordTypeExit, perffile.RecordTypeComm)
+	for rs.Next() {
+		t.Update(rs.Record)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Update updates t to reflect record r. Records must be passed to
+// Update in time order. Records other than fork, exit, and comm
+// records are ignored, as are forks and exits of threads and comm
+// changes of threads other than by exec.
+func (t *ProcessTree) Update(r perffile.Record) {
+	switch r := r.(type) {
+	case *perffile.RecordComm:
+		if r.PID != r.TID && !r.Exec {
+			// A thread renamed itself, which doesn't rename
+			// the process.
+			break
+		}
+		time := r.Time
+		if r.Format&perffile.SampleFormatTime == 0 {
+			// Without a time, assume this is for the
+			// latest process with this PID.
+			time = ^uint64(0)
+		}
+		t.ensure(r.PID, time).Comm = r.Comm
+
+	case *perffile.RecordExit:
+		if r.PID != r.TID {
+			// Thread exit
+			break
+		}
+		t.ensure(r.PID, r.Time).End = r.Time
+
+	case *perffile.RecordFork:
+		if r.PID != r.TID {
+			// Thread creation
+			break
+		}
+		parent := t.ensure(r.PPID, r.Time)
+		child := &Process{
+			PID:    r.PID,
+			Comm:   parent.Comm,
+			Start:  r.Time,
+			Parent: parent,
+		}
+		parent.Children = append(parent.Children, child)
+		if t.procs == nil {
+			t.procs = make(map[int][]*Process)
+		}
+		t.procs[r.PID] = append(t.procs[r.PID], child)
+	}
+}
+
+// ensure returns the process with the given PID at time, creating a
+// process with unknown start time and parent if there is none.
+func (t *ProcessTree) ensure(pid int, time uint64) *Process {
+	if p := t.Lookup(pid, time); p != nil {
+		return p
+	}
+	if t.procs == nil {
+		t.procs = make(map[int][]*Process)
+	}
+	p := &Process{PID: pid}
+	if len(t.procs[pid]) > 0 {
+		// The process must have started after the previous
+		// process with this PID exited.
+		p.Start = time
+	}
+	t.procs[pid] = append(t.procs[pid], p)
+	return p
+}
+
+// Lookup returns the process with the given PID that was running at
+// time, or nil if there is no such process.
+func (t *ProcessTree) Lookup(pid int, time uint64) *Process {
+	ps := t.procs[pid]
+	for i := len(ps) - 1; i >= 0; i-- {
+		p := ps[i]
+		if p.Start <= time {
+			if p.End != 0 && time > p.End {
+				return nil
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+// Ancestors returns the PIDs of the ancestors of the process with the
+// given PID that was running at time, starting with its parent. It
+// returns nil if there is no such process or its parent is unknown.
+func (t *ProcessTree) Ancestors(pid int, time uint64) []int {
+	p := t.Lookup(pid, time)
+	if p == nil {
+		return nil
+	}
+	var out []int
+	for p = p.Parent; p != nil; p = p.Parent {
+		out = append(out, p.PID)
+	}
+	return out
+}
+
+// Children returns the PIDs of the processes forked by the process
+// with the given PID that was running at time, in the order they were
+// forked.
+func (t *ProcessTree) Children(pid int, time uint64) []int {
+	p := t.Lookup(pid, time)
+	if p == nil {
+		return nil
+	}
+	out := make([]int, len(p.Children))
+	for i, c := range p.Children {
+		out[i] = c.PID
+	}
+	return out
+}
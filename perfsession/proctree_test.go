@@ -0,0 +1,69 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestProcessTree(t *testing.T) {
+	fork := func(pid, ppid int, time uint64) perffile.Record {
+		return &perffile.RecordFork{RecordCommon: perffile.RecordCommon{PID: pid, TID: pid, Time: time}, PPID: ppid, PTID: ppid}
+	}
+	exit := func(pid, ppid int, time uint64) perffile.Record {
+		return &perffile.RecordExit{RecordCommon: perffile.RecordCommon{PID: pid, TID: pid, Time: time}, PPID: ppid, PTID: ppid}
+	}
+	comm := func(pid int, time uint64, name string) perffile.Record {
+		return &perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: pid, TID: pid, Time: time, Format: perffile.SampleFormatTime}, Comm: name, Exec: true}
+	}
+
+	var tree ProcessTree
+	for _, r := range []perffile.Record{
+		comm(1, 0, "make"),
+		fork(10, 1, 10),
+		comm(10, 11, "go"),
+		fork(20, 10, 20),
+		// Thread creation should be ignored.
+		&perffile.RecordFork{RecordCommon: perffile.RecordCommon{PID: 20, TID: 21, Time: 21}, PPID: 20, PTID: 20},
+		comm(20, 22, "compile"),
+		// A thread renaming itself doesn't rename the process.
+		&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 20, TID: 21, Time: 23, Format: perffile.SampleFormatTime}, Comm: "worker"},
+		exit(20, 10, 30),
+		exit(10, 1, 40),
+		// Reuse PID 10.
+		fork(10, 1, 50),
+	} {
+		tree.Update(r)
+	}
+
+	if got, want := tree.Ancestors(20, 25), []int{10, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ancestors(20, 25) = %v, want %v", got, want)
+	}
+	if got := tree.Ancestors(20, 35); got != nil {
+		t.Errorf("Ancestors(20, 35) = %v, want nil", got)
+	}
+	if got, want := tree.Children(10, 25), []int{20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Children(10, 25) = %v, want %v", got, want)
+	}
+	if got, want := tree.Children(1, 100), []int{10, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Children(1, 100) = %v, want %v", got, want)
+	}
+	if p := tree.Lookup(20, 25); p == nil || p.Comm != "compile" || p.Start != 20 || p.End != 30 {
+		t.Errorf("Lookup(20, 25) = %+v", p)
+	}
+	if p := tree.Lookup(10, 45); p != nil {
+		t.Errorf("Lookup(10, 45) = %+v, want nil", p)
+	}
+	p := tree.Lookup(10, 60)
+	if p == nil || p.Comm != "make" || p.Start != 50 || len(p.Children) != 0 {
+		t.Errorf("Lookup(10, 60) = %+v, want new process forked from make", p)
+	}
+	if got, want := tree.Ancestors(10, 60), []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ancestors(10, 60) = %v, want %v", got, want)
+	}
+}
@@ -4,7 +4,13 @@
 
 package perfsession
 
-import "github.com/aclements/go-perf/perffile"
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
 
 // TODO: Per-TID state.
 
@@ -14,6 +20,78 @@ type Session struct {
 
 	File  *perffile.File
 	Extra map[ExtraKey]interface{}
+
+	// CoalesceMmaps enables merging adjacent mappings of the
+	// same file into a single Mmap as they are recorded. This
+	// reduces the size of the address space map and speeds up
+	// lookups for processes with many small mappings, such as
+	// JITs and programs with large heaps.
+	//
+	// Two mappings are merged only if they map the same file
+	// with the same protection, and the distance between their
+	// file offsets equals the distance between their addresses,
+	// so file offsets computed from the merged mapping are still
+	// correct. CoalesceGap is the largest unmapped gap between
+	// two mappings that will be merged. Addresses in such a gap
+	// will be treated as part of the merged mapping.
+	CoalesceMmaps bool
+	CoalesceGap   uint64
+
+	// AdjustReturnAddresses causes SymbolizeCallchain to
+	// subtract 1 from every callchain IP except the first. These
+	// IPs are return addresses, which point to the instruction
+	// after the call, so without adjustment they can be
+	// attributed to the wrong line or, if the call is the last
+	// instruction of a function, to the wrong function.
+	AdjustReturnAddresses bool
+
+	// SymbolCache, if non-nil, is used to share parsed symbol
+	// tables with other Sessions, keyed by build ID.
+	SymbolCache *SymbolCache
+
+	// SymbolSource, if non-nil, supplies the symbols of user
+	// binaries. Symbolize uses it before looking for binaries on
+	// the local file system, and only falls back to local files
+	// if the source does not have a binary. Line information for
+	// these binaries comes from DWARFSource, from SymbolSource
+	// itself if it is also a DWARFSource, or from the local
+	// binary, if it has the same build ID.
+	SymbolSource SymbolSource
+
+	// JITSymbolSource, if non-nil, supplies the symbols of code
+	// generated by just-in-time compilers, which Symbolize uses
+	// for JIT mappings (see Mmap.JIT). Symbolize calls its
+	// Symbols method with the path of the process's jitdump file
+	// if the profile recorded one, or otherwise the path of its
+	// perf map file, /tmp/perf-<pid>.map. The Offsets of the
+	// symbols it returns are virtual addresses. See
+	// JitdumpSource.
+	JITSymbolSource SymbolSource
+
+	// DWARFSource, if non-nil, supplies the DWARF debug info
+	// SymbolizeInline uses to expand inlined calls. If it is nil
+	// or does not have debug info for a binary, SymbolizeInline
+	// uses the binary's own DWARF debug info, if any.
+	DWARFSource DWARFSource
+
+	// jitdumps maps from PID to the path of that process's
+	// jitdump file.
+	jitdumps map[int]string
+
+	// history records, for each PID, the processes that have had
+	// that PID, in the order they started. See LookupPIDAt.
+	history map[int][]pidEpoch
+}
+
+// A pidEpoch is a period during which a PID identified a single
+// process with a single address space.
+type pidEpoch struct {
+	// start is the time of the record that started this epoch.
+	start uint64
+
+	// info is the state of the process, or nil if the PID was
+	// not in use.
+	info *PIDInfo
 }
 
 func New(f *perffile.File) *Session {
@@ -32,7 +110,21 @@ func New(f *perffile.File) *Session {
 	}
 }
 
+// Update updates the session state to reflect record r. Records must
+// be passed to Update in causal order (see perffile.RecordsCausalOrder)
+// for the session to track process address spaces correctly.
+//
+// Each PID's state, including its memory mappings, reflects the
+// records seen so far. When a process execs, it gets a new PIDInfo
+// without the mappings of the old program, and when a PID exits and
+// is later reused, the new process starts with the mappings of its
+// parent rather than those of the exited process. The earlier
+// PIDInfos remain available by time through LookupPIDAt.
 func (s *Session) Update(r perffile.Record) {
+	var time uint64
+	if c := r.Common(); c.Format&perffile.SampleFormatTime != 0 {
+		time = c.Time
+	}
 	ensurePID := func(pid int) *PIDInfo {
 		pidInfo, ok := s.pidInfo[pid]
 		if !ok {
@@ -40,30 +132,59 @@ func (s *Session) Update(r perffile.Record) {
 				kernel: s.kernel,
 				Extra:  make(ForkableExtra),
 			}
-			s.pidInfo[pid] = pidInfo
+			start := time
+			if len(s.history[pid]) == 0 {
+				// This process started before the
+				// recording.
+				start = 0
+			}
+			s.setPID(pid, start, pidInfo)
 		}
 		return pidInfo
 	}
 
 	switch r := r.(type) {
 	case *perffile.RecordComm:
-		ensurePID(r.PID).Comm = r.Comm
+		info := ensurePID(r.PID)
+		if r.Exec {
+			// exec replaces the address space. The kernel
+			// emits the exec's COMM record before the
+			// mmaps of the new program.
+			info = &PIDInfo{Extra: info.Extra, kernel: info.kernel}
+			s.setPID(r.PID, time, info)
+		}
+		info.Comm = r.Comm
 
 	case *perffile.RecordExit:
 		if r.PID == r.TID {
-			delete(s.pidInfo, r.PID)
+			s.setPID(r.PID, time, nil)
 		}
 		// Otherwise this is thread exit
 
 	case *perffile.RecordFork:
 		if r.PID == r.TID {
-			s.pidInfo[r.PID] = ensurePID(r.PPID).fork(r.PID)
+			s.setPID(r.PID, time, ensurePID(r.PPID).fork(r.PID))
 		}
 		// Otherwise this is thread creation
 
 	case *perffile.RecordMmap:
+		if r.IsKernel() && isKernelImage(r.Filename) {
+			r = kernelImageMmap(r)
+		}
+		if pid := jitdumpPID(r.Filename); pid != 0 {
+			if s.jitdumps == nil {
+				s.jitdumps = make(map[int]string)
+			}
+			s.jitdumps[pid] = r.Filename
+		}
 		info := ensurePID(r.PID)
+		if r.Misc.ProcMapParseTimeout {
+			info.MapParseError = true
+		}
 		info.munmap(r.Addr, r.Len)
+		if s.CoalesceMmaps && info.coalesce(r, s.CoalesceGap) {
+			break
+		}
 		info.maps = append(info.maps, &Mmap{make(ForkableExtra), *r})
 
 	case *perffile.RecordSample:
@@ -73,14 +194,63 @@ func (s *Session) Update(r perffile.Record) {
 	}
 }
 
+// setPID starts a new epoch of pid at time in which it is described
+// by info, or is not in use if info is nil.
+func (s *Session) setPID(pid int, time uint64, info *PIDInfo) {
+	if info == nil {
+		delete(s.pidInfo, pid)
+	} else {
+		s.pidInfo[pid] = info
+	}
+	if s.history == nil {
+		s.history = make(map[int][]pidEpoch)
+	}
+	s.history[pid] = append(s.history[pid], pidEpoch{time, info})
+}
+
+// LookupPID returns the current state of process pid, or nil if pid
+// is not in use.
 func (s *Session) LookupPID(pid int) *PIDInfo {
 	return s.pidInfo[pid]
 }
 
+// LookupPIDAt returns the state of process pid at time, or nil if pid
+// was not in use at time. Unlike LookupPID, this finds processes that
+// have since exited or exec'd, so samples can be attributed to the
+// right process and address space after all records have been
+// passed to Update. Records without times are treated as happening
+// at time 0.
+//
+// A PIDInfo returned by LookupPIDAt reflects all of the records of
+// that process, including mappings that were added or removed after
+// time, until the process exited or exec'd.
+func (s *Session) LookupPIDAt(pid int, time uint64) *PIDInfo {
+	if pid == -1 {
+		return s.kernel
+	}
+	epochs := s.history[pid]
+	i := sort.Search(len(epochs), func(i int) bool {
+		return epochs[i].start > time
+	})
+	if i == 0 {
+		return nil
+	}
+	return epochs[i-1].info
+}
+
 type PIDInfo struct {
 	Extra ForkableExtra
 
-	Comm   string
+	Comm string
+
+	// MapParseError indicates that perf timed out reading this
+	// process's /proc/<pid>/maps when it synthesized the
+	// process's initial mmap records, so its memory map may be
+	// incomplete. Perf flags this on the mmap records it
+	// synthesized (see perffile.MiscFlags.ProcMapParseTimeout).
+	// It is cleared when the process execs.
+	MapParseError bool
+
 	kernel *PIDInfo
 	maps   []*Mmap
 }
@@ -90,7 +260,7 @@ func (p *PIDInfo) fork(pid int) *PIDInfo {
 	for i, mmap := range p.maps {
 		maps[i] = mmap.fork(pid)
 	}
-	return &PIDInfo{p.Extra.Fork(pid).(ForkableExtra), p.Comm, p.kernel, maps}
+	return &PIDInfo{p.Extra.Fork(pid).(ForkableExtra), p.Comm, p.MapParseError, p.kernel, maps}
 }
 
 func (p *PIDInfo) munmap(addr, mlen uint64) {
@@ -136,6 +306,58 @@ func (p *PIDInfo) munmap(addr, mlen uint64) {
 	p.maps = nmaps
 }
 
+// coalesce attempts to merge r into an existing mapping that maps an
+// adjacent range of the same file. It returns true if successful.
+func (p *PIDInfo) coalesce(r *perffile.RecordMmap, gap uint64) bool {
+	var into *Mmap
+	for _, mmap := range p.maps {
+		if coalesceMmap(&mmap.RecordMmap, r, gap) {
+			into = mmap
+			break
+		}
+	}
+	if into == nil {
+		return false
+	}
+
+	// r may have bridged two existing mappings, so keep merging
+	// the grown mapping until no other mapping is adjacent.
+	for merged := true; merged; {
+		merged = false
+		for i, mmap := range p.maps {
+			if mmap != into && coalesceMmap(&into.RecordMmap, &mmap.RecordMmap, gap) {
+				p.maps = append(p.maps[:i], p.maps[i+1:]...)
+				merged = true
+				break
+			}
+		}
+	}
+	return true
+}
+
+// coalesceMmap extends m to also cover r if they map adjacent ranges
+// of the same file. It returns true if successful.
+func coalesceMmap(m, r *perffile.RecordMmap, gap uint64) bool {
+	if m.Filename != r.Filename || m.Ino != r.Ino || m.Major != r.Major || m.Minor != r.Minor || m.Prot != r.Prot || m.Flags != r.Flags || m.Data != r.Data {
+		return false
+	}
+	lo, hi := m, r
+	if r.Addr < m.Addr {
+		lo, hi = r, m
+	}
+	loEnd := lo.Addr + lo.Len
+	if hi.Addr < loEnd || hi.Addr-loEnd > gap {
+		return false
+	}
+	if hi.Addr-lo.Addr != hi.FileOffset-lo.FileOffset {
+		return false
+	}
+	end := hi.Addr + hi.Len
+	m.Addr, m.FileOffset = lo.Addr, lo.FileOffset
+	m.Len = end - m.Addr
+	return true
+}
+
 func (p *PIDInfo) mapFind(addr uint64) *Mmap {
 	for _, mmap := range p.maps {
 		if mmap.Addr <= addr && addr < mmap.Addr+mmap.Len {
@@ -159,6 +381,104 @@ type Mmap struct {
 	perffile.RecordMmap
 }
 
+// KernelModule returns the name of the kernel module mapped by m, or
+// "" if m does not map a kernel module. perf records module mappings
+// in the kernel's address space (PID -1) with either the module's
+// name in brackets, such as "[nvme]", or the path of the module's
+// object file. Module names use "_" in place of "-", as in
+// /proc/modules.
+func (m *Mmap) KernelModule() string {
+	if !m.IsKernel() {
+		return ""
+	}
+	name := m.Filename
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		name = name[1 : len(name)-1]
+		if strings.HasPrefix(name, "kernel.kallsyms") || strings.HasPrefix(name, "guest.kernel") || name == "vdso" || name == "vsyscall" {
+			return ""
+		}
+	} else {
+		name = path.Base(name)
+		for _, ext := range []string{".gz", ".xz", ".zst"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		if !strings.HasSuffix(name, ".ko") {
+			return ""
+		}
+		name = strings.TrimSuffix(name, ".ko")
+	}
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// isKernelImage returns whether filename is the name perf uses for the
+// mapping of the host kernel image, such as "[kernel.kallsyms]_text".
+// Guest kernels are not the host kernel, so their symbols can't be
+// found the same way.
+func isKernelImage(filename string) bool {
+	return strings.HasPrefix(filename, "[kernel.kallsyms]")
+}
+
+// kernelImageMmap returns r, a mapping of the kernel image, with its
+// range fixed up like perf does. Some perf versions record a
+// zero-sized kernel mapping or one that ends at 2^64, which
+// overflows. Both mean the kernel extends to the top of the address
+// space. See machine__set_kernel_mmap in tools/perf/util/machine.c.
+func kernelImageMmap(r *perffile.RecordMmap) *perffile.RecordMmap {
+	if !(r.Addr == 0 && r.Len == 0) && r.Addr+r.Len >= r.Addr {
+		return r
+	}
+	nr := *r
+	nr.Len = ^uint64(0) - r.Addr
+	return &nr
+}
+
+// kernelRefSym returns the name of the symbol perf uses to relocate
+// the kernel image mapped by m and that symbol's address when the
+// profile was recorded. perf appends the symbol's name to the name of
+// the kernel mapping, as in "[kernel.kallsyms]_text", and records its
+// address in the mapping's file offset. It returns "", 0 if m does
+// not map the kernel image or the symbol is unknown.
+func (m *Mmap) kernelRefSym() (name string, addr uint64) {
+	if !m.IsKernel() || !isKernelImage(m.Filename) {
+		return "", 0
+	}
+	i := strings.Index(m.Filename, "]")
+	if i < 0 || i+1 == len(m.Filename) {
+		return "", 0
+	}
+	return m.Filename[i+1:], m.FileOffset
+}
+
+// Special returns whether m maps a special memory region with no
+// backing file, such as the vDSO, the stack, or the heap. For these
+// regions, Filename is the name of the region in brackets, such as
+// "[vdso]", "[stack]", or "[heap]".
+func (m *Mmap) Special() bool {
+	return !m.IsKernel() && strings.HasPrefix(m.Filename, "[") && strings.HasSuffix(m.Filename, "]")
+}
+
+// Anonymous returns whether m maps anonymous memory, which has no
+// backing file. perf names anonymous mappings "//anon", or
+// "[anon:name]" for mappings a process has named, and also treats
+// mappings of /dev/zero and anonymous huge pages as anonymous. See
+// is_anon_memory in tools/perf/util/map.c.
+func (m *Mmap) Anonymous() bool {
+	name := m.Filename
+	return !m.IsKernel() && (name == "//anon" || strings.HasPrefix(name, "[anon:") || strings.HasPrefix(name, "/dev/zero") || strings.HasPrefix(name, "/anon_hugepage"))
+}
+
+// JIT returns whether m is an anonymous executable mapping. These
+// typically contain code generated by a just-in-time compiler, such
+// as the JVM or V8, whose symbols cannot be found in any binary.
+// Instead, JITs can write their symbols to a perf map or jitdump
+// file for the process.
+//
+// The kernel only records whether a mapping is executable in
+// RecordMmap.Data, which is set for non-executable mappings.
+func (m *Mmap) JIT() bool {
+	return m.Anonymous() && !m.Data
+}
+
 func (m *Mmap) fork(pid int) *Mmap {
 	return &Mmap{m.Extra.Fork(pid).(ForkableExtra), m.RecordMmap}
 }
@@ -0,0 +1,212 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func mmapRecord(pid int, addr, len uint64, filename string) *perffile.RecordMmap {
+	return &perffile.RecordMmap{
+		RecordCommon: perffile.RecordCommon{PID: pid, TID: pid},
+		Addr:         addr,
+		Len:          len,
+		Filename:     filename,
+	}
+}
+
+func lookupFile(s *Session, pid int, addr uint64) string {
+	info := s.LookupPID(pid)
+	if info == nil {
+		return "<no pid>"
+	}
+	m := info.LookupMmap(addr)
+	if m == nil {
+		return ""
+	}
+	return m.Filename
+}
+
+func TestPIDReuse(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/sbin/init"))
+
+	s.Update(&perffile.RecordFork{RecordCommon: perffile.RecordCommon{PID: 100, TID: 100}, PPID: 1, PTID: 1})
+	s.Update(mmapRecord(100, 0x400000, 0x1000, "/bin/a"))
+	if got := lookupFile(s, 100, 0x400000); got != "/bin/a" {
+		t.Fatalf("before exit, got %q, want /bin/a", got)
+	}
+
+	s.Update(&perffile.RecordExit{RecordCommon: perffile.RecordCommon{PID: 100, TID: 100}, PPID: 1, PTID: 1})
+	if got := lookupFile(s, 100, 0x400000); got != "<no pid>" {
+		t.Errorf("after exit, got %q, want no PID", got)
+	}
+
+	// Reuse PID 100 for a different binary.
+	s.Update(&perffile.RecordFork{RecordCommon: perffile.RecordCommon{PID: 100, TID: 100}, PPID: 1, PTID: 1})
+	if got := lookupFile(s, 100, 0x400000); got != "" {
+		t.Errorf("after reuse, got %q, want no mapping", got)
+	}
+	if got := lookupFile(s, 100, 0x1000); got != "/sbin/init" {
+		t.Errorf("after reuse, got %q, want parent mapping /sbin/init", got)
+	}
+	s.Update(&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 100, TID: 100}, Comm: "b", Exec: true})
+	s.Update(mmapRecord(100, 0x400000, 0x2000, "/bin/b"))
+	if got := lookupFile(s, 100, 0x400000); got != "/bin/b" {
+		t.Errorf("after reuse, got %q, want /bin/b", got)
+	}
+	if got := lookupFile(s, 100, 0x1000); got != "" {
+		t.Errorf("after exec, got %q, want no mapping", got)
+	}
+	if s.LookupPID(100).Comm != "b" {
+		t.Errorf("after reuse, got comm %q, want b", s.LookupPID(100).Comm)
+	}
+}
+
+func TestLookupPIDAt(t *testing.T) {
+	at := func(time uint64) perffile.RecordCommon {
+		return perffile.RecordCommon{PID: 100, TID: 100, Time: time, Format: perffile.SampleFormatTime}
+	}
+	mmap := func(time uint64, filename string) *perffile.RecordMmap {
+		r := mmapRecord(100, 0x400000, 0x1000, filename)
+		r.RecordCommon = at(time)
+		return r
+	}
+
+	// PID 100 runs /bin/a, execs /bin/b, exits, and is reused
+	// for /bin/c.
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/sbin/init"))
+	for _, r := range []perffile.Record{
+		&perffile.RecordFork{RecordCommon: at(10), PPID: 1, PTID: 1},
+		&perffile.RecordComm{RecordCommon: at(11), Comm: "a", Exec: true},
+		mmap(12, "/bin/a"),
+		&perffile.RecordComm{RecordCommon: at(20), Comm: "b", Exec: true},
+		mmap(21, "/bin/b"),
+		&perffile.RecordExit{RecordCommon: at(30), PPID: 1, PTID: 1},
+		&perffile.RecordFork{RecordCommon: at(40), PPID: 1, PTID: 1},
+		&perffile.RecordComm{RecordCommon: at(41), Comm: "c", Exec: true},
+		mmap(42, "/bin/c"),
+	} {
+		s.Update(r)
+	}
+
+	for _, test := range []struct {
+		time       uint64
+		comm, file string
+	}{
+		{5, "", ""},
+		{10, "", "/sbin/init"},
+		{15, "a", "/bin/a"},
+		{25, "b", "/bin/b"},
+		{35, "", ""},
+		{45, "c", "/bin/c"},
+	} {
+		info := s.LookupPIDAt(100, test.time)
+		if info == nil {
+			if test.file != "" {
+				t.Errorf("at %d: no process, want %s", test.time, test.file)
+			}
+			continue
+		}
+		if test.file == "" {
+			t.Errorf("at %d: got process %q, want none", test.time, info.Comm)
+			continue
+		}
+		file := ""
+		if m := info.LookupMmap(0x400000); m != nil {
+			file = m.Filename
+		} else if m := info.LookupMmap(0x1000); m != nil {
+			file = m.Filename
+		}
+		if info.Comm != test.comm || file != test.file {
+			t.Errorf("at %d: got %q running %s, want %q running %s", test.time, info.Comm, file, test.comm, test.file)
+		}
+	}
+	if got := s.LookupPIDAt(1, 100); got != s.LookupPID(1) {
+		t.Errorf("LookupPIDAt(1, 100) = %p, want current process %p", got, s.LookupPID(1))
+	}
+}
+
+func TestCoalesceMmaps(t *testing.T) {
+	type m struct {
+		addr, len, off uint64
+		file           string
+	}
+	for _, test := range []struct {
+		name  string
+		gap   uint64
+		mmaps []m
+		want  []m
+	}{
+		{"adjacent", 0,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x2000, 0x1000, 0x1000, "a"}},
+			[]m{{0x1000, 0x2000, 0, "a"}}},
+		{"below", 0,
+			[]m{{0x2000, 0x1000, 0x1000, "a"}, {0x1000, 0x1000, 0, "a"}},
+			[]m{{0x1000, 0x2000, 0, "a"}}},
+		{"offset mismatch", 0,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x2000, 0x1000, 0x5000, "a"}},
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x2000, 0x1000, 0x5000, "a"}}},
+		{"gap", 0x1000,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x3000, 0x1000, 0x2000, "a"}},
+			[]m{{0x1000, 0x3000, 0, "a"}}},
+		{"gap too large", 0x1000,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x4000, 0x1000, 0x3000, "a"}},
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x4000, 0x1000, 0x3000, "a"}}},
+		{"different file", 0,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x2000, 0x1000, 0x1000, "b"}},
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x2000, 0x1000, 0x1000, "b"}}},
+		{"bridge", 0,
+			[]m{{0x1000, 0x1000, 0, "a"}, {0x3000, 0x1000, 0x2000, "a"}, {0x2000, 0x1000, 0x1000, "a"}},
+			[]m{{0x1000, 0x3000, 0, "a"}}},
+		{"bridge other file", 0,
+			[]m{{0x1000, 0x1000, 0, "b"}, {0x2000, 0x1000, 0, "a"}, {0x4000, 0x1000, 0x2000, "a"}, {0x3000, 0x1000, 0x1000, "a"}},
+			[]m{{0x1000, 0x1000, 0, "b"}, {0x2000, 0x3000, 0, "a"}}},
+	} {
+		s := New(nil)
+		s.CoalesceMmaps, s.CoalesceGap = true, test.gap
+		for _, mm := range test.mmaps {
+			r := mmapRecord(1, mm.addr, mm.len, mm.file)
+			r.FileOffset = mm.off
+			s.Update(r)
+		}
+		var got []m
+		for _, mmap := range s.LookupPID(1).maps {
+			got = append(got, m{mmap.Addr, mmap.Len, mmap.FileOffset, mmap.Filename})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJIT(t *testing.T) {
+	for _, test := range []struct {
+		pid       int
+		filename  string
+		data      bool
+		anon, jit bool
+	}{
+		{1, "//anon", false, true, true},
+		{1, "//anon", true, true, false},
+		{1, "[anon:v8]", false, true, true},
+		{1, "/dev/zero (deleted)", false, true, true},
+		{1, "/anon_hugepage (deleted)", false, true, true},
+		{1, "/bin/a", false, false, false},
+		{1, "[heap]", false, false, false},
+		{-1, "//anon", false, false, false},
+	} {
+		r := mmapRecord(test.pid, 0x1000, 0x1000, test.filename)
+		r.Data = test.data
+		m := &Mmap{RecordMmap: *r}
+		if m.Anonymous() != test.anon || m.JIT() != test.jit {
+			t.Errorf("%+v: got Anonymous %v, JIT %v", test, m.Anonymous(), m.JIT())
+		}
+	}
+}
@@ -6,10 +6,14 @@ package perfsession
 
 import (
 	"bufio"
+	"bytes"
 	"debug/dwarf"
 	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
@@ -18,35 +22,186 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/aclements/go-perf/perffile"
 	"github.com/ianlancetaylor/demangle"
 )
 
 type Symbolic struct {
 	FuncName string
 	Line     dwarf.LineEntry
+
+	// MapParseError indicates that perf timed out reading the
+	// process's /proc/<pid>/maps when the profile was recorded,
+	// so the process's memory map may be incomplete and this
+	// frame may be unresolved or resolved to the wrong mapping.
+	// It is only set by SymbolizeCallchain and Symbolizer, which
+	// know the sample's process. See PIDInfo.MapParseError.
+	MapParseError bool
 }
 
 // TODO: Take a PID and look up the mmap.
 
 func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
-	s := getSymbolicExtra(session, mmap.Filename)
+	s := symbolicFor(session, mmap)
 	if s == nil {
+		if mmap.Special() {
+			*out = Symbolic{FuncName: mmap.Filename}
+			return true
+		}
 		return false
 	}
-	f, l := s.findIP(mmap, ip)
+	f, l, _ := s.findIP(mmap, ip)
 	if f == nil {
 		out.FuncName = ""
 	} else {
 		out.FuncName = f.name
 	}
-	if l == nil {
-		out.Line = dwarf.LineEntry{}
-	} else {
-		out.Line = *l
-	}
+	out.Line = l
 	return true
 }
 
+// SymbolizeCallchain symbolizes each IP in r.Callchain, skipping
+// callchain context markers, and returns the results starting from
+// the sampled instruction. IPs that can't be symbolized have a zero
+// Symbolic. If session.AdjustReturnAddresses is set, all IPs except
+// the first are treated as return addresses and adjusted to point
+// into the call instruction before lookup.
+//
+// Kernel IPs are looked up only in the kernel's mappings. Guest and
+// hypervisor IPs aren't in any address space the session tracks, so
+// they always have a zero Symbolic.
+func SymbolizeCallchain(session *Session, r *perffile.RecordSample) []Symbolic {
+	pidInfo := session.LookupPID(r.PID)
+	var out []Symbolic
+	r.WalkCallchain(func(i int, ip uint64, mode perffile.CPUMode) bool {
+		if session.AdjustReturnAddresses && len(out) > 0 {
+			ip--
+		}
+		var sym Symbolic
+		switch mode {
+		case perffile.CPUModeKernel:
+			sym = symbolizeIn(session, session.kernel, ip)
+		case perffile.CPUModeUser, perffile.CPUModeUnknown:
+			sym = symbolizeIn(session, pidInfo, ip)
+		}
+		out = append(out, sym)
+		return true
+	})
+	return out
+}
+
+// symbolizeIn symbolizes ip in the address space of pidInfo, which
+// may be nil.
+func symbolizeIn(session *Session, pidInfo *PIDInfo, ip uint64) Symbolic {
+	var sym Symbolic
+	if pidInfo == nil {
+		return sym
+	}
+	mmap := pidInfo.LookupMmap(ip)
+	if mmap != nil {
+		Symbolize(session, mmap, ip, &sym)
+	}
+	// A parse timeout only affects the user mappings perf
+	// synthesized for the process.
+	sym.MapParseError = pidInfo.MapParseError && (mmap == nil || !mmap.IsKernel())
+	return sym
+}
+
+// A Symbolizer resolves the IPs of samples to functions, using the
+// memory mappings tracked by Session. It implements
+// perffile.Symbolizer.
+type Symbolizer struct {
+	Session *Session
+}
+
+// NewSymbolizer returns a Symbolizer that resolves IPs using session.
+func NewSymbolizer(session *Session) *Symbolizer {
+	return &Symbolizer{session}
+}
+
+// Update updates z's session with record r. See Session.Update.
+func (z *Symbolizer) Update(r perffile.Record) {
+	z.Session.Update(r)
+}
+
+// Symbol returns the name of the function containing the IP of sample
+// r, or "" if unknown.
+func (z *Symbolizer) Symbol(r *perffile.RecordSample) string {
+	return z.frame(r.PID, r.IP).FuncName
+}
+
+// frame symbolizes ip in process pid.
+func (z *Symbolizer) frame(pid int, ip uint64) Symbolic {
+	return symbolizeIn(z.Session, z.Session.LookupPID(pid), ip)
+}
+
+// ResolveSample returns the stack of sample r, starting with the
+// function containing the sampled instruction. If r records a
+// callchain, this symbolizes the whole callchain like
+// SymbolizeCallchain, including adjusting return addresses if
+// Session.AdjustReturnAddresses is set. Otherwise, it returns just
+// the frame of r's IP. Frames that can't be symbolized have a zero
+// Symbolic.
+//
+// ResolveSample returns an error if r records neither an IP nor a
+// callchain.
+func (z *Symbolizer) ResolveSample(r *perffile.RecordSample) ([]Symbolic, error) {
+	if r.Format&perffile.SampleFormatCallchain != 0 && len(r.Callchain) > 0 {
+		return SymbolizeCallchain(z.Session, r), nil
+	}
+	if r.Format&perffile.SampleFormatIP == 0 {
+		return nil, fmt.Errorf("sample records neither IP nor callchain")
+	}
+	return []Symbolic{z.frame(r.PID, r.IP)}, nil
+}
+
+// SymbolizeInline is like Symbolize, but expands inlined function
+// calls at ip into separate frames. It returns the frames at ip,
+// starting with the innermost inlined function and ending with the
+// function that was actually called. For all but the first frame,
+// Line is the location of the inlined call in that frame's function.
+//
+// Inlined calls can only be expanded for binaries with DWARF debug
+// info, which comes from session.DWARFSource if it is set and
+// otherwise from the binary itself. Otherwise, the result is
+// equivalent to Symbolize. The DWARF inlining information is only
+// loaded the first time SymbolizeInline is called for a given binary,
+// so programs that only use Symbolize don't pay for it.
+// SymbolizeInline returns nil if the binary cannot be loaded.
+func SymbolizeInline(session *Session, mmap *Mmap, ip uint64) []Symbolic {
+	var sym Symbolic
+	if !Symbolize(session, mmap, ip, &sym) {
+		return nil
+	}
+	s := symbolicFor(session, mmap)
+	f, _, pc := s.findIP(mmap, ip)
+	if f == nil {
+		return []Symbolic{sym}
+	}
+	s.loadInlines(session, mmap.Filename)
+	dpc, ok := segPC(s.dwarfSegs, mmap, ip)
+	if !ok {
+		return []Symbolic{sym}
+	}
+	// f and the DWARF info may use different address spaces,
+	// but they differ by a constant within a function.
+	inl := s.findInlines(dpc-(pc-f.lowpc), dpc)
+	if len(inl) == 0 {
+		return []Symbolic{sym}
+	}
+
+	// inl is ordered from outermost to innermost. Each inlined
+	// call site is the location of the frame it was inlined in
+	// to.
+	out := make([]Symbolic, 0, len(inl)+1)
+	line := sym.Line
+	for i := len(inl) - 1; i >= 0; i-- {
+		out = append(out, Symbolic{FuncName: demangle.Filter(inl[i].name), Line: line})
+		line = inl[i].callLine
+	}
+	return append(out, Symbolic{FuncName: sym.FuncName, Line: line})
+}
+
 var symbolicExtraKey = NewExtraKey("perfsession.symbolicExtra")
 
 var buildIDDir = (func() string {
@@ -58,6 +213,271 @@ var buildIDDir = (func() string {
 	return fmt.Sprintf("%s/.debug", u.HomeDir)
 })()
 
+// buildIDPath returns the path of the file with build ID bid, a hex
+// string, in perf's build ID cache.
+func buildIDPath(bid string) string {
+	return fmt.Sprintf("%s/.build-id/%.2s/%s", buildIDDir, bid, bid[2:])
+}
+
+// symbolicFor returns the symbol tables for the file mapped by mmap,
+// or nil if they cannot be loaded.
+func symbolicFor(session *Session, mmap *Mmap) *symbolicExtra {
+	if name := mmap.KernelModule(); name != "" {
+		return getModuleSymbolicExtra(session, mmap.Filename, name)
+	}
+	if mmap.JIT() {
+		if extra := getJITSymbolicExtra(session, mmap.PID); extra != nil {
+			return extra
+		}
+	}
+	if mmap.Special() {
+		if mmap.Filename == "[vdso]" {
+			return getVDSOSymbolicExtra(session)
+		}
+		// Other special regions have no symbols.
+		return nil
+	}
+	return getSymbolicExtra(session, mmap.Filename)
+}
+
+// getVDSOSymbolicExtra returns the symbol tables for the vDSO.
+//
+// The vDSO has no backing file, but perf saves a copy of it in the
+// build ID cache. Failing that, if the running kernel's vDSO has the
+// same build ID as the profile's, this uses the running vDSO.
+func getVDSOSymbolicExtra(session *Session) *symbolicExtra {
+	const filename = "[vdso]"
+	tables, ok := session.Extra[symbolicExtraKey].(map[string]*symbolicExtra)
+	if !ok {
+		tables = make(map[string]*symbolicExtra)
+		session.Extra[symbolicExtraKey] = tables
+	}
+	if extra, ok := tables[filename]; ok {
+		return extra
+	}
+
+	var extra *symbolicExtra
+	bid := fileBuildID(session, filename)
+	if bid != "" {
+		extra = session.SymbolCache.lookup(bid)
+		if extra == nil {
+			nfilename := buildIDPath(bid)
+			extra, _ = newSymbolicExtra(nfilename, "")
+		}
+		if extra == nil {
+			extra, _ = runningVDSO(bid)
+		}
+		session.SymbolCache.add(bid, extra)
+	}
+
+	tables[filename] = extra
+	return extra
+}
+
+// runningVDSO loads the symbol tables of this process's vDSO if its
+// build ID is buildID.
+func runningVDSO(buildID string) (*symbolicExtra, error) {
+	elff, _, err := readRunningVDSO()
+	if err != nil {
+		return nil, err
+	}
+	if elfBuildID(elff) != buildID {
+		return nil, fmt.Errorf("running vDSO does not match profile")
+	}
+	return elfSymbolicExtra("[vdso]", elff)
+}
+
+// readRunningVDSO returns the ELF image of this process's vDSO and its
+// address.
+func readRunningVDSO() (*elf.File, uint64, error) {
+	maps, err := ioutil.ReadFile("/proc/self/maps")
+	if err != nil {
+		return nil, 0, err
+	}
+	var lo, hi uint64
+	for _, line := range strings.Split(string(maps), "\n") {
+		if !strings.HasSuffix(line, " [vdso]") {
+			continue
+		}
+		if _, err := fmt.Sscanf(line, "%x-%x", &lo, &hi); err != nil {
+			return nil, 0, err
+		}
+		break
+	}
+	if hi <= lo {
+		return nil, 0, fmt.Errorf("no vDSO mapping")
+	}
+
+	mem, err := os.Open("/proc/self/mem")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer mem.Close()
+	image := make([]byte, hi-lo)
+	if _, err := mem.ReadAt(image, int64(lo)); err != nil {
+		return nil, 0, err
+	}
+	elff, err := elf.NewFile(bytes.NewReader(image))
+	return elff, lo, err
+}
+
+// elfBuildID returns the GNU build ID of elff as a hex string, or ""
+// if it has none.
+func elfBuildID(elff *elf.File) string {
+	for _, prog := range elff.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		notes, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			continue
+		}
+		if bid := noteBuildID(notes, elff.ByteOrder); bid != "" {
+			return bid
+		}
+	}
+	// Relocatable objects, such as kernel modules, have no
+	// program headers, so look for note sections instead.
+	for _, sec := range elff.Sections {
+		if sec.Type != elf.SHT_NOTE {
+			continue
+		}
+		notes, err := sec.Data()
+		if err != nil {
+			continue
+		}
+		if bid := noteBuildID(notes, elff.ByteOrder); bid != "" {
+			return bid
+		}
+	}
+	return ""
+}
+
+// BuildIDMismatch is the error returned when a binary's build ID
+// differs from the build ID recorded for it in the profile. This
+// usually means the binary was rebuilt after the profile was
+// recorded, so its symbols would not match the profile's addresses.
+type BuildIDMismatch struct {
+	// Filename is the path of the binary.
+	Filename string
+
+	// Want is the build ID recorded in the profile and Got is
+	// the build ID of the binary, both as hex strings.
+	Want, Got string
+}
+
+func (e *BuildIDMismatch) Error() string {
+	return fmt.Sprintf("%s has build ID %s, but the profile recorded build ID %s", e.Filename, e.Got, e.Want)
+}
+
+// checkBuildID returns a *BuildIDMismatch error if want is non-empty
+// and elff, which was loaded from filename, has a different build ID.
+// Binaries with no build ID can't be checked, so they are assumed to
+// match.
+func checkBuildID(elff *elf.File, filename, want string) error {
+	if want == "" {
+		return nil
+	}
+	if got := elfBuildID(elff); got != "" && got != want {
+		return &BuildIDMismatch{filename, want, got}
+	}
+	return nil
+}
+
+// CheckBuildID checks that the ELF binary at filename matches the
+// build ID the profile recorded for filename. It returns a
+// *BuildIDMismatch error if they differ. It returns nil if the
+// profile recorded no build ID for filename or the binary has none.
+//
+// The symbolizer performs this check itself when it falls back to
+// loading binaries from their original paths, and ignores binaries
+// that don't match.
+func (s *Session) CheckBuildID(filename string) error {
+	elff, err := elf.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer elff.Close()
+	return checkBuildID(elff, filename, fileBuildID(s, filename))
+}
+
+// noteBuildID returns the GNU build ID in notes, the contents of an
+// ELF note segment, as a hex string, or "" if there is none.
+func noteBuildID(notes []byte, order binary.ByteOrder) string {
+	// Each note is a header of namesz, descsz, and type, followed
+	// by the name and descriptor, each padded to 4 bytes.
+	for len(notes) >= 12 {
+		namesz := int(order.Uint32(notes[0:]))
+		descsz := int(order.Uint32(notes[4:]))
+		typ := order.Uint32(notes[8:])
+		name := 12
+		desc := name + (namesz+3)&^3
+		next := desc + (descsz+3)&^3
+		if namesz < 0 || descsz < 0 || next > len(notes) {
+			break
+		}
+		const ntGNUBuildID = 3
+		if typ == ntGNUBuildID && string(notes[name:name+namesz]) == "GNU\x00" {
+			return fmt.Sprintf("%x", notes[desc:desc+descsz])
+		}
+		notes = notes[next:]
+	}
+	return ""
+}
+
+// getModuleSymbolicExtra returns the symbol tables for the kernel
+// module name, which perf recorded as filename.
+//
+// Like perf, this prefers the module's object file, found through the
+// build ID cache or its original path. Failing that, it uses the
+// module's symbols from the kernel's kallsyms, which lists the
+// symbols of all loaded modules.
+func getModuleSymbolicExtra(session *Session, filename, name string) *symbolicExtra {
+	tables, ok := session.Extra[symbolicExtraKey].(map[string]*symbolicExtra)
+	if !ok {
+		tables = make(map[string]*symbolicExtra)
+		session.Extra[symbolicExtraKey] = tables
+	}
+	if extra, ok := tables[filename]; ok {
+		return extra
+	}
+
+	// Only module object files are shared through the symbol
+	// cache. Symbols from kallsyms depend on where the module was
+	// loaded.
+	bid := fileBuildID(session, filename)
+	extra := session.SymbolCache.lookup(bid)
+	if extra != nil {
+		tables[filename] = extra
+		return extra
+	}
+	var err error
+	if bid != "" {
+		nfilename := buildIDPath(bid)
+		extra, err = newModuleSymbolicExtra(nfilename, "")
+	}
+	if extra == nil && !strings.HasPrefix(filename, "[") {
+		extra, err = newModuleSymbolicExtra(filename, bid)
+		if _, ok := err.(*BuildIDMismatch); ok {
+			log.Println(err)
+		}
+	}
+	if err == nil {
+		session.SymbolCache.add(bid, extra)
+	}
+	if extra == nil {
+		if kern := getSymbolicExtra(session, "[kernel.kallsyms]"); kern != nil && kern.modules[name] != nil {
+			extra = &symbolicExtra{functab: kern.modules[name]}
+		}
+	}
+	if extra == nil {
+		log.Printf("no symbols found for kernel module %s", name)
+	}
+
+	tables[filename] = extra
+	return extra
+}
+
 func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 	var err error
 
@@ -67,18 +487,16 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 		session.Extra[symbolicExtraKey] = tables
 	}
 
-	// For some reason, the filename for the kernel mapping looks
-	// like "[kernel.kallsyms]_text", but the build ID file name
-	// is just "[kernel.kallsyms]". Match them up.
-	//
-	// TODO: There may be a reason the file name is different that
-	// I don't understand. perf doesn't seem to have any special
-	// treatment of "_text".
+	// The filename for the kernel mapping looks like
+	// "[kernel.kallsyms]_text", where "_text" names the symbol
+	// used to relocate the kernel (see Mmap.kernelRefSym), but
+	// the build ID file name is just "[kernel.kallsyms]". Match
+	// them up.
 	//
 	// TODO: perf works a lot harder to find kernel symbols. See
 	// dso__find_kallsyms in tools/perf/util/symbol.c.
 	isKallsyms := false
-	if strings.HasPrefix(filename, "[kernel.kallsyms]") {
+	if isKernelImage(filename) {
 		isKallsyms = true
 		filename = "[kernel.kallsyms]"
 	}
@@ -91,45 +509,112 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 
 	// See dso__data_fd in toosl/perf/util/dso.c.
 
-	// Try build ID cache first.
-	//
-	// TODO: Cache filename to build ID mapping.
-	for _, bid := range session.File.Meta.BuildIDs {
-		if bid.Filename == filename {
-			nfilename := fmt.Sprintf("%s/.build-id/%.2s/%s", buildIDDir, bid.BuildID, bid.BuildID.String()[2:])
-			if isKallsyms {
-				extra, err = newKallsyms(nfilename)
-			} else {
-				extra, err = newSymbolicExtra(nfilename)
-			}
-			if err == nil {
-				break
-			}
+	// Try the symbol cache, the symbol source, then the build ID
+	// cache.
+	bid := fileBuildID(session, filename)
+	if extra = session.SymbolCache.lookup(bid); extra != nil {
+		tables[filename] = extra
+		return extra
+	}
+	if session.SymbolSource != nil && !isKallsyms {
+		extra, err = sourceSymbolicExtra(session.SymbolSource, rawFileBuildID(session, filename), filename)
+		if err != nil {
+			log.Println(err)
+		}
+		if extra != nil {
+			extra.loadLines(session, filename, bid)
+		}
+	}
+	if extra == nil && bid != "" {
+		nfilename := buildIDPath(bid)
+		if isKallsyms {
+			extra, err = newKallsyms(nfilename)
+		} else {
+			extra, err = newSymbolicExtra(nfilename, "")
 		}
 	}
 
-	// Try original path.
-	if extra == nil {
-		extra, err = newSymbolicExtra(filename)
+	if extra == nil && isKallsyms && bid != "" {
+		extra, err = runningKallsyms(bid)
 		if err != nil {
 			log.Println(err)
 		}
 	}
 
+	// Try original path. If the binary there has been rebuilt
+	// since the profile was recorded, its symbols would be
+	// plausible but wrong, so refuse it.
+	if extra == nil && !isKallsyms {
+		extra, err = newSymbolicExtra(filename, bid)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if extra != nil {
+		session.SymbolCache.add(bid, extra)
+	}
+
 	tables[filename] = extra
 	return extra
 }
 
-func newSymbolicExtra(filename string) (*symbolicExtra, error) {
+// fileBuildID returns the build ID of filename recorded in session's
+// profile as a hex string, or "" if there is none.
+func fileBuildID(session *Session, filename string) string {
+	return rawFileBuildID(session, filename).String()
+}
+
+// rawFileBuildID returns the build ID of filename recorded in
+// session's profile, or nil if there is none.
+func rawFileBuildID(session *Session, filename string) perffile.BuildID {
+	if session.File == nil {
+		return nil
+	}
+	for _, bid := range session.File.Meta.BuildIDs {
+		if bid.Filename == filename {
+			return bid.BuildID
+		}
+	}
+	return nil
+}
+
+// newSymbolicExtra loads the symbol tables of the ELF file filename.
+// If buildID is non-empty, it is the build ID the profile recorded
+// for filename, and newSymbolicExtra returns a *BuildIDMismatch error
+// if filename has a different build ID.
+func newSymbolicExtra(filename, buildID string) (*symbolicExtra, error) {
 	// Load ELF
 	elff, err := elf.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("error loading ELF file %s: %s", filename, err)
 	}
 	defer elff.Close()
+	if err := checkBuildID(elff, filename, buildID); err != nil {
+		return nil, err
+	}
+	extra, err := elfSymbolicExtra(filename, elff)
+	if extra != nil {
+		extra.path = filename
+	}
+	return extra, err
+}
 
+// elfSymbolicExtra loads the symbol tables of elff, which was loaded
+// from filename.
+func elfSymbolicExtra(filename string, elff *elf.File) (*symbolicExtra, error) {
 	extra := &symbolicExtra{}
 
+	// Go binaries have their own function and line tables, which
+	// are more reliable than the ELF symbols and survive
+	// stripping. We still load DWARF below if it's available to
+	// get inlining information.
+	if gotab, err := goTable(elff); err != nil {
+		// Fall back to DWARF or the ELF symbols.
+		log.Printf("error loading Go symbol table from %s: %s", filename, err)
+	} else if gotab != nil {
+		extra.setGoTable(gotab, elff)
+	}
+
 	// Load DWARF
 	//
 	// TODO: Support build IDs and debug links
@@ -141,17 +626,15 @@ func newSymbolicExtra(filename string) (*symbolicExtra, error) {
 			return nil, fmt.Errorf("error loading DWARF from %s: %s", filename, err)
 		}
 
-		extra.functab = dwarfFuncTable(dwarff)
-		extra.linetab = dwarfLineTable(dwarff)
-
-		return &symbolicExtra{
-			dwarfFuncTable(dwarff),
-			dwarfLineTable(dwarff),
-			false,
-		}, nil
+		if extra.gotab == nil {
+			extra.functab = dwarfFuncTable(dwarff)
+			extra.linetab = dwarfLineTable(dwarff)
+		}
+		extra.dwarf = dwarff
+		return extra, nil
 	}
 
-	if extra.functab == nil {
+	if extra.functab == nil && extra.gotab == nil {
 		// Make do with the ELF symbols.
 		extra.functab, extra.isReloc = elfFuncTable(filename, elff)
 	}
@@ -159,8 +642,205 @@ func newSymbolicExtra(filename string) (*symbolicExtra, error) {
 	return extra, nil
 }
 
+// setGoTable sets s's Go symbol table to gotab, which was loaded from
+// elff.
+func (s *symbolicExtra) setGoTable(gotab *gosym.Table, elff *elf.File) {
+	s.gotab = gotab
+	s.gofuncs = make([]funcRange, len(gotab.Funcs))
+	for i, fn := range gotab.Funcs {
+		s.gofuncs[i] = funcRange{fn.Name, fn.Entry, fn.End, true}
+	}
+	s.gofiles = make(map[string]*dwarf.LineFile)
+	if elff.Type == elf.ET_DYN {
+		s.segs = loadSegments(elff)
+	}
+}
+
+// goTable returns the Go symbol table of elff, or nil if elff is not
+// a Go binary. This supports both the Go 1.2 and Go 1.18+ formats of
+// the pclntab.
+//
+// Like "go tool addr2line", this looks for the table in the
+// .gopclntab section, then in .data.rel.ro.gopclntab, where the Go
+// linker puts it in position-independent binaries, and finally
+// between the runtime.pclntab and runtime.epclntab symbols, for
+// binaries linked by an external linker that merged the sections.
+func goTable(elff *elf.File) (*gosym.Table, error) {
+	textSec := elff.Section(".text")
+	if textSec == nil {
+		return nil, nil
+	}
+	pclntab, err := goTableSection(elff, "gopclntab")
+	if err != nil {
+		return nil, err
+	}
+	if pclntab == nil {
+		if pclntab, err = symbolData(elff, "runtime.pclntab", "runtime.epclntab"); pclntab == nil {
+			return nil, err
+		}
+	}
+	symtab, err := goTableSection(elff, "gosymtab")
+	if err != nil {
+		return nil, err
+	}
+	// For Go 1.18+ pclntabs, the text start address in the
+	// pclntab header overrides textSec.Addr.
+	return gosym.NewTable(symtab, gosym.NewLineTable(pclntab, textSec.Addr))
+}
+
+// goTableSection returns the contents of the Go table section name,
+// which may be prefixed by ".data.rel.ro", or nil if elff has no such
+// section.
+func goTableSection(elff *elf.File, name string) ([]byte, error) {
+	sec := elff.Section("." + name)
+	if sec == nil {
+		sec = elff.Section(".data.rel.ro." + name)
+	}
+	if sec == nil || sec.Type == elf.SHT_NOBITS {
+		return nil, nil
+	}
+	return sec.Data()
+}
+
+// symbolData returns the bytes of elff between the addresses of
+// symbols start and end, or nil if elff doesn't have both symbols in
+// the same section.
+func symbolData(elff *elf.File, start, end string) ([]byte, error) {
+	syms, err := elff.Symbols()
+	if err != nil {
+		return nil, nil
+	}
+	var lo, hi *elf.Symbol
+	for i := range syms {
+		switch syms[i].Name {
+		case start:
+			lo = &syms[i]
+		case end:
+			hi = &syms[i]
+		}
+	}
+	if lo == nil || hi == nil || lo.Section != hi.Section || hi.Value < lo.Value || int(lo.Section) >= len(elff.Sections) {
+		return nil, nil
+	}
+	sec := elff.Sections[lo.Section]
+	if sec.Type == elf.SHT_NOBITS || lo.Value < sec.Addr || hi.Value > sec.Addr+sec.Size {
+		return nil, nil
+	}
+	data := make([]byte, hi.Value-lo.Value)
+	if _, err := sec.ReadAt(data, int64(lo.Value-sec.Addr)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newModuleSymbolicExtra loads the symbol table of the kernel module
+// object file filename. Module object files are relocatable, so
+// symbol values are offsets in their sections. This finds where each
+// section lands in the module's mapping using moduleTextLayout.
+// buildID is as for newSymbolicExtra.
+func newModuleSymbolicExtra(filename, buildID string) (*symbolicExtra, error) {
+	elff, err := elf.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ELF file %s: %s", filename, err)
+	}
+	defer elff.Close()
+	if err := checkBuildID(elff, filename, buildID); err != nil {
+		return nil, err
+	}
+	if elff.Type != elf.ET_REL {
+		return nil, fmt.Errorf("%s is not a kernel module", filename)
+	}
+
+	syms, err := elff.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("error loading symbols from %s: %s", filename, err)
+	}
+	layout := moduleTextLayout(elff)
+	functab := make([]funcRange, 0)
+	for _, sym := range syms {
+		if elf.SymType(sym.Info&0xF) != elf.STT_FUNC {
+			continue
+		}
+		base, ok := layout[sym.Section]
+		if !ok {
+			continue
+		}
+		functab = append(functab, funcRange{sym.Name, base + sym.Value, base + sym.Value + sym.Size, false})
+	}
+
+	sort.Sort(funcRangeSorter(functab))
+	setFuncHighPCs(functab)
+
+	return &symbolicExtra{functab: functab, isModule: true}, nil
+}
+
+// moduleTextLayout returns the offset of each executable section of
+// the kernel module elff from the beginning of the module's mapping.
+//
+// The kernel places a module's executable sections at the beginning
+// of the module in section header order, each aligned to its
+// alignment. Sections whose names start with ".init" go in a separate
+// allocation that the kernel frees once the module is initialized,
+// so they are never part of the module's mapping and are omitted. See
+// layout_sections in kernel/module/main.c.
+func moduleTextLayout(elff *elf.File) map[elf.SectionIndex]uint64 {
+	const flags = elf.SHF_ALLOC | elf.SHF_EXECINSTR
+	layout := make(map[elf.SectionIndex]uint64)
+	var size uint64
+	for i, sec := range elff.Sections {
+		if sec.Flags&flags != flags || strings.HasPrefix(sec.Name, ".init") {
+			continue
+		}
+		if align := sec.Addralign; align > 1 {
+			size = (size + align - 1) &^ (align - 1)
+		}
+		layout[elf.SectionIndex(i)] = size
+		size += sec.Size
+	}
+	return layout
+}
+
+// loadSegments returns the loadable segments of elff.
+func loadSegments(elff *elf.File) []elf.ProgHeader {
+	var segs []elf.ProgHeader
+	for _, prog := range elff.Progs {
+		if prog.Type == elf.PT_LOAD {
+			segs = append(segs, prog.ProgHeader)
+		}
+	}
+	return segs
+}
+
 var kallsymsRe = regexp.MustCompile("^([0-9a-fA-F]*) +(.) (.*)")
 
+// runningKernelNotes and runningKallsymsPath are the ELF notes and
+// kallsyms of the running kernel.
+var (
+	runningKernelNotes  = "/sys/kernel/notes"
+	runningKallsymsPath = "/proc/kallsyms"
+)
+
+// runningKallsyms loads the running kernel's kallsyms if its build ID
+// is buildID.
+func runningKallsyms(buildID string) (*symbolicExtra, error) {
+	notes, err := ioutil.ReadFile(runningKernelNotes)
+	if err != nil {
+		return nil, err
+	}
+	if noteBuildID(notes, binary.NativeEndian) != buildID {
+		return nil, fmt.Errorf("running kernel does not match profile")
+	}
+	extra, err := newKallsyms(runningKallsymsPath)
+	if err != nil {
+		return nil, err
+	}
+	// Unprivileged users see all kernel addresses as 0.
+	if extra.refSyms["_text"] == 0 {
+		return nil, fmt.Errorf("kernel addresses in %s are hidden; see kernel.kptr_restrict", runningKallsymsPath)
+	}
+	return extra, nil
+}
+
 func newKallsyms(filename string) (*symbolicExtra, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -169,8 +849,11 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 	defer f.Close()
 
 	// This file is a nm-style object list. See kallsyms__parse in
-	// tools/lib/symbol/kallsyms.c.
+	// tools/lib/symbol/kallsyms.c. Symbols in modules are followed
+	// by a tab and the module name in brackets.
 	functab := make([]funcRange, 0)
+	modules := make(map[string][]funcRange)
+	refSyms := make(map[string]uint64)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		subs := kallsymsRe.FindStringSubmatch(scanner.Text())
@@ -178,10 +861,18 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 			continue
 		}
 		typ, name := subs[2][0], subs[3]
+		addr, _ := strconv.ParseUint(subs[1], 16, 64)
+		if name == "_text" || name == "_stext" {
+			refSyms[name] = addr
+		}
 		if !(typ == 't' || typ == 'T') {
 			continue
 		}
-		addr, _ := strconv.ParseUint(subs[1], 16, 64)
+		if i := strings.Index(name, "\t["); i >= 0 && strings.HasSuffix(name, "]") {
+			module := name[i+2 : len(name)-1]
+			modules[module] = append(modules[module], funcRange{name[:i], addr, addr, true})
+			continue
+		}
 		functab = append(functab, funcRange{name, addr, addr, true})
 	}
 	if err := scanner.Err(); err != nil {
@@ -190,8 +881,12 @@ func newKallsyms(filename string) (*symbolicExtra, error) {
 
 	sort.Sort(funcRangeSorter(functab))
 	setFuncHighPCs(functab)
+	for _, mtab := range modules {
+		sort.Sort(funcRangeSorter(mtab))
+		setFuncHighPCs(mtab)
+	}
 
-	return &symbolicExtra{functab, nil, false}, nil
+	return &symbolicExtra{functab: functab, modules: modules, refSyms: refSyms}, nil
 }
 
 type symbolicExtra struct {
@@ -201,18 +896,112 @@ type symbolicExtra struct {
 	// isReloc indicates that lowpc/highpc in functab are ELF file
 	// offsets rather than virtual addresses.
 	isReloc bool
+
+	// isModule indicates that lowpc/highpc in functab are offsets
+	// from the beginning of a kernel module's mapping.
+	isModule bool
+
+	// modules maps from kernel module name to the functions in
+	// that module. This is only set for kallsyms.
+	modules map[string][]funcRange
+
+	// refSyms maps from the names of the symbols perf uses to
+	// relocate the kernel, such as "_text", to their addresses in
+	// functab. This is only set for kallsyms.
+	refSyms map[string]uint64
+
+	// dwarf is the DWARF data for this binary, or nil. For
+	// executables with DWARF and binaries whose functions came
+	// from a SymbolSource, this is loaded with the line table.
+	// Otherwise, loadInlines loads it on demand from
+	// Session.DWARFSource or path. If dwarfSegs is non-nil, the
+	// binary is position-independent and dwarfSegs maps file
+	// offsets to the virtual addresses used by dwarf. If isReloc
+	// is set, linetab uses the addresses of dwarf, not file
+	// offsets. inltab is loaded from dwarf on demand.
+	dwarf       *dwarf.Data
+	dwarfSegs   []elf.ProgHeader
+	dwarfDone   bool
+	inltab      []inlineRange
+	inlinesDone bool
+
+	// path is the local ELF file these tables were loaded from,
+	// or "" if they weren't loaded from a file.
+	path string
+
+	// gotab is the Go symbol table for this binary, or nil if
+	// this is not a Go binary. If set, this is used instead of
+	// functab and linetab. For position-independent binaries,
+	// segs is used to map file offsets to the virtual addresses
+	// used by gotab.
+	gotab *gosym.Table
+	segs  []elf.ProgHeader
+
+	// gofuncs are the functions of gotab, in the same order as
+	// gotab.Funcs, and gofiles interns the files of gotab's line
+	// table. These let findIP look up Go binaries without
+	// allocating.
+	gofuncs []funcRange
+	gofiles map[string]*dwarf.LineFile
 }
 
-func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.LineEntry) {
+// segPC translates ip in mmap to a virtual address in a binary with
+// loadable segments segs. If segs is nil, the binary is not
+// position-independent, so ip is already a virtual address.
+func segPC(segs []elf.ProgHeader, mmap *Mmap, ip uint64) (uint64, bool) {
+	if segs == nil {
+		return ip, true
+	}
+	off, ok := mmap.FileOffsetOf(ip)
+	if !ok {
+		return 0, false
+	}
+	for _, seg := range segs {
+		if seg.Off <= off && off < seg.Off+seg.Filesz {
+			return off - seg.Off + seg.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// findIP returns the function and line containing ip in mmap. l is the
+// zero LineEntry if the line is unknown. pc is ip translated to the
+// address space of f.
+func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l dwarf.LineEntry, pc uint64) {
+	if s.gotab != nil {
+		pc, _ = segPC(s.segs, mmap, ip)
+		i := sort.Search(len(s.gofuncs), func(i int) bool {
+			return pc < s.gofuncs[i].highpc
+		})
+		if i == len(s.gofuncs) || pc < s.gofuncs[i].lowpc {
+			return nil, l, pc
+		}
+		f = &s.gofuncs[i]
+		if name, line, _ := s.gotab.PCToLine(pc); line != 0 {
+			file := s.gofiles[name]
+			if file == nil {
+				file = &dwarf.LineFile{Name: name}
+				s.gofiles[name] = file
+			}
+			l = dwarf.LineEntry{Address: pc, File: file, Line: line}
+		}
+		return
+	}
+
+	pc = ip
 	if s.functab != nil {
 		if s.isReloc {
 			// functab is indexed by file offset.
-			ip = ip - mmap.Addr + mmap.FileOffset
+			pc = ip - mmap.Addr + mmap.FileOffset
+		} else if s.isModule {
+			pc -= mmap.Addr
+		} else if s.refSyms != nil {
+			pc += s.kallsymsDelta(mmap)
 		}
 		i := sort.Search(len(s.functab), func(i int) bool {
-			return ip < s.functab[i].highpc
+			return pc < s.functab[i].highpc
 		})
-		if i < len(s.functab) && s.functab[i].lowpc <= ip && ip < s.functab[i].highpc {
+		if i < len(s.functab) && s.functab[i].lowpc <= pc && pc < s.functab[i].highpc {
 			f = &s.functab[i]
 			if !f.demangled {
 				f.name = demangle.Filter(f.name)
@@ -222,17 +1011,146 @@ func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.Li
 	}
 
 	if s.linetab != nil {
+		lpc, ok := pc, true
+		if s.isReloc {
+			lpc, ok = segPC(s.dwarfSegs, mmap, ip)
+		}
 		i := sort.Search(len(s.linetab), func(i int) bool {
-			return ip < s.linetab[i].Address
+			return lpc < s.linetab[i].Address
 		})
-		if i != 0 && !s.linetab[i-1].EndSequence {
-			l = &s.linetab[i-1]
+		if ok && i != 0 && !s.linetab[i-1].EndSequence {
+			l = s.linetab[i-1]
 		}
 	}
 
 	return
 }
 
+// kallsymsDelta returns the offset from addresses in the kernel image
+// mapped by mmap to addresses in kallsyms table s. These differ if s
+// was read during a different boot than the profile was recorded and
+// the kernel's address is randomized. Like perf, this compares the
+// addresses of the kernel's relocation reference symbol. See
+// kallsyms__delta in tools/perf/util/symbol.c.
+func (s *symbolicExtra) kallsymsDelta(mmap *Mmap) uint64 {
+	name, addr := mmap.kernelRefSym()
+	ref, ok := s.refSyms[name]
+	if !ok || addr == 0 {
+		return 0
+	}
+	return ref - addr
+}
+
+// loadLines loads the line table of s, whose function table came from
+// a SymbolSource, for the binary perf recorded as filename with build
+// ID buildID. Like newSymbolicExtra, this prefers the Go symbol table
+// of the local binary and otherwise uses the DWARF line table, which
+// comes from Session.DWARFSource, the SymbolSource itself if it is
+// also a DWARFSource, or the local binary.
+func (s *symbolicExtra) loadLines(session *Session, filename, buildID string) {
+	// Look for the local binary where getSymbolicExtra would.
+	path := filename
+	if buildID != "" {
+		if _, err := os.Stat(buildIDPath(buildID)); err == nil {
+			path = buildIDPath(buildID)
+		}
+	}
+	if elff, err := elf.Open(path); err == nil {
+		if checkBuildID(elff, path, buildID) == nil {
+			s.path = path
+			if gotab, err := goTable(elff); err != nil {
+				log.Printf("error loading Go symbol table from %s: %s", path, err)
+			} else if gotab != nil {
+				s.setGoTable(gotab, elff)
+			}
+		}
+		elff.Close()
+	}
+	if s.gotab != nil {
+		return
+	}
+	src := session.DWARFSource
+	if src == nil {
+		src, _ = session.SymbolSource.(DWARFSource)
+	}
+	s.loadDWARF(session, src, filename)
+	if s.dwarf != nil {
+		s.linetab = dwarfLineTable(s.dwarf)
+	}
+}
+
+// loadInlines loads s.inltab for the binary perf recorded as
+// filename, if it hasn't already been loaded.
+func (s *symbolicExtra) loadInlines(session *Session, filename string) {
+	if s.inlinesDone {
+		return
+	}
+	s.inlinesDone = true
+
+	s.loadDWARF(session, session.DWARFSource, filename)
+	if s.dwarf != nil {
+		s.inltab = dwarfInlineTable(s.dwarf)
+	}
+}
+
+// loadDWARF loads s.dwarf for the binary perf recorded as filename
+// from src, which may be nil, or, failing that, path, if it hasn't
+// already been loaded. DWARF from src replaces DWARF loaded with the
+// function and line tables.
+func (s *symbolicExtra) loadDWARF(session *Session, src DWARFSource, filename string) {
+	if s.dwarfDone {
+		return
+	}
+	s.dwarfDone = true
+
+	var elff *elf.File
+	var err error
+	if src != nil {
+		elff, err = src.DWARF(rawFileBuildID(session, filename), filename)
+		if err != nil {
+			log.Printf("error loading DWARF for %s: %s", filename, err)
+		}
+	}
+	if elff == nil && s.dwarf == nil && s.path != "" {
+		elff, err = elf.Open(s.path)
+		if err != nil {
+			log.Printf("error loading ELF file %s: %s", s.path, err)
+		}
+	}
+	if elff != nil && elff.Section(".debug_info") != nil {
+		if dwarff, err := elff.DWARF(); err != nil {
+			log.Printf("error loading DWARF for %s: %s", filename, err)
+		} else {
+			s.dwarf, s.dwarfSegs = dwarff, nil
+			if elff.Type == elf.ET_DYN {
+				s.dwarfSegs = loadSegments(elff)
+			}
+		}
+	}
+	if elff != nil {
+		elff.Close()
+	}
+}
+
+// findInlines returns the inlined calls at pc within the function
+// starting at lowpc, ordered from outermost to innermost. pc and
+// lowpc are addresses in s.dwarf.
+func (s *symbolicExtra) findInlines(lowpc, pc uint64) []inlineRange {
+	// Inlined ranges nest within their function, so only
+	// consider ranges that start within the function.
+	var out []inlineRange
+	i := sort.Search(len(s.inltab), func(i int) bool {
+		return s.inltab[i].lowpc >= lowpc
+	})
+	for ; i < len(s.inltab) && s.inltab[i].lowpc <= pc; i++ {
+		if pc < s.inltab[i].highpc {
+			out = append(out, s.inltab[i])
+		}
+	}
+	sort.Stable(inlineRangeDepthSorter(out))
+	return out
+}
+
 type funcRange struct {
 	name          string
 	lowpc, highpc uint64
@@ -313,9 +1231,14 @@ func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc boo
 
 	out = make([]funcRange, 0)
 	syms, err := elff.Symbols()
+	if err == elf.ErrNoSymbols {
+		// Stripped binaries and the vDSO may still have
+		// dynamic symbols.
+		syms, err = elff.DynamicSymbols()
+	}
 	if err != nil {
 		if err != elf.ErrNoSymbols {
-			log.Fatal("%s: %s", filename, err)
+			log.Fatalf("%s: %s", filename, err)
 		}
 		return nil, false
 	}
@@ -371,6 +1294,128 @@ func setFuncHighPCs(functab []funcRange) {
 	}
 }
 
+// An inlineRange is a range of PCs in an inlined function call.
+type inlineRange struct {
+	name          string
+	lowpc, highpc uint64
+
+	// callLine is the location of the call that was inlined.
+	callLine dwarf.LineEntry
+
+	// depth is the nesting depth of this inlined call within its
+	// function. Outer inlined calls have smaller depths.
+	depth int
+}
+
+type inlineRangeSorter []inlineRange
+
+func (s inlineRangeSorter) Len() int {
+	return len(s)
+}
+
+func (s inlineRangeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s inlineRangeSorter) Less(i, j int) bool {
+	return s[i].lowpc < s[j].lowpc
+}
+
+type inlineRangeDepthSorter []inlineRange
+
+func (s inlineRangeDepthSorter) Len() int {
+	return len(s)
+}
+
+func (s inlineRangeDepthSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s inlineRangeDepthSorter) Less(i, j int) bool {
+	return s[i].depth < s[j].depth
+}
+
+func dwarfInlineTable(dwarff *dwarf.Data) []inlineRange {
+	out := make([]inlineRange, 0)
+	names := make(map[dwarf.Offset]string)
+
+	// originName returns the name of the abstract function at
+	// off, following DW_AT_abstract_origin and
+	// DW_AT_specification chains.
+	var originName func(off dwarf.Offset) string
+	originName = func(off dwarf.Offset) string {
+		if name, ok := names[off]; ok {
+			return name
+		}
+		names[off] = ""
+		r := dwarff.Reader()
+		r.Seek(off)
+		ent, err := r.Next()
+		if ent == nil || err != nil {
+			return ""
+		}
+		const AttrLinkageName dwarf.Attr = 0x6e
+		name, ok := ent.Val(AttrLinkageName).(string)
+		if !ok {
+			name, ok = ent.Val(dwarf.AttrName).(string)
+		}
+		if !ok {
+			if origin, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+				name = originName(origin)
+			} else if spec, ok := ent.Val(dwarf.AttrSpecification).(dwarf.Offset); ok {
+				name = originName(spec)
+			}
+		}
+		names[off] = name
+		return name
+	}
+
+	dr := dwarff.Reader()
+	var files []*dwarf.LineFile
+	depth := 0
+	for {
+		ent, err := dr.Next()
+		if ent == nil || err != nil {
+			break
+		}
+		if ent.Tag == 0 {
+			// End of children.
+			depth--
+			continue
+		}
+		if ent.Tag == dwarf.TagCompileUnit {
+			files = nil
+			if lr, err := dwarff.LineReader(ent); err == nil && lr != nil {
+				files = lr.Files()
+			}
+			depth = 0
+		} else if ent.Tag == dwarf.TagInlinedSubroutine {
+			inl := inlineRange{depth: depth}
+			if origin, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+				inl.name = originName(origin)
+			}
+			if file, ok := ent.Val(dwarf.AttrCallFile).(int64); ok && file >= 0 && file < int64(len(files)) {
+				inl.callLine.File = files[file]
+			}
+			if line, ok := ent.Val(dwarf.AttrCallLine).(int64); ok {
+				inl.callLine.Line = int(line)
+			}
+			ranges, _ := dwarff.Ranges(ent)
+			for _, rng := range ranges {
+				inl.lowpc, inl.highpc = rng[0], rng[1]
+				inl.callLine.Address = rng[0]
+				out = append(out, inl)
+			}
+		}
+		if ent.Children {
+			depth++
+		}
+	}
+
+	sort.Stable(inlineRangeSorter(out))
+	return out
+}
+
 func dwarfLineTable(dwarff *dwarf.Data) []dwarf.LineEntry {
 	out := make([]dwarf.LineEntry, 0)
 
@@ -407,5 +1452,28 @@ func dwarfLineTable(dwarff *dwarf.Data) []dwarf.LineEntry {
 			out = append(out, lent)
 		}
 	}
+
+	// Line tables aren't necessarily in address order across
+	// compilation units.
+	sort.Stable(lineEntrySorter(out))
 	return out
 }
+
+type lineEntrySorter []dwarf.LineEntry
+
+func (s lineEntrySorter) Len() int {
+	return len(s)
+}
+
+func (s lineEntrySorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s lineEntrySorter) Less(i, j int) bool {
+	if s[i].Address != s[j].Address {
+		return s[i].Address < s[j].Address
+	}
+	// Put the end of one sequence before the beginning of the
+	// next sequence at the same address.
+	return s[i].EndSequence && !s[j].EndSequence
+}
@@ -0,0 +1,849 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestSymbolizeCallchain(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/bin/x"))
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{
+		"/bin/x": {functab: []funcRange{
+			{"f", 0x1000, 0x1010, true},
+			{"g", 0x1010, 0x1020, true},
+		}},
+	}
+
+	// g is called by a call instruction at the very end of f,
+	// so its return address is the first instruction of g.
+	r := &perffile.RecordSample{
+		RecordCommon: perffile.RecordCommon{PID: 1, TID: 1},
+		Callchain:    []uint64{perffile.CallchainUser, 0x1010, 0x1010},
+	}
+	for _, adjust := range []bool{false, true} {
+		s.AdjustReturnAddresses = adjust
+		var got []string
+		for _, sym := range SymbolizeCallchain(s, r) {
+			got = append(got, sym.FuncName)
+		}
+		want := []string{"g", "g"}
+		if adjust {
+			want = []string{"g", "f"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("with AdjustReturnAddresses=%v, got %v, want %v", adjust, got, want)
+		}
+	}
+}
+
+func TestSymbolizeCallchainModes(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(-1, 0xffffffff81000000, 0x1000, "/boot/vmlinux"))
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/bin/x"))
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{
+		"/boot/vmlinux": {functab: []funcRange{
+			{"schedule", 0xffffffff81000000, 0xffffffff81001000, true},
+		}},
+		"/bin/x": {functab: []funcRange{
+			{"main", 0x1000, 0x2000, true},
+		}},
+	}
+
+	// The same address in a kernel or guest segment must not
+	// resolve to the process's user mapping.
+	r := &perffile.RecordSample{
+		RecordCommon: perffile.RecordCommon{PID: 1, TID: 1},
+		Callchain: []uint64{
+			perffile.CallchainKernel, 0xffffffff81000010, 0x1010,
+			perffile.CallchainUser, 0x1010,
+			perffile.CallchainGuestKernel, 0x1010,
+			perffile.CallchainHypervisor, 0xffffffff81000010,
+		},
+	}
+	var got []string
+	for _, sym := range SymbolizeCallchain(s, r) {
+		got = append(got, sym.FuncName)
+	}
+	want := []string{"schedule", "", "main", "", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSymbolizeKernelModule(t *testing.T) {
+	kallsyms := filepath.Join(t.TempDir(), "kallsyms")
+	err := ioutil.WriteFile(kallsyms, []byte(`ffffffff81000000 T _text
+ffffffff81000100 T start_kernel
+ffffffff81001000 T _etext
+ffffffffc0001000 t nvme_probe	[nvme]
+ffffffffc0001100 t nvme_remove	[nvme]
+ffffffffc0001200 t nvme_exit	[nvme]
+ffffffffc0002000 t e1000_xmit	[e1000e]
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kern, err := newKallsyms(kallsyms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(&perffile.File{})
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{"[kernel.kallsyms]": kern}
+	s.Update(mmapRecord(-1, 0xffffffff81000000, 0x1000000, "[kernel.kallsyms]_text"))
+	s.Update(mmapRecord(-1, 0xffffffffc0001000, 0x1000, "[nvme]"))
+	s.Update(mmapRecord(-1, 0xffffffffc0002000, 0x1000, "/lib/modules/6.1.0/kernel/drivers/net/e1000e.ko.xz"))
+
+	for _, test := range []struct {
+		ip     uint64
+		module string
+		fn     string
+	}{
+		{0xffffffff81000104, "", "start_kernel"},
+		{0xffffffffc0001010, "nvme", "nvme_probe"},
+		{0xffffffffc0001104, "nvme", "nvme_remove"},
+		{0xffffffffc0002000, "e1000e", "e1000_xmit"},
+	} {
+		mmap := s.LookupPID(-1).LookupMmap(test.ip)
+		if mmap == nil {
+			t.Errorf("%#x: no mapping", test.ip)
+			continue
+		}
+		if got := mmap.KernelModule(); got != test.module {
+			t.Errorf("%#x: got module %q, want %q", test.ip, got, test.module)
+		}
+		var sym Symbolic
+		Symbolize(s, mmap, test.ip, &sym)
+		if sym.FuncName != test.fn {
+			t.Errorf("%#x: got %q, want %q", test.ip, sym.FuncName, test.fn)
+		}
+	}
+}
+
+// moduleS is a kernel module with functions in .text, a cold
+// function in a more aligned .text.unlikely section, and an init
+// function the kernel frees after loading the module.
+const moduleS = `	.text
+	.globl	mod_a
+	.type	mod_a, @function
+mod_a:	.skip	0x10
+	.size	mod_a, 0x10
+	.type	mod_b, @function
+mod_b:	.skip	0x10
+	.size	mod_b, 0x10
+	.section	.text.unlikely,"ax",@progbits
+	.p2align	6
+	.type	mod_cold, @function
+mod_cold:	.skip	8
+	.size	mod_cold, 8
+	.section	.init.text,"ax",@progbits
+	.type	mod_init, @function
+mod_init:	.skip	8
+	.size	mod_init, 8
+`
+
+func TestSymbolizeModuleObject(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir, err := ioutil.TempDir("", "perfsession")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, obj := filepath.Join(dir, "mod.s"), filepath.Join(dir, "mod.ko")
+	if err := ioutil.WriteFile(src, []byte(moduleS), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(cc, "-c", "-o", obj, src).CombinedOutput(); err != nil {
+		t.Skipf("failed to assemble module: %s\n%s", err, out)
+	}
+
+	s := New(&perffile.File{})
+	s.Update(mmapRecord(-1, 0xffffffffc0001000, 0x1000, obj))
+	for _, test := range []struct {
+		off uint64
+		fn  string
+	}{
+		{0x4, "mod_a"},
+		{0x14, "mod_b"},
+		{0x40, "mod_cold"},
+		{0x4c, ""},
+	} {
+		ip := 0xffffffffc0001000 + test.off
+		mmap := s.LookupPID(-1).LookupMmap(ip)
+		if got := mmap.KernelModule(); got != "mod" {
+			t.Fatalf("got module %q, want %q", got, "mod")
+		}
+		var sym Symbolic
+		Symbolize(s, mmap, ip, &sym)
+		if sym.FuncName != test.fn {
+			t.Errorf("%#x: got %q, want %q", ip, sym.FuncName, test.fn)
+		}
+	}
+}
+
+func TestSymbolizeKernelRelocated(t *testing.T) {
+	// kallsyms is from a boot where the kernel was loaded at
+	// 0xffffffff81000000, but the profile was recorded when it
+	// was loaded at 0xffffffff9a000000.
+	dir := t.TempDir()
+	defer func(notes, kallsyms string) {
+		runningKernelNotes, runningKallsymsPath = notes, kallsyms
+	}(runningKernelNotes, runningKallsymsPath)
+	runningKernelNotes = filepath.Join(dir, "notes")
+	runningKallsymsPath = filepath.Join(dir, "kallsyms")
+	notes := make([]byte, 12, 24)
+	binary.NativeEndian.PutUint32(notes[0:], 4)
+	binary.NativeEndian.PutUint32(notes[4:], 8)
+	binary.NativeEndian.PutUint32(notes[8:], 3)
+	notes = append(notes, "GNU\x00\x01\x02\x03\x04\x05\x06\x07\x08"...)
+	if err := ioutil.WriteFile(runningKernelNotes, notes, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(runningKallsymsPath, []byte(`ffffffff81000000 T _text
+ffffffff81000100 T start_kernel
+ffffffff81001000 T _etext
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		addr, len, pgoff uint64
+		ip               uint64
+		want             string
+	}{
+		{0xffffffff9a000000, 0x1000000, 0xffffffff9a000000, 0xffffffff9a000104, "start_kernel"},
+		{0xffffffff81000000, 0x1000000, 0xffffffff81000000, 0xffffffff81000104, "start_kernel"},
+		// A zero-sized mapping covers the whole address space.
+		{0, 0, 0xffffffff9a000000, 0xffffffff9a000104, "start_kernel"},
+		// A mapping whose end overflows extends to the top.
+		{0xffffffff9a000000, 1 << 63, 0xffffffff9a000000, 0xffffffff9a000104, "start_kernel"},
+	} {
+		f := &perffile.File{}
+		f.Meta.BuildIDs = []perffile.BuildIDInfo{{BuildID: perffile.BuildID{1, 2, 3, 4, 5, 6, 7, 8}, Filename: "[kernel.kallsyms]"}}
+		s := New(f)
+		r := mmapRecord(-1, test.addr, test.len, "[kernel.kallsyms]_text")
+		r.FileOffset = test.pgoff
+		s.Update(r)
+		mmap := s.LookupPID(-1).LookupMmap(test.ip)
+		if mmap == nil {
+			t.Errorf("%+v: no mapping", test)
+			continue
+		}
+		var sym Symbolic
+		Symbolize(s, mmap, test.ip, &sym)
+		if sym.FuncName != test.want {
+			t.Errorf("%+v: got %q, want %q", test, sym.FuncName, test.want)
+		}
+	}
+
+	// A guest kernel is not the host kernel, so it must not be
+	// symbolized with the running kernel's symbols.
+	f := &perffile.File{}
+	f.Meta.BuildIDs = []perffile.BuildIDInfo{{BuildID: perffile.BuildID{1, 2, 3, 4, 5, 6, 7, 8}, Filename: "[kernel.kallsyms]"}}
+	s := New(f)
+	r := mmapRecord(-1, 0xffffffff9a000000, 0x1000000, "[guest.kernel.kallsyms]_text")
+	r.FileOffset = 0xffffffff9a000000
+	s.Update(r)
+	var sym Symbolic
+	Symbolize(s, s.LookupPID(-1).LookupMmap(0xffffffff9a000104), 0xffffffff9a000104, &sym)
+	if sym.FuncName == "start_kernel" {
+		t.Errorf("guest kernel symbolized with host kernel symbols")
+	}
+}
+
+func TestSymbolizeSpecial(t *testing.T) {
+	s := New(&perffile.File{})
+	s.Update(mmapRecord(1, 0x7ffe0000, 0x1000, "[stack]"))
+	var sym Symbolic
+	if !Symbolize(s, s.LookupPID(1).LookupMmap(0x7ffe0010), 0x7ffe0010, &sym) || sym.FuncName != "[stack]" {
+		t.Errorf("got %q, want [stack]", sym.FuncName)
+	}
+}
+
+func TestSymbolizeVDSO(t *testing.T) {
+	elff, addr, err := readRunningVDSO()
+	if err != nil {
+		t.Skip("cannot read vDSO: ", err)
+	}
+	bid := elfBuildID(elff)
+	if bid == "" {
+		t.Skip("vDSO has no build ID")
+	}
+	syms, err := elff.DynamicSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fn elf.Symbol
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF && sym.Size > 0 {
+			fn = sym
+			break
+		}
+	}
+	if fn.Name == "" {
+		t.Skip("vDSO has no functions")
+	}
+
+	buildID := make(perffile.BuildID, len(bid)/2)
+	fmt.Sscanf(bid, "%x", &buildID)
+	f := &perffile.File{}
+	f.Meta.BuildIDs = []perffile.BuildIDInfo{{BuildID: buildID, Filename: "[vdso]"}}
+	s := New(f)
+	s.Update(mmapRecord(1, addr, 0x2000, "[vdso]"))
+	ip := addr + fn.Value
+	var sym Symbolic
+	if !Symbolize(s, s.LookupPID(1).LookupMmap(ip), ip, &sym) || sym.FuncName != fn.Name {
+		t.Errorf("got %q, want %q", sym.FuncName, fn.Name)
+	}
+}
+
+func TestResolveSample(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/bin/x"))
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{
+		"/bin/x": {functab: []funcRange{
+			{"f", 0x1000, 0x1010, true},
+			{"g", 0x1010, 0x1020, true},
+		}},
+	}
+	s.AdjustReturnAddresses = true
+	z := NewSymbolizer(s)
+	var _ perffile.Symbolizer = z
+
+	names := func(syms []Symbolic) []string {
+		var out []string
+		for _, sym := range syms {
+			out = append(out, sym.FuncName)
+		}
+		return out
+	}
+	for _, test := range []struct {
+		r    *perffile.RecordSample
+		want []string
+	}{
+		{&perffile.RecordSample{
+			RecordCommon: perffile.RecordCommon{PID: 1, Format: perffile.SampleFormatIP | perffile.SampleFormatCallchain},
+			IP:           0x1014,
+			Callchain:    []uint64{perffile.CallchainUser, 0x1014, 0x1010, 0x5000},
+		}, []string{"g", "f", ""}},
+		{&perffile.RecordSample{
+			RecordCommon: perffile.RecordCommon{PID: 1, Format: perffile.SampleFormatIP},
+			IP:           0x1010,
+		}, []string{"g"}},
+	} {
+		got, err := z.ResolveSample(test.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names(got), test.want) {
+			t.Errorf("got %v, want %v", names(got), test.want)
+		}
+		if got := z.Symbol(test.r); got != test.want[0] {
+			t.Errorf("got leaf %q, want %q", got, test.want[0])
+		}
+	}
+
+	if _, err := z.ResolveSample(&perffile.RecordSample{}); err == nil {
+		t.Errorf("want error for sample with no IP")
+	}
+}
+
+func TestBuildIDMismatch(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("cannot find test binary: ", err)
+	}
+	elff, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bid := elfBuildID(elff)
+	elff.Close()
+	if bid == "" {
+		t.Skip("test binary has no build ID")
+	}
+
+	for _, test := range []struct {
+		recorded perffile.BuildID
+		mismatch bool
+	}{
+		{nil, false},
+		{perffile.BuildID{0xde, 0xad, 0xbe, 0xef}, true},
+	} {
+		f := &perffile.File{}
+		if test.recorded != nil {
+			f.Meta.BuildIDs = []perffile.BuildIDInfo{{BuildID: test.recorded, Filename: exe}}
+		}
+		s := New(f)
+		err := s.CheckBuildID(exe)
+		if mm, ok := err.(*BuildIDMismatch); ok != test.mismatch {
+			t.Errorf("recorded %v: got error %v, want mismatch %v", test.recorded, err, test.mismatch)
+		} else if ok && (mm.Got != bid || mm.Want != test.recorded.String()) {
+			t.Errorf("got %+v, want Got %s, Want %s", mm, bid, test.recorded)
+		}
+
+		_, err = LocalSymbols{}.Symbols(test.recorded, exe)
+		if _, ok := err.(*BuildIDMismatch); ok != test.mismatch {
+			t.Errorf("recorded %v: LocalSymbols got error %v, want mismatch %v", test.recorded, err, test.mismatch)
+		}
+
+		s.Update(mmapRecord(1, 0x400000, 0x1000, exe))
+		var sym Symbolic
+		Symbolize(s, s.LookupPID(1).LookupMmap(0x400000), 0x400000, &sym)
+		tables := s.Extra[symbolicExtraKey].(map[string]*symbolicExtra)
+		if loaded := tables[exe] != nil; loaded == test.mismatch {
+			t.Errorf("recorded %v: loaded symbols %v, want %v", test.recorded, loaded, !test.mismatch)
+		}
+	}
+}
+
+func TestMapParseError(t *testing.T) {
+	s := New(nil)
+	s.Update(mmapRecord(1, 0x1000, 0x1000, "/bin/x"))
+	r := mmapRecord(1, 0x3000, 0x1000, "/lib/y.so")
+	r.Misc.ProcMapParseTimeout = true
+	s.Update(r)
+	s.Update(mmapRecord(2, 0x1000, 0x1000, "/bin/x"))
+	s.Update(mmapRecord(-1, 0xffffffff81000000, 0x1000000, "[kernel.kallsyms]_text"))
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{
+		"/bin/x": {functab: []funcRange{{"f", 0x1000, 0x1010, true}}},
+	}
+	z := NewSymbolizer(s)
+
+	for _, test := range []struct {
+		pid  int
+		ip   uint64
+		want bool
+	}{
+		{1, 0x1000, true},
+		{1, 0x8000, true},
+		{1, 0xffffffff81000010, false},
+		{2, 0x8000, false},
+	} {
+		sample := &perffile.RecordSample{
+			RecordCommon: perffile.RecordCommon{PID: test.pid, Format: perffile.SampleFormatIP},
+			IP:           test.ip,
+		}
+		syms, err := z.ResolveSample(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if syms[0].MapParseError != test.want {
+			t.Errorf("PID %d IP %#x: got MapParseError %v, want %v", test.pid, test.ip, syms[0].MapParseError, test.want)
+		}
+	}
+
+	// exec replaces the incomplete address space.
+	s.Update(&perffile.RecordComm{RecordCommon: perffile.RecordCommon{PID: 1, TID: 1}, Exec: true})
+	if s.LookupPID(1).MapParseError {
+		t.Errorf("MapParseError not cleared by exec")
+	}
+}
+
+// selfMmap returns the mapping of the running test binary that
+// contains pc, as perf would record it.
+func selfMmap(t *testing.T, pc uint64) *Mmap {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("cannot find test binary: ", err)
+	}
+	maps, err := ioutil.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Skip("cannot read memory map: ", err)
+	}
+	for _, line := range strings.Split(string(maps), "\n") {
+		var lo, hi, off uint64
+		var perms string
+		if _, err := fmt.Sscanf(line, "%x-%x %s %x", &lo, &hi, &perms, &off); err != nil {
+			continue
+		}
+		if lo <= pc && pc < hi {
+			r := mmapRecord(1, lo, hi-lo, exe)
+			r.FileOffset = off
+			return &Mmap{make(ForkableExtra), *r}
+		}
+	}
+	t.Skip("test binary is not mapped")
+	return nil
+}
+
+func TestSymbolizeGo(t *testing.T) {
+	pc := uint64(reflect.ValueOf(TestSymbolizeGo).Pointer())
+	mmap := selfMmap(t, pc)
+	elff, err := elf.Open(mmap.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer elff.Close()
+	extra, err := elfSymbolicExtra(mmap.Filename, elff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.gotab == nil {
+		t.Fatal("no Go symbol table in test binary")
+	}
+
+	s := New(nil)
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{mmap.Filename: extra}
+	var sym Symbolic
+	if !Symbolize(s, mmap, pc, &sym) {
+		t.Fatal("failed to symbolize")
+	}
+	if want := "github.com/aclements/go-perf/perfsession.TestSymbolizeGo"; sym.FuncName != want {
+		t.Errorf("got function %q, want %q", sym.FuncName, want)
+	}
+	if sym.Line.File == nil || !strings.HasSuffix(sym.Line.File.Name, "symbolize_test.go") || sym.Line.Line == 0 {
+		t.Errorf("got line %+v, want symbolize_test.go", sym.Line)
+	}
+
+	if n := testing.AllocsPerRun(100, func() { Symbolize(s, mmap, pc, &sym) }); n != 0 {
+		t.Errorf("Symbolize allocated %v times, want 0", n)
+	}
+}
+
+func TestGoTableFallback(t *testing.T) {
+	// An unreadable Go symbol table falls back to DWARF or the
+	// ELF symbols.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("cannot find test binary: ", err)
+	}
+	elff, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer elff.Close()
+	sec := elff.Section(".gopclntab")
+	if sec == nil {
+		sec = elff.Section(".data.rel.ro.gopclntab")
+	}
+	if sec == nil {
+		t.Skip("no pclntab section")
+	}
+	// debug/elf can't read compressed sections of unknown type.
+	sec.Flags |= elf.SHF_COMPRESSED
+	if _, err := goTable(elff); err == nil {
+		t.Fatal("unreadable Go symbol table was not detected")
+	}
+	extra, err := elfSymbolicExtra(exe, elff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.gotab != nil || extra.functab == nil {
+		t.Errorf("did not fall back to ELF or DWARF function table")
+	}
+}
+
+// inlineDWARF returns DWARF data for a function "outer" at
+// [0x401000, 0x401100) with "mid" inlined at [0x401040, 0x401080)
+// from line 10, and "leaf" inlined into that at [0x401048, 0x401060)
+// from line 20.
+func inlineDWARF(t *testing.T) *dwarf.Data {
+	const (
+		formAddr   = 0x01
+		formData8  = 0x07
+		formString = 0x08
+		formData1  = 0x0b
+		formRef4   = 0x13
+	)
+	abbrev := []byte{
+		1, byte(dwarf.TagCompileUnit), 1,
+		byte(dwarf.AttrName), formString,
+		0, 0,
+		2, byte(dwarf.TagSubprogram), 0,
+		byte(dwarf.AttrName), formString,
+		0, 0,
+		3, byte(dwarf.TagSubprogram), 1,
+		byte(dwarf.AttrName), formString,
+		byte(dwarf.AttrLowpc), formAddr,
+		byte(dwarf.AttrHighpc), formData8,
+		0, 0,
+		4, byte(dwarf.TagInlinedSubroutine), 1,
+		byte(dwarf.AttrAbstractOrigin), formRef4,
+		byte(dwarf.AttrLowpc), formAddr,
+		byte(dwarf.AttrHighpc), formData8,
+		byte(dwarf.AttrCallLine), formData1,
+		0, 0,
+		0,
+	}
+
+	var info bytes.Buffer
+	w := func(x interface{}) { binary.Write(&info, binary.LittleEndian, x) }
+	str := func(s string) { info.WriteString(s + "\x00") }
+	w(uint32(0)) // Length, filled in below
+	w(uint16(4))
+	w(uint32(0)) // Abbrev offset
+	w(uint8(8))
+	w(uint8(1))
+	str("x.c")
+	midOff := uint32(info.Len())
+	w(uint8(2))
+	str("mid")
+	leafOff := uint32(info.Len())
+	w(uint8(2))
+	str("leaf")
+	w(uint8(3))
+	str("outer")
+	w(uint64(0x401000))
+	w(uint64(0x100))
+	w(uint8(4))
+	w(midOff)
+	w(uint64(0x401040))
+	w(uint64(0x40))
+	w(uint8(10))
+	w(uint8(4))
+	w(leafOff)
+	w(uint64(0x401048))
+	w(uint64(0x18))
+	w(uint8(20))
+	w([]byte{0, 0, 0, 0}) // End leaf, mid, outer, CU
+	binary.LittleEndian.PutUint32(info.Bytes(), uint32(info.Len()-4))
+
+	d, err := dwarf.New(abbrev, nil, nil, info.Bytes(), nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSymbolizeInline(t *testing.T) {
+	// The function table is indexed by file offset, as it is for
+	// the symbols of a shared library, but the DWARF uses the
+	// virtual addresses of the binary.
+	extra := &symbolicExtra{
+		functab:   []funcRange{{"outer", 0x1000, 0x1100, true}},
+		isReloc:   true,
+		dwarf:     inlineDWARF(t),
+		dwarfSegs: []elf.ProgHeader{{Type: elf.PT_LOAD, Off: 0x1000, Vaddr: 0x401000, Filesz: 0x1000}},
+	}
+	s := New(nil)
+	s.Extra[symbolicExtraKey] = map[string]*symbolicExtra{"/lib/x.so": extra}
+	mmap := &Mmap{make(ForkableExtra), *mmapRecord(1, 0x7f0000000000, 0x1000, "/lib/x.so")}
+	mmap.FileOffset = 0x1000
+
+	for _, test := range []struct {
+		off   uint64
+		names []string
+		lines []int
+	}{
+		{0x10, []string{"outer"}, []int{0}},
+		{0x40, []string{"mid", "outer"}, []int{0, 10}},
+		{0x50, []string{"leaf", "mid", "outer"}, []int{0, 20, 10}},
+		{0x70, []string{"mid", "outer"}, []int{0, 10}},
+	} {
+		syms := SymbolizeInline(s, mmap, mmap.Addr+test.off)
+		var names []string
+		var lines []int
+		for _, sym := range syms {
+			names = append(names, sym.FuncName)
+			lines = append(lines, sym.Line.Line)
+		}
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("at offset %#x: got %v at lines %v, want %v at lines %v", test.off, names, lines, test.names, test.lines)
+		}
+	}
+}
+
+const inlineC = `static int g;
+static inline __attribute__((always_inline)) void leaf(int x) { g += x * 3; }
+__attribute__((noinline)) void outer(int x) {
+	leaf(x);
+	leaf(x + 1);
+}
+int main(void) { outer(1); return g; }
+`
+
+// buildInlineC builds inlineC with debug info and the given extra
+// compiler flags. It returns the path of the binary, the inlined call
+// of leaf, and the loadable segment containing it.
+func buildInlineC(t *testing.T, flags ...string) (bin string, leaf *inlineRange, seg *elf.ProgHeader) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir := t.TempDir()
+	src, bin := filepath.Join(dir, "x.c"), filepath.Join(dir, "x")
+	if err := ioutil.WriteFile(src, []byte(inlineC), 0666); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"-g", "-O1", "-o", bin, src}, flags...)
+	if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+		t.Skipf("failed to build C binary: %s\n%s", err, out)
+	}
+
+	elff, err := elf.Open(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer elff.Close()
+	d, err := elff.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inl := range dwarfInlineTable(d) {
+		if inl.name == "leaf" {
+			leaf = &inl
+			break
+		}
+	}
+	if leaf == nil {
+		t.Fatal("leaf was not inlined")
+	}
+	for _, ph := range loadSegments(elff) {
+		if ph.Vaddr <= leaf.lowpc && leaf.lowpc < ph.Vaddr+ph.Filesz {
+			seg = &ph
+			break
+		}
+	}
+	if seg == nil {
+		t.Fatal("leaf is not in a loadable segment")
+	}
+	return bin, leaf, seg
+}
+
+func TestSymbolizeInlinePIE(t *testing.T) {
+	// Build a position-independent C binary with an inlined
+	// call and find it the way a profile would, from an IP in a
+	// mapping of the binary at an arbitrary address.
+	bin, leaf, seg := buildInlineC(t, "-fPIE", "-pie")
+
+	check := func(s *Session) {
+		r := mmapRecord(1, 0x555500000000, seg.Filesz, bin)
+		r.FileOffset = seg.Off
+		s.Update(r)
+		mmap := s.LookupPID(1).LookupMmap(r.Addr)
+		ip := r.Addr + leaf.lowpc - seg.Vaddr
+
+		syms := SymbolizeInline(s, mmap, ip)
+		if len(syms) != 2 || syms[0].FuncName != "leaf" || syms[1].FuncName != "outer" {
+			t.Fatalf("got %+v, want leaf inlined in outer", syms)
+		}
+		if line := syms[1].Line.Line; line != leaf.callLine.Line || line != 4 && line != 5 {
+			t.Errorf("got call at line %d, want line 4 or 5", line)
+		}
+	}
+
+	// Load DWARF from the binary itself.
+	check(New(nil))
+
+	// Load symbols from a SymbolSource and DWARF from a
+	// DWARFSource.
+	s := New(nil)
+	s.SymbolSource = LocalSymbols{}
+	s.DWARFSource = testDWARFSource(bin)
+	check(s)
+}
+
+func TestSymbolSourceLines(t *testing.T) {
+	// Symbols from a SymbolSource get line numbers from the
+	// binary's DWARF.
+	for _, pie := range []bool{false, true} {
+		flags := []string{"-no-pie"}
+		if pie {
+			flags = []string{"-fPIE", "-pie"}
+		}
+		bin, leaf, seg := buildInlineC(t, flags...)
+		addr := seg.Vaddr
+		if pie {
+			addr = 0x555500000000
+		}
+		for _, dwarfSource := range []bool{false, true} {
+			s := New(nil)
+			s.SymbolSource = LocalSymbols{}
+			if dwarfSource {
+				s.DWARFSource = testDWARFSource(bin)
+			}
+			r := mmapRecord(1, addr, seg.Filesz, bin)
+			r.FileOffset = seg.Off
+			s.Update(r)
+			ip := addr + leaf.lowpc - seg.Vaddr
+
+			var sym Symbolic
+			if !Symbolize(s, s.LookupPID(1).LookupMmap(ip), ip, &sym) {
+				t.Fatalf("pie=%v: failed to symbolize", pie)
+			}
+			if sym.FuncName != "outer" {
+				t.Errorf("pie=%v: got function %q, want outer", pie, sym.FuncName)
+			}
+			// The code of leaf is on line 2.
+			if sym.Line.File == nil || !strings.HasSuffix(sym.Line.File.Name, "x.c") || sym.Line.Line != 2 {
+				t.Errorf("pie=%v, DWARFSource=%v: got line %+v, want x.c:2", pie, dwarfSource, sym.Line)
+			}
+			syms := SymbolizeInline(s, s.LookupPID(1).LookupMmap(ip), ip)
+			if len(syms) != 2 || syms[0].FuncName != "leaf" || syms[0].Line != sym.Line {
+				t.Errorf("pie=%v: got %+v, want leaf at %+v inlined in outer", pie, syms, sym.Line)
+			}
+		}
+	}
+}
+
+func TestSymbolSourceGoLines(t *testing.T) {
+	// Symbols from a SymbolSource for a Go binary get line
+	// numbers from the binary's Go symbol table.
+	pc := uint64(reflect.ValueOf(TestSymbolSourceGoLines).Pointer())
+	mmap := selfMmap(t, pc)
+	s := New(nil)
+	s.SymbolSource = LocalSymbols{}
+	var sym Symbolic
+	if !Symbolize(s, mmap, pc, &sym) {
+		t.Fatal("failed to symbolize")
+	}
+	if want := "github.com/aclements/go-perf/perfsession.TestSymbolSourceGoLines"; sym.FuncName != want {
+		t.Errorf("got function %q, want %q", sym.FuncName, want)
+	}
+	if sym.Line.File == nil || !strings.HasSuffix(sym.Line.File.Name, "symbolize_test.go") || sym.Line.Line == 0 {
+		t.Errorf("got line %+v, want symbolize_test.go", sym.Line)
+	}
+}
+
+type testDWARFSource string
+
+func (p testDWARFSource) DWARF(buildID perffile.BuildID, filename string) (*elf.File, error) {
+	return elf.Open(string(p))
+}
+
+func TestLineEntrySorter(t *testing.T) {
+	// Two compilation units whose line tables are out of address
+	// order, where the first sequence ends at the address the
+	// second begins.
+	lines := []dwarf.LineEntry{
+		{Address: 0x200, Line: 3},
+		{Address: 0x210, EndSequence: true},
+		{Address: 0x100, Line: 1},
+		{Address: 0x180, Line: 2},
+		{Address: 0x200, EndSequence: true},
+	}
+	sort.Stable(lineEntrySorter(lines))
+	var got []uint64
+	for _, l := range lines {
+		got = append(got, l.Address)
+	}
+	if want := []uint64{0x100, 0x180, 0x200, 0x200, 0x210}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got addresses %#x, want %#x", got, want)
+	}
+	if !lines[2].EndSequence || lines[3].Line != 3 {
+		t.Errorf("end of sequence at 0x200 does not come before the line at 0x200")
+	}
+}
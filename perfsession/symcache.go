@@ -0,0 +1,90 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A SymbolCache caches the parsed symbol tables of binaries, keyed by
+// build ID. Sharing a SymbolCache between Sessions avoids re-parsing
+// the symbol table of a binary that appears in many profiles, such as
+// the kernel or libc. Only binaries that have a build ID in a
+// profile's build ID table are cached.
+//
+// The zero value is an empty SymbolCache with no size limit. A
+// SymbolCache is safe for concurrent use, but symbolization lazily
+// updates cached symbol tables, so Sessions sharing a SymbolCache must
+// not symbolize concurrently.
+type SymbolCache struct {
+	// MaxEntries is the maximum number of symbol tables to
+	// cache. If the cache is full, the least recently used symbol
+	// table is evicted. If MaxEntries is 0, there is no limit.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Of *symbolCacheEntry, most recent first
+}
+
+type symbolCacheEntry struct {
+	buildID string
+	extra   *symbolicExtra
+}
+
+// Len returns the number of symbol tables in c.
+func (c *SymbolCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Clear removes all symbol tables from c.
+func (c *SymbolCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru.Init()
+}
+
+// lookup returns the cached symbol table for buildID, or nil. c may be
+// nil, in which case lookup always returns nil.
+func (c *SymbolCache) lookup(buildID string) *symbolicExtra {
+	if c == nil || buildID == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.entries[buildID]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elt)
+	return elt.Value.(*symbolCacheEntry).extra
+}
+
+// add adds extra to c as the symbol table for buildID. If c is nil or
+// buildID is "", add does nothing.
+func (c *SymbolCache) add(buildID string, extra *symbolicExtra) {
+	if c == nil || buildID == "" || extra == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[buildID]; ok {
+		elt.Value.(*symbolCacheEntry).extra = extra
+		c.lru.MoveToFront(elt)
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[buildID] = c.lru.PushFront(&symbolCacheEntry{buildID, extra})
+	for c.MaxEntries > 0 && len(c.entries) > c.MaxEntries {
+		old := c.lru.Remove(c.lru.Back()).(*symbolCacheEntry)
+		delete(c.entries, old.buildID)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestSymbolCache(t *testing.T) {
+	cache := &SymbolCache{MaxEntries: 2}
+	cache.add("01", &symbolicExtra{functab: []funcRange{{"f", 0x1000, 0x1010, true}}})
+
+	// Sessions for different profiles of the same binary should
+	// share its symbol table.
+	for _, name := range []string{"/bin/x", "/old/bin/x"} {
+		f := &perffile.File{}
+		f.Meta.BuildIDs = []perffile.BuildIDInfo{{BuildID: perffile.BuildID{1}, Filename: name}}
+		s := New(f)
+		s.SymbolCache = cache
+		s.Update(mmapRecord(1, 0x1000, 0x1000, name))
+		var sym Symbolic
+		if !Symbolize(s, s.LookupPID(1).LookupMmap(0x1000), 0x1000, &sym) || sym.FuncName != "f" {
+			t.Errorf("%s: got %q, want f", name, sym.FuncName)
+		}
+	}
+
+	// Adding more entries should evict the least recently used.
+	cache.add("02", &symbolicExtra{})
+	cache.lookup("01")
+	cache.add("03", &symbolicExtra{})
+	if cache.Len() != 2 {
+		t.Errorf("got %d entries, want 2", cache.Len())
+	}
+	if cache.lookup("01") == nil || cache.lookup("02") != nil || cache.lookup("03") == nil {
+		t.Errorf("evicted wrong entry")
+	}
+
+	cache.Clear()
+	if cache.Len() != 0 || cache.lookup("01") != nil {
+		t.Errorf("Clear did not empty cache")
+	}
+}
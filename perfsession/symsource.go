@@ -0,0 +1,279 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Symbol is a function symbol of a binary.
+type Symbol struct {
+	Name string
+
+	// Offset and Size give the range of the function's code as
+	// byte offsets in the binary file. Using file offsets rather
+	// than virtual addresses means symbols can be found the same
+	// way for executables and shared libraries, wherever they
+	// were mapped.
+	Offset, Size uint64
+}
+
+// A SymbolSource supplies the function symbols of binaries. This
+// allows symbols to come from somewhere other than the local file
+// system, such as a debuginfod server, a symbol cache, or tables
+// embedded in a program.
+type SymbolSource interface {
+	// Symbols returns the function symbols of the binary with
+	// the given build ID, which perf recorded as filename.
+	// buildID is nil if the profile does not record the binary's
+	// build ID. If the source does not have the binary, Symbols
+	// returns nil, nil.
+	Symbols(buildID perffile.BuildID, filename string) ([]Symbol, error)
+}
+
+// A DWARFSource supplies the DWARF debug info of binaries, which
+// SymbolizeInline uses to expand inlined calls. Like SymbolSource,
+// this allows debug info to come from somewhere other than the binary
+// itself, such as a separate debug file or a debuginfod server.
+type DWARFSource interface {
+	// DWARF returns an ELF file with the DWARF debug info of the
+	// binary with the given build ID, which perf recorded as
+	// filename. This may be the binary itself or a separate
+	// debug file, but its program headers must match the
+	// binary's so addresses in the profile can be mapped to
+	// addresses in the debug info. buildID is nil if the profile
+	// does not record the binary's build ID. If the source does
+	// not have debug info for the binary, DWARF returns nil, nil.
+	// The caller closes the returned file.
+	DWARF(buildID perffile.BuildID, filename string) (*elf.File, error)
+}
+
+// LocalSymbols is a SymbolSource that reads ELF symbol tables from the
+// local file system. Like perf, it looks for a binary first in perf's
+// build ID cache in ~/.debug and then at its original path.
+//
+// Binaries installed by Linux distributions are usually stripped, with
+// their symbols in separate debug files. Like gdb, LocalSymbols looks
+// for a debug file by build ID in /usr/lib/debug/.build-id, and then
+// by the name in the binary's .gnu_debuglink section next to the
+// binary, in its .debug directory, and under /usr/lib/debug. If it
+// finds a debug file with symbols, it uses those rather than the
+// binary's own symbols.
+//
+// If the binary at the original path has a different build ID than
+// the profile recorded, Symbols returns a *BuildIDMismatch error
+// rather than symbols that don't match the profile.
+type LocalSymbols struct{}
+
+// debugFileDir is the global directory of separate debug files, as in
+// gdb's debug-file-directory setting.
+var debugFileDir = "/usr/lib/debug"
+
+func (LocalSymbols) Symbols(buildID perffile.BuildID, filename string) ([]Symbol, error) {
+	bid := buildID.String()
+	if bid != "" {
+		if syms := debugFileSymbols(buildIDDebugPath(bid)); syms != nil {
+			return syms, nil
+		}
+	}
+
+	var elff *elf.File
+	err := os.ErrNotExist
+	if bid != "" {
+		elff, err = elf.Open(buildIDPath(bid))
+	}
+	fromCache := err == nil
+	if err != nil {
+		elff, err = elf.Open(filename)
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer elff.Close()
+	if !fromCache {
+		if err := checkBuildID(elff, filename, bid); err != nil {
+			return nil, err
+		}
+	}
+
+	if bid == "" {
+		if bid = elfBuildID(elff); bid != "" {
+			if syms := debugFileSymbols(buildIDDebugPath(bid)); syms != nil {
+				return syms, nil
+			}
+		}
+	}
+	if path := debugLinkPath(elff, filename); path != "" {
+		if syms := debugFileSymbols(path); syms != nil {
+			return syms, nil
+		}
+	}
+	return elfSymbols(elff)
+}
+
+// buildIDDebugPath returns the path of the separate debug file for
+// build ID bid, a hex string.
+func buildIDDebugPath(bid string) string {
+	return fmt.Sprintf("%s/.build-id/%.2s/%s.debug", debugFileDir, bid, bid[2:])
+}
+
+// debugFileSymbols returns the symbols of the separate debug file at
+// path, or nil if it can't be loaded or has no function symbols.
+func debugFileSymbols(path string) []Symbol {
+	elff, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer elff.Close()
+	syms, err := elfSymbols(elff)
+	if err != nil || len(syms) == 0 {
+		return nil
+	}
+	return syms
+}
+
+// debugLinkPath returns the path of the separate debug file named by
+// the .gnu_debuglink section of elff, which perf recorded as filename,
+// or "" if there is no such file with the expected CRC.
+func debugLinkPath(elff *elf.File, filename string) string {
+	sec := elff.Section(".gnu_debuglink")
+	if sec == nil {
+		return ""
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return ""
+	}
+	name, crc, ok := parseDebugLink(data, elff.ByteOrder)
+	if !ok {
+		return ""
+	}
+	dir := filepath.Dir(filename)
+	for _, path := range []string{
+		filepath.Join(dir, name),
+		filepath.Join(dir, ".debug", name),
+		filepath.Join(debugFileDir, dir, name),
+	} {
+		if path == filename {
+			// The link names the binary itself.
+			continue
+		}
+		if fileCRC(path) == crc {
+			return path
+		}
+	}
+	return ""
+}
+
+// parseDebugLink parses the contents of a .gnu_debuglink section,
+// which is a NUL-terminated file name, padded to 4 bytes, followed by
+// the CRC-32 of the file.
+func parseDebugLink(data []byte, order binary.ByteOrder) (name string, crc uint32, ok bool) {
+	n := bytes.IndexByte(data, 0)
+	if n <= 0 {
+		return "", 0, false
+	}
+	off := (n + 4) &^ 3
+	if off+4 > len(data) {
+		return "", 0, false
+	}
+	return string(data[:n]), order.Uint32(data[off:]), true
+}
+
+// fileCRC returns the CRC-32 of the file at path, or 0 if it can't be
+// read.
+func fileCRC(path string) uint32 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0
+	}
+	return h.Sum32()
+}
+
+// elfSymbols returns the function symbols of elff. elff may be a
+// separate debug info file, whose program headers match those of the
+// binary, but whose section headers don't give the binary's file
+// offsets, so symbols are translated to file offsets using only the
+// program headers.
+func elfSymbols(elff *elf.File) ([]Symbol, error) {
+	esyms, err := elff.Symbols()
+	if err == elf.ErrNoSymbols {
+		// Stripped binaries may still have dynamic symbols.
+		esyms, err = elff.DynamicSymbols()
+	}
+	if err == elf.ErrNoSymbols {
+		return []Symbol{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	segs := loadSegments(elff)
+	syms := make([]Symbol, 0, len(esyms))
+	for _, esym := range esyms {
+		if elf.SymType(esym.Info&0xF) != elf.STT_FUNC || esym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		// Symbol values of executables and shared libraries
+		// are both virtual addresses.
+		off, ok := vaddrToOffset(segs, esym.Value)
+		if !ok {
+			continue
+		}
+		syms = append(syms, Symbol{esym.Name, off, esym.Size})
+	}
+	return syms, nil
+}
+
+// vaddrToOffset returns the file offset of virtual address addr in the
+// loadable segments segs.
+func vaddrToOffset(segs []elf.ProgHeader, addr uint64) (uint64, bool) {
+	for _, seg := range segs {
+		if seg.Vaddr <= addr && addr < seg.Vaddr+seg.Filesz {
+			return addr - seg.Vaddr + seg.Off, true
+		}
+	}
+	return 0, false
+}
+
+// sourceSymbolicExtra returns the symbol tables for filename from
+// src, or nil if src does not have them.
+func sourceSymbolicExtra(src SymbolSource, buildID perffile.BuildID, filename string) (*symbolicExtra, error) {
+	syms, err := src.Symbols(buildID, filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading symbols for %s: %s", filename, err)
+	}
+	if syms == nil {
+		return nil, nil
+	}
+	// functab is indexed by file offset.
+	return &symbolicExtra{functab: symbolFuncTable(syms), isReloc: true}, nil
+}
+
+// symbolFuncTable returns a sorted function table of syms.
+func symbolFuncTable(syms []Symbol) []funcRange {
+	functab := make([]funcRange, len(syms))
+	for i, sym := range syms {
+		functab[i] = funcRange{sym.Name, sym.Offset, sym.Offset + sym.Size, false}
+	}
+	sort.Sort(funcRangeSorter(functab))
+	setFuncHighPCs(functab)
+	return functab
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+type testSymbolSource struct {
+	buildID perffile.BuildID
+	syms    []Symbol
+	calls   int
+}
+
+func (s *testSymbolSource) Symbols(buildID perffile.BuildID, filename string) ([]Symbol, error) {
+	s.calls++
+	if !bytes.Equal(buildID, s.buildID) {
+		return nil, nil
+	}
+	return s.syms, nil
+}
+
+func TestSymbolSource(t *testing.T) {
+	bid := perffile.BuildID{0xab, 0xcd, 0xef}
+	src := &testSymbolSource{
+		buildID: bid,
+		syms: []Symbol{
+			{"g", 0x2100, 0x80},
+			{"f", 0x2000, 0x100},
+		},
+	}
+	f := &perffile.File{}
+	f.Meta.BuildIDs = []perffile.BuildIDInfo{{Filename: "/lib/libx.so", BuildID: bid}}
+	s := New(f)
+	s.SymbolSource = src
+	// The library's text is at file offset 0x2000, mapped at
+	// 0x7f0000002000.
+	m := mmapRecord(1, 0x7f0000002000, 0x1000, "/lib/libx.so")
+	m.FileOffset = 0x2000
+	s.Update(m)
+
+	for _, test := range []struct {
+		ip uint64
+		fn string
+	}{
+		{0x7f0000002010, "f"},
+		{0x7f0000002100, "g"},
+		{0x7f0000002200, ""},
+	} {
+		var sym Symbolic
+		if !Symbolize(s, s.LookupPID(1).LookupMmap(test.ip), test.ip, &sym) {
+			t.Errorf("%#x: no symbols", test.ip)
+		} else if sym.FuncName != test.fn {
+			t.Errorf("%#x: got %q, want %q", test.ip, sym.FuncName, test.fn)
+		}
+	}
+	if src.calls != 1 {
+		t.Errorf("symbol source called %d times, want 1", src.calls)
+	}
+}
+
+func TestLocalSymbols(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	elff, err := elf.Open(exe)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer elff.Close()
+	if elff.Type != elf.ET_EXEC {
+		t.Skipf("test binary has type %v, want %v", elff.Type, elf.ET_EXEC)
+	}
+	// The test binary may only have dynamic symbols.
+	esyms, err := elff.Symbols()
+	if err != nil {
+		esyms, _ = elff.DynamicSymbols()
+	}
+	var want *Symbol
+	for _, esym := range esyms {
+		if elf.SymType(esym.Info&0xF) != elf.STT_FUNC || esym.Size == 0 {
+			continue
+		}
+		for _, prog := range elff.Progs {
+			if prog.Type == elf.PT_LOAD && prog.Vaddr <= esym.Value && esym.Value < prog.Vaddr+prog.Filesz {
+				want = &Symbol{esym.Name, esym.Value - prog.Vaddr + prog.Off, esym.Size}
+			}
+		}
+		if want != nil {
+			break
+		}
+	}
+	if want == nil {
+		t.Skip("test binary has no function symbols")
+	}
+
+	syms, err := LocalSymbols{}.Symbols(nil, exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, sym := range syms {
+		if sym.Name == want.Name {
+			found = true
+			if sym != *want {
+				t.Errorf("got %+v, want %+v", sym, *want)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("symbol %s not found in %d symbols of %s", want.Name, len(syms), exe)
+	}
+
+	if syms, err := (LocalSymbols{}).Symbols(nil, "/does/not/exist"); syms != nil || err != nil {
+		t.Errorf("for missing file, got %d symbols, %v; want nil, nil", len(syms), err)
+	}
+}
+
+func TestLocalSymbolsDebugFile(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	want, err := LocalSymbols{}.Symbols(nil, exe)
+	if err != nil || len(want) == 0 {
+		t.Skipf("test binary has no symbols: %v", err)
+	}
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Install the test binary as the debug file for build ID
+	// abcdef. The binary itself doesn't exist.
+	defer func(old string) { debugFileDir = old }(debugFileDir)
+	debugFileDir = t.TempDir()
+	dir := filepath.Join(debugFileDir, ".build-id", "ab")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cdef.debug"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LocalSymbols{}.Symbols(perffile.BuildID{0xab, 0xcd, 0xef}, "/does/not/exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d symbols, want %d", len(got), len(want))
+	}
+
+	// The debug link names the debug file and gives its CRC.
+	link := append([]byte("x.debug\x00"), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(link[8:], crc32.ChecksumIEEE(data))
+	name, crc, ok := parseDebugLink(link, binary.LittleEndian)
+	if !ok || name != "x.debug" {
+		t.Fatalf("got debug link %q, %v; want x.debug", name, ok)
+	}
+	if got := fileCRC(filepath.Join(dir, "cdef.debug")); got != crc {
+		t.Errorf("got CRC %#x, want %#x", got, crc)
+	}
+	if _, _, ok := parseDebugLink([]byte("x.debug\x00"), binary.LittleEndian); ok {
+		t.Errorf("want failure for debug link without CRC")
+	}
+}